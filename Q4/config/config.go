@@ -0,0 +1,430 @@
+package config
+
+import (
+	"Q4/internal/cors"
+	"Q4/internal/model"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+)
+
+// Mail transports
+const (
+	MailSMTP   = "smtp"
+	MailFile   = "file"
+	MailMemory = "memory"
+)
+
+// Config holds the server settings. Every flag falls back to an environment variable,
+// then to a default suited to local development. Secrets have no flags; see getSecret.
+type Config struct {
+	Addr       string
+	Storage    string
+	SQLitePath string
+	// PostgresDSN comes from DATABASE_URL, as it may hold a password
+	PostgresDSN string
+	// GRPCAddr is where the gRPC server listens; empty, the default, disables it
+	GRPCAddr string
+
+	// TLSCertFile and TLSKeyFile switch the server to HTTPS. The files are checked for changes
+	// every TLSReloadInterval, so that renewed certificates are used without a restart.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	// TLSClientCAFile lets clients present certificates issued by these CAs, which sign in as the
+	// service principal their subject is mapped to
+	TLSClientCAFile string
+	// HTTPRedirectAddr is a plain HTTP listener that redirects to HTTPS; empty disables it
+	HTTPRedirectAddr string
+	// HSTSMaxAge is how long browsers keep to HTTPS after an HTTPS response; zero sends no HSTS header
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+
+	// MaxBodyBytes bounds request bodies, except user imports, which MaxImportBytes bounds
+	MaxBodyBytes   int64
+	MaxImportBytes int64
+	// MaxHeaderBytes bounds the request line and headers, MaxURLLength the URL alone
+	MaxHeaderBytes int
+	MaxURLLength   int
+
+	// CacheSize is the number of users kept by the in-process cache; zero disables caching
+	CacheSize        int
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+	// CacheRedisAddr switches the cache to a Redis-compatible server instead of the in-process LRU
+	CacheRedisAddr string
+
+	// PublicURL is where clients reach the service; links in emails are built from it
+	PublicURL string
+	// TokenSecret, from TOKEN_SECRET, signs verification tokens and keys the WebAuthn placeholders; an empty secret uses a random key per process
+	TokenSecret          string
+	EmailVerificationTTL time.Duration
+	SessionTTL           time.Duration
+	PasswordResetTTL     time.Duration
+	// SessionCookieSecure limits browser session cookies to HTTPS
+	SessionCookieSecure   bool
+	SessionCookieSameSite http.SameSite
+
+	// LockoutThreshold and LockoutIPThreshold are the failed sign-ins that lock an account or a
+	// client address out for LockoutDuration
+	LockoutThreshold   int
+	LockoutIPThreshold int
+	LockoutDuration    time.Duration
+
+	// RateLimit is the number of requests each client may send per RateLimitWindow across the
+	// whole server; zero disables the limit. Routes declare stricter limits of their own.
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitRedisAddr shares rate limits through a Redis-compatible server, so that every
+	// instance behind a load balancer counts toward the same limits
+	RateLimitRedisAddr string
+
+	// CORS is the cross-origin policy of the API, built from the --cors-* flags
+	CORS *cors.Policy
+
+	// MFAIssuer names the service in authenticator apps
+	MFAIssuer string
+	// MFARequiredRoles lists the roles that must sign in with a second factor
+	MFARequiredRoles []string
+	// AdminEmails are promoted to admins at startup once verified, so that a new deployment can get
+	// its first admin; only admins may give others a role
+	AdminEmails []string
+	// WebAuthnRPID is the domain passkeys are bound to; it defaults to the host of PublicURL
+	WebAuthnRPID string
+	// WebAuthnOrigins are the origins pages may use passkeys from; they default to the origin of PublicURL
+	WebAuthnOrigins []string
+	// OIDCAuthorizeURL is the page that signs users in for OAuth clients; it defaults to PublicURL + "/authorize"
+	OIDCAuthorizeURL string
+	// OIDCTokenTTL is the lifetime of OAuth access tokens and ID tokens
+	OIDCTokenTTL time.Duration
+	// OIDCKeyRotation is how long an ID token signing key is used before it is replaced
+	OIDCKeyRotation time.Duration
+	// APIKeyTTL is the lifetime of API keys issued without an explicit expiry
+	APIKeyTTL time.Duration
+	// APIKeyRotationOverlap is how long a rotated API key keeps working next to its replacement
+	APIKeyRotationOverlap time.Duration
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are replayed
+	IdempotencyTTL time.Duration
+	// GraphQLMaxDepth bounds how deeply GraphQL selections nest, GraphQLMaxComplexity the estimated
+	// cost of a query, in which list fields count once per item they may return
+	GraphQLMaxDepth      int
+	GraphQLMaxComplexity int
+	// GraphiQL serves the GraphiQL page on GET /graphql
+	GraphiQL bool
+	// EventReplay is how many user events are kept for clients that resume a stream
+	EventReplay int
+	// EventBuffer is how many user events a stream may fall behind before it is disconnected
+	EventBuffer int
+	// EventHeartbeat is how often idle event streams get a comment that keeps proxies from closing them
+	EventHeartbeat time.Duration
+	// WebSocketPingInterval is how often WebSocket clients are pinged; clients that miss two pings are disconnected
+	WebSocketPingInterval time.Duration
+	// ShutdownTimeout is how long the server waits for requests and connections to finish when it is stopped
+	ShutdownTimeout time.Duration
+
+	MailTransport string
+	MailFrom      string
+	// MailDir receives one .eml file per message with the file transport
+	MailDir      string
+	SMTPAddr     string
+	SMTPUsername string
+	// SMTPPassword comes from SMTP_PASSWORD
+	SMTPPassword string
+}
+
+// Load parses args (usually os.Args[1:]) into a Config
+func Load(args []string) (Config, error) {
+	var cfg Config
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", getEnv("ADDR", ":8080"), "address the HTTP server listens on")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", getEnv("GRPC_ADDR", ""), "address the gRPC server listens on, such as :9090; empty disables it")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", getEnv("TLS_CERT_FILE", ""), "PEM certificate chain that turns on HTTPS")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", getEnv("TLS_KEY_FILE", ""), "PEM private key of --tls-cert-file")
+	fs.DurationVar(&cfg.TLSReloadInterval, "tls-reload-interval", getEnvDuration("TLS_RELOAD_INTERVAL", 30*time.Second), "how often the certificate files are checked for changes")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca-file", getEnv("TLS_CLIENT_CA_FILE", ""), "PEM CA certificates that issue client certificates, empty to not ask for them")
+	fs.StringVar(&cfg.HTTPRedirectAddr, "http-redirect-addr", getEnv("HTTP_REDIRECT_ADDR", ""), "address of a plain HTTP listener that redirects to HTTPS, such as :80")
+	fs.DurationVar(&cfg.HSTSMaxAge, "hsts-max-age", getEnvDuration("HSTS_MAX_AGE", 180*24*time.Hour), "max-age of the Strict-Transport-Security header sent over HTTPS, 0 disables it")
+	fs.BoolVar(&cfg.HSTSIncludeSubdomains, "hsts-include-subdomains", getEnvBool("HSTS_INCLUDE_SUBDOMAINS", false), "extend HSTS to every subdomain")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", int64(getEnvInt("MAX_BODY_BYTES", 1<<20)), "largest request body accepted, except for user imports")
+	fs.Int64Var(&cfg.MaxImportBytes, "max-import-bytes", int64(getEnvInt("MAX_IMPORT_BYTES", 64<<20)), "largest user import accepted")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", getEnvInt("MAX_HEADER_BYTES", 32<<10), "largest request line and headers accepted")
+	fs.IntVar(&cfg.MaxURLLength, "max-url-length", getEnvInt("MAX_URL_LENGTH", 8<<10), "longest request URL accepted")
+	fs.StringVar(&cfg.Storage, "storage", getEnv("STORAGE", StorageSQLite), "storage backend: sqlite, postgres or memory")
+	fs.StringVar(&cfg.SQLitePath, "sqlite-path", getEnv("SQLITE_PATH", "./users.db"), "path of the SQLite database file")
+	fs.IntVar(&cfg.CacheSize, "cache-size", getEnvInt("CACHE_SIZE", 10000), "users kept in the lookup cache, 0 disables it")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", getEnvDuration("CACHE_TTL", time.Minute), "how long cached users stay fresh")
+	fs.DurationVar(&cfg.CacheNegativeTTL, "cache-negative-ttl", getEnvDuration("CACHE_NEGATIVE_TTL", 10*time.Second), "how long missing user IDs are cached")
+	fs.StringVar(&cfg.CacheRedisAddr, "cache-redis-addr", getEnv("CACHE_REDIS_ADDR", ""), "host:port of a Redis-compatible cache server")
+	fs.StringVar(&cfg.PublicURL, "public-url", getEnv("PUBLIC_URL", "http://localhost:8080"), "base URL used in links sent to users")
+	fs.DurationVar(&cfg.EmailVerificationTTL, "email-verification-ttl", getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour), "how long email verification links stay valid")
+	fs.DurationVar(&cfg.SessionTTL, "session-ttl", getEnvDuration("SESSION_TTL", 24*time.Hour), "how long a sign-in lasts")
+	fs.BoolVar(&cfg.SessionCookieSecure, "session-cookie-secure", getEnvBool("SESSION_COOKIE_SECURE", true), "send browser session cookies over HTTPS only")
+	sameSite := fs.String("session-cookie-samesite", getEnv("SESSION_COOKIE_SAMESITE", "lax"), "SameSite attribute of browser session cookies: lax, strict or none")
+	fs.DurationVar(&cfg.PasswordResetTTL, "password-reset-ttl", getEnvDuration("PASSWORD_RESET_TTL", time.Hour), "how long password reset links stay valid")
+	fs.IntVar(&cfg.LockoutThreshold, "lockout-threshold", getEnvInt("LOCKOUT_THRESHOLD", 5), "failed sign-ins that lock an account")
+	fs.IntVar(&cfg.LockoutIPThreshold, "lockout-ip-threshold", getEnvInt("LOCKOUT_IP_THRESHOLD", 50), "failed sign-ins that lock a client address")
+	fs.DurationVar(&cfg.LockoutDuration, "lockout-duration", getEnvDuration("LOCKOUT_DURATION", 15*time.Minute), "how long the first lockout lasts; repeated lockouts double it")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", getEnvInt("RATE_LIMIT", 300), "requests each client may send per --rate-limit-window, 0 disables the limit")
+	fs.DurationVar(&cfg.RateLimitWindow, "rate-limit-window", getEnvDuration("RATE_LIMIT_WINDOW", time.Minute), "period of --rate-limit")
+	fs.StringVar(&cfg.RateLimitRedisAddr, "rate-limit-redis-addr", getEnv("RATE_LIMIT_REDIS_ADDR", ""), "host:port of a Redis-compatible server that shares rate limits between instances")
+	corsOrigins := fs.String("cors-origins", getEnv("CORS_ORIGINS", "http://localhost:3000"), "comma-separated origins whose scripts may call the API; \"*\" for any, \"https://*.example.com\" for subdomains, \"http://localhost:*\" for any port, empty for none")
+	corsOriginPatterns := fs.String("cors-origin-patterns", getEnv("CORS_ORIGIN_PATTERNS", ""), "space-separated regular expressions matched against the whole origin")
+	corsCredentials := fs.Bool("cors-allow-credentials", getEnvBool("CORS_ALLOW_CREDENTIALS", false), "let allowed origins send session cookies")
+	corsMaxAge := fs.Duration("cors-max-age", getEnvDuration("CORS_MAX_AGE", 10*time.Minute), "how long browsers may cache preflight responses")
+	fs.StringVar(&cfg.MFAIssuer, "mfa-issuer", getEnv("MFA_ISSUER", "Q4"), "service name shown in authenticator apps")
+	fs.StringVar(&cfg.WebAuthnRPID, "webauthn-rp-id", getEnv("WEBAUTHN_RP_ID", ""), "domain passkeys are bound to, default the host of --public-url")
+	webAuthnOrigins := fs.String("webauthn-origins", getEnv("WEBAUTHN_ORIGINS", ""), "comma-separated origins allowed to use passkeys, default the origin of --public-url")
+	fs.StringVar(&cfg.OIDCAuthorizeURL, "oidc-authorize-url", getEnv("OIDC_AUTHORIZE_URL", ""), "sign-in page OAuth clients send users to, default --public-url + /authorize")
+	fs.DurationVar(&cfg.OIDCTokenTTL, "oidc-token-ttl", getEnvDuration("OIDC_TOKEN_TTL", time.Hour), "how long OAuth access tokens and ID tokens stay valid")
+	fs.DurationVar(&cfg.OIDCKeyRotation, "oidc-key-rotation", getEnvDuration("OIDC_KEY_ROTATION", 30*24*time.Hour), "how long an ID token signing key is used before it is replaced")
+	fs.DurationVar(&cfg.APIKeyTTL, "api-key-ttl", getEnvDuration("API_KEY_TTL", 90*24*time.Hour), "how long API keys stay valid unless issued with expires_in")
+	fs.DurationVar(&cfg.APIKeyRotationOverlap, "api-key-rotation-overlap", getEnvDuration("API_KEY_ROTATION_OVERLAP", 24*time.Hour), "how long a rotated API key keeps working unless rotated with overlap")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour), "how long the responses to requests with an Idempotency-Key header are replayed to retries")
+	fs.IntVar(&cfg.GraphQLMaxDepth, "graphql-max-depth", getEnvInt("GRAPHQL_MAX_DEPTH", 10), "deepest nesting of fields a GraphQL query may have")
+	fs.IntVar(&cfg.GraphQLMaxComplexity, "graphql-max-complexity", getEnvInt("GRAPHQL_MAX_COMPLEXITY", 1000), "highest estimated cost of a GraphQL query")
+	fs.BoolVar(&cfg.GraphiQL, "graphiql", getEnvBool("GRAPHIQL", true), "serve the GraphiQL page on GET /graphql")
+	fs.IntVar(&cfg.EventReplay, "event-replay", getEnvInt("EVENT_REPLAY", 1000), "user events kept for clients that resume a stream with Last-Event-ID")
+	fs.IntVar(&cfg.EventBuffer, "event-buffer", getEnvInt("EVENT_BUFFER", 64), "user events a stream may fall behind before it is disconnected")
+	fs.DurationVar(&cfg.EventHeartbeat, "event-heartbeat", getEnvDuration("EVENT_HEARTBEAT", 15*time.Second), "how often idle user event streams get a heartbeat")
+	fs.DurationVar(&cfg.WebSocketPingInterval, "ws-ping-interval", getEnvDuration("WS_PING_INTERVAL", 30*time.Second), "how often WebSocket clients are pinged")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second), "how long to wait for requests and connections to finish on shutdown")
+	adminEmails := fs.String("admin-emails", getEnv("ADMIN_EMAILS", ""), "comma-separated verified emails whose users are made admins at startup")
+	mfaRequiredRoles := fs.String("mfa-required-roles", getEnv("MFA_REQUIRED_ROLES", model.RoleAdmin), "comma-separated roles that must use MFA, empty for none")
+	fs.StringVar(&cfg.MailTransport, "mail-transport", getEnv("MAIL_TRANSPORT", MailFile), "mail transport: smtp, file or memory")
+	fs.StringVar(&cfg.MailFrom, "mail-from", getEnv("MAIL_FROM", "Q4 <no-reply@localhost>"), "sender address of outgoing email")
+	fs.StringVar(&cfg.MailDir, "mail-dir", getEnv("MAIL_DIR", "./mail"), "directory the file mail transport writes to")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", getEnv("SMTP_ADDR", ""), "host:port of the SMTP server")
+	fs.StringVar(&cfg.SMTPUsername, "smtp-username", getEnv("SMTP_USERNAME", ""), "SMTP username, empty to send without authentication")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	for key, secret := range map[string]*string{
+		"DATABASE_URL":  &cfg.PostgresDSN,
+		"TOKEN_SECRET":  &cfg.TokenSecret,
+		"SMTP_PASSWORD": &cfg.SMTPPassword,
+	} {
+		value, err := getSecret(key)
+		if err != nil {
+			return cfg, err
+		}
+		*secret = value
+	}
+
+	switch cfg.Storage {
+	case StorageSQLite, StorageMemory:
+	case StoragePostgres:
+		if cfg.PostgresDSN == "" {
+			return cfg, fmt.Errorf("the postgres storage requires DATABASE_URL or DATABASE_URL_FILE")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+
+	if cfg.GRPCAddr != "" && cfg.GRPCAddr == cfg.Addr {
+		return cfg, fmt.Errorf("--grpc-addr must differ from --addr")
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, fmt.Errorf("--tls-cert-file and --tls-key-file must be set together")
+	}
+	if cfg.TLSCertFile == "" && (cfg.TLSClientCAFile != "" || cfg.HTTPRedirectAddr != "") {
+		return cfg, fmt.Errorf("--tls-client-ca-file and --http-redirect-addr require --tls-cert-file")
+	}
+	if cfg.TLSReloadInterval <= 0 || cfg.HSTSMaxAge < 0 {
+		return cfg, fmt.Errorf("--tls-reload-interval must be positive and --hsts-max-age must not be negative")
+	}
+
+	if cfg.MaxBodyBytes <= 0 || cfg.MaxImportBytes <= 0 || cfg.MaxHeaderBytes <= 0 || cfg.MaxURLLength <= 0 {
+		return cfg, fmt.Errorf("--max-body-bytes, --max-import-bytes, --max-header-bytes and --max-url-length must be positive")
+	}
+
+	switch *sameSite {
+	case "lax":
+		cfg.SessionCookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cfg.SessionCookieSameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not also Secure
+		if !cfg.SessionCookieSecure {
+			return cfg, fmt.Errorf("--session-cookie-samesite=none requires --session-cookie-secure")
+		}
+		cfg.SessionCookieSameSite = http.SameSiteNoneMode
+	default:
+		return cfg, fmt.Errorf("unknown --session-cookie-samesite %q", *sameSite)
+	}
+
+	if cfg.LockoutThreshold <= 0 || cfg.LockoutIPThreshold <= 0 || cfg.LockoutDuration <= 0 {
+		return cfg, fmt.Errorf("--lockout-threshold, --lockout-ip-threshold and --lockout-duration must be positive")
+	}
+
+	if cfg.RateLimit < 0 || cfg.RateLimitWindow <= 0 {
+		return cfg, fmt.Errorf("--rate-limit must not be negative and --rate-limit-window must be positive")
+	}
+
+	if err := cfg.loadCORS(*corsOrigins, *corsOriginPatterns, *corsCredentials, *corsMaxAge); err != nil {
+		return cfg, err
+	}
+
+	for _, role := range strings.Split(*mfaRequiredRoles, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if !model.ValidRole(role) {
+			return cfg, fmt.Errorf("unknown role %q in --mfa-required-roles", role)
+		}
+		cfg.MFARequiredRoles = append(cfg.MFARequiredRoles, role)
+	}
+
+	for _, email := range strings.Split(*adminEmails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			cfg.AdminEmails = append(cfg.AdminEmails, email)
+		}
+	}
+
+	if err := cfg.loadWebAuthn(*webAuthnOrigins); err != nil {
+		return cfg, err
+	}
+
+	if cfg.OIDCAuthorizeURL == "" {
+		cfg.OIDCAuthorizeURL = strings.TrimRight(cfg.PublicURL, "/") + "/authorize"
+	}
+	if cfg.OIDCTokenTTL <= 0 || cfg.OIDCKeyRotation <= 0 {
+		return cfg, fmt.Errorf("--oidc-token-ttl and --oidc-key-rotation must be positive")
+	}
+	if cfg.APIKeyTTL <= 0 || cfg.APIKeyRotationOverlap <= 0 {
+		return cfg, fmt.Errorf("--api-key-ttl and --api-key-rotation-overlap must be positive")
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return cfg, fmt.Errorf("--idempotency-ttl must be positive")
+	}
+	if cfg.GraphQLMaxDepth <= 0 || cfg.GraphQLMaxComplexity <= 0 {
+		return cfg, fmt.Errorf("--graphql-max-depth and --graphql-max-complexity must be positive")
+	}
+	if cfg.EventReplay <= 0 || cfg.EventBuffer <= 0 || cfg.EventHeartbeat <= 0 {
+		return cfg, fmt.Errorf("--event-replay, --event-buffer and --event-heartbeat must be positive")
+	}
+	if cfg.WebSocketPingInterval <= 0 || cfg.ShutdownTimeout <= 0 {
+		return cfg, fmt.Errorf("--ws-ping-interval and --shutdown-timeout must be positive")
+	}
+
+	switch cfg.MailTransport {
+	case MailFile, MailMemory:
+	case MailSMTP:
+		if cfg.SMTPAddr == "" {
+			return cfg, fmt.Errorf("the smtp mail transport requires --smtp-addr or SMTP_ADDR")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown mail transport %q", cfg.MailTransport)
+	}
+
+	return cfg, nil
+}
+
+// loadWebAuthn fills in the passkey settings from PublicURL and checks that every origin
+// belongs to the relying party, since browsers refuse passkeys from other domains
+func (cfg *Config) loadWebAuthn(origins string) error {
+	public, err := url.Parse(cfg.PublicURL)
+	if err != nil || public.Scheme == "" || public.Host == "" {
+		return fmt.Errorf("invalid --public-url %q", cfg.PublicURL)
+	}
+	if cfg.WebAuthnRPID == "" {
+		cfg.WebAuthnRPID = public.Hostname()
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			cfg.WebAuthnOrigins = append(cfg.WebAuthnOrigins, origin)
+		}
+	}
+	if len(cfg.WebAuthnOrigins) == 0 {
+		cfg.WebAuthnOrigins = []string{public.Scheme + "://" + public.Host}
+	}
+
+	for _, origin := range cfg.WebAuthnOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid origin %q in --webauthn-origins", origin)
+		}
+		if host := u.Hostname(); host != cfg.WebAuthnRPID && !strings.HasSuffix(host, "."+cfg.WebAuthnRPID) {
+			return fmt.Errorf("origin %q is not on the domain of --webauthn-rp-id %q", origin, cfg.WebAuthnRPID)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value and drops empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getSecret returns the environment variable key or, when key_FILE is set instead, the contents
+// of the file it names without the final line break, as container secrets are mounted. Secrets
+// are never taken from flags, which other local users can read from the process list.
+func getSecret(key string) (string, error) {
+	file, ok := os.LookupEnv(key + "_FILE")
+	if !ok {
+		return os.Getenv(key), nil
+	}
+	if _, ok := os.LookupEnv(key); ok {
+		return "", fmt.Errorf("set %s or %s_FILE, not both", key, key)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
@@ -1,18 +1,32 @@
 package config
 
 import (
-	"net/http"
+	"Q4/internal/cors"
+	"fmt"
+	"strings"
+	"time"
 )
 
-func CorsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
+// CORSExposedHeaders are the response headers beyond the CORS-safelisted ones that scripts on
+// other origins need: the rate limit headers, the file name of exports and the mark of replayed
+// idempotent responses
+var CORSExposedHeaders = []string{
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy",
+	"Retry-After", "Content-Disposition", "Idempotent-Replayed",
+}
+
+// loadCORS builds the API's cross-origin policy from the --cors-* flags
+func (cfg *Config) loadCORS(origins, patterns string, credentials bool, maxAge time.Duration) error {
+	policy, err := cors.New(cors.Options{
+		Origins:          splitList(origins),
+		OriginPatterns:   strings.Fields(patterns),
+		ExposedHeaders:   CORSExposedHeaders,
+		AllowCredentials: credentials,
+		MaxAge:           maxAge,
 	})
+	if err != nil {
+		return fmt.Errorf("invalid CORS settings: %w", err)
+	}
+	cfg.CORS = policy
+	return nil
 }
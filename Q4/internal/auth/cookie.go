@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+const (
+	// SessionCookie holds the bearer token of browser sessions. Scripts cannot read it.
+	SessionCookie = "q4_session"
+	// CSRFCookie holds the CSRF token of the session, for scripts to copy into CSRFHeader
+	CSRFCookie = "q4_csrf"
+	// CSRFHeader must carry the CSRF token on every unsafe request made with SessionCookie
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// SessionCookies sets the attributes of the cookies that carry browser sessions
+type SessionCookies struct {
+	// Secure limits the cookies to HTTPS; browsers also accept them on http://localhost
+	Secure bool
+	// SameSite defaults to http.SameSiteLaxMode
+	SameSite http.SameSite
+}
+
+// Set stores a session's bearer token and its CSRF token in cookies that expire with the session
+func (c SessionCookies) Set(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, c.cookie(SessionCookie, token, true, expiresAt))
+	http.SetCookie(w, c.cookie(CSRFCookie, CSRFToken(token), false, expiresAt))
+}
+
+// Clear removes the session cookies
+func (c SessionCookies) Clear(w http.ResponseWriter) {
+	for _, cookie := range []*http.Cookie{c.cookie(SessionCookie, "", true, time.Time{}), c.cookie(CSRFCookie, "", false, time.Time{})} {
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+func (c SessionCookies) cookie(name, value string, httpOnly bool, expiresAt time.Time) *http.Cookie {
+	sameSite := c.SameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   c.Secure,
+		HttpOnly: httpOnly,
+		SameSite: sameSite,
+	}
+}
+
+// CSRFToken returns the CSRF token of the session with the given bearer token. It is derived
+// rather than stored: another site can neither read the session cookie nor compute the token,
+// and the token does not reveal the session.
+func CSRFToken(sessionToken string) string {
+	sum := sha256.Sum256([]byte("csrf\x00" + sessionToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CheckCSRFToken reports whether csrfToken belongs to the session with the given bearer token
+func CheckCSRFToken(sessionToken, csrfToken string) bool {
+	return subtle.ConstantTimeCompare([]byte(CSRFToken(sessionToken)), []byte(csrfToken)) == 1
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+)
+
+// ErrUnauthenticated is wrapped by the errors of authenticators that reject a credential,
+// as opposed to failing to check it
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal is the authenticated caller of a request: a signed-in user or a service principal
+// using an API key
+type Principal struct {
+	UserID    int
+	SessionID string
+	// ServicePrincipalID and APIKeyID are set instead of UserID and SessionID for API keys
+	ServicePrincipalID string
+	APIKeyID           string
+	// Scopes limit what a service principal may do; users are governed by their role instead
+	Scopes []string
+}
+
+// IsService reports whether the caller is a service principal rather than a user
+func (p *Principal) IsService() bool {
+	return p.ServicePrincipalID != ""
+}
+
+// HasScope reports whether the caller may act within scope. Users always may.
+func (p *Principal) HasScope(scope string) bool {
+	return !p.IsService() || slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the caller attached by the auth middleware, or nil for anonymous requests
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// NewOpaqueToken returns a random bearer token and the hash to store in its place
+func NewOpaqueToken() (token, hash string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashOpaqueToken(token)
+}
+
+// HashOpaqueToken returns the stored form of a token from NewOpaqueToken. Tokens carry 256 bits
+// of entropy, so a fast unsalted hash is enough to make a leaked table useless.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewID returns a random identifier that is safe to show to clients
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,13 @@
+// Package cache provides key/value backends for caching encoded values with a time to live
+package cache
+
+import "time"
+
+// Backend stores opaque values by key. Implementations must be safe for concurrent use and
+// treat an expired entry as missing. Errors are not part of the contract: a backend that cannot
+// be reached should behave as an empty cache.
+type Backend interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(keys ...string)
+}
@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRedisPoolSize is how many connections a Redis backend opens at most by default
+const DefaultRedisPoolSize = 8
+
+// Redis is a Backend speaking the RESP protocol, so it works with Redis and compatible servers
+// such as KeyDB, Dragonfly or an in-process stand-in during development. It keeps a small pool of
+// connections, opened lazily and dropped after a failure, so that calls do not queue behind
+// each other on a single connection.
+type Redis struct {
+	Addr    string
+	Prefix  string
+	Timeout time.Duration
+	// PoolSize is how many connections may be open at once; calls beyond it wait up to Timeout
+	// for one to be free. It is read on the first call.
+	PoolSize int
+
+	mu    sync.Mutex
+	slots chan struct{}
+	idle  []*redisConn
+	// generation counts Close calls, so that connections in use during one are not pooled again
+	generation int
+}
+
+type redisConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	generation int
+}
+
+func NewRedis(addr, prefix string) *Redis {
+	return &Redis{
+		Addr:     addr,
+		Prefix:   prefix,
+		Timeout:  time.Second,
+		PoolSize: DefaultRedisPoolSize,
+	}
+}
+
+func (r *Redis) Get(key string) ([]byte, bool) {
+	reply, err := r.do("GET", r.Prefix+key)
+	if err != nil {
+		logrus.Warnf("Redis cache GET failed: %v", err)
+		return nil, false
+	}
+	value, ok := reply.([]byte)
+	return value, ok
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) {
+	// PX must be positive; entries shorter than that are kept for a millisecond
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	if _, err := r.do("SET", r.Prefix+key, string(value), "PX", ms); err != nil {
+		logrus.Warnf("Redis cache SET failed: %v", err)
+	}
+}
+
+func (r *Redis) Delete(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, r.Prefix+key)
+	}
+	if _, err := r.do(args...); err != nil {
+		logrus.Warnf("Redis cache DEL failed: %v", err)
+	}
+}
+
+// Close closes the idle connections, and those in use once their calls finish. Later calls
+// connect again.
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	idle := r.idle
+	r.idle = nil
+	r.generation++
+	r.mu.Unlock()
+
+	var errs []error
+	for _, conn := range idle {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Do sends a single command and returns its decoded reply, for callers that need more than
+// Get, Set and Delete. Keys in args are sent as they are, without Prefix.
+func (r *Redis) Do(args ...string) (any, error) {
+	return r.do(args...)
+}
+
+func (r *Redis) do(args ...string) (any, error) {
+	conn, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.roundTrip(args, r.Timeout)
+	var redisErr redisError
+	// After any other error the stream may be out of sync, so the connection is not reused
+	r.release(conn, err == nil || errors.As(err, &redisErr))
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// acquire takes a free slot of the pool and returns an idle connection, or a new one
+func (r *Redis) acquire() (*redisConn, error) {
+	r.mu.Lock()
+	if r.slots == nil {
+		r.slots = make(chan struct{}, max(r.PoolSize, 1))
+	}
+	slots := r.slots
+	r.mu.Unlock()
+
+	timer := time.NewTimer(r.Timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errors.New("redis: timed out waiting for a free connection")
+	}
+
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return conn, nil
+	}
+	generation := r.generation
+	r.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", r.Addr, r.Timeout)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	return &redisConn{Conn: conn, reader: bufio.NewReader(conn), generation: generation}, nil
+}
+
+// release frees the slot of conn and pools conn again if reuse is true and Close was not called
+// since it was opened
+func (r *Redis) release(conn *redisConn, reuse bool) {
+	r.mu.Lock()
+	reuse = reuse && conn.generation == r.generation
+	if reuse {
+		r.idle = append(r.idle, conn)
+	}
+	slots := r.slots
+	r.mu.Unlock()
+
+	if !reuse {
+		_ = conn.Close()
+	}
+	<-slots
+}
+
+func (c *redisConn) roundTrip(args []string, timeout time.Duration) (any, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readReply decodes a single RESP2 reply. Null bulk strings decode to nil.
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]any, 0, max(count, 0))
+		for i := 0; i < count; i++ {
+			item, err := readReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,154 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Options describe which cross-origin requests a Policy allows
+type Options struct {
+	// Origins are exact origins such as "https://app.example.com", "*" for any origin, or
+	// wildcards: "https://*.example.com" matches any subdomain and "http://localhost:*" any port
+	Origins []string
+	// OriginPatterns are regular expressions that must match the whole origin
+	OriginPatterns []string
+	// Methods default to GET, POST, PUT and DELETE
+	Methods []string
+	// Headers are the request headers scripts may send; they default to DefaultHeaders
+	Headers []string
+	// ExposedHeaders are the response headers scripts may read besides the safelisted ones
+	ExposedHeaders []string
+	// AllowCredentials lets scripts send cookies and read the responses. It cannot be combined
+	// with "*", since any site could then act with the user's cookies.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response; zero leaves it to the browser
+	MaxAge time.Duration
+}
+
+// DefaultHeaders are the request headers the API reads
+var DefaultHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "Last-Event-ID", "X-API-Key", "X-CSRF-Token"}
+
+// Policy is a validated set of Options
+type Policy struct {
+	Options
+	anyOrigin bool
+	origins   []*regexp.Regexp
+	headers   []string
+}
+
+// New validates opts and compiles their origin wildcards and patterns
+func New(opts Options) (*Policy, error) {
+	p := &Policy{Options: opts}
+	p.Methods = slices.Clone(opts.Methods)
+	if len(p.Methods) == 0 {
+		p.Methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	}
+	if p.Headers == nil {
+		p.Headers = DefaultHeaders
+	}
+	if p.MaxAge < 0 {
+		return nil, fmt.Errorf("negative max age %s", p.MaxAge)
+	}
+
+	for _, origin := range opts.Origins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		re, err := compileOrigin(origin)
+		if err != nil {
+			return nil, err
+		}
+		p.origins = append(p.origins, re)
+	}
+	if p.anyOrigin && p.AllowCredentials {
+		return nil, fmt.Errorf("the origin \"*\" cannot be combined with credentials")
+	}
+	for _, pattern := range opts.OriginPatterns {
+		// Anchored, so that "https://app\.example\.com" does not also match https://app.example.com.evil.net
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %q: %w", pattern, err)
+		}
+		p.origins = append(p.origins, re)
+	}
+
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+	for _, header := range p.Headers {
+		p.headers = append(p.headers, strings.ToLower(header))
+	}
+	return p, nil
+}
+
+// MustNew is New for policies fixed in code; it panics if opts are invalid
+func MustNew(opts Options) *Policy {
+	p, err := New(opts)
+	if err != nil {
+		panic("cors: " + err.Error())
+	}
+	return p
+}
+
+// compileOrigin turns an origin with optional wildcards into an anchored expression
+func compileOrigin(origin string) (*regexp.Regexp, error) {
+	origin = strings.ToLower(strings.TrimRight(origin, "/"))
+	// Parse the origin with the wildcards swapped for placeholders that are valid in a URL
+	u, err := url.Parse(strings.Replace(strings.Replace(origin, "://*.", "://x.", 1), ":*", ":1", 1))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return nil, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+	}
+
+	expr := regexp.QuoteMeta(origin)
+	expr = strings.Replace(expr, `://\*\.`, `://([a-z0-9-]+\.)+`, 1)
+	expr = strings.Replace(expr, `:\*`, `:[0-9]+`, 1)
+	if strings.Contains(expr, `\*`) {
+		return nil, fmt.Errorf("invalid origin %q, \"*\" may only stand for subdomains or the port", origin)
+	}
+	return regexp.MustCompile("^" + expr + "$"), nil
+}
+
+// AllowsOrigin reports whether scripts on origin may call the API. The "null" origin of
+// sandboxed pages and local files is only allowed by "*" or a pattern that matches it.
+func (p *Policy) AllowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, re := range p.origins {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsMethod reports whether a preflight for method succeeds
+func (p *Policy) AllowsMethod(method string) bool {
+	return slices.Contains(p.Methods, method)
+}
+
+// AllowsHeaders reports whether a preflight for the comma-separated header names succeeds
+func (p *Policy) AllowsHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !slices.Contains(p.headers, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowOriginHeader returns the Access-Control-Allow-Origin value for an allowed origin
+func (p *Policy) AllowOriginHeader(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	return origin
+}
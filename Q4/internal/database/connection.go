@@ -1,30 +1,89 @@
 package database
 
 import (
+	"Q4/config"
+	"Q4/internal/cache"
+	"Q4/internal/repository"
 	"database/sql"
+	"embed"
+	"fmt"
 	"log"
 
 	_ "modernc.org/sqlite"
 )
 
-func NewConnection() *sql.DB {
-	db, err := sql.Open("sqlite", "./users.db")
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+// NewStore opens the storage backend selected in cfg and puts the user cache in front of it
+func NewStore(cfg config.Config) (*repository.Store, error) {
+	store, err := openBackend(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return nil, err
+	}
+	if cfg.CacheSize <= 0 && cfg.CacheRedisAddr == "" {
+		return store, nil
+	}
+
+	var backend cache.Backend = cache.NewLRU(cfg.CacheSize)
+	closeStore := store.Close
+	if cfg.CacheRedisAddr != "" {
+		redis := cache.NewRedis(cfg.CacheRedisAddr, "q4:")
+		backend = redis
+		store.Close = func() error {
+			_ = redis.Close()
+			return closeStore()
+		}
+		log.Printf("Caching user lookups in Redis at %s", cfg.CacheRedisAddr)
+	}
+
+	cached := repository.NewCachedUserRepository(store.Users, backend)
+	cached.TTL = cfg.CacheTTL
+	cached.NegativeTTL = cfg.CacheNegativeTTL
+	store.Users = cached
+	store.Tx = repository.NewCachedTxManager(store.Tx, cached)
+	return store, nil
+}
+
+func openBackend(cfg config.Config) (*repository.Store, error) {
+	switch cfg.Storage {
+	case config.StorageSQLite:
+		db, err := Open(cfg.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Database connection established and migrations applied.")
+		return repository.NewSQLiteStore(db), nil
+
+	case config.StoragePostgres:
+		db, err := OpenPostgres(cfg.PostgresDSN)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("PostgreSQL connection established and migrations applied.")
+		return repository.NewPostgresStore(db), nil
+
+	case config.StorageMemory:
+		log.Println("Using in-memory storage; data is lost when the server stops.")
+		return repository.NewMemoryStore(), nil
 	}
 
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		email TEXT NOT NULL UNIQUE
-	);
-	`
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+}
+
+// Open opens the SQLite database at path and applies pending migrations.
+// Connections wait up to five seconds for a competing writer before reporting SQLITE_BUSY,
+// and enforce foreign keys so that deleting a user deletes their sessions and credentials.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err = db.Exec(createTableQuery); err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+	if err := migrate(db, sqliteMigrations, "migrations/sqlite", sqliteDialect); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
 
-	log.Println("Database connection established and table verified.")
-	return db
+	return db, nil
 }
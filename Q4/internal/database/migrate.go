@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dialect captures the SQL differences the migration runner has to care about
+type dialect struct {
+	name             string
+	createMigrations string
+	placeholder      string
+	lock, unlock     string
+}
+
+var (
+	sqliteDialect = dialect{
+		name: "SQLite",
+		createMigrations: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version TEXT PRIMARY KEY,
+				applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);`,
+		placeholder: "?",
+	}
+	postgresDialect = dialect{
+		name: "PostgreSQL",
+		createMigrations: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version TEXT PRIMARY KEY,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);`,
+		placeholder: "$1",
+		// An advisory lock serialises servers that start at the same time
+		lock:   "SELECT pg_advisory_lock(72210501);",
+		unlock: "SELECT pg_advisory_unlock(72210501);",
+	}
+)
+
+// migrate applies every migration in dir that has not been recorded in schema_migrations yet.
+// Migrations are applied in file name order, each in its own transaction.
+func migrate(db *sql.DB, files fs.FS, dir string, d dialect) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if d.lock != "" {
+		if _, err := conn.ExecContext(ctx, d.lock); err != nil {
+			return err
+		}
+		defer func() {
+			_, _ = conn.ExecContext(ctx, d.unlock)
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, d.createMigrations); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(files, path.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(path.Base(name), ".sql")
+
+		var applied bool
+		if err := conn.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = "+d.placeholder+");", version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		body, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ("+d.placeholder+");", version); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		logrus.Infof("Applied %s migration %s", d.name, version)
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+-- Times are Unix seconds
+CREATE TABLE IF NOT EXISTS user_mfa (
+	user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	-- confirmed_at stays NULL until the user proves their authenticator works
+	confirmed_at BIGINT,
+	last_step BIGINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	PRIMARY KEY (user_id, code_hash)
+);
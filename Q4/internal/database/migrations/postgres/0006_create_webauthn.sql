@@ -0,0 +1,24 @@
+-- Times are Unix seconds
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	public_key BYTEA NOT NULL,
+	sign_count BIGINT NOT NULL DEFAULT 0,
+	aaguid TEXT NOT NULL,
+	attestation_format TEXT NOT NULL,
+	-- transports is a comma-separated list of hints such as "internal,hybrid"
+	transports TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+	challenge TEXT PRIMARY KEY,
+	-- user_id is NULL for sign-ins where the authenticator picks the account
+	user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+	purpose TEXT NOT NULL,
+	expires_at BIGINT NOT NULL
+);
@@ -0,0 +1,4 @@
+-- The subject of the client certificate that signs in as the principal, in RFC 2253 form
+ALTER TABLE service_principals ADD COLUMN IF NOT EXISTS certificate_subject TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS service_principals_certificate_subject ON service_principals (certificate_subject);
@@ -0,0 +1,38 @@
+-- Word index for prefix matching and bm25 ranking
+CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(
+	name,
+	email,
+	content = 'users',
+	content_rowid = 'id',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+-- Trigram index used to find candidates for typo-tolerant matching
+CREATE VIRTUAL TABLE IF NOT EXISTS users_trigram USING fts5(
+	name,
+	email,
+	content = 'users',
+	content_rowid = 'id',
+	tokenize = 'trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS users_search_insert AFTER INSERT ON users BEGIN
+	INSERT INTO users_fts (rowid, name, email) VALUES (new.id, new.name, new.email);
+	INSERT INTO users_trigram (rowid, name, email) VALUES (new.id, new.name, new.email);
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_search_delete AFTER DELETE ON users BEGIN
+	INSERT INTO users_fts (users_fts, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+	INSERT INTO users_trigram (users_trigram, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_search_update AFTER UPDATE ON users BEGIN
+	INSERT INTO users_fts (users_fts, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+	INSERT INTO users_trigram (users_trigram, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+	INSERT INTO users_fts (rowid, name, email) VALUES (new.id, new.name, new.email);
+	INSERT INTO users_trigram (rowid, name, email) VALUES (new.id, new.name, new.email);
+END;
+
+-- Index the users that existed before search was introduced
+INSERT INTO users_fts (users_fts) VALUES ('rebuild');
+INSERT INTO users_trigram (users_trigram) VALUES ('rebuild');
@@ -0,0 +1,43 @@
+-- Times are Unix seconds. Lists are space-separated, since neither URIs nor scopes contain spaces.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	-- secret_hash is empty for public clients
+	secret_hash TEXT NOT NULL DEFAULT '',
+	token_endpoint_auth_method TEXT NOT NULL,
+	redirect_uris TEXT NOT NULL DEFAULT '',
+	grant_types TEXT NOT NULL,
+	scopes TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+	code_hash TEXT PRIMARY KEY,
+	client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	redirect_uri TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	nonce TEXT NOT NULL DEFAULT '',
+	code_challenge TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+	token_hash TEXT PRIMARY KEY,
+	client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	-- user_id is NULL for client credentials tokens
+	user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+	scope TEXT NOT NULL,
+	issued_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_tokens_user_id ON oauth_tokens (user_id);
+CREATE INDEX IF NOT EXISTS oauth_tokens_expires_at ON oauth_tokens (expires_at);
+
+CREATE TABLE IF NOT EXISTS oauth_signing_keys (
+	id TEXT PRIMARY KEY,
+	-- private_key is PKCS #8 DER
+	private_key BLOB NOT NULL,
+	created_at INTEGER NOT NULL
+);
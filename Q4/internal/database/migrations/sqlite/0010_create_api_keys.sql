@@ -0,0 +1,20 @@
+-- Times are Unix seconds. Scopes are space-separated.
+CREATE TABLE IF NOT EXISTS service_principals (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	scopes TEXT NOT NULL DEFAULT '',
+	created_by INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	service_principal_id TEXT NOT NULL REFERENCES service_principals (id) ON DELETE CASCADE,
+	prefix TEXT NOT NULL UNIQUE,
+	key_hash TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	last_used_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_service_principal_id ON api_keys (service_principal_id);
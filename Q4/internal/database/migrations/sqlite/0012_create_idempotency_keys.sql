@@ -0,0 +1,15 @@
+-- Times are Unix seconds. response_status is 0 while the request is in progress and
+-- response_header is a JSON object.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	scope TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	response_status INTEGER NOT NULL DEFAULT 0,
+	response_header TEXT NOT NULL DEFAULT '{}',
+	response_body BLOB,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	PRIMARY KEY (scope, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at ON idempotency_keys (expires_at);
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+
+	_ "github.com/lib/pq"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// OpenPostgres connects to the PostgreSQL database described by dsn and applies pending migrations
+func OpenPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if err := MigratePostgres(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// MigratePostgres applies the embedded PostgreSQL migrations that have not run yet
+func MigratePostgres(db *sql.DB) error {
+	return migrate(db, postgresMigrations, "migrations/postgres", postgresDialect)
+}
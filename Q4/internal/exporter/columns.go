@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"Q4/internal/model"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Column is a single exportable user attribute
+type Column struct {
+	Name    string
+	Numeric bool
+	Value   func(user model.User) string
+}
+
+var columns = []Column{
+	{Name: "id", Numeric: true, Value: func(user model.User) string { return strconv.Itoa(user.ID) }},
+	{Name: "name", Value: func(user model.User) string { return user.Name }},
+	{Name: "email", Value: func(user model.User) string { return user.Email }},
+}
+
+// DefaultColumns returns every exportable column in declaration order
+func DefaultColumns() []Column {
+	return append([]Column(nil), columns...)
+}
+
+// ParseColumns resolves a comma separated column list such as "email,name"; an empty list selects every column
+func ParseColumns(s string) ([]Column, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultColumns(), nil
+	}
+
+	var selected []Column
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			continue
+		}
+		column, ok := lookupColumn(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		seen[name] = true
+		selected = append(selected, column)
+	}
+	return selected, nil
+}
+
+func lookupColumn(name string) (Column, bool) {
+	for _, column := range columns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
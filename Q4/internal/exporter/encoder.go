@@ -0,0 +1,163 @@
+package exporter
+
+import (
+	"Q4/internal/model"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format identifies the encoding of an export stream
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+	FormatXLSX   Format = "xlsx"
+)
+
+var ErrNotAcceptable = errors.New("no acceptable export format")
+
+var contentTypes = map[Format]string{
+	FormatCSV:    "text/csv; charset=utf-8",
+	FormatNDJSON: "application/x-ndjson",
+	FormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+var mediaTypes = map[string]Format{
+	"text/csv":             FormatCSV,
+	"application/csv":      FormatCSV,
+	"application/x-ndjson": FormatNDJSON,
+	"application/ndjson":   FormatNDJSON,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": FormatXLSX,
+}
+
+// ContentType returns the media type sent for a format
+func (f Format) ContentType() string {
+	return contentTypes[f]
+}
+
+// Negotiate picks a format from an explicit name or, if empty, from an Accept header.
+// CSV is used when the client accepts anything.
+func Negotiate(name, accept string) (Format, error) {
+	if name != "" {
+		format := Format(strings.ToLower(name))
+		if _, ok := contentTypes[format]; !ok {
+			return "", fmt.Errorf("%w: %s", ErrNotAcceptable, name)
+		}
+		return format, nil
+	}
+	if strings.TrimSpace(accept) == "" {
+		return FormatCSV, nil
+	}
+
+	type candidate struct {
+		format Format
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		switch {
+		case mediaType == "*/*" || mediaType == "text/*":
+			candidates = append(candidates, candidate{FormatCSV, q})
+		case mediaTypes[mediaType] != "":
+			candidates = append(candidates, candidate{mediaTypes[mediaType], q})
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrNotAcceptable, accept)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].format, nil
+}
+
+// Encoder writes users in a particular format; Close must be called to complete the document
+type Encoder interface {
+	Encode(user model.User) error
+	Close() error
+}
+
+// NewEncoder returns an Encoder for format that writes the selected columns to w
+func NewEncoder(format Format, w io.Writer, columns []Column) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVEncoder(w, columns)
+	case FormatNDJSON:
+		return &ndjsonEncoder{encoder: json.NewEncoder(w), columns: columns}, nil
+	case FormatXLSX:
+		return newXLSXEncoder(w, columns)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotAcceptable, format)
+}
+
+type csvEncoder struct {
+	writer  *csv.Writer
+	columns []Column
+	record  []string
+}
+
+func newCSVEncoder(w io.Writer, columns []Column) (*csvEncoder, error) {
+	writer := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvEncoder{writer: writer, columns: columns, record: make([]string, len(columns))}, nil
+}
+
+func (e *csvEncoder) Encode(user model.User) error {
+	for i, column := range e.columns {
+		e.record[i] = column.Value(user)
+	}
+	return e.writer.Write(e.record)
+}
+
+func (e *csvEncoder) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+	columns []Column
+}
+
+func (e *ndjsonEncoder) Encode(user model.User) error {
+	object := make(map[string]any, len(e.columns))
+	for _, column := range e.columns {
+		value := column.Value(user)
+		if column.Numeric {
+			object[column.Name] = json.Number(value)
+		} else {
+			object[column.Name] = value
+		}
+	}
+	return e.encoder.Encode(object)
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
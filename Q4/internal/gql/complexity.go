@@ -0,0 +1,486 @@
+package gql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// listSizes give, from the arguments of each list field, the number of users it may return; the
+// fields selected below it count once per user
+var listSizes = map[string]func(c *complexity, args map[string]value) int{
+	"users": func(c *complexity, args map[string]value) int {
+		limit, ok := c.intValue(args["limit"])
+		if !ok {
+			return DefaultPageSize
+		}
+		return min(max(limit, 0), MaxPageSize)
+	},
+	"usersByIds": func(c *complexity, args map[string]value) int {
+		return c.listLength(args["ids"])
+	},
+}
+
+// Complexity estimates the cost of running operationName from query: every field costs one, and
+// the fields selected below a list cost that once per item the list may hold. Queries must be
+// validated first; Complexity only parses as much as it needs.
+func Complexity(query, operationName string, variables map[string]interface{}) (int, error) {
+	doc, err := parseDocument(query)
+	if err != nil {
+		return 0, err
+	}
+	var operation *operation
+	switch {
+	case operationName != "":
+		for _, op := range doc.operations {
+			if op.name == operationName {
+				operation = op
+			}
+		}
+	case len(doc.operations) == 1:
+		operation = doc.operations[0]
+	}
+	if operation == nil {
+		return 0, fmt.Errorf("no operation %q to run", operationName)
+	}
+
+	c := complexity{
+		fragments: doc.fragments,
+		variables: variables,
+		defaults:  operation.defaults,
+		visiting:  map[string]bool{},
+	}
+	return c.selections(operation.selections), nil
+}
+
+type complexity struct {
+	fragments map[string][]selection
+	variables map[string]interface{}
+	// defaults are the default values of the operation's variables
+	defaults map[string]value
+	// visiting guards against fragments that spread themselves, which validation also rejects
+	visiting map[string]bool
+}
+
+func (c *complexity) selections(selections []selection) int {
+	cost := 0
+	for _, sel := range selections {
+		switch {
+		case sel.fragment != "":
+			if c.visiting[sel.fragment] {
+				continue
+			}
+			c.visiting[sel.fragment] = true
+			cost += c.selections(c.fragments[sel.fragment])
+			delete(c.visiting, sel.fragment)
+		case sel.field == "":
+			// Inline fragment
+			cost += c.selections(sel.selections)
+		default:
+			items := 1
+			if size, ok := listSizes[sel.field]; ok {
+				items = size(c, sel.args)
+			}
+			cost += 1 + items*c.selections(sel.selections)
+		}
+	}
+	return cost
+}
+
+// variable returns the value of a variable sent with the query, or else its default value
+func (c *complexity) variable(name string) (interface{}, value, bool) {
+	if v, ok := c.variables[name]; ok && v != nil {
+		return v, value{}, true
+	}
+	def, ok := c.defaults[name]
+	return nil, def, ok
+}
+
+func (c *complexity) intValue(v value) (int, bool) {
+	if v.variable != "" {
+		sent, def, ok := c.variable(v.variable)
+		switch n := sent.(type) {
+		case float64:
+			return int(n), true
+		case int:
+			return n, true
+		}
+		if !ok || def.variable != "" {
+			return 0, false
+		}
+		v = def
+	}
+	n, err := strconv.Atoi(v.literal)
+	return n, err == nil
+}
+
+func (c *complexity) listLength(v value) int {
+	if v.variable != "" {
+		sent, def, ok := c.variable(v.variable)
+		if list, isList := sent.([]interface{}); isList {
+			return len(list)
+		}
+		if sent != nil || !ok || def.variable != "" {
+			// A single value stands for a list of one
+			return 1
+		}
+		v = def
+	}
+	if v.isList {
+		return len(v.list)
+	}
+	return 1
+}
+
+// document holds what Complexity needs from a GraphQL query document
+type document struct {
+	operations []*operation
+	fragments  map[string][]selection
+}
+
+type operation struct {
+	name       string
+	defaults   map[string]value
+	selections []selection
+}
+
+// selection is a field, a fragment spread (fragment set) or an inline fragment (neither set)
+type selection struct {
+	field      string
+	args       map[string]value
+	fragment   string
+	selections []selection
+}
+
+// value is an argument value: a variable, a scalar literal or a list of values
+type value struct {
+	variable string
+	literal  string
+	list     []value
+	isList   bool
+}
+
+func parseDocument(query string) (*document, error) {
+	p := &parser{lexer: lexer{src: query}}
+	p.next()
+	doc := &document{fragments: map[string][]selection{}}
+	for p.err == nil && p.tok.kind != tokEOF {
+		switch {
+		case p.tok.is(tokPunct, "{"):
+			doc.operations = append(doc.operations, &operation{selections: p.selectionSet()})
+		case p.tok.is(tokName, "fragment"):
+			p.next()
+			name := p.name()
+			p.expectName("on")
+			p.name()
+			p.directives()
+			doc.fragments[name] = p.selectionSet()
+		case p.tok.is(tokName, "query"), p.tok.is(tokName, "mutation"), p.tok.is(tokName, "subscription"):
+			p.next()
+			op := &operation{}
+			if p.tok.kind == tokName {
+				op.name = p.name()
+			}
+			if p.tok.is(tokPunct, "(") {
+				op.defaults = p.variableDefinitions()
+			}
+			p.directives()
+			op.selections = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("expected an operation or fragment")
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return doc, nil
+}
+
+type parser struct {
+	lexer lexer
+	tok   token
+	err   error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *parser) fail(message string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("syntax error at offset %d: %s", p.tok.pos, message)
+	}
+	p.tok = token{kind: tokEOF}
+}
+
+func (p *parser) name() string {
+	if p.tok.kind != tokName {
+		p.fail("expected a name")
+		return ""
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+func (p *parser) expectName(name string) {
+	if !p.tok.is(tokName, name) {
+		p.fail("expected " + name)
+		return
+	}
+	p.next()
+}
+
+func (p *parser) expect(punct string) {
+	if !p.tok.is(tokPunct, punct) {
+		p.fail("expected " + punct)
+		return
+	}
+	p.next()
+}
+
+func (p *parser) selectionSet() []selection {
+	p.expect("{")
+	var selections []selection
+	for p.err == nil && !p.tok.is(tokPunct, "}") {
+		selections = append(selections, p.selection())
+	}
+	p.expect("}")
+	return selections
+}
+
+func (p *parser) selection() selection {
+	if p.tok.is(tokPunct, "...") {
+		p.next()
+		if p.tok.kind == tokName && p.tok.text != "on" {
+			sel := selection{fragment: p.name()}
+			p.directives()
+			return sel
+		}
+		if p.tok.is(tokName, "on") {
+			p.next()
+			p.name()
+		}
+		p.directives()
+		return selection{selections: p.selectionSet()}
+	}
+
+	sel := selection{field: p.name()}
+	if p.tok.is(tokPunct, ":") {
+		// The first name was an alias
+		p.next()
+		sel.field = p.name()
+	}
+	if p.tok.is(tokPunct, "(") {
+		sel.args = p.arguments()
+	}
+	p.directives()
+	if p.tok.is(tokPunct, "{") {
+		sel.selections = p.selectionSet()
+	}
+	return sel
+}
+
+func (p *parser) arguments() map[string]value {
+	args := map[string]value{}
+	p.expect("(")
+	for p.err == nil && !p.tok.is(tokPunct, ")") {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value()
+	}
+	p.expect(")")
+	return args
+}
+
+func (p *parser) value() value {
+	switch {
+	case p.tok.is(tokPunct, "$"):
+		p.next()
+		return value{variable: p.name()}
+	case p.tok.is(tokPunct, "["):
+		p.next()
+		v := value{isList: true}
+		for p.err == nil && !p.tok.is(tokPunct, "]") {
+			v.list = append(v.list, p.value())
+		}
+		p.expect("]")
+		return v
+	case p.tok.is(tokPunct, "{"):
+		// Input objects only matter for what they contain, which no list size depends on
+		p.next()
+		for p.err == nil && !p.tok.is(tokPunct, "}") {
+			p.name()
+			p.expect(":")
+			p.value()
+		}
+		p.expect("}")
+		return value{}
+	case p.tok.kind == tokName, p.tok.kind == tokNumber, p.tok.kind == tokString:
+		v := value{literal: p.tok.text}
+		p.next()
+		return v
+	}
+	p.fail("expected a value")
+	return value{}
+}
+
+// variableDefinitions returns the default values of the variables that have one
+func (p *parser) variableDefinitions() map[string]value {
+	defaults := map[string]value{}
+	p.expect("(")
+	for p.err == nil && !p.tok.is(tokPunct, ")") {
+		p.expect("$")
+		name := p.name()
+		p.expect(":")
+		p.typeRef()
+		if p.tok.is(tokPunct, "=") {
+			p.next()
+			defaults[name] = p.value()
+		}
+		p.directives()
+	}
+	p.expect(")")
+	return defaults
+}
+
+func (p *parser) typeRef() {
+	if p.tok.is(tokPunct, "[") {
+		p.next()
+		p.typeRef()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	if p.tok.is(tokPunct, "!") {
+		p.next()
+	}
+}
+
+func (p *parser) directives() {
+	for p.err == nil && p.tok.is(tokPunct, "@") {
+		p.next()
+		p.name()
+		if p.tok.is(tokPunct, "(") {
+			p.arguments()
+		}
+	}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokNumber
+	tokString
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// lexer splits GraphQL source into tokens, skipping whitespace, commas and comments
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipIgnored()
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: tokPunct, text: "...", pos: start}, nil
+	case strings.IndexByte("!$&().:=@[]{}|", c) >= 0:
+		l.pos++
+		return token{kind: tokPunct, text: string(c), pos: start}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokName, text: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case strings.HasPrefix(l.src[l.pos:], `"""`):
+		l.pos += 3
+		for !strings.HasPrefix(l.src[l.pos:], `"""`) {
+			if l.pos >= len(l.src) {
+				return token{}, fmt.Errorf("syntax error at offset %d: unterminated block string", start)
+			}
+			if strings.HasPrefix(l.src[l.pos:], `\"""`) {
+				l.pos += 3
+			}
+			l.pos++
+		}
+		l.pos += 3
+		return token{kind: tokString, text: l.src[start+3 : l.pos-3], pos: start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' && l.src[l.pos] != '\n' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			return token{}, fmt.Errorf("syntax error at offset %d: unterminated string", start)
+		}
+		l.pos++
+		return token{kind: tokString, text: l.src[start+1 : l.pos-1], pos: start}, nil
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return token{}, fmt.Errorf("syntax error at offset %d: unexpected character %q", start, r)
+}
+
+func (l *lexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], byteOrderMark):
+			l.pos += len(byteOrderMark)
+		default:
+			return
+		}
+	}
+}
+
+const byteOrderMark = "\uFEFF"
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,154 @@
+package gql
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchWait is how long a batch of lookups collects IDs before they are fetched. The
+	// fields of a query are resolved concurrently, so sibling lookups arrive within it.
+	DefaultBatchWait = 2 * time.Millisecond
+	// DefaultMaxBatch bounds the IDs fetched by one query; a full batch is fetched at once
+	DefaultMaxBatch = 100
+)
+
+// UserLoader batches the user lookups of one GraphQL request: lookups made while a batch is
+// collecting are answered by one GetUsersByIDs call instead of one query each, and every user is
+// fetched at most once per request. It is not meant to outlive the request, since it never forgets
+// a user.
+type UserLoader struct {
+	Users service.UserServiceInterface
+	// Wait is how long a batch collects IDs after its first one
+	Wait     time.Duration
+	MaxBatch int
+
+	mu      sync.Mutex
+	loads   map[int]*userLoad
+	pending *userBatch
+}
+
+// userLoad is the lookup of one ID; done is closed once user and err are set
+type userLoad struct {
+	done chan struct{}
+	user *model.User
+	err  error
+}
+
+type userBatch struct {
+	loads map[int]*userLoad
+}
+
+func NewUserLoader(users service.UserServiceInterface) *UserLoader {
+	return &UserLoader{
+		Users:    users,
+		Wait:     DefaultBatchWait,
+		MaxBatch: DefaultMaxBatch,
+		loads:    map[int]*userLoad{},
+	}
+}
+
+// Load returns the user with id, or nil if there is none
+func (l *UserLoader) Load(id int) (*model.User, error) {
+	users, err := l.LoadMany([]int{id})
+	if err != nil {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+// LoadMany returns the users with ids in the same order, with nil for unknown IDs
+func (l *UserLoader) LoadMany(ids []int) ([]*model.User, error) {
+	l.mu.Lock()
+	loads := make([]*userLoad, len(ids))
+	for i, id := range ids {
+		loads[i] = l.enqueue(id)
+	}
+	l.mu.Unlock()
+
+	users := make([]*model.User, len(ids))
+	for i, load := range loads {
+		<-load.done
+		if load.err != nil {
+			return nil, load.err
+		}
+		users[i] = load.user
+	}
+	return users, nil
+}
+
+// enqueue returns the lookup of id, adding it to the pending batch unless it was made before.
+// The caller holds l.mu.
+func (l *UserLoader) enqueue(id int) *userLoad {
+	if load, ok := l.loads[id]; ok {
+		return load
+	}
+	load := &userLoad{done: make(chan struct{})}
+	l.loads[id] = load
+
+	if l.pending == nil {
+		batch := &userBatch{loads: map[int]*userLoad{}}
+		l.pending = batch
+		time.AfterFunc(l.Wait, func() { l.dispatch(batch) })
+	}
+	l.pending.loads[id] = load
+	if len(l.pending.loads) >= l.MaxBatch {
+		batch := l.pending
+		l.pending = nil
+		go l.fetch(batch)
+	}
+	return load
+}
+
+// dispatch fetches batch when its wait is over, unless it filled up and was fetched before
+func (l *UserLoader) dispatch(batch *userBatch) {
+	l.mu.Lock()
+	if l.pending != batch {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = nil
+	l.mu.Unlock()
+	l.fetch(batch)
+}
+
+func (l *UserLoader) fetch(batch *userBatch) {
+	ids := make([]int, 0, len(batch.loads))
+	for id := range batch.loads {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	users, err := l.Users.GetUsersByIDs(ids)
+	byID := make(map[int]model.User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+	for id, load := range batch.loads {
+		if err != nil {
+			load.err = err
+		} else if user, ok := byID[id]; ok {
+			load.user = &user
+		}
+		close(load.done)
+	}
+}
+
+type loaderKey struct{}
+
+// WithLoader returns a copy of ctx that carries loader for the resolvers
+func WithLoader(ctx context.Context, loader *UserLoader) context.Context {
+	return context.WithValue(ctx, loaderKey{}, loader)
+}
+
+func loaderFrom(ctx context.Context, users service.UserServiceInterface) *UserLoader {
+	if loader, ok := ctx.Value(loaderKey{}).(*UserLoader); ok {
+		return loader
+	}
+	// Without a request-wide loader, lookups are still batched within the field
+	return NewUserLoader(users)
+}
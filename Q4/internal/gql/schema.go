@@ -0,0 +1,384 @@
+// Package gql serves users over GraphQL. Resolvers go through service.UserServiceInterface, like
+// the REST handlers, and lookups by ID are batched per request by a UserLoader.
+package gql
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed schema.graphql
+var schemaSource string
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+	DefaultMaxDepth = 10
+	// DefaultMaxComplexity allows, for example, a full page of users with ten fields each
+	DefaultMaxComplexity = 1000
+)
+
+// Error codes, sent in the "code" extension of errors
+const (
+	CodeBadUserInput    = "BAD_USER_INPUT"
+	CodeUnauthenticated = "UNAUTHENTICATED"
+	CodeForbidden       = "FORBIDDEN"
+	CodeNotFound        = "NOT_FOUND"
+	CodeConflict        = "CONFLICT"
+	CodeQueryTooComplex = "QUERY_TOO_COMPLEX"
+	CodeInternal        = "INTERNAL"
+)
+
+// Error is an error a client can act on; its code goes out in the error's extensions
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.Code}
+}
+
+// Request is a GraphQL request as sent in a JSON body
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Schema runs GraphQL requests against the users of a UserServiceInterface
+type Schema struct {
+	Users service.UserServiceInterface
+	// MaxComplexity bounds the cost Complexity estimates for a query
+	MaxComplexity int
+	// BatchWait is the Wait of the UserLoader of each request
+	BatchWait time.Duration
+
+	schema *graphql.Schema
+}
+
+// NewSchema returns a Schema that rejects queries whose selections nest deeper than maxDepth
+func NewSchema(users service.UserServiceInterface, maxDepth int) (*Schema, error) {
+	schema, err := graphql.ParseSchema(schemaSource, &resolver{users: users},
+		graphql.UseStringDescriptions(),
+		graphql.MaxDepth(maxDepth),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GraphQL schema: %w", err)
+	}
+	return &Schema{
+		Users:         users,
+		MaxComplexity: DefaultMaxComplexity,
+		BatchWait:     DefaultBatchWait,
+		schema:        schema,
+	}, nil
+}
+
+// Exec validates req, rejects it if it is too complex and otherwise runs it. Errors go into the
+// response, as GraphQL has it.
+func (s *Schema) Exec(ctx context.Context, req Request) *graphql.Response {
+	if errs := s.schema.ValidateWithVariables(req.Query, req.Variables); len(errs) > 0 {
+		return &graphql.Response{Errors: errs}
+	}
+	cost, err := Complexity(req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		return &graphql.Response{Errors: []*gqlerrors.QueryError{gqlerrors.Errorf("%s", err)}}
+	}
+	if cost > s.MaxComplexity {
+		logrus.Warnf("Rejected GraphQL query of complexity %d", cost)
+		queryErr := gqlerrors.Errorf("query complexity %d exceeds the maximum of %d", cost, s.MaxComplexity)
+		queryErr.Extensions = map[string]interface{}{"code": CodeQueryTooComplex}
+		return &graphql.Response{Errors: []*gqlerrors.QueryError{queryErr}}
+	}
+
+	loader := NewUserLoader(s.Users)
+	loader.Wait = s.BatchWait
+	return s.schema.Exec(WithLoader(ctx, loader), req.Query, req.OperationName, req.Variables)
+}
+
+type resolver struct {
+	users service.UserServiceInterface
+}
+
+// requireScope keeps API keys to the scopes of their service principal, like
+// middleware.RequireScope does for the REST routes
+func requireScope(ctx context.Context, scope string) error {
+	if principal := auth.PrincipalFrom(ctx); principal != nil && !principal.HasScope(scope) {
+		logrus.Warnf("Rejected GraphQL request by service principal %s without scope %s", principal.ServicePrincipalID, scope)
+		return &Error{Code: CodeForbidden, Message: "the API key needs the " + scope + " scope"}
+	}
+	return nil
+}
+
+func parseID(id graphql.ID) (int, error) {
+	n, err := strconv.Atoi(string(id))
+	if err != nil || n <= 0 {
+		return 0, &Error{Code: CodeBadUserInput, Message: fmt.Sprintf("invalid user ID %q", id)}
+	}
+	return n, nil
+}
+
+// userError turns the errors of the user service into ones for clients. Unexpected errors are
+// logged and reported without their details.
+func userError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrUserNotFound):
+		return &Error{Code: CodeNotFound, Message: "user not found"}
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		return &Error{Code: CodeConflict, Message: "another user already has this email address"}
+	case errors.Is(err, service.ErrInvalidRole), errors.Is(err, auth.ErrWeakPassword):
+		return &Error{Code: CodeBadUserInput, Message: err.Error()}
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return &Error{Code: CodeUnauthenticated, Message: "sign in to change users"}
+	case errors.Is(err, service.ErrRoleDenied), errors.Is(err, service.ErrUserAccessDenied),
+		errors.Is(err, service.ErrPasswordConfirmation), errors.Is(err, service.ErrAdminEmailDenied):
+		return &Error{Code: CodeForbidden, Message: err.Error()}
+	}
+	logrus.Errorf("GraphQL request failed: %v", err)
+	return &Error{Code: CodeInternal, Message: "internal error"}
+}
+
+func (r *resolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	if err := requireScope(ctx, auth.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := loaderFrom(ctx, r.users).Load(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	if user == nil {
+		return nil, nil
+	}
+	return &userResolver{user: *user}, nil
+}
+
+func (r *resolver) UsersByIds(ctx context.Context, args struct{ IDs []graphql.ID }) ([]*userResolver, error) {
+	if err := requireScope(ctx, auth.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(args.IDs))
+	for i, id := range args.IDs {
+		n, err := parseID(id)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = n
+	}
+	users, err := loaderFrom(ctx, r.users).LoadMany(ids)
+	if err != nil {
+		return nil, userError(err)
+	}
+	resolvers := make([]*userResolver, len(users))
+	for i, user := range users {
+		if user != nil {
+			resolvers[i] = &userResolver{user: *user}
+		}
+	}
+	return resolvers, nil
+}
+
+type userFilterInput struct {
+	Name  *string
+	Email *string
+}
+
+func (r *resolver) Users(ctx context.Context, args struct {
+	Filter *userFilterInput
+	Limit  int32
+	Offset int32
+}) (*userPageResolver, error) {
+	if err := requireScope(ctx, auth.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	limit, offset := int(args.Limit), int(args.Offset)
+	if limit < 1 || limit > MaxPageSize {
+		return nil, &Error{Code: CodeBadUserInput, Message: fmt.Sprintf("limit must be between 1 and %d", MaxPageSize)}
+	}
+	if offset < 0 {
+		return nil, &Error{Code: CodeBadUserInput, Message: "offset must not be negative"}
+	}
+
+	var filter model.UserFilter
+	if args.Filter != nil {
+		filter.Name = stringValue(args.Filter.Name)
+		filter.Email = stringValue(args.Filter.Email)
+	}
+	users, err := r.users.ListUsers(filter)
+	if err != nil {
+		return nil, userError(err)
+	}
+
+	page := &userPageResolver{totalCount: len(users)}
+	if offset < len(users) {
+		end := min(offset+limit, len(users))
+		page.nodes = users[offset:end]
+		page.hasNextPage = end < len(users)
+	}
+	return page, nil
+}
+
+type createUserInput struct {
+	Name     string
+	Email    string
+	Role     *string
+	Password *string
+}
+
+func (r *resolver) CreateUser(ctx context.Context, args struct{ Input createUserInput }) (*userResolver, error) {
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	user := model.User{
+		Name:     args.Input.Name,
+		Email:    args.Input.Email,
+		Role:     stringValue(args.Input.Role),
+		Password: stringValue(args.Input.Password),
+	}
+	if err := r.users.CreateUser(auth.PrincipalFrom(ctx), &user); err != nil {
+		return nil, userError(err)
+	}
+	logrus.Infof("User with ID %d created over GraphQL", user.ID)
+	return r.reload(user.ID)
+}
+
+type updateUserInput struct {
+	Name            *string
+	Email           *string
+	Role            *string
+	CurrentPassword *string
+}
+
+func (r *resolver) UpdateUser(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input updateUserInput
+}) (*userResolver, error) {
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.users.GetUserByID(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	if args.Input.Name != nil {
+		user.Name = *args.Input.Name
+	}
+	if args.Input.Email != nil {
+		user.Email = *args.Input.Email
+	}
+	if args.Input.Role != nil {
+		user.Role = *args.Input.Role
+	}
+	user.CurrentPassword = stringValue(args.Input.CurrentPassword)
+	if err := r.users.UpdateUser(auth.PrincipalFrom(ctx), user); err != nil {
+		return nil, userError(err)
+	}
+	logrus.Infof("User with ID %d updated over GraphQL", id)
+	return r.reload(id)
+}
+
+func (r *resolver) DeleteUser(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return "", err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.users.GetUserByID(id); err != nil {
+		return "", userError(err)
+	}
+	if err := r.users.DeleteUser(auth.PrincipalFrom(ctx), id); err != nil {
+		return "", userError(err)
+	}
+	logrus.Infof("User with ID %d deleted over GraphQL", id)
+	return args.ID, nil
+}
+
+// reload returns the user as stored, with the role and verification state the store gave them
+func (r *resolver) reload(id int) (*userResolver, error) {
+	user, err := r.users.GetUserByID(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	return &userResolver{user: *user}, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+type userResolver struct {
+	user model.User
+}
+
+func (u *userResolver) ID() graphql.ID {
+	return graphql.ID(strconv.Itoa(u.user.ID))
+}
+
+func (u *userResolver) Name() string {
+	return u.user.Name
+}
+
+func (u *userResolver) Email() string {
+	return u.user.Email
+}
+
+func (u *userResolver) Role() string {
+	if u.user.Role == "" {
+		return model.RoleUser
+	}
+	return u.user.Role
+}
+
+func (u *userResolver) EmailVerified() bool {
+	return u.user.EmailVerified
+}
+
+type userPageResolver struct {
+	nodes       []model.User
+	totalCount  int
+	hasNextPage bool
+}
+
+func (p *userPageResolver) Nodes() []*userResolver {
+	resolvers := make([]*userResolver, len(p.nodes))
+	for i := range p.nodes {
+		resolvers[i] = &userResolver{user: p.nodes[i]}
+	}
+	return resolvers
+}
+
+func (p *userPageResolver) TotalCount() int32 {
+	return int32(p.totalCount)
+}
+
+func (p *userPageResolver) HasNextPage() bool {
+	return p.hasNextPage
+}
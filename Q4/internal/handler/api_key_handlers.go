@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+)
+
+type APIKeyHandler struct {
+	APIKeys service.APIKeyServiceInterface
+}
+
+func NewAPIKeyHandler(apiKeys service.APIKeyServiceInterface) *APIKeyHandler {
+	return &APIKeyHandler{
+		APIKeys: apiKeys,
+	}
+}
+
+// CreateServicePrincipal godoc
+// @Summary Create a service principal
+// @Description Create a caller for batch jobs and other services, which signs in with API keys instead of a password.
+// @Description Its scopes decide what its keys may do: "users:read", "users:write" and "metrics:read". Only admins may manage service principals.
+// @Description With a certificate_subject such as "CN=nightly-export,O=Example", clients presenting a certificate of that subject, issued by a CA the server trusts for client certificates, sign in as the principal without an API key.
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Param principal body service.CreateServicePrincipalRequest true "Name and scopes"
+// @Success 201 {object} model.ServicePrincipal
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals [post]
+func (ah *APIKeyHandler) CreateServicePrincipal(rw http.ResponseWriter, r *http.Request) {
+	var request service.CreateServicePrincipalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logrus.Warn("Invalid service principal provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid service principal", "The request body must be JSON with a name and scopes")
+		return
+	}
+
+	principal, err := ah.APIKeys.CreateServicePrincipal(auth.PrincipalFrom(r.Context()).UserID, request)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to create service principal: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to create service principal", err.Error())
+		return
+	}
+	writeAPIKeyJSON(rw, http.StatusCreated, principal)
+}
+
+// ListServicePrincipals godoc
+// @Summary List the service principals
+// @Tags api-keys
+// @Produce  json
+// @Success 200 {array} model.ServicePrincipal
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals [get]
+func (ah *APIKeyHandler) ListServicePrincipals(rw http.ResponseWriter, r *http.Request) {
+	principals, err := ah.APIKeys.ListServicePrincipals(auth.PrincipalFrom(r.Context()).UserID)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to list service principals: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to list service principals", err.Error())
+		return
+	}
+	writeAPIKeyJSON(rw, http.StatusOK, principals)
+}
+
+// DeleteServicePrincipal godoc
+// @Summary Delete a service principal
+// @Description Delete the service principal and revoke all of its API keys
+// @Tags api-keys
+// @Produce  json
+// @Param id path string true "Service principal ID"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals/{id} [delete]
+func (ah *APIKeyHandler) DeleteServicePrincipal(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := ah.APIKeys.DeleteServicePrincipal(auth.PrincipalFrom(r.Context()).UserID, id)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to delete service principal %s: %v", id, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to delete service principal", err.Error())
+		return
+	}
+	respondWithSuccess(rw, "Service principal deleted")
+}
+
+// IssueAPIKey godoc
+// @Summary Issue an API key
+// @Description Issue a key to the service principal. The key is returned once and only its hash is stored; send it as "Authorization: Bearer <key>" or in the X-API-Key header.
+// @Description Keys expire after 90 days unless expires_in (seconds, up to a year) says otherwise. The body may be omitted.
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Service principal ID"
+// @Param key body service.IssueAPIKeyRequest false "Lifetime"
+// @Success 201 {object} service.IssuedAPIKey
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals/{id}/keys [post]
+func (ah *APIKeyHandler) IssueAPIKey(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var request service.IssueAPIKeyRequest
+	if !decodeOptionalBody(rw, r, &request) {
+		return
+	}
+
+	issued, err := ah.APIKeys.IssueAPIKey(auth.PrincipalFrom(r.Context()).UserID, id, request)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to issue API key to service principal %s: %v", id, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to issue API key", err.Error())
+		return
+	}
+	writeAPIKeyJSON(rw, http.StatusCreated, issued)
+}
+
+// ListAPIKeys godoc
+// @Summary List the API keys of a service principal
+// @Description Return the keys with their prefix, expiry and last use, oldest first. The keys themselves cannot be shown again.
+// @Tags api-keys
+// @Produce  json
+// @Param id path string true "Service principal ID"
+// @Success 200 {array} model.APIKey
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals/{id}/keys [get]
+func (ah *APIKeyHandler) ListAPIKeys(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	keys, err := ah.APIKeys.ListAPIKeys(auth.PrincipalFrom(r.Context()).UserID, id)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to list API keys of service principal %s: %v", id, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to list API keys", err.Error())
+		return
+	}
+	writeAPIKeyJSON(rw, http.StatusOK, keys)
+}
+
+// RotateAPIKey godoc
+// @Summary Rotate an API key
+// @Description Issue a replacement for the key. The old key keeps working for overlap seconds, a day by default, so that jobs can switch without downtime.
+// @Description The body may be omitted.
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Service principal ID"
+// @Param keyId path string true "API key ID"
+// @Param rotation body service.RotateAPIKeyRequest false "Lifetime of the new key and overlap"
+// @Success 201 {object} service.IssuedAPIKey
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals/{id}/keys/{keyId}/rotate [post]
+func (ah *APIKeyHandler) RotateAPIKey(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var request service.RotateAPIKeyRequest
+	if !decodeOptionalBody(rw, r, &request) {
+		return
+	}
+
+	issued, err := ah.APIKeys.RotateAPIKey(auth.PrincipalFrom(r.Context()).UserID, vars["id"], vars["keyId"], request)
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to rotate API key %s: %v", vars["keyId"], err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to rotate API key", err.Error())
+		return
+	}
+	writeAPIKeyJSON(rw, http.StatusCreated, issued)
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key
+// @Description Revoke the key at once
+// @Tags api-keys
+// @Produce  json
+// @Param id path string true "Service principal ID"
+// @Param keyId path string true "API key ID"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /service-principals/{id}/keys/{keyId} [delete]
+func (ah *APIKeyHandler) RevokeAPIKey(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := ah.APIKeys.RevokeAPIKey(auth.PrincipalFrom(r.Context()).UserID, vars["id"], vars["keyId"])
+	if writeAPIKeyError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to revoke API key %s: %v", vars["keyId"], err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to revoke API key", err.Error())
+		return
+	}
+	respondWithSuccess(rw, "API key revoked")
+}
+
+// decodeOptionalBody decodes a JSON body into v unless the body is empty. It answers malformed
+// bodies itself and reports false.
+func decodeOptionalBody(rw http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid request body", "The request body must be JSON or empty")
+		return false
+	}
+	return true
+}
+
+func writeAPIKeyError(rw http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, service.ErrAPIKeyAdminRequired):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Admin role required", err.Error())
+	case errors.Is(err, service.ErrInvalidAPIKeyRequest):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid request", err.Error())
+	case errors.Is(err, repository.ErrServicePrincipalNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "Service principal not found", "No service principal with this ID exists")
+	case errors.Is(err, repository.ErrDuplicateCertificateSubject):
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "Certificate subject already assigned", "Another service principal signs in with this certificate subject")
+	case errors.Is(err, repository.ErrAPIKeyNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "API key not found", "The service principal has no API key with this ID")
+	default:
+		return false
+	}
+	return true
+}
+
+// writeAPIKeyJSON writes v uncached, since responses may carry a key that is shown only once
+func writeAPIKeyJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logrus.Errorf("Failed to encode API key response: %v", err)
+	}
+}
@@ -0,0 +1,455 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type AuthHandler struct {
+	Verification service.EmailVerificationServiceInterface
+	Auth         service.AuthServiceInterface
+	// Cookies sets the attributes of browser session cookies
+	Cookies auth.SessionCookies
+}
+
+func NewAuthHandler(verification service.EmailVerificationServiceInterface, authService service.AuthServiceInterface) *AuthHandler {
+	return &AuthHandler{
+		Verification: verification,
+		Auth:         authService,
+		Cookies:      auth.SessionCookies{Secure: true},
+	}
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type VerifyEmailResponse struct {
+	Message string     `json:"message"`
+	User    model.User `json:"user"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type VerifyMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a code from the authenticator app or a recovery code
+	Code string `json:"code"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type UnlockIPRequest struct {
+	IP string `json:"ip"`
+}
+
+type UnlockResponse struct {
+	// Unlocked is false when there was no lockout to lift
+	Unlocked bool `json:"unlocked"`
+}
+
+// VerifyEmail godoc
+// @Summary Verify an email address
+// @Description Confirm a user's email address with the token from their verification email. Each token works once and only while the user still has the address it was sent to.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body VerifyEmailRequest true "Verification token"
+// @Success 200 {object} VerifyEmailResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/verify-email [post]
+func (ah *AuthHandler) VerifyEmail(rw http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		logrus.Warn("Invalid email verification request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid verification request", "The request body must be JSON with a token")
+		return
+	}
+
+	user, err := ah.Verification.VerifyEmail(req.Token)
+	switch {
+	case errors.Is(err, service.ErrInvalidVerificationToken):
+		logrus.Warn("Rejected invalid or expired email verification token")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid or expired token", "Request a new verification email and try again")
+		return
+	case errors.Is(err, service.ErrEmailAlreadyVerified):
+		logrus.Warn("Rejected reused email verification token")
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "Email already verified", "This verification link has already been used")
+		return
+	case err != nil:
+		logrus.Errorf("Failed to verify email: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to verify email", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(VerifyEmailResponse{Message: "Email verified successfully", User: *user}); err != nil {
+		logrus.Errorf("Failed to encode email verification response: %v", err)
+		return
+	}
+	logrus.Infof("User with ID %d verified their email", user.ID)
+}
+
+// ResendVerification godoc
+// @Summary Resend the verification email
+// @Description Send a new verification link if the address belongs to an unverified user.
+// @Description The response is the same whether or not an email was sent, and it is sent before the address is looked up, so it cannot be used to find registered addresses.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body ResendVerificationRequest true "Email address"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/verify-email/resend [post]
+func (ah *AuthHandler) ResendVerification(rw http.ResponseWriter, r *http.Request) {
+	var req ResendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		logrus.Warn("Invalid verification resend request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid resend request", "The request body must be JSON with an email")
+		return
+	}
+
+	if err := ah.Verification.ResendVerification(req.Email); err != nil {
+		logrus.Errorf("Failed to resend verification email: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to send verification email", "Try again later")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(rw).Encode(map[string]string{
+		"message": "If the address belongs to an unverified account, a verification email is on its way",
+	})
+}
+
+// Login godoc
+// @Summary Sign in with email and password
+// @Description Exchange an email and password for a bearer token. Send it as "Authorization: Bearer <token>" until it expires or the user signs out.
+// @Description Users with MFA, or whose role requires it, get mfa_required and an mfa_token for /auth/mfa/verify instead of a token.
+// @Description With session=cookie the token is set as an HttpOnly cookie instead, and unsafe requests must send the returned csrf_token in the X-CSRF-Token header.
+// @Description Repeated failures are answered increasingly slowly and then lock the account, or the client address, out for a while with 429.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body LoginRequest true "Credentials"
+// @Param session query string false "cookie for a browser session"
+// @Success 200 {object} service.LoginResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/login [post]
+func (ah *AuthHandler) Login(rw http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.Password == "" {
+		logrus.Warn("Invalid login request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid login request", "The request body must be JSON with an email and a password")
+		return
+	}
+
+	result, err := ah.Auth.Login(req.Email, req.Password, clientInfo(r))
+	if writeRateLimited(rw, err) {
+		return
+	}
+	if errors.Is(err, service.ErrInvalidCredentials) {
+		logrus.Warnf("Failed sign-in for %s from %s", req.Email, helpers.ClientIP(r))
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Invalid email or password", "Check your credentials and try again")
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to sign in: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to sign in", err.Error())
+		return
+	}
+	writeLoginResult(rw, r, ah.Cookies, result)
+}
+
+// VerifyMFA godoc
+// @Summary Complete sign-in with an MFA code
+// @Description Exchange the mfa_token from /auth/login and a code from the authenticator app, or a recovery code, for a bearer token.
+// @Description If login asked for enrollment, the code must come from the authenticator set up with /auth/mfa/enroll; the response then includes the recovery codes, which are not shown again.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body VerifyMFARequest true "MFA token and code"
+// @Param session query string false "cookie for a browser session"
+// @Success 200 {object} service.LoginResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa/verify [post]
+func (ah *AuthHandler) VerifyMFA(rw http.ResponseWriter, r *http.Request) {
+	var req VerifyMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		logrus.Warn("Invalid MFA verification request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid MFA request", "The request body must be JSON with an mfa_token and a code")
+		return
+	}
+
+	result, err := ah.Auth.VerifyMFA(req.MFAToken, req.Code, clientInfo(r))
+	if writeRateLimited(rw, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, service.ErrInvalidMFAChallenge):
+		logrus.Warnf("Rejected invalid or expired MFA token from %s", helpers.ClientIP(r))
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Invalid or expired MFA token", "Sign in again")
+		return
+	case errors.Is(err, service.ErrMFANotEnabled):
+		logrus.Warn("Rejected MFA verification before enrollment was started")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "No authenticator to verify", "Set up an authenticator with /auth/mfa/enroll first")
+		return
+	case errors.Is(err, service.ErrInvalidMFACode):
+		logrus.Warnf("Rejected MFA code from %s", helpers.ClientIP(r))
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Invalid authentication code", "Enter the current code from your authenticator app or an unused recovery code")
+		return
+	case err != nil:
+		logrus.Errorf("Failed to verify MFA code: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to sign in", err.Error())
+		return
+	}
+	writeLoginResult(rw, r, ah.Cookies, result)
+}
+
+// Logout godoc
+// @Summary Sign out
+// @Description Revoke the bearer token the request was sent with, in the Authorization header or the session cookie.
+// @Tags auth
+// @Produce  json
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/logout [post]
+func (ah *AuthHandler) Logout(rw http.ResponseWriter, r *http.Request) {
+	if err := ah.Auth.Logout(auth.PrincipalFrom(r.Context())); err != nil {
+		logrus.Errorf("Failed to sign out: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to sign out", err.Error())
+		return
+	}
+	if _, err := r.Cookie(auth.SessionCookie); err == nil {
+		ah.Cookies.Clear(rw)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(map[string]string{
+		"message": "Signed out successfully",
+	})
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset email
+// @Description Email a single-use password reset link if the address belongs to a user.
+// @Description The response is the same whether or not an email was sent, so it cannot be used to find registered addresses.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body ForgotPasswordRequest true "Email address"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Router /auth/password/forgot [post]
+func (ah *AuthHandler) ForgotPassword(rw http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		logrus.Warn("Invalid forgot password request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid password reset request", "The request body must be JSON with an email")
+		return
+	}
+
+	err := ah.Auth.ForgotPassword(req.Email, helpers.ClientIP(r))
+	if writeRateLimited(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to start password reset: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to send password reset email", "Try again later")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(rw).Encode(map[string]string{
+		"message": "If the address belongs to an account, a password reset email is on its way",
+	})
+}
+
+// ResetPassword godoc
+// @Summary Reset a password
+// @Description Set a new password with the token from a password reset email. The token works once, and every existing sign-in of the user is revoked, along with the OAuth tokens issued for them and the API keys of the service principals they created.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/password/reset [post]
+func (ah *AuthHandler) ResetPassword(rw http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		logrus.Warn("Invalid password reset request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid password reset request", "The request body must be JSON with a token and a password")
+		return
+	}
+
+	err := ah.Auth.ResetPassword(req.Token, req.Password, helpers.ClientIP(r))
+	if writeRateLimited(rw, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, auth.ErrWeakPassword):
+		logrus.Warn("Rejected weak password in password reset")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid password", err.Error())
+		return
+	case errors.Is(err, service.ErrInvalidResetToken):
+		logrus.Warn("Rejected invalid or expired password reset token")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid or expired token", "Request a new password reset email and try again")
+		return
+	case err != nil:
+		logrus.Errorf("Failed to reset password: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to reset password", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(map[string]string{
+		"message": "Password reset successfully; sign in with the new password",
+	})
+}
+
+// UnlockUser godoc
+// @Summary Unlock a user's sign-in
+// @Description Lift the lockout that failed sign-ins put on a user's account. Admins only.
+// @Tags auth
+// @Produce  json
+// @Param id path int true "User ID"
+// @Success 200 {object} UnlockResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/unlock [post]
+func (ah *AuthHandler) UnlockUser(rw http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromURL(r)
+	if err != nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user ID", "The provided ID must be a positive number")
+		return
+	}
+
+	unlocked, err := ah.Auth.UnlockAccount(auth.PrincipalFrom(r.Context()).UserID, userID)
+	if writeUnlockError(rw, err) {
+		return
+	}
+	writeUnlockResponse(rw, unlocked)
+}
+
+// UnlockIP godoc
+// @Summary Unlock sign-ins from an address
+// @Description Lift the lockout that failed sign-ins put on a client address. Admins only.
+// @Tags auth
+// @Accept  json
+// @Produce  json
+// @Param request body UnlockIPRequest true "Client address"
+// @Success 200 {object} UnlockResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/unlock-ip [post]
+func (ah *AuthHandler) UnlockIP(rw http.ResponseWriter, r *http.Request) {
+	var req UnlockIPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || net.ParseIP(req.IP) == nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid unlock request", "The request body must be JSON with an IP address")
+		return
+	}
+
+	unlocked, err := ah.Auth.UnlockIP(auth.PrincipalFrom(r.Context()).UserID, req.IP)
+	if writeUnlockError(rw, err) {
+		return
+	}
+	writeUnlockResponse(rw, unlocked)
+}
+
+// writeUnlockError answers the errors of the unlock endpoints and reports whether there was one
+func writeUnlockError(rw http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, service.ErrUnlockDenied):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Access denied", "Only admins can unlock sign-ins")
+	case errors.Is(err, repository.ErrUserNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "User not found", "No user exists with this ID")
+	default:
+		logrus.Errorf("Failed to unlock sign-in: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to unlock sign-in", err.Error())
+	}
+	return true
+}
+
+func writeUnlockResponse(rw http.ResponseWriter, unlocked bool) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(UnlockResponse{Unlocked: unlocked})
+}
+
+// clientInfo describes the client that sent r, for the session it signs in to
+func clientInfo(r *http.Request) service.ClientInfo {
+	return service.ClientInfo{UserAgent: r.UserAgent(), IP: helpers.ClientIP(r)}
+}
+
+// writeLoginResult sends the result of a sign-in. With the session=cookie query parameter, a
+// session token goes into an HttpOnly cookie instead of the body, which gets the CSRF token.
+func writeLoginResult(rw http.ResponseWriter, r *http.Request, cookies auth.SessionCookies, result *service.LoginResult) {
+	if result.Token != "" && r.URL.Query().Get("session") == "cookie" {
+		cookies.Set(rw, result.Token, result.ExpiresAt)
+		result.CSRFToken = auth.CSRFToken(result.Token)
+		result.Token = ""
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		logrus.Errorf("Failed to encode login response: %v", err)
+	}
+}
+
+// writeRateLimited answers 429 with a Retry-After header if err is a rate limit, and reports whether it did
+func writeRateLimited(rw http.ResponseWriter, err error) bool {
+	var limited *service.RateLimitError
+	if !errors.As(err, &limited) {
+		return false
+	}
+	seconds := int(math.Ceil(limited.RetryAfter.Seconds()))
+	rw.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	helpers.WriteErrorResponse(rw, http.StatusTooManyRequests, "Too many requests", limited.Error())
+	return true
+}
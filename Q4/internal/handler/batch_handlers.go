@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type BatchHandler struct {
+	Service service.BatchServiceInterface
+}
+
+func NewBatchHandler(service service.BatchServiceInterface) *BatchHandler {
+	return &BatchHandler{
+		Service: service,
+	}
+}
+
+// BatchUsers godoc
+// @Summary Run a batch of user operations
+// @Description Execute an ordered list of create, update and delete operations in one transaction.
+// @Description In "atomic" mode (the default) any failure rolls back the whole batch; in "best_effort" mode only the failed operations are undone.
+// @Description Only signed-in admins and API keys may run batches, and operations that change a role fail unless the caller is a signed-in admin.
+// @Description Creates may carry a password, which is stored hashed; updates that carry one fail, since passwords are changed through a password reset.
+// @Description With an Idempotency-Key header, retries of the batch get the stored response, marked with Idempotent-Replayed: true, instead of running it again. The key of a batch still running gets 409, and the key of a different request 422.
+// @Tags users
+// @Accept  json
+// @Produce  json
+// @Param Idempotency-Key header string false "Unique key of the batch, up to 255 characters"
+// @Param batch body service.BatchRequest true "Operations to execute"
+// @Success 200 {object} service.BatchResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} service.BatchResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users:batch [post]
+func (bh *BatchHandler) BatchUsers(rw http.ResponseWriter, r *http.Request) {
+	var req service.BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logrus.Warn("Invalid batch request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid batch request", "The request body must be valid JSON")
+		return
+	}
+
+	resp, err := bh.Service.Execute(auth.PrincipalFrom(r.Context()), req)
+	if err != nil {
+		if writeUserAccessError(rw, err) {
+			logrus.Warnf("Rejected batch: %v", err)
+			return
+		}
+		if errors.Is(err, service.ErrInvalidBatch) {
+			logrus.Warnf("Rejected batch: %v", err)
+			helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid batch request", err.Error())
+			return
+		}
+		logrus.Errorf("Failed to execute batch: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to execute batch", err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if !resp.Committed {
+		status = http.StatusUnprocessableEntity
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		logrus.Errorf("Failed to encode batch response: %v", err)
+		return
+	}
+	logrus.Infof("Batch of %d operations finished in %s mode (committed: %t)", len(resp.Results), resp.Mode, resp.Committed)
+}
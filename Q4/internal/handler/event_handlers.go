@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"Q4/internal/helpers"
+	"Q4/internal/metrics"
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultEventHeartbeat    = 15 * time.Second
+	DefaultEventWriteTimeout = 10 * time.Second
+)
+
+type UserEventHandler struct {
+	Events *service.UserEvents
+	// Buffer is how many events a stream may fall behind before it is disconnected
+	Buffer int
+	// Heartbeat is how often idle streams get a comment, so that proxies do not close them
+	Heartbeat time.Duration
+	// WriteTimeout disconnects clients that stop reading, even while there are no events to queue up
+	WriteTimeout time.Duration
+}
+
+func NewUserEventHandler(events *service.UserEvents) *UserEventHandler {
+	return &UserEventHandler{
+		Events:       events,
+		Buffer:       service.DefaultEventBuffer,
+		Heartbeat:    DefaultEventHeartbeat,
+		WriteTimeout: DefaultEventWriteTimeout,
+	}
+}
+
+// userEventFilter selects the events a stream sends; empty fields match every event
+type userEventFilter struct {
+	userIDs []int
+	types   []string
+}
+
+func (f userEventFilter) matches(event model.UserEvent) bool {
+	return (len(f.userIDs) == 0 || slices.Contains(f.userIDs, event.User.ID)) &&
+		(len(f.types) == 0 || slices.Contains(f.types, event.Type))
+}
+
+// StreamUserEvents godoc
+// @Summary Stream user changes
+// @Description Stream users as they are created, updated and deleted, as Server-Sent Events named after the change, with the event ID as their id and the model.UserEvent as JSON data.
+// @Description Clients that reconnect with Last-Event-ID, or last_event_id, first get the events they missed. If those are no longer kept, a "reset" event says so and the stream continues with new changes.
+// @Description Idle streams get a heartbeat comment regularly. Clients that fall too far behind are disconnected and may resume.
+// @Tags users
+// @Produce  text/event-stream
+// @Param user_id query string false "Comma separated IDs of the users to send events of"
+// @Param type query string false "Comma separated types of the events to send (created, updated, deleted)"
+// @Param Last-Event-ID header string false "ID of the last event the client received"
+// @Param last_event_id query string false "Last-Event-ID for clients that cannot send headers"
+// @Success 200 {object} model.UserEvent
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/events [get]
+func (eh *UserEventHandler) StreamUserEvents(rw http.ResponseWriter, r *http.Request) {
+	filter, err := parseUserEventFilter(r)
+	if err != nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid event filter", err.Error())
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid Last-Event-ID", "The ID must be one the stream sent")
+			return
+		}
+	}
+
+	var sub *service.UserSubscription
+	complete := true
+	if lastEventID == "" {
+		sub = eh.Events.Subscribe(eh.Buffer)
+	} else {
+		sub, complete = eh.Events.Resume(lastID, eh.Buffer)
+	}
+	defer sub.Close()
+
+	stream := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	if err := stream.Flush(); err != nil {
+		logrus.Errorf("Failed to start user event stream: %v", err)
+		return
+	}
+	if !complete {
+		logrus.Infof("User event stream could not resume after event %d", lastID)
+		if !eh.write(stream, rw, "event: reset\ndata: {}\n\n") {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(eh.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-eh.Events.Done():
+			// The server is shutting down; clients reconnect elsewhere and resume from the last event
+			return
+		case <-heartbeat.C:
+			if !eh.write(stream, rw, ": heartbeat\n\n") {
+				return
+			}
+		case event, ok := <-sub.Events():
+			if !ok {
+				metrics.Counter("user_event_streams_dropped_total").Add(1)
+				logrus.Warnf("Disconnected user event stream of %s: %v", helpers.ClientIP(r), sub.Err())
+				return
+			}
+			if !filter.matches(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logrus.Errorf("Failed to encode user event %d: %v", event.ID, err)
+				return
+			}
+			if !eh.write(stream, rw, fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)) {
+				return
+			}
+		}
+	}
+}
+
+// write sends frame and reports whether the client is still there
+func (eh *UserEventHandler) write(stream *http.ResponseController, rw http.ResponseWriter, frame string) bool {
+	if err := stream.SetWriteDeadline(time.Now().Add(eh.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return false
+	}
+	if _, err := rw.Write([]byte(frame)); err != nil {
+		logrus.Infof("User event stream ended: %v", err)
+		return false
+	}
+	return stream.Flush() == nil
+}
+
+func parseUserEventFilter(r *http.Request) (userEventFilter, error) {
+	var filter userEventFilter
+	query := r.URL.Query()
+	for _, value := range query["user_id"] {
+		for _, part := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || id <= 0 {
+				return filter, fmt.Errorf("invalid user_id %q", part)
+			}
+			filter.userIDs = append(filter.userIDs, id)
+		}
+	}
+	for _, value := range query["type"] {
+		for _, part := range strings.Split(value, ",") {
+			eventType := strings.TrimSpace(part)
+			switch eventType {
+			case model.UserCreated, model.UserUpdated, model.UserDeleted:
+				filter.types = append(filter.types, eventType)
+			default:
+				return filter, fmt.Errorf("type must be %s, %s or %s, not %q", model.UserCreated, model.UserUpdated, model.UserDeleted, eventType)
+			}
+		}
+	}
+	return filter, nil
+}
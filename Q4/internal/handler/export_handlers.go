@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"Q4/internal/exporter"
+	"Q4/internal/helpers"
+	"Q4/internal/model"
+	"compress/gzip"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExportUsers godoc
+// @Summary Export users
+// @Description Stream users as CSV, NDJSON or XLSX, selected by the format parameter or the Accept header
+// @Tags users
+// @Produce  text/csv
+// @Produce  application/x-ndjson
+// @Produce  application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param format query string false "Output format (csv, ndjson or xlsx)"
+// @Param columns query string false "Comma separated columns to include (id, name, email)"
+// @Param name query string false "Only users whose name contains this value"
+// @Param email query string false "Only users whose email contains this value"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 406 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users:export [get]
+func (uh *UserHandler) ExportUsers(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format, err := exporter.Negotiate(query.Get("format"), r.Header.Get("Accept"))
+	if err != nil {
+		logrus.Warnf("Rejected export: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusNotAcceptable, "Unsupported export format", "Use csv, ndjson or xlsx")
+		return
+	}
+
+	columns, err := exporter.ParseColumns(query.Get("columns"))
+	if err != nil {
+		logrus.Warnf("Rejected export: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid columns", err.Error())
+		return
+	}
+
+	filter := parseUserFilter(r)
+	it, err := uh.Service.IterateUsers(filter)
+	if err != nil {
+		logrus.Errorf("Failed to query users for export: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to export users", err.Error())
+		return
+	}
+	defer it.Close()
+
+	rw.Header().Set("Content-Type", format.ContentType())
+	rw.Header().Set("Content-Disposition", `attachment; filename="users-`+time.Now().UTC().Format("20060102-150405")+"."+string(format)+`"`)
+	rw.Header().Add("Vary", "Accept, Accept-Encoding")
+
+	var out io.Writer = rw
+	// XLSX is already a zip archive, compressing it again only costs CPU
+	if format != exporter.FormatXLSX && acceptsGzip(r) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(rw)
+		defer func() {
+			if err := gz.Close(); err != nil {
+				logrus.Warnf("Failed to finish gzip stream: %v", err)
+			}
+		}()
+		out = gz
+	}
+
+	encoder, err := exporter.NewEncoder(format, out, columns)
+	if err != nil {
+		logrus.Errorf("Failed to start %s export: %v", format, err)
+		return
+	}
+
+	// Headers are already on the wire once rows are written, so failures can only be logged
+	count := 0
+	for it.Next() {
+		if err := encoder.Encode(it.User()); err != nil {
+			logrus.Errorf("Export aborted after %d users: %v", count, err)
+			return
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		logrus.Errorf("Export aborted after %d users: %v", count, err)
+		return
+	}
+	if err := encoder.Close(); err != nil {
+		logrus.Errorf("Failed to finish %s export: %v", format, err)
+		return
+	}
+	logrus.Infof("Exported %d users as %s", count, format)
+}
+
+func parseUserFilter(r *http.Request) model.UserFilter {
+	query := r.URL.Query()
+	return model.UserFilter{
+		Name:  strings.TrimSpace(query.Get("name")),
+		Email: strings.TrimSpace(query.Get("email")),
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/gql"
+	"Q4/internal/helpers"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+type GraphQLHandler struct {
+	Schema *gql.Schema
+}
+
+func NewGraphQLHandler(schema *gql.Schema) *GraphQLHandler {
+	return &GraphQLHandler{
+		Schema: schema,
+	}
+}
+
+// Query runs a GraphQL request sent as a JSON body with query, operationName and variables.
+// Like most GraphQL servers it answers 200 whenever it could read the request, with any errors in
+// the response; only bodies that are not a request get 400.
+func (gh *GraphQLHandler) Query(rw http.ResponseWriter, r *http.Request) {
+	var req gql.Request
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		if bodyTooLarge(err) {
+			helpers.WriteErrorResponse(rw, http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+			return
+		}
+		logrus.Warnf("Invalid GraphQL request: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid GraphQL request", "The request body must be JSON with a query")
+		return
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF || req.Query == "" {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid GraphQL request", "The request body must be JSON with a query")
+		return
+	}
+
+	response := gh.Schema.Exec(r.Context(), req)
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		logrus.Errorf("Failed to encode GraphQL response: %v", err)
+	}
+}
+
+// GraphiQL serves a GraphiQL page that sends its queries to the URL it was loaded from. Its
+// scripts come from unpkg.com; GraphiQLContentSecurityPolicy allows them.
+func (gh *GraphQLHandler) GraphiQL(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := io.WriteString(rw, graphiQLPage); err != nil {
+		logrus.Errorf("Failed to write GraphiQL page: %v", err)
+	}
+}
+
+// graphiQLScript starts GraphiQL. Browsers send the session cookie along, so the script copies the
+// session's CSRF token into the header that must accompany it.
+const graphiQLScript = `
+const csrf = document.cookie.split('; ').find((c) => c.startsWith('` + auth.CSRFCookie + `='));
+const headers = csrf ? { '` + auth.CSRFHeader + `': decodeURIComponent(csrf.split('=')[1]) } : {};
+const fetcher = GraphiQL.createFetcher({ url: window.location.pathname, headers });
+ReactDOM.createRoot(document.getElementById('graphiql')).render(React.createElement(GraphiQL, { fetcher }));
+`
+
+const graphiQLPage = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>GraphiQL</title>
+<link rel="stylesheet" href="https://unpkg.com/graphiql@3.7.1/graphiql.min.css" crossorigin>
+</head>
+<body style="margin: 0">
+<div id="graphiql" style="height: 100vh">Loading…</div>
+<script src="https://unpkg.com/react@18.3.1/umd/react.production.min.js" crossorigin></script>
+<script src="https://unpkg.com/react-dom@18.3.1/umd/react-dom.production.min.js" crossorigin></script>
+<script src="https://unpkg.com/graphiql@3.7.1/graphiql.min.js" crossorigin></script>
+<script>` + graphiQLScript + `</script>
+</body>
+</html>
+`
+
+// GraphiQLContentSecurityPolicy lets the GraphiQL page load its scripts and styles from unpkg.com,
+// run its own inline script, known by its hash, and send queries to this server only
+var GraphiQLContentSecurityPolicy = "default-src 'none'; script-src https://unpkg.com 'sha256-" + scriptHash(graphiQLScript) + "'; " +
+	"style-src https://unpkg.com 'unsafe-inline'; font-src https://unpkg.com data:; img-src 'self' data:; connect-src 'self'; " +
+	"frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+func scriptHash(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
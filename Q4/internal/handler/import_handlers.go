@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/importer"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+type ImportHandler struct {
+	Service service.ImportServiceInterface
+}
+
+func NewImportHandler(service service.ImportServiceInterface) *ImportHandler {
+	return &ImportHandler{
+		Service: service,
+	}
+}
+
+// ImportUsers godoc
+// @Summary Import users
+// @Description Bulk create or update users by email from a CSV or NDJSON stream. Only signed-in admins and API keys may import.
+// @Tags users
+// @Accept  text/csv
+// @Accept  application/x-ndjson
+// @Produce  json
+// @Param format query string false "Input format (csv or ndjson); defaults to the Content-Type"
+// @Param mapping query string false "Column mapping, e.g. name:Full Name,email:Mail"
+// @Param dry_run query bool false "Validate and report without writing"
+// @Param async query bool false "Run the import as a background job"
+// @Param batch_size query int false "Rows per transaction"
+// @Success 200 {object} service.ImportReport
+// @Success 202 {object} service.ImportJob
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users:import [post]
+func (ih *ImportHandler) ImportUsers(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format, err := importer.ParseFormat(query.Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		logrus.Warnf("Rejected import: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Unsupported import format", "Use text/csv or application/x-ndjson, or set the format parameter")
+		return
+	}
+
+	mapping, err := importer.ParseColumnMapping(query.Get("mapping"))
+	if err != nil {
+		logrus.Warnf("Rejected import: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid column mapping", err.Error())
+		return
+	}
+
+	opts := service.ImportOptions{
+		Format:  format,
+		Mapping: mapping,
+		DryRun:  query.Get("dry_run") == "true",
+	}
+	if batchSize := query.Get("batch_size"); batchSize != "" {
+		opts.BatchSize, err = strconv.Atoi(batchSize)
+		if err != nil || opts.BatchSize <= 0 {
+			helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid batch size", "batch_size must be a positive integer")
+			return
+		}
+	}
+
+	if query.Get("async") == "true" {
+		job, err := ih.Service.StartImportJob(auth.PrincipalFrom(r.Context()), r.Body, opts)
+		if writeUserAccessError(rw, err) {
+			logrus.Warnf("Rejected import: %v", err)
+			return
+		}
+		if bodyTooLarge(err) {
+			logrus.Warnf("Rejected import: %v", err)
+			helpers.WriteErrorResponse(rw, http.StatusRequestEntityTooLarge, "Import too large", err.Error())
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Failed to start import job: %v", err)
+			helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to start import", err.Error())
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Location", "/api/v1/users:import/"+job.ID)
+		rw.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(rw).Encode(job); err != nil {
+			logrus.Errorf("Failed to encode import job: %v", err)
+			return
+		}
+		logrus.Infof("Import job %s started", job.ID)
+		return
+	}
+
+	report, err := ih.Service.Import(auth.PrincipalFrom(r.Context()), r.Body, opts)
+	if writeUserAccessError(rw, err) {
+		logrus.Warnf("Rejected import: %v", err)
+		return
+	}
+	if bodyTooLarge(err) {
+		logrus.Warnf("Rejected import: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusRequestEntityTooLarge, "Import too large", err.Error())
+		return
+	}
+	if err != nil {
+		if errors.Is(err, importer.ErrMissingColumn) || errors.Is(err, importer.ErrUnsupportedFormat) {
+			logrus.Warnf("Rejected import: %v", err)
+			helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid import data", err.Error())
+			return
+		}
+		logrus.Errorf("Failed to import users: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to import users", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(report); err != nil {
+		logrus.Errorf("Failed to encode import report: %v", err)
+		return
+	}
+	logrus.Infof("Import finished: %d created, %d updated, %d invalid, %d failed (dry run: %t)",
+		report.Created, report.Updated, report.Invalid, report.Failed, report.DryRun)
+}
+
+// GetImportJob godoc
+// @Summary Get import job progress
+// @Description Get the status, progress and, once finished, the report of an asynchronous import
+// @Tags users
+// @Produce  json
+// @Param jobId path string true "Import job ID"
+// @Success 200 {object} service.ImportJob
+// @Failure 404 {object} ErrorResponse
+// @Router /users:import/{jobId} [get]
+func (ih *ImportHandler) GetImportJob(rw http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["jobId"]
+
+	job, err := ih.Service.GetImportJob(jobID)
+	if err != nil {
+		logrus.Warnf("Import job %s not found", jobID)
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "Import job not found", "No import job exists with the specified ID")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(job); err != nil {
+		logrus.Errorf("Failed to encode import job %s: %v", jobID, err)
+	}
+}
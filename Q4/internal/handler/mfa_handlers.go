@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type MFAHandler struct {
+	MFA service.MFAServiceInterface
+}
+
+func NewMFAHandler(mfa service.MFAServiceInterface) *MFAHandler {
+	return &MFAHandler{
+		MFA: mfa,
+	}
+}
+
+type BeginMFAEnrollmentRequest struct {
+	// MFAToken from /auth/login authorizes enrollment for users who cannot sign in without MFA
+	MFAToken string `json:"mfa_token,omitempty"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// GetMFAStatus godoc
+// @Summary Get the MFA status of the signed-in user
+// @Tags mfa
+// @Produce  json
+// @Success 200 {object} service.MFAStatus
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa [get]
+func (mh *MFAHandler) GetMFAStatus(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	status, err := mh.MFA.Status(principal.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to get MFA status of user %d: %v", principal.UserID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to get MFA status", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(status)
+}
+
+// BeginMFAEnrollment godoc
+// @Summary Set up an authenticator app
+// @Description Generate a TOTP secret and return it as text, as an otpauth:// URI and as a QR code PNG. MFA is not on until the enrollment is confirmed.
+// @Description Send a bearer token, or the mfa_token from /auth/login when the user's role requires MFA and they have none yet.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Param request body BeginMFAEnrollmentRequest false "MFA token, when not signed in"
+// @Success 200 {object} service.MFASetup
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa/enroll [post]
+func (mh *MFAHandler) BeginMFAEnrollment(rw http.ResponseWriter, r *http.Request) {
+	var userID int
+	if principal := auth.PrincipalFrom(r.Context()); principal != nil {
+		userID = principal.UserID
+	} else {
+		var req BeginMFAEnrollmentRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		id, err := mh.MFA.EnrollmentChallengeUser(req.MFAToken)
+		if err != nil {
+			logrus.Warn("Rejected MFA enrollment without a session or a valid MFA token")
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="q4"`)
+			helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Authentication required", "Sign in, or send the mfa_token from /auth/login")
+			return
+		}
+		userID = id
+	}
+
+	setup, err := mh.MFA.BeginEnrollment(userID)
+	if errors.Is(err, service.ErrMFAAlreadyEnabled) {
+		logrus.Warnf("Rejected MFA enrollment of user %d: already enabled", userID)
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "MFA already enabled", "Disable MFA before setting up another authenticator")
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to start MFA enrollment of user %d: %v", userID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to start MFA enrollment", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(setup)
+}
+
+// ConfirmMFAEnrollment godoc
+// @Summary Turn on MFA
+// @Description Confirm the authenticator from /auth/mfa/enroll with a code it shows. The response holds recovery codes, which are not shown again.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Param request body MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa/enroll/confirm [post]
+func (mh *MFAHandler) ConfirmMFAEnrollment(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	code, ok := decodeMFACode(rw, r)
+	if !ok {
+		return
+	}
+
+	codes, err := mh.MFA.ConfirmEnrollment(principal.UserID, code)
+	if writeMFAError(rw, err, principal.UserID) {
+		return
+	}
+	writeRecoveryCodes(rw, "MFA enabled; store these recovery codes somewhere safe", codes)
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary Replace the MFA recovery codes
+// @Description Invalidate the remaining recovery codes and return new ones. Requires a current code.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Param request body MFACodeRequest true "Code from the authenticator app or a recovery code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa/recovery-codes [post]
+func (mh *MFAHandler) RegenerateRecoveryCodes(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	code, ok := decodeMFACode(rw, r)
+	if !ok {
+		return
+	}
+
+	codes, err := mh.MFA.RegenerateRecoveryCodes(principal.UserID, code)
+	if writeMFAError(rw, err, principal.UserID) {
+		return
+	}
+	writeRecoveryCodes(rw, "Recovery codes replaced; the old ones no longer work", codes)
+}
+
+// DisableMFA godoc
+// @Summary Turn off MFA
+// @Description Remove the authenticator and recovery codes. Requires a current code, and is refused for roles that must use MFA.
+// @Tags mfa
+// @Accept  json
+// @Produce  json
+// @Param request body MFACodeRequest true "Code from the authenticator app or a recovery code"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/mfa/disable [post]
+func (mh *MFAHandler) DisableMFA(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	code, ok := decodeMFACode(rw, r)
+	if !ok {
+		return
+	}
+
+	if writeMFAError(rw, mh.MFA.Disable(principal.UserID, code), principal.UserID) {
+		return
+	}
+	respondWithSuccess(rw, "MFA disabled")
+}
+
+func decodeMFACode(rw http.ResponseWriter, r *http.Request) (string, bool) {
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		logrus.Warn("Invalid MFA code request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid MFA request", "The request body must be JSON with a code")
+		return "", false
+	}
+	return req.Code, true
+}
+
+// writeMFAError answers for a failed MFA operation and reports whether there was an error
+func writeMFAError(rw http.ResponseWriter, err error, userID int) bool {
+	if err == nil {
+		return false
+	}
+	if writeRateLimited(rw, err) {
+		return true
+	}
+	switch {
+	case errors.Is(err, service.ErrInvalidMFACode):
+		logrus.Warnf("Rejected MFA code of user %d", userID)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid authentication code", "Enter the current code from your authenticator app")
+	case errors.Is(err, service.ErrMFANotEnabled):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "MFA not set up", "Set up an authenticator with /auth/mfa/enroll first")
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "MFA already enabled", "The authenticator is already confirmed")
+	case errors.Is(err, service.ErrMFARequiredByPolicy):
+		logrus.Warnf("Refused to disable MFA of user %d: required for their role", userID)
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "MFA is required for your role", err.Error())
+	case errors.Is(err, repository.ErrUserNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "User not found", "The signed-in user no longer exists")
+	default:
+		logrus.Errorf("MFA operation for user %d failed: %v", userID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "MFA operation failed", err.Error())
+	}
+	return true
+}
+
+func writeRecoveryCodes(rw http.ResponseWriter, message string, codes []string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(RecoveryCodesResponse{Message: message, RecoveryCodes: codes}); err != nil {
+		logrus.Errorf("Failed to encode recovery codes response: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/oidc"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type OIDCHandler struct {
+	OIDC service.OIDCServiceInterface
+}
+
+func NewOIDCHandler(oidcService service.OIDCServiceInterface) *OIDCHandler {
+	return &OIDCHandler{
+		OIDC: oidcService,
+	}
+}
+
+type RotateSigningKeyResponse struct {
+	// KeyID is the "kid" of the key that signs from now on
+	KeyID string `json:"kid"`
+}
+
+// RegisterOAuthClient godoc
+// @Summary Register an OAuth client
+// @Description Register an app that signs users in with OpenID Connect. Only admins may register clients. The client secret is returned once; public clients ("token_endpoint_auth_method": "none") get none and must use PKCE.
+// @Tags oauth
+// @Accept  json
+// @Produce  json
+// @Param client body service.ClientRegistration true "Client metadata"
+// @Success 201 {object} service.RegisteredClient
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /oauth/clients [post]
+func (oh *OIDCHandler) RegisterOAuthClient(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	var registration service.ClientRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		logrus.Warn("Invalid OAuth client registration provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid client registration", "The request body must be JSON client metadata")
+		return
+	}
+
+	client, err := oh.OIDC.RegisterClient(principal.UserID, registration)
+	if writeOIDCAdminError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to register OAuth client: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to register client", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(rw).Encode(client); err != nil {
+		logrus.Errorf("Failed to encode client response: %v", err)
+	}
+}
+
+// ListOAuthClients godoc
+// @Summary List the OAuth clients
+// @Tags oauth
+// @Produce  json
+// @Success 200 {array} model.OAuthClient
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /oauth/clients [get]
+func (oh *OIDCHandler) ListOAuthClients(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	clients, err := oh.OIDC.ListClients(principal.UserID)
+	if writeOIDCAdminError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to list OAuth clients: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to list clients", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(clients)
+}
+
+// DeleteOAuthClient godoc
+// @Summary Delete an OAuth client
+// @Description Delete the client and revoke every token issued to it
+// @Tags oauth
+// @Produce  json
+// @Param id path string true "Client ID"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /oauth/clients/{id} [delete]
+func (oh *OIDCHandler) DeleteOAuthClient(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	id := mux.Vars(r)["id"]
+
+	err := oh.OIDC.DeleteClient(principal.UserID, id)
+	if writeOIDCAdminError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to delete OAuth client %s: %v", id, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to delete client", err.Error())
+		return
+	}
+	respondWithSuccess(rw, "Client deleted")
+}
+
+// RotateSigningKey godoc
+// @Summary Rotate the ID token signing key
+// @Description Replace the signing key at once, for example after it leaked. Keys also rotate on their own; replaced keys stay in the JWKS until the tokens they signed have expired.
+// @Tags oauth
+// @Produce  json
+// @Success 200 {object} RotateSigningKeyResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /oauth/keys/rotate [post]
+func (oh *OIDCHandler) RotateSigningKey(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	kid, err := oh.OIDC.RotateSigningKey(principal.UserID)
+	if writeOIDCAdminError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to rotate the signing key: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to rotate the signing key", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(RotateSigningKeyResponse{KeyID: kid})
+}
+
+// Authorize godoc
+// @Summary Authorize an OAuth client for the signed-in user
+// @Description The sign-in page at the authorization endpoint calls this with the parameters it was opened with. Send the browser to redirect_to, which carries either the code or an error for the client.
+// @Tags oauth
+// @Accept  json
+// @Produce  json
+// @Param request body service.AuthorizationRequest true "Authorization request parameters"
+// @Success 200 {object} service.AuthorizationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /oauth/authorize [post]
+func (oh *OIDCHandler) Authorize(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	var request service.AuthorizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logrus.Warn("Invalid authorization request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid authorization request", "The request body must be JSON with the authorization parameters")
+		return
+	}
+
+	response, err := oh.OIDC.Authorize(principal.UserID, request)
+	var oauthErr *oidc.Error
+	if errors.As(err, &oauthErr) {
+		logrus.Warnf("Rejected authorization request of client %q: %v", request.ClientID, err)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid authorization request", oauthErr.Description)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to authorize OAuth client %q: %v", request.ClientID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to authorize client", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(response)
+}
+
+// writeOIDCAdminError writes the response for the errors the client management endpoints share
+// and reports whether it did
+func writeOIDCAdminError(rw http.ResponseWriter, err error) bool {
+	var oauthErr *oidc.Error
+	switch {
+	case errors.Is(err, service.ErrAdminRequired):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Admin role required", err.Error())
+	case errors.Is(err, repository.ErrClientNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "Client not found", "No OAuth client with this ID exists")
+	case errors.As(err, &oauthErr):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid client metadata", oauthErr.Description)
+	default:
+		return false
+	}
+	return true
+}
+
+// The protocol endpoints below are served outside /api/v1 at the paths the discovery document
+// lists. They speak OAuth rather than this API: form-encoded requests and RFC 6749 error bodies.
+
+// Discovery serves the provider metadata at /.well-known/openid-configuration
+func (oh *OIDCHandler) Discovery(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	writeOAuthJSON(rw, http.StatusOK, oh.OIDC.Discovery())
+}
+
+// JWKS serves the public keys ID tokens are signed with at /oauth/jwks
+func (oh *OIDCHandler) JWKS(rw http.ResponseWriter, r *http.Request) {
+	keys, err := oh.OIDC.JWKS()
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	// Relying parties refetch the set when they meet an unknown key ID, so a short cache is enough
+	rw.Header().Set("Cache-Control", "public, max-age=600")
+	writeOAuthJSON(rw, http.StatusOK, keys)
+}
+
+// Token serves the token endpoint at /oauth/token for the authorization_code and
+// client_credentials grants
+func (oh *OIDCHandler) Token(rw http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, err := clientCredentials(r)
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	response, err := oh.OIDC.Token(service.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		Scope:        r.PostForm.Get("scope"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	})
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	writeOAuthJSON(rw, http.StatusOK, response)
+}
+
+// Introspect serves token introspection (RFC 7662) at /oauth/introspect
+func (oh *OIDCHandler) Introspect(rw http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, err := clientCredentials(r)
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	introspection, err := oh.OIDC.Introspect(clientID, clientSecret, r.PostForm.Get("token"))
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeOAuthJSON(rw, http.StatusOK, introspection)
+}
+
+// Revoke serves token revocation (RFC 7009) at /oauth/revoke
+func (oh *OIDCHandler) Revoke(rw http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, err := clientCredentials(r)
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(rw, oidc.Errorf(oidc.ErrInvalidRequest, "token is required"))
+		return
+	}
+	if err := oh.OIDC.Revoke(clientID, clientSecret, token); err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// UserInfo serves the claims of the user an access token was issued for at /oauth/userinfo
+func (oh *OIDCHandler) UserInfo(rw http.ResponseWriter, r *http.Request) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="q4"`)
+		writeOAuthJSON(rw, http.StatusUnauthorized, oidc.Errorf(oidc.ErrInvalidRequest, "send the access token as \"Authorization: Bearer <token>\""))
+		return
+	}
+
+	claims, err := oh.OIDC.UserInfo(token)
+	var oauthErr *oidc.Error
+	if errors.As(err, &oauthErr) {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="q4", error=%q, error_description=%q`, oauthErr.Code, oauthErr.Description))
+		writeOAuthJSON(rw, http.StatusUnauthorized, oauthErr)
+		return
+	}
+	if err != nil {
+		writeOAuthError(rw, err)
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeOAuthJSON(rw, http.StatusOK, claims)
+}
+
+// clientCredentials returns the client ID and secret from HTTP Basic authentication or, for
+// client_secret_post and public clients, from the form. It parses the form.
+func clientCredentials(r *http.Request) (string, string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", "", oidc.Errorf(oidc.ErrInvalidRequest, "the body must be application/x-www-form-urlencoded")
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), nil
+	}
+	if r.PostForm.Get("client_secret") != "" {
+		return "", "", oidc.Errorf(oidc.ErrInvalidRequest, "use one client authentication method")
+	}
+	// RFC 6749 section 2.3.1 form-encodes both before they are put in the header
+	id, idErr := url.QueryUnescape(id)
+	secret, secretErr := url.QueryUnescape(secret)
+	if idErr != nil || secretErr != nil {
+		return "", "", oidc.Errorf(oidc.ErrInvalidClient, "malformed client credentials")
+	}
+	return id, secret, nil
+}
+
+// writeOAuthError writes err as an RFC 6749 error response; errors that are not OAuth errors
+// become server_error
+func writeOAuthError(rw http.ResponseWriter, err error) {
+	var oauthErr *oidc.Error
+	if !errors.As(err, &oauthErr) {
+		logrus.Errorf("OAuth request failed: %v", err)
+		writeOAuthJSON(rw, http.StatusInternalServerError, &oidc.Error{Code: "server_error"})
+		return
+	}
+	status := http.StatusBadRequest
+	if errors.Is(oauthErr, oidc.ErrInvalidClient) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="q4"`)
+		status = http.StatusUnauthorized
+	}
+	writeOAuthJSON(rw, status, oauthErr)
+}
+
+func writeOAuthJSON(rw http.ResponseWriter, status int, body any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		logrus.Errorf("Failed to encode OAuth response: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"Q4/internal/helpers"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type SearchResponse struct {
+	Query  string `json:"query"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	repository.SearchResult
+}
+
+// SearchUsers godoc
+// @Summary Search users
+// @Description Full-text search over user names and emails with prefix matching, ranking and highlighted matches.
+// @Description When nothing matches, results come from typo-tolerant trigram similarity and "fuzzy" is true.
+// @Tags users
+// @Produce  json
+// @Param q query string true "Search text"
+// @Param limit query int false "Maximum number of results (default 20, max 100)"
+// @Param offset query int false "Number of results to skip"
+// @Success 200 {object} SearchResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 501 {object} ErrorResponse
+// @Router /users/search [get]
+func (uh *UserHandler) SearchUsers(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	text := strings.TrimSpace(query.Get("q"))
+	if text == "" {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Search text is missing", "Provide the text to search for in the 'q' parameter")
+		return
+	}
+
+	limit, err := optionalInt(query.Get("limit"))
+	if err != nil || limit < 0 {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid limit", "limit must be a positive integer")
+		return
+	}
+	offset, err := optionalInt(query.Get("offset"))
+	if err != nil || offset < 0 {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid offset", "offset must be zero or a positive integer")
+		return
+	}
+
+	result, err := uh.Service.Search(text, limit, offset)
+	if errors.Is(err, repository.ErrSearchUnsupported) {
+		logrus.Warnf("Search requested but not supported: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusNotImplemented, "Search is not available", err.Error())
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to search users for %q: %v", text, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to search users", err.Error())
+		return
+	}
+
+	if limit == 0 {
+		limit = service.DefaultSearchLimit
+	}
+	limit = min(limit, service.MaxSearchLimit)
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(SearchResponse{Query: text, Limit: limit, Offset: offset, SearchResult: *result}); err != nil {
+		logrus.Errorf("Failed to encode search results: %v", err)
+		return
+	}
+	logrus.Infof("Search for %q returned %d of %d users (fuzzy: %t)", text, len(result.Hits), result.Total, result.Fuzzy)
+}
+
+func optionalInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type SessionHandler struct {
+	Sessions service.SessionServiceInterface
+}
+
+func NewSessionHandler(sessions service.SessionServiceInterface) *SessionHandler {
+	return &SessionHandler{
+		Sessions: sessions,
+	}
+}
+
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// ListUserSessions godoc
+// @Summary List the sessions of a user
+// @Description Return the active sign-ins of a user with the device, IP address and last-seen time of each, most recently seen first.
+// @Description Users can list their own sessions; admins can list anyone's.
+// @Tags sessions
+// @Produce  json
+// @Param id path int true "User ID"
+// @Success 200 {array} service.UserSession
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/sessions [get]
+func (sh *SessionHandler) ListUserSessions(rw http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromURL(r)
+	if err != nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user ID", "The provided ID must be a positive number")
+		return
+	}
+
+	sessions, err := sh.Sessions.ListSessions(auth.PrincipalFrom(r.Context()), userID)
+	if writeSessionError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to list sessions of user %d: %v", userID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to list sessions", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(sessions)
+}
+
+// RevokeUserSession godoc
+// @Summary Revoke a session
+// @Description Sign a user out of one session. The session's token stops working immediately.
+// @Tags sessions
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param sessionId path string true "Session ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/sessions/{sessionId} [delete]
+func (sh *SessionHandler) RevokeUserSession(rw http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromURL(r)
+	if err != nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user ID", "The provided ID must be a positive number")
+		return
+	}
+	sessionID := mux.Vars(r)["sessionId"]
+
+	err = sh.Sessions.RevokeSession(auth.PrincipalFrom(r.Context()), userID, sessionID)
+	if errors.Is(err, repository.ErrSessionNotFound) {
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "Session not found", "The user has no active session with this ID")
+		return
+	}
+	if writeSessionError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to revoke session %s of user %d: %v", sessionID, userID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to revoke session", err.Error())
+		return
+	}
+	respondWithSuccess(rw, "Session revoked")
+}
+
+// RevokeUserSessions godoc
+// @Summary Revoke all sessions of a user
+// @Description Sign a user out everywhere. With keep_current=true, users signing themselves out of their other devices stay signed in on this one.
+// @Tags sessions
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param keep_current query bool false "Keep the session of this request"
+// @Success 200 {object} RevokeSessionsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/sessions [delete]
+func (sh *SessionHandler) RevokeUserSessions(rw http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromURL(r)
+	if err != nil {
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user ID", "The provided ID must be a positive number")
+		return
+	}
+	keepCurrent := r.URL.Query().Get("keep_current") == "true"
+
+	revoked, err := sh.Sessions.RevokeSessions(auth.PrincipalFrom(r.Context()), userID, keepCurrent)
+	if writeSessionError(rw, err) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to revoke sessions of user %d: %v", userID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to revoke sessions", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(RevokeSessionsResponse{Revoked: revoked})
+}
+
+// writeSessionError answers the errors every session endpoint shares and reports whether it did
+func writeSessionError(rw http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, service.ErrSessionAccessDenied):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Access denied", "Only admins can manage the sessions of other users")
+		return true
+	case errors.Is(err, repository.ErrUserNotFound):
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "User not found", "No user exists with this ID")
+		return true
+	}
+	return false
+}
@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"Q4/internal/auth"
 	"Q4/internal/helpers"
 	"Q4/internal/model"
+	"Q4/internal/repository"
 	"Q4/internal/service"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -29,15 +32,23 @@ type ErrorResponse struct {
 
 // GetAllUsers godoc
 // @Summary Get all users
-// @Description Get a list of all users
+// @Description Get a list of all users, optionally filtered by name or email
 // @Tags users
 // @Accept  json
 // @Produce  json
+// @Param name query string false "Only users whose name contains this value"
+// @Param email query string false "Only users whose email contains this value"
 // @Success 200 {array} model.User
 // @Failure 500 {object} ErrorResponse
 // @Router /users [get]
 func (uh *UserHandler) GetAllUsers(rw http.ResponseWriter, r *http.Request) {
-	users, err := uh.Service.GetAllUsers()
+	var users []model.User
+	var err error
+	if filter := parseUserFilter(r); filter.IsZero() {
+		users, err = uh.Service.GetAllUsers()
+	} else {
+		users, err = uh.Service.ListUsers(filter)
+	}
 	if err != nil {
 		logrus.Errorf("Failed to retrieve users: %v", err)
 		http.Error(rw, "Failed to retrieve users", http.StatusInternalServerError)
@@ -100,25 +111,54 @@ func (uh *UserHandler) GetUserByID(rw http.ResponseWriter, r *http.Request) {
 
 // CreateUser godoc
 // @Summary Create a new user
-// @Description Create a new user with the provided data
+// @Description Create a new user with the provided data. An optional password (8 to 72 bytes) lets the user sign in at /auth/login.
+// @Description Only signed-in admins may give the user a role other than "user".
+// @Description Bodies with unknown fields or anything after the user are rejected.
+// @Description With an Idempotency-Key header, retries get the stored response, marked with Idempotent-Replayed: true, instead of creating the user again. The key of a request still in progress gets 409, and the key of a different request 422.
 // @Tags users
 // @Accept  json
 // @Produce  json
+// @Param Idempotency-Key header string false "Unique key of the request, up to 255 characters"
 // @Param user body model.User true "User data"
 // @Success 201 {object} map[string]string
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /users [post]
 func (uh *UserHandler) CreateUser(rw http.ResponseWriter, r *http.Request) {
-	var user model.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	user, err := decodeUserFromBody(r.Body)
 	if err != nil {
-		logrus.Warn("Invalid user data provided")
-		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user data", "The request body must be valid JSON")
+		logrus.Warnf("Invalid user data provided: %v", err)
+		writeUserBodyError(rw, err)
 		return
 	}
 
-	err = uh.Service.CreateUser(&user)
+	err = uh.Service.CreateUser(auth.PrincipalFrom(r.Context()), &user)
+	if errors.Is(err, service.ErrInvalidRole) {
+		logrus.Warnf("Rejected user with unknown role %q", user.Role)
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid role", err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrRoleDenied) {
+		logrus.Warnf("Rejected user with role %q from a caller who is not an admin", user.Role)
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Role not allowed", err.Error())
+		return
+	}
+	if errors.Is(err, auth.ErrWeakPassword) {
+		logrus.Warn("Rejected user with a weak password")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid password", err.Error())
+		return
+	}
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		logrus.Warnf("Rejected user with duplicate email %s", user.Email)
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "Email already in use", "Another user already has this email address")
+		return
+	}
 	if err != nil {
 		logrus.Errorf("Failed to create user: %v", err)
 		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to create user", err.Error())
@@ -139,7 +179,8 @@ func (uh *UserHandler) CreateUser(rw http.ResponseWriter, r *http.Request) {
 
 // UpdateUser godoc
 // @Summary Update a user
-// @Description Update an existing user with the provided data
+// @Description Update an existing user with the provided data. Users may update themselves and admins anyone; only signed-in admins may change the role.
+// @Description Users who change their own email must send their current password as current_password. Only signed-in admins may change the email of an admin.
 // @Tags users
 // @Accept  json
 // @Produce  json
@@ -147,7 +188,12 @@ func (uh *UserHandler) CreateUser(rw http.ResponseWriter, r *http.Request) {
 // @Param user body model.User true "User data"
 // @Success 200 {object} map[string]string
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /users/{id} [put]
 func (uh *UserHandler) UpdateUser(rw http.ResponseWriter, r *http.Request) {
@@ -160,7 +206,7 @@ func (uh *UserHandler) UpdateUser(rw http.ResponseWriter, r *http.Request) {
 
 	user, err := decodeUserFromBody(r.Body)
 	if err != nil {
-		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user data", err.Error())
+		writeUserBodyError(rw, err)
 		logrus.Warn(err.Error())
 		return
 	}
@@ -173,7 +219,26 @@ func (uh *UserHandler) UpdateUser(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := uh.Service.UpdateUser(&user); err != nil {
+	if err := uh.Service.UpdateUser(auth.PrincipalFrom(r.Context()), &user); err != nil {
+		if writeUserAccessError(rw, err) {
+			logrus.Warnf("Rejected update of user %d: %v", user.ID, err)
+			return
+		}
+		if errors.Is(err, service.ErrInvalidRole) {
+			logrus.Warnf("Rejected update of user %d with unknown role %q", user.ID, user.Role)
+			helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid role", err.Error())
+			return
+		}
+		if errors.Is(err, service.ErrRoleDenied) {
+			logrus.Warnf("Rejected role change of user %d by a caller who is not an admin", user.ID)
+			helpers.WriteErrorResponse(rw, http.StatusForbidden, "Role not allowed", err.Error())
+			return
+		}
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			logrus.Warnf("Rejected update of user %d with duplicate email %s", user.ID, user.Email)
+			helpers.WriteErrorResponse(rw, http.StatusConflict, "Email already in use", "Another user already has this email address")
+			return
+		}
 		logrus.Errorf("Failed to update user with ID %d: %v", user.ID, err)
 		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to update user", err.Error())
 		return
@@ -185,13 +250,15 @@ func (uh *UserHandler) UpdateUser(rw http.ResponseWriter, r *http.Request) {
 
 // DeleteUser godoc
 // @Summary Delete a user
-// @Description Delete a user by their ID
+// @Description Delete a user by their ID. Users may delete themselves and admins anyone.
 // @Tags users
 // @Accept  json
 // @Produce  json
 // @Param id path int true "User ID"
 // @Success 200 {object} map[string]string
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /users/{id} [delete]
@@ -224,7 +291,11 @@ func (uh *UserHandler) DeleteUser(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = uh.Service.DeleteUser(id)
+	err = uh.Service.DeleteUser(auth.PrincipalFrom(r.Context()), id)
+	if writeUserAccessError(rw, err) {
+		logrus.Warnf("Rejected deletion of user %d: %v", id, err)
+		return
+	}
 	if err != nil {
 		logrus.Errorf("Failed to delete user with ID %d: %v", id, err)
 		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to delete user", err.Error())
@@ -267,12 +338,57 @@ func decodeUserFromBody(body io.ReadCloser) (model.User, error) {
 		}
 	}(body)
 	var user model.User
-	if err := json.NewDecoder(body).Decode(&user); err != nil {
-		return user, fmt.Errorf("the request body must be valid JSON")
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&user); err != nil {
+		if bodyTooLarge(err) {
+			return user, err
+		}
+		return user, fmt.Errorf("the request body must be a single valid JSON user: %w", err)
+	}
+	// A second value, or anything else after the user, is as suspect as an unknown field
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		if bodyTooLarge(err) {
+			return user, err
+		}
+		return user, fmt.Errorf("the request body must be a single valid JSON user: unexpected data after the user")
 	}
 	return user, nil
 }
 
+// writeUserBodyError answers a request whose user could not be decoded
+func writeUserBodyError(rw http.ResponseWriter, err error) {
+	if bodyTooLarge(err) {
+		helpers.WriteErrorResponse(rw, http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+		return
+	}
+	helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid user data", err.Error())
+}
+
+// writeUserAccessError answers a request that the service refused for its caller and reports
+// whether err was such a refusal
+func writeUserAccessError(rw http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="q4"`)
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Authentication required", "Sign in to change users")
+	case errors.Is(err, service.ErrUserAccessDenied), errors.Is(err, service.ErrAdminEmailDenied):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Access denied", err.Error())
+	case errors.Is(err, service.ErrPasswordConfirmation):
+		helpers.WriteErrorResponse(rw, http.StatusForbidden, "Current password required",
+			"Send your current password as current_password to change your email")
+	default:
+		return false
+	}
+	return true
+}
+
+// bodyTooLarge reports whether err comes from a body cut off by the request size limit
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
 func respondWithSuccess(rw http.ResponseWriter, message string) {
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"Q4/internal/webauthn"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type WebAuthnHandler struct {
+	WebAuthn service.WebAuthnServiceInterface
+	// Cookies sets the attributes of browser session cookies
+	Cookies auth.SessionCookies
+}
+
+func NewWebAuthnHandler(webAuthn service.WebAuthnServiceInterface) *WebAuthnHandler {
+	return &WebAuthnHandler{
+		WebAuthn: webAuthn,
+		Cookies:  auth.SessionCookies{Secure: true},
+	}
+}
+
+type FinishWebAuthnRegistrationRequest struct {
+	// Name tells the user's passkeys apart, such as "Work laptop"
+	Name string `json:"name"`
+	// Credential is the result of navigator.credentials.create, serialized with toJSON()
+	Credential webauthn.RegistrationCredential `json:"credential"`
+}
+
+type BeginWebAuthnLoginRequest struct {
+	// Email limits the sign-in to the passkeys of one account; leave it out to let the browser offer any
+	Email string `json:"email,omitempty"`
+}
+
+// BeginWebAuthnRegistration godoc
+// @Summary Start adding a passkey
+// @Description Return options for navigator.credentials.create. Send the result to /auth/webauthn/register/finish within the timeout.
+// @Tags webauthn
+// @Produce  json
+// @Success 200 {object} webauthn.CredentialCreationOptions
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/register/begin [post]
+func (wh *WebAuthnHandler) BeginWebAuthnRegistration(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	options, err := wh.WebAuthn.BeginRegistration(principal.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to start passkey registration of user %d: %v", principal.UserID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to start passkey registration", err.Error())
+		return
+	}
+	writeWebAuthnOptions(rw, options)
+}
+
+// FinishWebAuthnRegistration godoc
+// @Summary Add a passkey
+// @Description Verify the credential created with the options from /auth/webauthn/register/begin and store it. Attestation formats "none" and "packed" are accepted; user verification is required.
+// @Tags webauthn
+// @Accept  json
+// @Produce  json
+// @Param request body FinishWebAuthnRegistrationRequest true "Name and new credential"
+// @Success 201 {object} model.WebAuthnCredential
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/register/finish [post]
+func (wh *WebAuthnHandler) FinishWebAuthnRegistration(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	var req FinishWebAuthnRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logrus.Warn("Invalid passkey registration request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid passkey registration", "The request body must be JSON with a credential")
+		return
+	}
+
+	credential, err := wh.WebAuthn.FinishRegistration(principal.UserID, req.Name, req.Credential)
+	switch {
+	case errors.Is(err, service.ErrInvalidWebAuthnChallenge):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid or expired challenge", "Start again with /auth/webauthn/register/begin")
+		return
+	case errors.Is(err, webauthn.ErrVerification):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Passkey verification failed", err.Error())
+		return
+	case errors.Is(err, repository.ErrDuplicateCredential):
+		logrus.Warnf("Rejected passkey of user %d: already registered", principal.UserID)
+		helpers.WriteErrorResponse(rw, http.StatusConflict, "Passkey already registered", "This authenticator is registered already")
+		return
+	case err != nil:
+		logrus.Errorf("Failed to register passkey of user %d: %v", principal.UserID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to register passkey", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(rw).Encode(credential); err != nil {
+		logrus.Errorf("Failed to encode passkey response: %v", err)
+	}
+}
+
+// BeginWebAuthnLogin godoc
+// @Summary Start signing in with a passkey
+// @Description Return options for navigator.credentials.get. Send the result to /auth/webauthn/login/finish within the timeout.
+// @Description With an email, the options list the passkeys of that account. Emails without passkeys, including unknown ones, get a placeholder that matches no authenticator, so the response does not reveal which emails are registered.
+// @Tags webauthn
+// @Accept  json
+// @Produce  json
+// @Param request body BeginWebAuthnLoginRequest false "Account to sign in to"
+// @Success 200 {object} webauthn.CredentialRequestOptions
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/login/begin [post]
+func (wh *WebAuthnHandler) BeginWebAuthnLogin(rw http.ResponseWriter, r *http.Request) {
+	var req BeginWebAuthnLoginRequest
+	// The body is optional: without an email the browser offers every passkey of the site
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	options, err := wh.WebAuthn.BeginLogin(req.Email)
+	if err != nil {
+		logrus.Errorf("Failed to start passkey sign-in: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to start passkey sign-in", err.Error())
+		return
+	}
+	writeWebAuthnOptions(rw, options)
+}
+
+// FinishWebAuthnLogin godoc
+// @Summary Sign in with a passkey
+// @Description Verify the assertion made with the options from /auth/webauthn/login/begin and return a bearer token. A passkey replaces both the password and the MFA code.
+// @Tags webauthn
+// @Accept  json
+// @Produce  json
+// @Param request body webauthn.AssertionCredential true "Result of navigator.credentials.get"
+// @Param session query string false "cookie for a browser session"
+// @Success 200 {object} service.LoginResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/login/finish [post]
+func (wh *WebAuthnHandler) FinishWebAuthnLogin(rw http.ResponseWriter, r *http.Request) {
+	var credential webauthn.AssertionCredential
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		logrus.Warn("Invalid passkey sign-in request provided")
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid passkey sign-in", "The request body must be the JSON of a credential")
+		return
+	}
+
+	result, err := wh.WebAuthn.FinishLogin(credential, clientInfo(r))
+	switch {
+	case errors.Is(err, service.ErrInvalidWebAuthnChallenge):
+		helpers.WriteErrorResponse(rw, http.StatusBadRequest, "Invalid or expired challenge", "Start again with /auth/webauthn/login/begin")
+		return
+	case errors.Is(err, service.ErrUnknownPasskey), errors.Is(err, webauthn.ErrVerification):
+		logrus.Warnf("Rejected passkey sign-in from %s: %v", helpers.ClientIP(r), err)
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Passkey sign-in failed", "The passkey is not registered or could not be verified")
+		return
+	case err != nil:
+		logrus.Errorf("Failed to sign in with passkey: %v", err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to sign in", err.Error())
+		return
+	}
+	writeLoginResult(rw, r, wh.Cookies, result)
+}
+
+// ListWebAuthnCredentials godoc
+// @Summary List the passkeys of the signed-in user
+// @Tags webauthn
+// @Produce  json
+// @Success 200 {array} model.WebAuthnCredential
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/credentials [get]
+func (wh *WebAuthnHandler) ListWebAuthnCredentials(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	credentials, err := wh.WebAuthn.ListCredentials(principal.UserID)
+	if err != nil {
+		logrus.Errorf("Failed to list passkeys of user %d: %v", principal.UserID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to list passkeys", err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(credentials)
+}
+
+// DeleteWebAuthnCredential godoc
+// @Summary Remove a passkey
+// @Tags webauthn
+// @Produce  json
+// @Param id path string true "Credential ID"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /auth/webauthn/credentials/{id} [delete]
+func (wh *WebAuthnHandler) DeleteWebAuthnCredential(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	id := mux.Vars(r)["id"]
+
+	err := wh.WebAuthn.DeleteCredential(principal.UserID, id)
+	if errors.Is(err, repository.ErrCredentialNotFound) {
+		helpers.WriteErrorResponse(rw, http.StatusNotFound, "Passkey not found", "No passkey with this ID is registered to you")
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to remove passkey %s of user %d: %v", id, principal.UserID, err)
+		helpers.WriteErrorResponse(rw, http.StatusInternalServerError, "Failed to remove passkey", err.Error())
+		return
+	}
+	respondWithSuccess(rw, "Passkey removed")
+}
+
+func writeWebAuthnOptions(rw http.ResponseWriter, options any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(options); err != nil {
+		logrus.Errorf("Failed to encode WebAuthn options: %v", err)
+	}
+}
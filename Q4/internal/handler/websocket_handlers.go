@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/cors"
+	"Q4/internal/helpers"
+	"Q4/internal/middleware"
+	"Q4/internal/ws"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+type WebSocketHandler struct {
+	Hub *ws.Hub
+	// CORS decides which other origins may connect, as it does for API requests. Browsers send
+	// the session cookie with any WebSocket connection, so pages on other origins may only connect
+	// with it if the policy allows credentials.
+	CORS *cors.Policy
+
+	upgrader websocket.Upgrader
+}
+
+func NewWebSocketHandler(hub *ws.Hub, policy *cors.Policy) *WebSocketHandler {
+	wh := &WebSocketHandler{
+		Hub:  hub,
+		CORS: policy,
+	}
+	wh.upgrader = websocket.Upgrader{
+		CheckOrigin: wh.checkOrigin,
+		Error: func(rw http.ResponseWriter, r *http.Request, status int, reason error) {
+			helpers.WriteErrorResponse(rw, status, "WebSocket upgrade failed", reason.Error())
+		},
+	}
+	return wh
+}
+
+// Subscribe upgrades the request of a signed-in user or service principal to a WebSocket that
+// pushes user changes for the topics the client subscribes to
+func (wh *WebSocketHandler) Subscribe(rw http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	if principal == nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="q4"`)
+		helpers.WriteErrorResponse(rw, http.StatusUnauthorized, "Authentication required",
+			"Sign in and send the token as \"Authorization: Bearer <token>\", or connect with the session cookie")
+		return
+	}
+
+	conn, err := wh.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		logrus.Warnf("Rejected WebSocket connection from %s: %v", helpers.ClientIP(r), err)
+		return
+	}
+	wh.Hub.Serve(conn, principal)
+}
+
+func (wh *WebSocketHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || middleware.SameOrigin(r, origin) {
+		return true
+	}
+	if wh.CORS == nil || !wh.CORS.AllowsOrigin(origin) {
+		return false
+	}
+	byCookie := r.Header.Get("Authorization") == "" && r.Header.Get(middleware.APIKeyHeader) == ""
+	return !byCookie || wh.CORS.AllowCredentials
+}
@@ -0,0 +1,128 @@
+package idempotency
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrInvalidKey is returned for keys that are empty, too long or not printable ASCII
+	ErrInvalidKey = errors.New("invalid idempotency key")
+	// ErrKeyReused is returned when a key is sent again with a different request
+	ErrKeyReused = errors.New("idempotency key already used for a different request")
+	// ErrKeyInUse is returned while another request with the same key is being handled
+	ErrKeyInUse = errors.New("a request with this idempotency key is in progress")
+)
+
+const (
+	DefaultTTL = 24 * time.Hour
+	// DefaultLockTimeout is how long a request holds its key before another one may take it over,
+	// should the first never finish
+	DefaultLockTimeout = time.Minute
+	MaxKeyLength       = 255
+	// claimAttempts bounds the retries of Begin when the holder releases the key in between
+	claimAttempts = 3
+)
+
+// Keys claims idempotency keys for requests and keeps their responses for TTL, so that a retried
+// request is answered with the response to the first one instead of being handled again
+type Keys struct {
+	Repo repository.IdempotencyKeyRepository
+	// TTL is how long responses are replayed
+	TTL         time.Duration
+	LockTimeout time.Duration
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+}
+
+func NewKeys(repo repository.IdempotencyKeyRepository) *Keys {
+	return &Keys{
+		Repo:        repo,
+		TTL:         DefaultTTL,
+		LockTimeout: DefaultLockTimeout,
+		Now:         time.Now,
+	}
+}
+
+// Fingerprint identifies a request by its method, URL and body
+func Fingerprint(method, uri string, body []byte) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", method, uri)
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Begin claims key for the caller scope and the request with fingerprint. If the key was used
+// before for the same request, it returns the stored record, whose Status is set, for its response
+// to be replayed. Otherwise it returns a claim with a zero Status, which the caller must pass to
+// Complete or Release once it has handled the request.
+func (k *Keys) Begin(scope, key, fingerprint string) (*model.IdempotencyKey, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("%w: use 1 to %d printable ASCII characters", ErrInvalidKey, MaxKeyLength)
+	}
+	for attempt := 0; ; attempt++ {
+		now := k.Now()
+		claim := &model.IdempotencyKey{
+			Scope:       scope,
+			Key:         key,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(k.LockTimeout),
+		}
+		err := k.Repo.CreateIdempotencyKey(claim)
+		if err == nil {
+			return claim, nil
+		}
+		if !errors.Is(err, repository.ErrDuplicateIdempotencyKey) {
+			return nil, err
+		}
+
+		stored, err := k.Repo.GetIdempotencyKey(scope, key)
+		if errors.Is(err, repository.ErrIdempotencyKeyNotFound) && attempt < claimAttempts {
+			// Released or expired since the insert failed; claim it again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stored.Fingerprint != fingerprint {
+			return nil, ErrKeyReused
+		}
+		if stored.Status == 0 {
+			return nil, ErrKeyInUse
+		}
+		return stored, nil
+	}
+}
+
+// Complete stores the response to the request of claim for TTL
+func (k *Keys) Complete(claim *model.IdempotencyKey, status int, header map[string]string, body []byte) error {
+	completed := *claim
+	completed.Status = status
+	completed.Header = header
+	completed.Body = body
+	completed.ExpiresAt = claim.CreatedAt.Add(k.TTL)
+	return k.Repo.CompleteIdempotencyKey(&completed)
+}
+
+// Release gives up the claim without storing a response, so that the request may be retried
+func (k *Keys) Release(claim *model.IdempotencyKey) error {
+	return k.Repo.ReleaseIdempotencyKey(claim)
+}
+
+func validKey(key string) bool {
+	if key == "" || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fields lists the user fields that can be populated by an import
+var Fields = []string{"name", "email"}
+
+// ColumnMapping maps a user field to the source column (CSV header or NDJSON key) it is read from
+type ColumnMapping map[string]string
+
+// DefaultMapping reads every field from a column with the same name
+func DefaultMapping() ColumnMapping {
+	mapping := make(ColumnMapping, len(Fields))
+	for _, field := range Fields {
+		mapping[field] = field
+	}
+	return mapping
+}
+
+// ParseColumnMapping parses a mapping of the form "name:Full Name,email:E-mail".
+// Fields that are not mentioned keep their default column.
+func ParseColumnMapping(s string) (ColumnMapping, error) {
+	mapping := DefaultMapping()
+	if strings.TrimSpace(s) == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		field, column, ok := strings.Cut(pair, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		column = strings.TrimSpace(column)
+		if !ok || field == "" || column == "" {
+			return nil, fmt.Errorf("invalid mapping entry %q, expected field:column", pair)
+		}
+		if _, known := mapping[field]; !known {
+			return nil, fmt.Errorf("unknown field %q in mapping", field)
+		}
+		mapping[field] = column
+	}
+
+	return mapping, nil
+}
@@ -0,0 +1,194 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Format identifies the encoding of an import stream
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported import format")
+	ErrMissingColumn     = errors.New("missing column")
+)
+
+// maxLineSize bounds a single NDJSON line so a malformed stream cannot exhaust memory
+const maxLineSize = 1 << 20
+
+// Record is a single row of an import stream with its values keyed by user field
+type Record struct {
+	Row    int
+	Fields map[string]string
+	Err    error
+}
+
+// RecordReader reads records one at a time and returns io.EOF once the stream is exhausted.
+// Errors that only affect a single row are reported through Record.Err.
+type RecordReader interface {
+	Next() (Record, error)
+}
+
+// ParseFormat resolves a format from an explicit name or, if empty, from a Content-Type header
+func ParseFormat(name, contentType string) (Format, error) {
+	if name != "" {
+		switch Format(strings.ToLower(name)) {
+		case FormatCSV:
+			return FormatCSV, nil
+		case FormatNDJSON, "jsonl":
+			return FormatNDJSON, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, contentType)
+	}
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return FormatCSV, nil
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, mediaType)
+}
+
+// NewReader returns a RecordReader for the given format
+func NewReader(format Format, r io.Reader, mapping ColumnMapping) (RecordReader, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVReader(r, mapping), nil
+	case FormatNDJSON:
+		return NewNDJSONReader(r, mapping), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	mapping ColumnMapping
+	columns map[string]int
+	row     int
+}
+
+// NewCSVReader reads CSV with a header row; columns are matched against the mapping case-insensitively
+func NewCSVReader(r io.Reader, mapping ColumnMapping) RecordReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+	return &csvReader{reader: reader, mapping: mapping}
+}
+
+func (cr *csvReader) readHeader() error {
+	header, err := cr.reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: the CSV stream has no header row", ErrMissingColumn)
+		}
+		return err
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		positions[column] = i
+	}
+
+	cr.columns = make(map[string]int, len(cr.mapping))
+	for field, column := range cr.mapping {
+		pos, ok := positions[strings.ToLower(column)]
+		if !ok {
+			return fmt.Errorf("%w: %q (for field %s)", ErrMissingColumn, column, field)
+		}
+		cr.columns[field] = pos
+	}
+	return nil
+}
+
+func (cr *csvReader) Next() (Record, error) {
+	if cr.columns == nil {
+		if err := cr.readHeader(); err != nil {
+			return Record{}, err
+		}
+	}
+
+	values, err := cr.reader.Read()
+	if errors.Is(err, io.EOF) {
+		return Record{}, io.EOF
+	}
+	cr.row++
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return Record{Row: cr.row, Err: parseErr}, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	fields := make(map[string]string, len(cr.columns))
+	for field, pos := range cr.columns {
+		if pos < len(values) {
+			fields[field] = values[pos]
+		}
+	}
+	return Record{Row: cr.row, Fields: fields}, nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	mapping ColumnMapping
+	row     int
+}
+
+// NewNDJSONReader reads one JSON object per line; blank lines are skipped
+func NewNDJSONReader(r io.Reader, mapping ColumnMapping) RecordReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return &ndjsonReader{scanner: scanner, mapping: mapping}
+}
+
+func (nr *ndjsonReader) Next() (Record, error) {
+	for nr.scanner.Scan() {
+		line := strings.TrimSpace(nr.scanner.Text())
+		if line == "" {
+			continue
+		}
+		nr.row++
+
+		var object map[string]any
+		if err := json.Unmarshal([]byte(line), &object); err != nil {
+			return Record{Row: nr.row, Err: fmt.Errorf("invalid JSON: %v", err)}, nil
+		}
+
+		fields := make(map[string]string, len(nr.mapping))
+		for field, key := range nr.mapping {
+			switch value := object[key].(type) {
+			case nil:
+			case string:
+				fields[field] = value
+			default:
+				fields[field] = fmt.Sprint(value)
+			}
+		}
+		return Record{Row: nr.row, Fields: fields}, nil
+	}
+
+	if err := nr.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var (
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templateFS, "templates/*.txt"))
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/*.html"))
+)
+
+// Render builds a message for to from the templates named name. name.txt must define a
+// "subject" template alongside the text body; name.html is the HTML body.
+func Render(name, to string, data any) (Message, error) {
+	msg := Message{To: to}
+
+	var buf bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&buf, name+".subject", data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := textTemplates.ExecuteTemplate(&buf, name+".txt", data); err != nil {
+		return msg, err
+	}
+	msg.Text = strings.TrimLeft(buf.String(), "\n")
+
+	buf.Reset()
+	if err := htmlTemplates.ExecuteTemplate(&buf, name+".html", data); err != nil {
+		return msg, err
+	}
+	msg.HTML = buf.String()
+	return msg, nil
+}
@@ -0,0 +1,26 @@
+// Package metrics publishes counters through expvar so they can be scraped from /debug/vars
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	mu       sync.Mutex
+	counters = make(map[string]*expvar.Int)
+)
+
+// Counter returns the counter registered under name, creating it on first use.
+// Unlike expvar.NewInt it can be called repeatedly with the same name.
+func Counter(name string) *expvar.Int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if counter, ok := counters[name]; ok {
+		return counter
+	}
+	counter := expvar.NewInt(name)
+	counters[name] = counter
+	return counter
+}
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/model"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIKeyHeader carries the API key of clients that do not send it in the Authorization header
+const APIKeyHeader = "X-API-Key"
+
+// Authenticator resolves bearer tokens to the principal they belong to. Tokens it rejects
+// produce an error wrapping auth.ErrUnauthenticated.
+type Authenticator interface {
+	Authenticate(token string) (*auth.Principal, error)
+}
+
+// CertificateAuthenticator is implemented by authenticators that also accept client certificates
+// verified during the TLS handshake
+type CertificateAuthenticator interface {
+	AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error)
+}
+
+// AuthMiddleware attaches the principal of the request's bearer token to its context. The token
+// comes from the Authorization header, from the X-API-Key header for API keys or, for browser
+// sessions, from the session cookie; unsafe requests authenticated by the cookie must also send
+// the session's CSRF token in a header.
+// Without a token, a client certificate verified over mutual TLS authenticates the request if the
+// authenticator is also a CertificateAuthenticator.
+// Requests without either continue anonymously; requests with a token or certificate that does not
+// authenticate are rejected, so that a client never silently loses its identity.
+func AuthMiddleware(authenticator Authenticator) func(http.Handler) http.Handler {
+	certificates, _ := authenticator.(CertificateAuthenticator)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(w, r)
+			if !ok {
+				return
+			}
+
+			var principal *auth.Principal
+			var err error
+			switch {
+			case token != "":
+				principal, err = authenticator.Authenticate(token)
+			case certificates != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+				principal, err = certificates.AuthenticateCertificate(r.TLS.VerifiedChains[0][0])
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				if errors.Is(err, auth.ErrUnauthenticated) && token == "" {
+					logrus.Warnf("Rejected client certificate %q for %s %s", r.TLS.VerifiedChains[0][0].Subject, r.Method, r.URL.Path)
+					writeUnauthorized(w, "The client certificate is not mapped to a service principal")
+					return
+				}
+				if errors.Is(err, auth.ErrUnauthenticated) {
+					logrus.Warnf("Rejected bearer token for %s %s", r.Method, r.URL.Path)
+					writeUnauthorized(w, "The token is invalid or has expired")
+					return
+				}
+				logrus.Errorf("Failed to authenticate request: %v", err)
+				helpers.WriteErrorResponse(w, http.StatusInternalServerError, "Failed to authenticate request", err.Error())
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// bearerToken returns the token of r, or "" for anonymous requests. It answers requests with a
+// malformed Authorization header or a missing CSRF token itself and reports false.
+func bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			writeUnauthorized(w, "The Authorization header must be \"Bearer <token>\"")
+			return "", false
+		}
+		return token, true
+	}
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key, true
+	}
+
+	cookie, err := r.Cookie(auth.SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		// Browsers attach cookies to requests other sites trigger, but those sites cannot read the CSRF token
+		if !auth.CheckCSRFToken(cookie.Value, r.Header.Get(auth.CSRFHeader)) {
+			logrus.Warnf("Rejected cookie-authenticated %s %s without a valid CSRF token", r.Method, r.URL.Path)
+			helpers.WriteErrorResponse(w, http.StatusForbidden, "CSRF token missing or invalid",
+				"Send the value of the "+auth.CSRFCookie+" cookie in the "+auth.CSRFHeader+" header")
+			return "", false
+		}
+	}
+	return cookie.Value, true
+}
+
+// RequireAuth rejects requests that AuthMiddleware left anonymous. The routes behind it act for the
+// signed-in user, so requests made with an API key are rejected as well.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.PrincipalFrom(r.Context())
+		if principal == nil {
+			writeUnauthorized(w, "Sign in and send the token as \"Authorization: Bearer <token>\"")
+			return
+		}
+		if principal.IsService() {
+			helpers.WriteErrorResponse(w, http.StatusForbidden, "User sign-in required", "API keys cannot be used for this endpoint")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope rejects requests made with an API key that was not granted scope. Anonymous
+// requests and signed-in users pass; whatever else the route requires is up to it.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if principal := auth.PrincipalFrom(r.Context()); principal != nil && !principal.HasScope(scope) {
+				logrus.Warnf("Rejected %s %s by service principal %s without scope %s", r.Method, r.URL.Path, principal.ServicePrincipalID, scope)
+				helpers.WriteErrorResponse(w, http.StatusForbidden, "Insufficient scope", "The API key needs the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserLookup finds the user a principal acts for
+type UserLookup interface {
+	GetUserByID(id int) (*model.User, error)
+}
+
+// RequireAdmin rejects requests that are not made by a signed-in admin or by an API key that was
+// granted scope. It belongs behind AuthMiddleware.
+func RequireAdmin(users UserLookup, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := auth.PrincipalFrom(r.Context())
+			if principal == nil {
+				writeUnauthorized(w, "Sign in as an admin or send an API key with the "+scope+" scope")
+				return
+			}
+			if principal.IsService() {
+				if !principal.HasScope(scope) {
+					logrus.Warnf("Rejected %s %s by service principal %s without scope %s", r.Method, r.URL.Path, principal.ServicePrincipalID, scope)
+					helpers.WriteErrorResponse(w, http.StatusForbidden, "Insufficient scope", "The API key needs the "+scope+" scope")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			user, err := users.GetUserByID(principal.UserID)
+			if err != nil {
+				logrus.Errorf("Failed to load user %d to check their role: %v", principal.UserID, err)
+				helpers.WriteErrorResponse(w, http.StatusInternalServerError, "Failed to authorize request", err.Error())
+				return
+			}
+			if user.Role != model.RoleAdmin {
+				logrus.Warnf("Rejected %s %s by user %d who is not an admin", r.Method, r.URL.Path, principal.UserID)
+				helpers.WriteErrorResponse(w, http.StatusForbidden, "Admin required", "Only admins may use this endpoint")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeUnauthorized(w http.ResponseWriter, details string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="q4"`)
+	helpers.WriteErrorResponse(w, http.StatusUnauthorized, "Authentication required", details)
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"Q4/internal/cors"
+	"Q4/internal/helpers"
+	"Q4/internal/metrics"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CORSRoute applies a policy to a path and everything below it. A nil Policy keeps the paths
+// same-origin only.
+type CORSRoute struct {
+	PathPrefix string
+	Policy     *cors.Policy
+}
+
+func (c CORSRoute) matches(path string) bool {
+	return underPath(path, c.PathPrefix)
+}
+
+// CORS answers preflight requests and adds the CORS headers to responses, following the first
+// route that covers the request path; list more specific routes first. It must wrap the router,
+// since mux answers OPTIONS requests for routes without that method itself.
+//
+// Requests from origins the policy does not allow are served without CORS headers, so that the
+// browser withholds the response from the script, and are logged. Their preflights get 403.
+func CORS(routes ...CORSRoute) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var policy *cors.Policy
+			for _, route := range routes {
+				if route.matches(r.URL.Path) {
+					policy = route.Policy
+					break
+				}
+			}
+			if policy == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+			} else {
+				// The response differs between origins, so shared caches must not mix them up
+				w.Header().Add("Vary", "Origin")
+			}
+			if origin == "" || SameOrigin(r, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !policy.AllowsOrigin(origin) {
+				rejectCORS(w, r, preflight, origin, "origin not allowed")
+				if !preflight {
+					next.ServeHTTP(w, r)
+				}
+				return
+			}
+			if preflight {
+				method := r.Header.Get("Access-Control-Request-Method")
+				if !policy.AllowsMethod(method) {
+					rejectCORS(w, r, preflight, origin, "method "+method+" not allowed")
+					return
+				}
+				if headers := r.Header.Get("Access-Control-Request-Headers"); !policy.AllowsHeaders(headers) {
+					rejectCORS(w, r, preflight, origin, "headers "+headers+" not allowed")
+					return
+				}
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", policy.AllowOriginHeader(origin))
+			if policy.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				if len(policy.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// SameOrigin reports whether origin is the API's own, which browsers also send with some
+// same-origin requests
+func SameOrigin(r *http.Request, origin string) bool {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return strings.EqualFold(origin, scheme+"://"+r.Host)
+}
+
+func rejectCORS(w http.ResponseWriter, r *http.Request, preflight bool, origin, reason string) {
+	metrics.Counter("cors_rejected_total").Add(1)
+	if preflight {
+		logrus.Warnf("Rejected CORS preflight from %s for %s %s: %s", origin, r.Header.Get("Access-Control-Request-Method"), r.URL.Path, reason)
+		helpers.WriteErrorResponse(w, http.StatusForbidden, "Cross-origin request not allowed", reason)
+		return
+	}
+	logrus.Warnf("Served %s %s to %s without CORS headers: %s", r.Method, r.URL.Path, origin, reason)
+}
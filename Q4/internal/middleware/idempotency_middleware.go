@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/idempotency"
+	"Q4/internal/metrics"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks responses that were stored for an earlier request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// replayedHeaders are the response headers stored with an idempotent response. Others, such as
+// the rate limit headers, are set afresh on every request.
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// Idempotency lets clients retry requests safely by sending an Idempotency-Key header: each
+// caller's key is handled once, and retries of the same request get the stored response. The key
+// of a different request gets 422 and the key of a request still in progress 409. Requests
+// without the header are served as usual. It must run after AuthMiddleware, since keys are scoped
+// to the signed-in user or service principal, or else to the client address.
+//
+// Responses with 5xx or 429 are not stored, so that the request can be retried.
+func Idempotency(keys *idempotency.Keys) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					helpers.WriteErrorResponse(w, http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+					return
+				}
+				helpers.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			scope := idempotencyScope(r)
+			claim, err := keys.Begin(scope, key, idempotency.Fingerprint(r.Method, r.URL.RequestURI(), body))
+			switch {
+			case errors.Is(err, idempotency.ErrInvalidKey):
+				helpers.WriteErrorResponse(w, http.StatusBadRequest, "Invalid idempotency key", err.Error())
+				return
+			case errors.Is(err, idempotency.ErrKeyReused):
+				logrus.Warnf("Rejected %s %s by %s: idempotency key reused with a different request", r.Method, r.URL.Path, scope)
+				helpers.WriteErrorResponse(w, http.StatusUnprocessableEntity, "Idempotency key reused", "The key was used for a request with a different body; use a new key for a new request")
+				return
+			case errors.Is(err, idempotency.ErrKeyInUse):
+				w.Header().Set("Retry-After", "1")
+				helpers.WriteErrorResponse(w, http.StatusConflict, "Request in progress", "A request with this idempotency key is still being handled; retry later")
+				return
+			case err != nil:
+				logrus.Errorf("Failed to claim idempotency key for %s %s: %v", r.Method, r.URL.Path, err)
+				helpers.WriteErrorResponse(w, http.StatusInternalServerError, "Failed to check idempotency key", err.Error())
+				return
+			case claim.Status != 0:
+				metrics.Counter("idempotent_replays_total").Add(1)
+				logrus.Infof("Replayed the response to %s %s for %s", r.Method, r.URL.Path, scope)
+				for name, value := range claim.Header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(claim.Status)
+				_, _ = w.Write(claim.Body)
+				return
+			}
+
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status >= http.StatusInternalServerError || recorder.status == http.StatusTooManyRequests {
+				if err := keys.Release(claim); err != nil {
+					logrus.Errorf("Failed to release idempotency key of %s %s: %v", r.Method, r.URL.Path, err)
+				}
+				return
+			}
+			header := make(map[string]string)
+			for _, name := range replayedHeaders {
+				if value := w.Header().Get(name); value != "" {
+					header[name] = value
+				}
+			}
+			if err := keys.Complete(claim, recorder.status, header, recorder.body.Bytes()); err != nil {
+				logrus.Errorf("Failed to store the response to %s %s for idempotent retries: %v", r.Method, r.URL.Path, err)
+			}
+		})
+	}
+}
+
+// idempotencyScope keeps the keys of different callers apart
+func idempotencyScope(r *http.Request) string {
+	if principal := auth.PrincipalFrom(r.Context()); principal != nil {
+		if principal.IsService() {
+			return "service-principal:" + principal.ServicePrincipalID
+		}
+		return "user:" + strconv.Itoa(principal.UserID)
+	}
+	return KeyByIP(r)
+}
+
+// responseRecorder passes a response on and keeps a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status, rr.wroteHeader = status, true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(p)
+	return rr.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/helpers"
+	"Q4/internal/metrics"
+	"Q4/internal/ratelimit"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KeyFunc returns the client a request is counted against
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests per client address
+func KeyByIP(r *http.Request) string {
+	return "ip:" + helpers.ClientIP(r)
+}
+
+// KeyByAPIKey counts requests per API key, sent in the X-API-Key or the Authorization header, and
+// requests without one per client address. Keys are hashed so that they are never written to the
+// limiter's store. The keys are not checked, so a client can get a fresh bucket with every made-up
+// key; policies keyed by it must sit behind one keyed by KeyByIP.
+func KeyByAPIKey(r *http.Request) string {
+	key := r.Header.Get(APIKeyHeader)
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && auth.IsAPIKey(bearer) {
+		key = bearer
+	}
+	if key == "" {
+		return KeyByIP(r)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:16])
+}
+
+// KeyByUser counts requests per signed-in user or service principal, and anonymous requests per
+// client address. It must run after AuthMiddleware.
+func KeyByUser(r *http.Request) string {
+	if principal := auth.PrincipalFrom(r.Context()); principal != nil {
+		if principal.IsService() {
+			return "service-principal:" + principal.ServicePrincipalID
+		}
+		return "user:" + strconv.Itoa(principal.UserID)
+	}
+	return KeyByIP(r)
+}
+
+// RateLimitPolicy limits the requests of each client to the routes it is applied to
+type RateLimitPolicy struct {
+	// Name separates the counters of policies that share a store
+	Name    string
+	Limiter ratelimit.Limiter
+	Key     KeyFunc
+}
+
+// RateLimit rejects requests over the policy's limit with 429 and a Retry-After header, and tells
+// every client its quota in the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers. When several policies apply, the headers describe the one closest to
+// running out. Requests are let through if the store cannot be reached.
+func RateLimit(policy RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision, err := policy.Limiter.Take(policy.Name + ":" + policy.Key(r))
+			if err != nil {
+				logrus.Warnf("Rate limit %s failed, letting %s %s through: %v", policy.Name, r.Method, r.URL.Path, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			setRateLimitHeaders(w.Header(), decision)
+			if !decision.Allowed {
+				metrics.Counter("rate_limited_total").Add(1)
+				w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(decision.RetryAfter), 1)))
+				helpers.WriteErrorResponse(w, http.StatusTooManyRequests, "Too many requests",
+					fmt.Sprintf("The %s limit of %d requests per %s was exceeded", policy.Name, decision.Limit, decision.Window))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setRateLimitHeaders describes decision in the RateLimit headers unless an outer policy left
+// fewer requests
+func setRateLimitHeaders(header http.Header, decision ratelimit.Decision) {
+	if current, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err == nil && current < decision.Remaining {
+		return
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, ceilSeconds(decision.Window)))
+}
+
+// ceilSeconds rounds d up to whole seconds, the unit of the rate limit headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// ServicePrincipal is a caller that is not a person, such as a batch job. It signs in with API keys
+// and may only do what its scopes allow.
+type ServicePrincipal struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// CertificateSubject lets clients with a certificate of this subject, in RFC 2253 form, sign in
+	// as the principal when the server asks for client certificates
+	CertificateSubject string `json:"certificate_subject,omitempty"`
+	// CreatedBy is the admin who created the principal
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey is a credential of a service principal. Only its hash is stored; Prefix stays readable
+// to look the key up and to tell keys apart in listings.
+type APIKey struct {
+	ID                 string     `json:"id"`
+	ServicePrincipalID string     `json:"service_principal_id"`
+	Prefix             string     `json:"prefix"`
+	KeyHash            string     `json:"-"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ExpiresAt          time.Time  `json:"expires_at"`
+	LastUsedAt         *time.Time `json:"last_used_at,omitempty"`
+}
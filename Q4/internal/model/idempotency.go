@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// IdempotencyKey records a request sent with an Idempotency-Key header and, once it has been
+// handled, its response, so that retries get that response instead of repeating the request
+type IdempotencyKey struct {
+	// Scope is the caller the key belongs to, such as "user:5"; callers cannot see each other's keys
+	Scope string
+	Key   string
+	// Fingerprint is a hash of the method, path and body of the request
+	Fingerprint string
+	// Status is the status of the response, zero while the request is in progress
+	Status int
+	// Header holds the response headers that are replayed, such as Content-Type
+	Header map[string]string
+	Body   []byte
+	// CreatedAt identifies the request that holds the key
+	CreatedAt time.Time
+	// ExpiresAt comes soon after CreatedAt while the request is in progress, so that a request that
+	// never finishes does not hold the key for long, and the replay window after it once completed
+	ExpiresAt time.Time
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// MFAEnrollment is a user's TOTP authenticator. It only guards sign-ins once confirmed.
+type MFAEnrollment struct {
+	UserID int
+	Secret string
+	// ConfirmedAt is nil until the user enters a code from the new authenticator
+	ConfirmedAt *time.Time
+	// LastStep is the TOTP time step of the last accepted code, so that no code is accepted twice
+	LastStep  int64
+	CreatedAt time.Time
+}
+
+func (e MFAEnrollment) Confirmed() bool {
+	return e.ConfirmedAt != nil
+}
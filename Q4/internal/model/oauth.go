@@ -0,0 +1,58 @@
+package model
+
+import "time"
+
+// OAuthClient is an application that signs users in through the OpenID Connect provider
+type OAuthClient struct {
+	ID   string `json:"client_id"`
+	Name string `json:"name"`
+	// SecretHash is empty for public clients, which cannot keep a secret and must use PKCE
+	SecretHash string `json:"-"`
+	// TokenEndpointAuthMethod is "client_secret_basic", "client_secret_post" or "none" for public clients
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+	// RedirectURIs are the exact URIs authorization responses may be sent to
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	// Scopes are the scopes the client may request
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// OAuthAuthorizationCode is an outstanding, single-use authorization code. Only its hash is stored.
+type OAuthAuthorizationCode struct {
+	CodeHash    string
+	ClientID    string
+	UserID      int
+	RedirectURI string
+	// Scope is the space-delimited scope that was granted
+	Scope string
+	Nonce string
+	// CodeChallenge is the S256 PKCE challenge the token request has to answer
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// OAuthToken is an access token. Only its hash is stored, so that introspection and revocation
+// work without the token being readable from the database.
+type OAuthToken struct {
+	TokenHash string
+	ClientID  string
+	// UserID is 0 for client credentials tokens, which act for the client itself
+	UserID    int
+	Scope     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// OAuthSigningKey is an RSA key of the provider. The newest key signs ID tokens; older ones
+// stay published until the tokens they signed have expired.
+type OAuthSigningKey struct {
+	ID string
+	// PrivateKey is the key as PKCS #8 DER
+	PrivateKey []byte
+	CreatedAt  time.Time
+}
@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// Session is a signed-in client. Only a hash of its bearer token is stored.
+type Session struct {
+	ID        string `json:"id"`
+	UserID    int    `json:"user_id"`
+	TokenHash string `json:"-"`
+	// Device is a readable summary of UserAgent, such as "Firefox on Windows"
+	Device    string `json:"device"`
+	UserAgent string `json:"user_agent"`
+	// IP is the address the session was started from
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// PasswordResetToken is an emailed, single-use permission to set a new password
+type PasswordResetToken struct {
+	TokenHash string
+	UserID    int
+	ExpiresAt time.Time
+}
@@ -1,7 +1,36 @@
 package model
 
+// Roles a user can have. Users created without a role get RoleUser.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
 type User struct {
 	ID    int    `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+	// Role defaults to "user" on create and is left unchanged by updates that omit it
+	Role string `json:"role" enums:"user,admin"`
+	// EmailVerified is set once the user follows a verification link; it is ignored on create and update
+	EmailVerified bool `json:"email_verified"`
+	// Password is only read when creating a user; it is stored hashed and never returned
+	Password string `json:"password,omitempty"`
+	// CurrentPassword is only read when users change their own email, and never returned
+	CurrentPassword string `json:"current_password,omitempty"`
+}
+
+// UserFilter narrows a user listing; empty fields match every user
+type UserFilter struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+func (f UserFilter) IsZero() bool {
+	return f.Name == "" && f.Email == ""
 }
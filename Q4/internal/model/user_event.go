@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Kinds of user events
+const (
+	UserCreated = "created"
+	UserUpdated = "updated"
+	UserDeleted = "deleted"
+)
+
+// UserEvent announces a change to a user
+type UserEvent struct {
+	// ID increases with every event
+	ID   uint64 `json:"id"`
+	Type string `json:"type" enums:"created,updated,deleted"`
+	// User is the user after the change, or before it for deletions
+	User User      `json:"user"`
+	Time time.Time `json:"time"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// WebAuthnCredential is a passkey or security key registered to a user
+type WebAuthnCredential struct {
+	// ID is the credential ID chosen by the authenticator, in unpadded base64url
+	ID     string `json:"id"`
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+	// PublicKey is the COSE_Key the authenticator returned at registration
+	PublicKey []byte `json:"-"`
+	// SignCount is the last signature counter reported, used to detect cloned authenticators
+	SignCount uint32 `json:"-"`
+	// AAGUID identifies the authenticator model; it is all zeroes for authenticators that hide it
+	AAGUID            string     `json:"aaguid"`
+	AttestationFormat string     `json:"attestation_format"`
+	Transports        []string   `json:"transports,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthn ceremonies a challenge can be issued for
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+)
+
+// WebAuthnChallenge is the random value of a ceremony in progress. Each is accepted once.
+type WebAuthnChallenge struct {
+	// Challenge is the value in unpadded base64url
+	Challenge string
+	// UserID is the user the ceremony is for, or 0 for a sign-in where the user is only known
+	// once the authenticator answers with a discoverable credential
+	UserID    int
+	Purpose   string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,51 @@
+package oidc
+
+import (
+	"Q4/internal/model"
+	"slices"
+	"strconv"
+)
+
+// UserClaims are the claims about a user that the ID token and the userinfo endpoint release.
+// Which of them are set depends on the granted scopes.
+type UserClaims struct {
+	// Subject is the user ID in decimal. It never changes, unlike the email address, so relying
+	// parties should key accounts on it.
+	Subject string `json:"sub"`
+	// Name and Role are released with the profile scope. Role is not a standard claim; apps use
+	// it to map Q4 admins to their own admins.
+	Name string `json:"name,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Email and EmailVerified are released with the email scope
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// ClaimsForUser maps user to the claims scopes allow
+func ClaimsForUser(user *model.User, scopes []string) UserClaims {
+	claims := UserClaims{Subject: strconv.Itoa(user.ID)}
+	if slices.Contains(scopes, ScopeProfile) {
+		claims.Name = user.Name
+		claims.Role = user.Role
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+// IDTokenClaims is the payload of an ID token
+type IDTokenClaims struct {
+	Issuer string `json:"iss"`
+	// Audience is the client ID of the relying party the token was issued to
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	// Nonce echoes the nonce of the authorization request so that the client can detect replays
+	Nonce string `json:"nonce,omitempty"`
+	// AuthorizedParty is the client the token was issued to, as the spec asks for with a single audience
+	AuthorizedParty string `json:"azp,omitempty"`
+	UserClaims
+}
@@ -0,0 +1,187 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// AlgRS256 is the JWS algorithm of ID tokens, RSASSA-PKCS1-v1_5 with SHA-256. It is the one
+// algorithm every OpenID Connect relying party has to support.
+const AlgRS256 = "RS256"
+
+// SigningKeyBits is the modulus size of new signing keys
+const SigningKeyBits = 2048
+
+// ErrInvalidJWT is returned for tokens that are malformed, signed with an unknown key or tampered with
+var ErrInvalidJWT = errors.New("invalid jwt")
+
+// SigningKey is an RSA key that signs ID tokens
+type SigningKey struct {
+	// ID is the "kid" of the key: its JWK thumbprint (RFC 7638), so it is derived from the key
+	// and the same on every instance
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// NewSigningKey generates a key
+func NewSigningKey() (*SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, SigningKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: thumbprint(&key.PublicKey), Key: key}, nil
+}
+
+// ParseSigningKey reads a key stored with SigningKey.Marshal
+func ParseSigningKey(der []byte) (*SigningKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is a %T, not an RSA key", parsed)
+	}
+	return &SigningKey{ID: thumbprint(&key.PublicKey), Key: key}, nil
+}
+
+// Marshal returns the private key as PKCS #8 DER
+func (k *SigningKey) Marshal() ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(k.Key)
+}
+
+// JWK is the public half of a signing key as RFC 7517 represents it
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// JWK returns the public key to publish
+func (k *SigningKey) JWK() JWK {
+	n, e := rsaComponents(&k.Key.PublicKey)
+	return JWK{KeyType: "RSA", Use: "sig", Algorithm: AlgRS256, KeyID: k.ID, N: n, E: e}
+}
+
+// JSONWebKeySet is the document relying parties fetch to verify ID tokens
+type JSONWebKeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Key returns the key with kid, or nil
+func (s *JSONWebKeySet) Key(kid string) *JWK {
+	for i := range s.Keys {
+		if s.Keys[i].KeyID == kid {
+			return &s.Keys[i]
+		}
+	}
+	return nil
+}
+
+func rsaComponents(key *rsa.PublicKey) (n, e string) {
+	return base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+}
+
+// thumbprint computes the RFC 7638 thumbprint, the hash of the required members in lexical order
+func thumbprint(key *rsa.PublicKey) string {
+	n, e := rsaComponents(key)
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Sign returns claims as a JWT in compact serialization, signed with RS256
+func (k *SigningKey) Sign(claims any) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: AlgRS256, Type: "JWT", KeyID: k.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the RS256 signature of token against the key its header names and decodes
+// the payload into claims. Checking the claims themselves, such as the expiry, is up to the caller.
+func Verify(token string, keys *JSONWebKeySet, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: not a compact JWS", ErrInvalidJWT)
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: header is not base64url", ErrInvalidJWT)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return fmt.Errorf("%w: header is not JSON", ErrInvalidJWT)
+	}
+	// Only accepting the algorithm the keys are for rules out "none" and HMAC confusion attacks
+	if header.Algorithm != AlgRS256 {
+		return fmt.Errorf("%w: algorithm %q is not accepted", ErrInvalidJWT, header.Algorithm)
+	}
+	jwk := keys.Key(header.KeyID)
+	if jwk == nil {
+		return fmt.Errorf("%w: unknown key %q", ErrInvalidJWT, header.KeyID)
+	}
+	publicKey, err := jwk.publicKey()
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: signature is not base64url", ErrInvalidJWT)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("%w: bad signature", ErrInvalidJWT)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: payload is not base64url", ErrInvalidJWT)
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return fmt.Errorf("%w: payload: %v", ErrInvalidJWT, err)
+	}
+	return nil
+}
+
+func (k *JWK) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || k.KeyType != "RSA" {
+		return nil, fmt.Errorf("%w: key %q is not an RSA key", ErrInvalidJWT, k.KeyID)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("%w: key %q has an invalid exponent", ErrInvalidJWT, k.KeyID)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
@@ -0,0 +1,147 @@
+// Package oidc implements the protocol side of an OAuth 2.0 (RFC 6749) authorization server
+// that is also an OpenID Connect provider (https://openid.net/specs/openid-connect-core-1_0.html):
+// error responses, PKCE, RS256 ID tokens and the discovery and JWKS documents. Storing clients,
+// codes, tokens and keys is up to the caller.
+package oidc
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Error is an OAuth error response. Its JSON is the body RFC 6749 section 5.2 defines, and
+// errors.Is matches any two Errors with the same code.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errorf returns an error with the code of base and a formatted description
+func Errorf(base *Error, format string, args ...any) *Error {
+	return &Error{Code: base.Code, Description: fmt.Sprintf(format, args...)}
+}
+
+// Error codes of RFC 6749 sections 4.1.2.1 and 5.2
+var (
+	ErrInvalidRequest          = &Error{Code: "invalid_request"}
+	ErrInvalidClient           = &Error{Code: "invalid_client"}
+	ErrInvalidGrant            = &Error{Code: "invalid_grant"}
+	ErrUnauthorizedClient      = &Error{Code: "unauthorized_client"}
+	ErrUnsupportedGrantType    = &Error{Code: "unsupported_grant_type"}
+	ErrUnsupportedResponseType = &Error{Code: "unsupported_response_type"}
+	ErrInvalidScope            = &Error{Code: "invalid_scope"}
+	ErrAccessDenied            = &Error{Code: "access_denied"}
+	// ErrInvalidToken is the error of the userinfo endpoint for bad access tokens (RFC 6750)
+	ErrInvalidToken = &Error{Code: "invalid_token"}
+	// ErrInvalidRedirectURI and ErrInvalidClientMetadata reject client registrations (RFC 7591)
+	ErrInvalidRedirectURI    = &Error{Code: "invalid_redirect_uri"}
+	ErrInvalidClientMetadata = &Error{Code: "invalid_client_metadata"}
+)
+
+// Grant types
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+// ResponseTypeCode is the only response type supported, the authorization code flow
+const ResponseTypeCode = "code"
+
+// Client authentication methods of the token endpoint. Public clients, such as single-page and
+// mobile apps, cannot keep a secret and use AuthMethodNone with PKCE.
+const (
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodNone              = "none"
+)
+
+// Scopes that release user claims. A request without ScopeOpenID is plain OAuth and gets no ID token.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// UserScopes are the scopes that only make sense with a signed-in user
+var UserScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// ParseScope splits a space-delimited scope parameter, dropping duplicates
+func ParseScope(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// ValidScopeToken reports whether s is a scope token as RFC 6749 section 3.3 defines it
+func ValidScopeToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// Discovery is the provider metadata served at /.well-known/openid-configuration
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	// AuthorizationResponseIssParameterSupported announces the iss parameter of RFC 9207, which
+	// lets clients that use several providers tell which one answered
+	AuthorizationResponseIssParameterSupported bool `json:"authorization_response_iss_parameter_supported"`
+}
+
+// NewDiscovery returns the metadata of a provider whose protocol endpoints are served under issuer
+func NewDiscovery(issuer, authorizationEndpoint string) *Discovery {
+	return &Discovery{
+		Issuer:                                     issuer,
+		AuthorizationEndpoint:                      authorizationEndpoint,
+		TokenEndpoint:                              issuer + "/oauth/token",
+		UserinfoEndpoint:                           issuer + "/oauth/userinfo",
+		JWKSURI:                                    issuer + "/oauth/jwks",
+		IntrospectionEndpoint:                      issuer + "/oauth/introspect",
+		RevocationEndpoint:                         issuer + "/oauth/revoke",
+		ScopesSupported:                            UserScopes,
+		ResponseTypesSupported:                     []string{ResponseTypeCode},
+		GrantTypesSupported:                        []string{GrantAuthorizationCode, GrantClientCredentials},
+		SubjectTypesSupported:                      []string{"public"},
+		IDTokenSigningAlgValuesSupported:           []string{AlgRS256},
+		TokenEndpointAuthMethodsSupported:          []string{AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodNone},
+		CodeChallengeMethodsSupported:              []string{CodeChallengeS256},
+		ClaimsSupported:                            []string{"iss", "sub", "aud", "exp", "iat", "nonce", "name", "email", "email_verified", "role"},
+		AuthorizationResponseIssParameterSupported: true,
+	}
+}
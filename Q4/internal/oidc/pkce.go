@@ -0,0 +1,47 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// CodeChallengeS256 is the only PKCE method accepted. The "plain" method protects nothing once
+// the authorization request leaks, so RFC 9700 advises against it.
+const CodeChallengeS256 = "S256"
+
+// ValidCodeVerifier reports whether verifier has the length and alphabet RFC 7636 section 4.1 requires
+func ValidCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidCodeChallenge reports whether challenge can be an S256 challenge, the unpadded
+// base64url of a SHA-256 hash
+func ValidCodeChallenge(challenge string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(raw) == sha256.Size
+}
+
+// S256Challenge returns the S256 code challenge of verifier
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyCodeChallenge reports whether verifier is the secret the S256 challenge was derived from
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	if !ValidCodeVerifier(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(S256Challenge(verifier)), []byte(challenge)) == 1
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrContention is returned when other requests kept changing a key's state while a limiter
+// tried to update it
+var ErrContention = errors.New("rate limit state changed concurrently too often")
+
+// maxSwapAttempts bounds the compare-and-swap retries of a single request
+const maxSwapAttempts = 8
+
+// Decision is a limiter's answer to one request
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests allowed per Window
+	Limit  int
+	Window time.Duration
+	// Remaining is the number of requests left right now
+	Remaining int
+	// Reset is how long until the limit is fully available again
+	Reset time.Duration
+	// RetryAfter is how long a denied request should wait before trying again
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the request identified by key may proceed and counts it if so
+type Limiter interface {
+	Take(key string) (Decision, error)
+}
+
+// TokenBucket allows Limit requests per Period on average and bursts of up to Burst requests.
+// Each key has a bucket of Burst tokens that refills steadily; every request takes one token.
+type TokenBucket struct {
+	Store  Store
+	Limit  int
+	Period time.Duration
+	// Burst is the size of the bucket; zero means Limit
+	Burst int
+	// Now returns the current time; tests replace it to refill buckets
+	Now func() time.Time
+}
+
+func NewTokenBucket(store Store, limit int, period time.Duration) *TokenBucket {
+	return &TokenBucket{Store: store, Limit: limit, Period: period, Now: time.Now}
+}
+
+func (b *TokenBucket) Take(key string) (Decision, error) {
+	burst := b.Burst
+	if burst <= 0 {
+		burst = b.Limit
+	}
+	// interval is the time it takes to refill one token
+	interval := b.Period / time.Duration(b.Limit)
+
+	for range maxSwapAttempts {
+		now := b.Now()
+		old, err := b.Store.Get(key)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		tokens := float64(burst)
+		if state, ok := parseState(old, 2); ok {
+			elapsed := now.Sub(time.UnixMicro(int64(state[1])))
+			tokens = min(float64(burst), state[0]+float64(elapsed)/float64(interval))
+		}
+
+		decision := Decision{Limit: burst, Window: b.Period}
+		if tokens < 1 {
+			// Nothing changes, so there is nothing to write back
+			decision.Remaining = 0
+			decision.Reset = time.Duration((float64(burst) - tokens) * float64(interval))
+			decision.RetryAfter = time.Duration((1 - tokens) * float64(interval))
+			return decision, nil
+		}
+
+		tokens--
+		decision.Allowed = true
+		decision.Remaining = int(tokens)
+		decision.Reset = time.Duration((float64(burst) - tokens) * float64(interval))
+		// A bucket that refilled completely is the same as a missing one, so the key can expire then
+		state := formatState(tokens, float64(now.UnixMicro()))
+		swapped, err := b.Store.CompareAndSwap(key, old, state, decision.Reset+time.Second)
+		if err != nil {
+			return Decision{}, err
+		}
+		if swapped {
+			return decision, nil
+		}
+	}
+	return Decision{}, ErrContention
+}
+
+// SlidingWindowCounter allows about Limit requests within any Window-long interval. Unlike
+// SlidingWindow it keeps two counters per key instead of a timestamp per request: the requests
+// of the current fixed window plus those of the previous one, weighted by how much of it still
+// overlaps the sliding window.
+type SlidingWindowCounter struct {
+	Store  Store
+	Limit  int
+	Window time.Duration
+	// Now returns the current time; tests replace it to move the window
+	Now func() time.Time
+}
+
+func NewSlidingWindowCounter(store Store, limit int, window time.Duration) *SlidingWindowCounter {
+	return &SlidingWindowCounter{Store: store, Limit: limit, Window: window, Now: time.Now}
+}
+
+func (c *SlidingWindowCounter) Take(key string) (Decision, error) {
+	for range maxSwapAttempts {
+		now := c.Now()
+		start := now.Truncate(c.Window)
+		old, err := c.Store.Get(key)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		var previous, current float64
+		if state, ok := parseState(old, 3); ok {
+			switch stateStart := time.UnixMicro(int64(state[0])); {
+			case stateStart.Equal(start):
+				previous, current = state[1], state[2]
+			case stateStart.Equal(start.Add(-c.Window)):
+				previous = state[2]
+			}
+		}
+
+		// weight is the share of the previous window that the sliding window still covers
+		weight := 1 - float64(now.Sub(start))/float64(c.Window)
+		limit := float64(c.Limit)
+		decision := Decision{Limit: c.Limit, Window: c.Window, Reset: start.Add(c.Window).Sub(now)}
+		if previous*weight+current+1 > limit {
+			decision.RetryAfter = c.retryAfter(now, start, previous, current)
+			return decision, nil
+		}
+
+		current++
+		decision.Allowed = true
+		decision.Remaining = max(int(limit-previous*weight-current), 0)
+		state := formatState(float64(start.UnixMicro()), previous, current)
+		swapped, err := c.Store.CompareAndSwap(key, old, state, 2*c.Window)
+		if err != nil {
+			return Decision{}, err
+		}
+		if swapped {
+			return decision, nil
+		}
+	}
+	return Decision{}, ErrContention
+}
+
+// retryAfter returns how long until the weighted count leaves room for one more request
+func (c *SlidingWindowCounter) retryAfter(now, start time.Time, previous, current float64) time.Duration {
+	room := float64(c.Limit) - 1
+	if current <= room {
+		// The previous window has to fade until previous*weight <= room-current
+		fraction := 1 - (room-current)/previous
+		return start.Add(fade(fraction, c.Window)).Sub(now)
+	}
+	// Only the next window leaves room, once enough of this one has faded in turn
+	fraction := 1 - room/current
+	return start.Add(c.Window + fade(fraction, c.Window)).Sub(now)
+}
+
+// fade returns the given fraction of window, rounded to hide floating point noise
+func fade(fraction float64, window time.Duration) time.Duration {
+	return time.Duration(fraction * float64(window)).Round(time.Millisecond)
+}
+
+// formatState encodes limiter state as comma-separated numbers, so it stays readable in the
+// store. Times are kept in microseconds, which float64 still holds exactly.
+func formatState(values ...float64) []byte {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return []byte(strings.Join(parts, ","))
+}
+
+// parseState decodes state written by formatState, which must hold n numbers
+func parseState(state []byte, n int) ([]float64, bool) {
+	if state == nil {
+		return nil, false
+	}
+	parts := strings.Split(string(state), ",")
+	if len(parts) != n {
+		return nil, false
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, false
+		}
+		values[i] = value
+	}
+	return values, true
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Lockout locks keys out after repeated failures. Every failure is answered more slowly than the
+// last, and Threshold failures within Window lock the key for Duration. A key that fails again
+// soon after a lockout ended is locked twice as long each time, up to MaxDuration.
+type Lockout struct {
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+	// MaxDuration caps the doubling of repeated lockouts
+	MaxDuration time.Duration
+	// Delay is the delay after the first failure; it doubles with each further one up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Now returns the current time; tests replace it to move past lockouts
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastPrune time.Time
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	// lockouts counts the lockouts in a row, without a quiet Window between them
+	lockouts    int
+	lockedUntil time.Time
+}
+
+func NewLockout(threshold int, duration time.Duration) *Lockout {
+	return &Lockout{
+		Threshold:   threshold,
+		Window:      duration,
+		Duration:    duration,
+		MaxDuration: 24 * time.Hour,
+		Delay:       250 * time.Millisecond,
+		MaxDelay:    4 * time.Second,
+		Now:         time.Now,
+		entries:     make(map[string]*lockoutEntry),
+	}
+}
+
+// Locked returns how much longer key is locked out, or zero if it is not
+func (l *Lockout) Locked(key string) time.Duration {
+	now := l.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[key]; ok && now.Before(entry.lockedUntil) {
+		return entry.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// Fail records a failure for key. It returns how long to wait before answering it and, when
+// this failure locked the key out, for how long.
+func (l *Lockout) Fail(key string) (delay, lockedFor time.Duration) {
+	now := l.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+	if entry.quiet(now, l.Window) {
+		*entry = lockoutEntry{}
+	}
+	entry.failures++
+	entry.lastFailure = now
+
+	delay = l.Delay
+	for i := 1; i < entry.failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, l.MaxDelay)
+
+	if entry.failures >= l.Threshold {
+		lockedFor = l.Duration
+		for i := 0; i < entry.lockouts && lockedFor < l.MaxDuration; i++ {
+			lockedFor *= 2
+		}
+		lockedFor = min(lockedFor, l.MaxDuration)
+		entry.lockouts++
+		entry.failures = 0
+		entry.lockedUntil = now.Add(lockedFor)
+	}
+	return delay, lockedFor
+}
+
+// Reset forgets the failures and lockouts of key, and reports whether it was locked out
+func (l *Lockout) Reset(key string) bool {
+	now := l.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok && now.Before(entry.lockedUntil)
+}
+
+// quiet reports whether the key has had neither a failure nor a lockout for a whole window
+func (e *lockoutEntry) quiet(now time.Time, window time.Duration) bool {
+	last := e.lastFailure
+	if e.lockedUntil.After(last) {
+		last = e.lockedUntil
+	}
+	return now.Sub(last) > window
+}
+
+// prune drops keys that went quiet so the map does not grow with every client ever seen
+func (l *Lockout) prune(now time.Time) {
+	if now.Sub(l.lastPrune) <= l.Window {
+		return
+	}
+	l.lastPrune = now
+	for key, entry := range l.entries {
+		if entry.quiet(now, l.Window) {
+			delete(l.entries, key)
+		}
+	}
+}
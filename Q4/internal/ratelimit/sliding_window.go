@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingWindow allows at most Limit events per key within any Window-long interval.
+// It keeps the timestamps of recent events, so it suits low limits such as login or email sends.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+	// Now returns the current time; tests replace it to move the window
+	Now func() time.Time
+
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	lastPrune time.Time
+}
+
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{
+		Limit:  limit,
+		Window: window,
+		Now:    time.Now,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key if it is within the limit. When it is not, nothing is recorded
+// and retryAfter tells how long until the oldest event leaves the window.
+func (w *SlidingWindow) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	now := w.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := w.recent(key, now)
+	if len(events) >= w.Limit {
+		w.events[key] = events
+		return false, events[0].Add(w.Window).Sub(now)
+	}
+	w.events[key] = append(events, now)
+
+	// Drop keys that went quiet so the map does not grow with every client ever seen
+	if now.Sub(w.lastPrune) > w.Window {
+		w.lastPrune = now
+		for k := range w.events {
+			if len(w.recent(k, now)) == 0 {
+				delete(w.events, k)
+			}
+		}
+	}
+	return true, 0
+}
+
+// Reset forgets the events recorded for key
+func (w *SlidingWindow) Reset(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.events, key)
+}
+
+func (w *SlidingWindow) recent(key string, now time.Time) []time.Time {
+	events := w.events[key]
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-w.Window)) {
+		i++
+	}
+	return events[i:]
+}
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"Q4/internal/cache"
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store keeps the state of request limiters. Limiters only read a key and swap it for a new
+// value, so a store shared by several instances makes them enforce one limit together.
+type Store interface {
+	// Get returns the value of key, or nil if it is missing or expired
+	Get(key string) ([]byte, error)
+	// CompareAndSwap sets key to value for ttl if its current value is still old, where nil
+	// stands for a missing key, and reports whether it did
+	CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error)
+}
+
+type storeEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryStore is a Store for a single instance
+type MemoryStore struct {
+	// Now returns the current time; tests replace it to expire entries
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]storeEntry
+	lastPrune time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Now:     time.Now,
+		entries: make(map[string]storeEntry),
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(key, now), nil
+}
+
+func (s *MemoryStore) CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.get(key, now)
+	if (current == nil) != (old == nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	s.entries[key] = storeEntry{value: value, expiresAt: now.Add(ttl)}
+
+	// Drop expired keys now and then so the map does not grow with every client ever seen
+	if now.Sub(s.lastPrune) > time.Minute {
+		s.lastPrune = now
+		for k, entry := range s.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) get(key string, now time.Time) []byte {
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expiresAt) {
+		return nil
+	}
+	return entry.value
+}
+
+// compareAndSwapScript runs on the server so that no other client can write between the
+// comparison and the swap. An empty ARGV[1] stands for a missing key; limiter state is never empty.
+const compareAndSwapScript = `
+local current = redis.call('GET', KEYS[1])
+if (current or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1`
+
+// RedisStore is a Store on a Redis-compatible server, shared by every instance that uses it.
+// The server must support EVAL.
+type RedisStore struct {
+	Redis *cache.Redis
+}
+
+func NewRedisStore(redis *cache.Redis) *RedisStore {
+	return &RedisStore{Redis: redis}
+}
+
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	reply, err := s.Redis.Do("GET", s.Redis.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := reply.([]byte)
+	return value, nil
+}
+
+func (s *RedisStore) CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	reply, err := s.Redis.Do("EVAL", compareAndSwapScript, "1", s.Redis.Prefix+key, string(old), string(value), ms)
+	if err != nil {
+		return false, err
+	}
+	swapped, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("redis: unexpected EVAL reply %v", reply)
+	}
+	return swapped == 1, nil
+}
@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrPasswordNotSet is returned for users who have never set a password
+	ErrPasswordNotSet = errors.New("password not set")
+	// ErrSessionNotFound is returned for unknown or revoked sessions
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrResetTokenNotFound is returned for password reset tokens that are unknown, expired or already used
+	ErrResetTokenNotFound = errors.New("password reset token not found")
+	// ErrMFANotEnrolled is returned for users without a TOTP authenticator
+	ErrMFANotEnrolled = errors.New("mfa not enrolled")
+	// ErrTOTPStepUsed is returned when a code for the same or a later time step was already accepted
+	ErrTOTPStepUsed = errors.New("totp code already used")
+	// ErrRecoveryCodeNotFound is returned for recovery codes that are unknown or already used
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+	// ErrCredentialNotFound is returned for WebAuthn credentials that are unknown or belong to another user
+	ErrCredentialNotFound = errors.New("webauthn credential not found")
+	// ErrDuplicateCredential is returned when a WebAuthn credential ID is registered already
+	ErrDuplicateCredential = errors.New("webauthn credential already registered")
+	// ErrSignCountStale is returned when a signature counter is not above the stored one,
+	// including when a concurrent sign-in stored it first
+	ErrSignCountStale = errors.New("webauthn sign count not above the stored one")
+	// ErrChallengeNotFound is returned for WebAuthn challenges that are unknown, expired or already used
+	ErrChallengeNotFound = errors.New("webauthn challenge not found")
+	// ErrClientNotFound is returned for unknown OAuth clients
+	ErrClientNotFound = errors.New("oauth client not found")
+	// ErrAuthorizationCodeNotFound is returned for authorization codes that are unknown, expired or already used
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found")
+	// ErrOAuthTokenNotFound is returned for access tokens that are unknown or revoked
+	ErrOAuthTokenNotFound = errors.New("oauth token not found")
+	// ErrServicePrincipalNotFound is returned for unknown service principals
+	ErrServicePrincipalNotFound = errors.New("service principal not found")
+	// ErrAPIKeyNotFound is returned for API keys that are unknown or belong to another service principal
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrDuplicateCertificateSubject is returned when another service principal has the certificate subject already
+	ErrDuplicateCertificateSubject = errors.New("certificate subject already assigned")
+	// ErrIdempotencyKeyNotFound is returned for idempotency keys that are unknown, expired or held by another request
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	// ErrDuplicateIdempotencyKey is returned when an unexpired record holds the idempotency key already
+	ErrDuplicateIdempotencyKey = errors.New("idempotency key already used")
+)
+
+// PasswordRepository stores password hashes apart from the user record so that they never reach
+// caches or API responses. Deleting a user deletes their password.
+type PasswordRepository interface {
+	GetPasswordHash(userID int) (string, error)
+	SetPasswordHash(userID int, hash string) error
+}
+
+// SessionRepository stores signed-in sessions. Deleting a user deletes their sessions.
+type SessionRepository interface {
+	CreateSession(session *model.Session) error
+	GetSessionByTokenHash(tokenHash string) (*model.Session, error)
+	// ListUserSessions returns the sessions of the user, most recently seen first
+	ListUserSessions(userID int) ([]model.Session, error)
+	TouchSession(id string, lastSeenAt time.Time) error
+	DeleteSession(id string) error
+	// DeleteUserSessions revokes every session of the user except exceptID, which may be empty,
+	// and returns how many were revoked
+	DeleteUserSessions(userID int, exceptID string) (int, error)
+}
+
+// PasswordResetRepository stores hashes of outstanding password reset tokens
+type PasswordResetRepository interface {
+	CreateResetToken(token model.PasswordResetToken) error
+	// ConsumeResetToken deletes the token and returns its user. Expired tokens and tokens already
+	// consumed, including by a concurrent caller, give ErrResetTokenNotFound.
+	ConsumeResetToken(tokenHash string, now time.Time) (int, error)
+	DeleteUserResetTokens(userID int) error
+}
+
+// MFARepository stores TOTP authenticators and hashes of one-time recovery codes.
+// Deleting a user deletes both.
+type MFARepository interface {
+	GetMFAEnrollment(userID int) (*model.MFAEnrollment, error)
+	// SaveMFAEnrollment creates or replaces the user's enrollment
+	SaveMFAEnrollment(enrollment model.MFAEnrollment) error
+	// UseTOTPStep records step as the user's last accepted code. It fails with ErrTOTPStepUsed
+	// unless step is later than every step accepted before, including by a concurrent caller.
+	UseTOTPStep(userID int, step int64) error
+	// DeleteMFAEnrollment removes the enrollment and the recovery codes of the user
+	DeleteMFAEnrollment(userID int) error
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	// ConsumeRecoveryCode deletes the code, failing with ErrRecoveryCodeNotFound if it was not there
+	ConsumeRecoveryCode(userID int, codeHash string) error
+	CountRecoveryCodes(userID int) (int, error)
+}
+
+// WebAuthnRepository stores passkeys and the challenges of WebAuthn ceremonies in progress.
+// Deleting a user deletes both.
+type WebAuthnRepository interface {
+	// CreateWebAuthnCredential fails with ErrDuplicateCredential if any user registered the ID already
+	CreateWebAuthnCredential(credential *model.WebAuthnCredential) error
+	GetWebAuthnCredential(id string) (*model.WebAuthnCredential, error)
+	// ListWebAuthnCredentials returns the credentials of the user, oldest first
+	ListWebAuthnCredentials(userID int) ([]model.WebAuthnCredential, error)
+	// UpdateWebAuthnSignCount records a sign-in. Unless both are zero, signCount has to be above
+	// the stored counter or ErrSignCountStale is returned.
+	UpdateWebAuthnSignCount(id string, signCount uint32, usedAt time.Time) error
+	// DeleteWebAuthnCredential fails with ErrCredentialNotFound unless the credential belongs to userID
+	DeleteWebAuthnCredential(userID int, id string) error
+	CreateWebAuthnChallenge(challenge model.WebAuthnChallenge) error
+	// ConsumeWebAuthnChallenge deletes the challenge and returns it. Expired challenges and challenges
+	// already consumed, including by a concurrent caller, give ErrChallengeNotFound.
+	ConsumeWebAuthnChallenge(challenge string, now time.Time) (*model.WebAuthnChallenge, error)
+}
+
+// OAuthRepository stores the clients, authorization codes, access tokens and signing keys of the
+// OpenID Connect provider. Deleting a user deletes their codes and tokens; deleting a client
+// deletes the codes and tokens issued to it.
+type OAuthRepository interface {
+	CreateOAuthClient(client *model.OAuthClient) error
+	GetOAuthClient(id string) (*model.OAuthClient, error)
+	// ListOAuthClients returns every client, oldest first
+	ListOAuthClients() ([]model.OAuthClient, error)
+	DeleteOAuthClient(id string) error
+	CreateAuthorizationCode(code model.OAuthAuthorizationCode) error
+	// ConsumeAuthorizationCode deletes the code and returns it. Expired codes and codes already
+	// consumed, including by a concurrent caller, give ErrAuthorizationCodeNotFound.
+	ConsumeAuthorizationCode(codeHash string, now time.Time) (*model.OAuthAuthorizationCode, error)
+	CreateOAuthToken(token model.OAuthToken) error
+	// GetOAuthToken returns the token whether or not it has expired
+	GetOAuthToken(tokenHash string) (*model.OAuthToken, error)
+	DeleteOAuthToken(tokenHash string) error
+	// DeleteUserOAuthTokens removes the tokens issued for the user and returns how many
+	DeleteUserOAuthTokens(userID int) (int, error)
+	// DeleteExpiredOAuthTokens removes the tokens that expired at or before now and returns how many
+	DeleteExpiredOAuthTokens(now time.Time) (int, error)
+	// ListSigningKeys returns every signing key, newest first
+	ListSigningKeys() ([]model.OAuthSigningKey, error)
+	CreateSigningKey(key model.OAuthSigningKey) error
+	DeleteSigningKey(id string) error
+}
+
+// APIKeyRepository stores service principals and their API keys. Deleting a principal deletes its keys.
+type APIKeyRepository interface {
+	// CreateServicePrincipal fails with ErrDuplicateCertificateSubject if another principal has its certificate subject
+	CreateServicePrincipal(principal *model.ServicePrincipal) error
+	GetServicePrincipal(id string) (*model.ServicePrincipal, error)
+	GetServicePrincipalByCertificateSubject(subject string) (*model.ServicePrincipal, error)
+	// ListServicePrincipals returns every principal, oldest first
+	ListServicePrincipals() ([]model.ServicePrincipal, error)
+	DeleteServicePrincipal(id string) error
+	// CreateAPIKey fails with ErrServicePrincipalNotFound if the principal does not exist
+	CreateAPIKey(key *model.APIKey) error
+	// GetAPIKey fails with ErrAPIKeyNotFound unless the key belongs to servicePrincipalID
+	GetAPIKey(servicePrincipalID, id string) (*model.APIKey, error)
+	// GetAPIKeyByPrefix returns the key whether or not it has expired
+	GetAPIKeyByPrefix(prefix string) (*model.APIKey, error)
+	// ListAPIKeys returns the keys of the principal, oldest first
+	ListAPIKeys(servicePrincipalID string) ([]model.APIKey, error)
+	SetAPIKeyExpiry(id string, expiresAt time.Time) error
+	TouchAPIKey(id string, usedAt time.Time) error
+	// DeleteAPIKey fails with ErrAPIKeyNotFound unless the key belongs to servicePrincipalID
+	DeleteAPIKey(servicePrincipalID, id string) error
+	// DeleteAPIKeysCreatedBy removes the keys of every principal the user created and returns how many.
+	// The principals themselves stay, so new keys can be issued for them.
+	DeleteAPIKeysCreatedBy(userID int) (int, error)
+}
+
+// IdempotencyKeyRepository stores idempotency keys with the responses to their requests. Records
+// are identified by scope and key; only the request that created a record, told apart by its
+// CreatedAt, may complete or release it.
+type IdempotencyKeyRepository interface {
+	// CreateIdempotencyKey claims the key for a request in progress. Records that expired at or
+	// before key.CreatedAt are removed first; an unexpired one gives ErrDuplicateIdempotencyKey.
+	CreateIdempotencyKey(key *model.IdempotencyKey) error
+	// GetIdempotencyKey returns the record whether or not it has expired
+	GetIdempotencyKey(scope, key string) (*model.IdempotencyKey, error)
+	// CompleteIdempotencyKey stores the response and the new expiry of key, and fails with
+	// ErrIdempotencyKeyNotFound if its request no longer holds the key
+	CompleteIdempotencyKey(key *model.IdempotencyKey) error
+	// ReleaseIdempotencyKey deletes the record of a request in progress, so that the key may be
+	// used again, and fails with ErrIdempotencyKeyNotFound if the request no longer holds it
+	ReleaseIdempotencyKey(key *model.IdempotencyKey) error
+}
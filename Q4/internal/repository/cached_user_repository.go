@@ -0,0 +1,243 @@
+package repository
+
+import (
+	"Q4/internal/cache"
+	"Q4/internal/metrics"
+	"Q4/internal/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultCacheTTL         = time.Minute
+	DefaultCacheNegativeTTL = 10 * time.Second
+)
+
+// notFoundEntry marks an ID that is known not to exist
+var notFoundEntry = []byte("null")
+
+// CacheStats is a point-in-time view of the cache counters
+type CacheStats struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	NegativeHits int64 `json:"negative_hits"`
+}
+
+// CachedUserRepository is a read-through cache for GetUserByID in front of another UserRepository.
+// Missing IDs are cached for NegativeTTL, writes invalidate the affected IDs and concurrent misses
+// for the same ID share a single load. Listings, batch lookups and email lookups are passed through.
+type CachedUserRepository struct {
+	UserRepository
+	Cache       cache.Backend
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	loads singleflight.Group
+	// epoch is bumped by every invalidation so a load that raced with a write does not cache stale data
+	epoch        atomic.Uint64
+	hits         atomic.Int64
+	misses       atomic.Int64
+	negativeHits atomic.Int64
+}
+
+func NewCachedUserRepository(inner UserRepository, backend cache.Backend) *CachedUserRepository {
+	return &CachedUserRepository{
+		UserRepository: inner,
+		Cache:          backend,
+		TTL:            DefaultCacheTTL,
+		NegativeTTL:    DefaultCacheNegativeTTL,
+	}
+}
+
+func userCacheKey(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+func (cr *CachedUserRepository) GetUserByID(id int) (*model.User, error) {
+	key := userCacheKey(id)
+
+	if data, ok := cr.Cache.Get(key); ok {
+		if string(data) == string(notFoundEntry) {
+			cr.negativeHits.Add(1)
+			metrics.Counter("user_cache_negative_hits_total").Add(1)
+			return nil, ErrUserNotFound
+		}
+		var user model.User
+		if err := json.Unmarshal(data, &user); err == nil {
+			cr.hits.Add(1)
+			metrics.Counter("user_cache_hits_total").Add(1)
+			return &user, nil
+		}
+		logrus.Warnf("Discarding undecodable cache entry %s", key)
+		cr.Cache.Delete(key)
+	}
+
+	cr.misses.Add(1)
+	metrics.Counter("user_cache_misses_total").Add(1)
+
+	value, err, _ := cr.loads.Do(key, func() (any, error) {
+		epoch := cr.epoch.Load()
+		user, err := cr.UserRepository.GetUserByID(id)
+
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			if cr.epoch.Load() == epoch {
+				cr.Cache.Set(key, notFoundEntry, cr.NegativeTTL)
+			}
+		case err == nil:
+			if data, encErr := json.Marshal(user); encErr == nil && cr.epoch.Load() == epoch {
+				cr.Cache.Set(key, data, cr.TTL)
+			}
+		}
+		return user, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers sharing a load must not share the same pointer
+	user := *value.(*model.User)
+	return &user, nil
+}
+
+func (cr *CachedUserRepository) CreateUser(user *model.User) error {
+	err := cr.UserRepository.CreateUser(user)
+	if err == nil && user.ID != 0 {
+		// The new ID may have been cached as missing
+		cr.Invalidate(user.ID)
+	}
+	return err
+}
+
+func (cr *CachedUserRepository) UpdateUser(user *model.User) error {
+	defer cr.Invalidate(user.ID)
+	return cr.UserRepository.UpdateUser(user)
+}
+
+func (cr *CachedUserRepository) DeleteUser(id int) error {
+	defer cr.Invalidate(id)
+	return cr.UserRepository.DeleteUser(id)
+}
+
+func (cr *CachedUserRepository) MarkEmailVerified(id int, email string) error {
+	defer cr.Invalidate(id)
+	return cr.UserRepository.MarkEmailVerified(id, email)
+}
+
+func (cr *CachedUserRepository) UpsertUsers(users []model.User) ([]UpsertResult, error) {
+	results, err := cr.UserRepository.UpsertUsers(users)
+	ids := make([]int, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	cr.Invalidate(ids...)
+	return results, err
+}
+
+// SearchUsers passes through to the wrapped repository when it supports search
+func (cr *CachedUserRepository) SearchUsers(query SearchQuery) (*SearchResult, error) {
+	searcher, ok := cr.UserRepository.(UserSearcher)
+	if !ok {
+		return nil, ErrSearchUnsupported
+	}
+	return searcher.SearchUsers(query)
+}
+
+// Invalidate drops the cached entries, positive or negative, for the given IDs
+func (cr *CachedUserRepository) Invalidate(ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	cr.epoch.Add(1)
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = userCacheKey(id)
+		cr.loads.Forget(keys[i])
+	}
+	cr.Cache.Delete(keys...)
+}
+
+func (cr *CachedUserRepository) Stats() CacheStats {
+	return CacheStats{
+		Hits:         cr.hits.Load(),
+		Misses:       cr.misses.Load(),
+		NegativeHits: cr.negativeHits.Load(),
+	}
+}
+
+// CachedTxManager keeps a CachedUserRepository consistent with writes made inside transactions.
+// Reads inside a transaction bypass the cache; every ID written is invalidated once the
+// outermost transaction finishes, whether it committed or not.
+type CachedTxManager struct {
+	TxManager
+	Cache *CachedUserRepository
+}
+
+func NewCachedTxManager(inner TxManager, cached *CachedUserRepository) *CachedTxManager {
+	return &CachedTxManager{
+		TxManager: inner,
+		Cache:     cached,
+	}
+}
+
+type cachedTxKey struct{}
+
+func (m *CachedTxManager) WithinTx(ctx context.Context, fn func(ctx context.Context, repos Repositories) error) error {
+	if touched, nested := ctx.Value(cachedTxKey{}).(*[]int); nested {
+		return m.TxManager.WithinTx(ctx, func(ctx context.Context, repos Repositories) error {
+			repos.Users = &touchTrackingUserRepository{UserRepository: repos.Users, touched: touched}
+			return fn(ctx, repos)
+		})
+	}
+
+	var touched []int
+	defer func() { m.Cache.Invalidate(touched...) }()
+
+	ctx = context.WithValue(ctx, cachedTxKey{}, &touched)
+	return m.TxManager.WithinTx(ctx, func(ctx context.Context, repos Repositories) error {
+		repos.Users = &touchTrackingUserRepository{UserRepository: repos.Users, touched: &touched}
+		return fn(ctx, repos)
+	})
+}
+
+// touchTrackingUserRepository records the IDs written through a transaction-bound repository
+type touchTrackingUserRepository struct {
+	UserRepository
+	touched *[]int
+}
+
+func (r *touchTrackingUserRepository) CreateUser(user *model.User) error {
+	err := r.UserRepository.CreateUser(user)
+	*r.touched = append(*r.touched, user.ID)
+	return err
+}
+
+func (r *touchTrackingUserRepository) UpdateUser(user *model.User) error {
+	*r.touched = append(*r.touched, user.ID)
+	return r.UserRepository.UpdateUser(user)
+}
+
+func (r *touchTrackingUserRepository) DeleteUser(id int) error {
+	*r.touched = append(*r.touched, id)
+	return r.UserRepository.DeleteUser(id)
+}
+
+func (r *touchTrackingUserRepository) MarkEmailVerified(id int, email string) error {
+	*r.touched = append(*r.touched, id)
+	return r.UserRepository.MarkEmailVerified(id, email)
+}
+
+func (r *touchTrackingUserRepository) UpsertUsers(users []model.User) ([]UpsertResult, error) {
+	results, err := r.UserRepository.UpsertUsers(users)
+	for _, result := range results {
+		*r.touched = append(*r.touched, result.ID)
+	}
+	return results, err
+}
@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MemoryAPIKeyRepository implements APIKeyRepository over the data of a MemoryUserRepository
+type MemoryAPIKeyRepository struct {
+	memoryStore
+}
+
+func NewMemoryAPIKeyRepository(users *MemoryUserRepository) *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{users.memoryStore}
+}
+
+func (r *MemoryAPIKeyRepository) CreateServicePrincipal(principal *model.ServicePrincipal) error {
+	defer r.lock()()
+
+	if principal.CertificateSubject != "" {
+		for _, other := range r.data.servicePrincipals {
+			if other.CertificateSubject == principal.CertificateSubject {
+				return fmt.Errorf("%w: %s", ErrDuplicateCertificateSubject, principal.CertificateSubject)
+			}
+		}
+	}
+	stored := *principal
+	stored.Scopes = slices.Clone(principal.Scopes)
+	r.data.servicePrincipals[principal.ID] = stored
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) GetServicePrincipal(id string) (*model.ServicePrincipal, error) {
+	defer r.rlock()()
+
+	principal, ok := r.data.servicePrincipals[id]
+	if !ok {
+		return nil, ErrServicePrincipalNotFound
+	}
+	return &principal, nil
+}
+
+func (r *MemoryAPIKeyRepository) GetServicePrincipalByCertificateSubject(subject string) (*model.ServicePrincipal, error) {
+	defer r.rlock()()
+
+	for _, principal := range r.data.servicePrincipals {
+		if subject != "" && principal.CertificateSubject == subject {
+			return &principal, nil
+		}
+	}
+	return nil, ErrServicePrincipalNotFound
+}
+
+func (r *MemoryAPIKeyRepository) ListServicePrincipals() ([]model.ServicePrincipal, error) {
+	defer r.rlock()()
+
+	principals := slices.Collect(maps.Values(r.data.servicePrincipals))
+	if principals == nil {
+		principals = []model.ServicePrincipal{}
+	}
+	sort.Slice(principals, func(i, j int) bool {
+		if !principals[i].CreatedAt.Equal(principals[j].CreatedAt) {
+			return principals[i].CreatedAt.Before(principals[j].CreatedAt)
+		}
+		return principals[i].ID < principals[j].ID
+	})
+	return principals, nil
+}
+
+func (r *MemoryAPIKeyRepository) DeleteServicePrincipal(id string) error {
+	defer r.lock()()
+
+	if _, ok := r.data.servicePrincipals[id]; !ok {
+		return ErrServicePrincipalNotFound
+	}
+	delete(r.data.servicePrincipals, id)
+	// Cascade like the foreign keys of the SQL backends
+	maps.DeleteFunc(r.data.apiKeys, func(_ string, k model.APIKey) bool { return k.ServicePrincipalID == id })
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) CreateAPIKey(key *model.APIKey) error {
+	defer r.lock()()
+
+	if _, ok := r.data.servicePrincipals[key.ServicePrincipalID]; !ok {
+		return ErrServicePrincipalNotFound
+	}
+	stored := *key
+	stored.LastUsedAt = nil
+	r.data.apiKeys[key.ID] = stored
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) GetAPIKey(servicePrincipalID, id string) (*model.APIKey, error) {
+	defer r.rlock()()
+
+	key, ok := r.data.apiKeys[id]
+	if !ok || key.ServicePrincipalID != servicePrincipalID {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func (r *MemoryAPIKeyRepository) GetAPIKeyByPrefix(prefix string) (*model.APIKey, error) {
+	defer r.rlock()()
+
+	for _, key := range r.data.apiKeys {
+		if key.Prefix == prefix {
+			return &key, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (r *MemoryAPIKeyRepository) ListAPIKeys(servicePrincipalID string) ([]model.APIKey, error) {
+	defer r.rlock()()
+
+	keys := []model.APIKey{}
+	for _, key := range r.data.apiKeys {
+		if key.ServicePrincipalID == servicePrincipalID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (r *MemoryAPIKeyRepository) SetAPIKeyExpiry(id string, expiresAt time.Time) error {
+	defer r.lock()()
+
+	key, ok := r.data.apiKeys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.ExpiresAt = expiresAt
+	r.data.apiKeys[id] = key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) TouchAPIKey(id string, usedAt time.Time) error {
+	defer r.lock()()
+
+	key, ok := r.data.apiKeys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &usedAt
+	r.data.apiKeys[id] = key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) DeleteAPIKey(servicePrincipalID, id string) error {
+	defer r.lock()()
+
+	key, ok := r.data.apiKeys[id]
+	if !ok || key.ServicePrincipalID != servicePrincipalID {
+		return ErrAPIKeyNotFound
+	}
+	delete(r.data.apiKeys, id)
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) DeleteAPIKeysCreatedBy(userID int) (int, error) {
+	defer r.lock()()
+
+	before := len(r.data.apiKeys)
+	maps.DeleteFunc(r.data.apiKeys, func(_ string, k model.APIKey) bool {
+		return r.data.servicePrincipals[k.ServicePrincipalID].CreatedBy == userID
+	})
+	return before - len(r.data.apiKeys), nil
+}
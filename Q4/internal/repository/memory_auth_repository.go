@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MemoryPasswordRepository implements PasswordRepository over the data of a MemoryUserRepository
+type MemoryPasswordRepository struct {
+	memoryStore
+}
+
+func NewMemoryPasswordRepository(users *MemoryUserRepository) *MemoryPasswordRepository {
+	return &MemoryPasswordRepository{users.memoryStore}
+}
+
+func (r *MemoryPasswordRepository) GetPasswordHash(userID int) (string, error) {
+	defer r.rlock()()
+
+	hash, ok := r.data.passwords[userID]
+	if !ok {
+		return "", ErrPasswordNotSet
+	}
+	return hash, nil
+}
+
+func (r *MemoryPasswordRepository) SetPasswordHash(userID int, hash string) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	r.data.passwords[userID] = hash
+	return nil
+}
+
+// MemorySessionRepository implements SessionRepository over the data of a MemoryUserRepository
+type MemorySessionRepository struct {
+	memoryStore
+}
+
+func NewMemorySessionRepository(users *MemoryUserRepository) *MemorySessionRepository {
+	return &MemorySessionRepository{users.memoryStore}
+}
+
+func (r *MemorySessionRepository) CreateSession(session *model.Session) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[session.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	r.data.sessions[session.ID] = *session
+	return nil
+}
+
+func (r *MemorySessionRepository) GetSessionByTokenHash(tokenHash string) (*model.Session, error) {
+	defer r.rlock()()
+
+	for _, session := range r.data.sessions {
+		if session.TokenHash == tokenHash {
+			return &session, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (r *MemorySessionRepository) ListUserSessions(userID int) ([]model.Session, error) {
+	defer r.rlock()()
+
+	sessions := []model.Session{}
+	for _, session := range r.data.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b model.Session) int {
+		if c := b.LastSeenAt.Compare(a.LastSeenAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return sessions, nil
+}
+
+func (r *MemorySessionRepository) TouchSession(id string, lastSeenAt time.Time) error {
+	defer r.lock()()
+
+	if session, ok := r.data.sessions[id]; ok {
+		session.LastSeenAt = lastSeenAt
+		r.data.sessions[id] = session
+	}
+	return nil
+}
+
+func (r *MemorySessionRepository) DeleteSession(id string) error {
+	defer r.lock()()
+
+	delete(r.data.sessions, id)
+	return nil
+}
+
+func (r *MemorySessionRepository) DeleteUserSessions(userID int, exceptID string) (int, error) {
+	defer r.lock()()
+
+	before := len(r.data.sessions)
+	maps.DeleteFunc(r.data.sessions, func(id string, s model.Session) bool {
+		return s.UserID == userID && id != exceptID
+	})
+	return before - len(r.data.sessions), nil
+}
+
+// MemoryPasswordResetRepository implements PasswordResetRepository over the data of a MemoryUserRepository
+type MemoryPasswordResetRepository struct {
+	memoryStore
+}
+
+func NewMemoryPasswordResetRepository(users *MemoryUserRepository) *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{users.memoryStore}
+}
+
+func (r *MemoryPasswordResetRepository) CreateResetToken(token model.PasswordResetToken) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[token.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	r.data.resetTokens[token.TokenHash] = token
+	return nil
+}
+
+func (r *MemoryPasswordResetRepository) ConsumeResetToken(tokenHash string, now time.Time) (int, error) {
+	defer r.lock()()
+
+	token, ok := r.data.resetTokens[tokenHash]
+	if !ok {
+		return 0, ErrResetTokenNotFound
+	}
+	delete(r.data.resetTokens, tokenHash)
+	if !now.Before(token.ExpiresAt) {
+		return 0, ErrResetTokenNotFound
+	}
+	return token.UserID, nil
+}
+
+func (r *MemoryPasswordResetRepository) DeleteUserResetTokens(userID int) error {
+	defer r.lock()()
+
+	maps.DeleteFunc(r.data.resetTokens, func(_ string, t model.PasswordResetToken) bool { return t.UserID == userID })
+	return nil
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// MemoryIdempotencyKeyRepository implements IdempotencyKeyRepository over the data of a MemoryUserRepository
+type MemoryIdempotencyKeyRepository struct {
+	memoryStore
+}
+
+func NewMemoryIdempotencyKeyRepository(users *MemoryUserRepository) *MemoryIdempotencyKeyRepository {
+	return &MemoryIdempotencyKeyRepository{users.memoryStore}
+}
+
+func idempotencyKeyID(scope, key string) string {
+	return scope + "\x00" + key
+}
+
+func (r *MemoryIdempotencyKeyRepository) CreateIdempotencyKey(key *model.IdempotencyKey) error {
+	defer r.lock()()
+
+	for id, stored := range r.data.idempotencyKeys {
+		if !stored.ExpiresAt.After(key.CreatedAt) {
+			delete(r.data.idempotencyKeys, id)
+		}
+	}
+	id := idempotencyKeyID(key.Scope, key.Key)
+	if _, ok := r.data.idempotencyKeys[id]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateIdempotencyKey, key.Key)
+	}
+	r.data.idempotencyKeys[id] = cloneIdempotencyKey(*key)
+	return nil
+}
+
+func (r *MemoryIdempotencyKeyRepository) GetIdempotencyKey(scope, key string) (*model.IdempotencyKey, error) {
+	defer r.rlock()()
+
+	stored, ok := r.data.idempotencyKeys[idempotencyKeyID(scope, key)]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	stored = cloneIdempotencyKey(stored)
+	return &stored, nil
+}
+
+func (r *MemoryIdempotencyKeyRepository) CompleteIdempotencyKey(key *model.IdempotencyKey) error {
+	defer r.lock()()
+
+	id := idempotencyKeyID(key.Scope, key.Key)
+	if !r.heldLocked(id, key) {
+		return ErrIdempotencyKeyNotFound
+	}
+	r.data.idempotencyKeys[id] = cloneIdempotencyKey(*key)
+	return nil
+}
+
+func (r *MemoryIdempotencyKeyRepository) ReleaseIdempotencyKey(key *model.IdempotencyKey) error {
+	defer r.lock()()
+
+	id := idempotencyKeyID(key.Scope, key.Key)
+	if !r.heldLocked(id, key) {
+		return ErrIdempotencyKeyNotFound
+	}
+	delete(r.data.idempotencyKeys, id)
+	return nil
+}
+
+// heldLocked reports whether the request of key still holds its record in progress
+func (r *MemoryIdempotencyKeyRepository) heldLocked(id string, key *model.IdempotencyKey) bool {
+	stored, ok := r.data.idempotencyKeys[id]
+	return ok && stored.Status == 0 && stored.CreatedAt.Unix() == key.CreatedAt.Unix()
+}
+
+func cloneIdempotencyKey(key model.IdempotencyKey) model.IdempotencyKey {
+	key.Header = maps.Clone(key.Header)
+	key.Body = slices.Clone(key.Body)
+	return key
+}
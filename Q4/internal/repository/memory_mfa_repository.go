@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"maps"
+)
+
+// MemoryMFARepository implements MFARepository over the data of a MemoryUserRepository
+type MemoryMFARepository struct {
+	memoryStore
+}
+
+func NewMemoryMFARepository(users *MemoryUserRepository) *MemoryMFARepository {
+	return &MemoryMFARepository{users.memoryStore}
+}
+
+func (r *MemoryMFARepository) GetMFAEnrollment(userID int) (*model.MFAEnrollment, error) {
+	defer r.rlock()()
+
+	enrollment, ok := r.data.mfa[userID]
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	return &enrollment, nil
+}
+
+func (r *MemoryMFARepository) SaveMFAEnrollment(enrollment model.MFAEnrollment) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[enrollment.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	r.data.mfa[enrollment.UserID] = enrollment
+	return nil
+}
+
+func (r *MemoryMFARepository) UseTOTPStep(userID int, step int64) error {
+	defer r.lock()()
+
+	enrollment, ok := r.data.mfa[userID]
+	if !ok || enrollment.LastStep >= step {
+		return ErrTOTPStepUsed
+	}
+	enrollment.LastStep = step
+	r.data.mfa[userID] = enrollment
+	return nil
+}
+
+func (r *MemoryMFARepository) DeleteMFAEnrollment(userID int) error {
+	defer r.lock()()
+
+	delete(r.data.mfa, userID)
+	delete(r.data.recoveryCodes, userID)
+	return nil
+}
+
+func (r *MemoryMFARepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	codes := make(map[string]struct{}, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes[hash] = struct{}{}
+	}
+	r.data.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (r *MemoryMFARepository) ConsumeRecoveryCode(userID int, codeHash string) error {
+	defer r.lock()()
+
+	codes := r.data.recoveryCodes[userID]
+	if _, ok := codes[codeHash]; !ok {
+		return ErrRecoveryCodeNotFound
+	}
+	// Copy before deleting: snapshots taken for transactions share the inner maps
+	codes = maps.Clone(codes)
+	delete(codes, codeHash)
+	r.data.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (r *MemoryMFARepository) CountRecoveryCodes(userID int) (int, error) {
+	defer r.rlock()()
+	return len(r.data.recoveryCodes[userID]), nil
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MemoryOAuthRepository implements OAuthRepository over the data of a MemoryUserRepository
+type MemoryOAuthRepository struct {
+	memoryStore
+}
+
+func NewMemoryOAuthRepository(users *MemoryUserRepository) *MemoryOAuthRepository {
+	return &MemoryOAuthRepository{users.memoryStore}
+}
+
+func (r *MemoryOAuthRepository) CreateOAuthClient(client *model.OAuthClient) error {
+	defer r.lock()()
+
+	stored := *client
+	stored.RedirectURIs = slices.Clone(client.RedirectURIs)
+	stored.GrantTypes = slices.Clone(client.GrantTypes)
+	stored.Scopes = slices.Clone(client.Scopes)
+	r.data.oauthClients[client.ID] = stored
+	return nil
+}
+
+func (r *MemoryOAuthRepository) GetOAuthClient(id string) (*model.OAuthClient, error) {
+	defer r.rlock()()
+
+	client, ok := r.data.oauthClients[id]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return &client, nil
+}
+
+func (r *MemoryOAuthRepository) ListOAuthClients() ([]model.OAuthClient, error) {
+	defer r.rlock()()
+
+	clients := slices.Collect(maps.Values(r.data.oauthClients))
+	if clients == nil {
+		clients = []model.OAuthClient{}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].CreatedAt.Equal(clients[j].CreatedAt) {
+			return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, nil
+}
+
+func (r *MemoryOAuthRepository) DeleteOAuthClient(id string) error {
+	defer r.lock()()
+
+	if _, ok := r.data.oauthClients[id]; !ok {
+		return ErrClientNotFound
+	}
+	delete(r.data.oauthClients, id)
+	// Cascade like the foreign keys of the SQL backends
+	maps.DeleteFunc(r.data.oauthCodes, func(_ string, c model.OAuthAuthorizationCode) bool { return c.ClientID == id })
+	maps.DeleteFunc(r.data.oauthTokens, func(_ string, t model.OAuthToken) bool { return t.ClientID == id })
+	return nil
+}
+
+func (r *MemoryOAuthRepository) CreateAuthorizationCode(code model.OAuthAuthorizationCode) error {
+	defer r.lock()()
+
+	if _, ok := r.data.oauthClients[code.ClientID]; !ok {
+		return ErrClientNotFound
+	}
+	if _, ok := r.data.users[code.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	r.data.oauthCodes[code.CodeHash] = code
+	return nil
+}
+
+func (r *MemoryOAuthRepository) ConsumeAuthorizationCode(codeHash string, now time.Time) (*model.OAuthAuthorizationCode, error) {
+	defer r.lock()()
+
+	maps.DeleteFunc(r.data.oauthCodes, func(_ string, c model.OAuthAuthorizationCode) bool { return !now.Before(c.ExpiresAt) })
+	code, ok := r.data.oauthCodes[codeHash]
+	if !ok {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	delete(r.data.oauthCodes, codeHash)
+	return &code, nil
+}
+
+func (r *MemoryOAuthRepository) CreateOAuthToken(token model.OAuthToken) error {
+	defer r.lock()()
+
+	if _, ok := r.data.oauthClients[token.ClientID]; !ok {
+		return ErrClientNotFound
+	}
+	if _, ok := r.data.users[token.UserID]; token.UserID != 0 && !ok {
+		return ErrUserNotFound
+	}
+	r.data.oauthTokens[token.TokenHash] = token
+	return nil
+}
+
+func (r *MemoryOAuthRepository) GetOAuthToken(tokenHash string) (*model.OAuthToken, error) {
+	defer r.rlock()()
+
+	token, ok := r.data.oauthTokens[tokenHash]
+	if !ok {
+		return nil, ErrOAuthTokenNotFound
+	}
+	return &token, nil
+}
+
+func (r *MemoryOAuthRepository) DeleteOAuthToken(tokenHash string) error {
+	defer r.lock()()
+
+	if _, ok := r.data.oauthTokens[tokenHash]; !ok {
+		return ErrOAuthTokenNotFound
+	}
+	delete(r.data.oauthTokens, tokenHash)
+	return nil
+}
+
+func (r *MemoryOAuthRepository) DeleteUserOAuthTokens(userID int) (int, error) {
+	defer r.lock()()
+
+	before := len(r.data.oauthTokens)
+	maps.DeleteFunc(r.data.oauthTokens, func(_ string, t model.OAuthToken) bool { return t.UserID == userID })
+	return before - len(r.data.oauthTokens), nil
+}
+
+func (r *MemoryOAuthRepository) DeleteExpiredOAuthTokens(now time.Time) (int, error) {
+	defer r.lock()()
+
+	before := len(r.data.oauthTokens)
+	maps.DeleteFunc(r.data.oauthTokens, func(_ string, t model.OAuthToken) bool { return !now.Before(t.ExpiresAt) })
+	return before - len(r.data.oauthTokens), nil
+}
+
+func (r *MemoryOAuthRepository) ListSigningKeys() ([]model.OAuthSigningKey, error) {
+	defer r.rlock()()
+
+	keys := slices.Collect(maps.Values(r.data.oauthSigningKeys))
+	if keys == nil {
+		keys = []model.OAuthSigningKey{}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (r *MemoryOAuthRepository) CreateSigningKey(key model.OAuthSigningKey) error {
+	defer r.lock()()
+
+	key.PrivateKey = slices.Clone(key.PrivateKey)
+	r.data.oauthSigningKeys[key.ID] = key
+	return nil
+}
+
+func (r *MemoryOAuthRepository) DeleteSigningKey(id string) error {
+	defer r.lock()()
+
+	delete(r.data.oauthSigningKeys, id)
+	return nil
+}
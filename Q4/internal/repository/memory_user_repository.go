@@ -0,0 +1,407 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/search"
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryData holds every table of the memory backend so that one snapshot covers them all
+type memoryData struct {
+	users       map[int]model.User
+	byEmail     map[string]int
+	nextID      int
+	passwords   map[int]string
+	sessions    map[string]model.Session
+	resetTokens map[string]model.PasswordResetToken
+	mfa         map[int]model.MFAEnrollment
+	// recoveryCodes holds a set of code hashes per user; the sets are replaced, never modified in place
+	recoveryCodes map[int]map[string]struct{}
+	// webauthnCredentials and webauthnChallenges are keyed by credential ID and challenge
+	webauthnCredentials map[string]model.WebAuthnCredential
+	webauthnChallenges  map[string]model.WebAuthnChallenge
+	// oauthClients and oauthSigningKeys are keyed by ID, oauthCodes and oauthTokens by hash
+	oauthClients     map[string]model.OAuthClient
+	oauthCodes       map[string]model.OAuthAuthorizationCode
+	oauthTokens      map[string]model.OAuthToken
+	oauthSigningKeys map[string]model.OAuthSigningKey
+	// servicePrincipals and apiKeys are keyed by ID
+	servicePrincipals map[string]model.ServicePrincipal
+	apiKeys           map[string]model.APIKey
+	// idempotencyKeys are keyed by idempotencyKeyID
+	idempotencyKeys map[string]model.IdempotencyKey
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		users:               maps.Clone(d.users),
+		byEmail:             maps.Clone(d.byEmail),
+		nextID:              d.nextID,
+		passwords:           maps.Clone(d.passwords),
+		sessions:            maps.Clone(d.sessions),
+		resetTokens:         maps.Clone(d.resetTokens),
+		mfa:                 maps.Clone(d.mfa),
+		recoveryCodes:       maps.Clone(d.recoveryCodes),
+		webauthnCredentials: maps.Clone(d.webauthnCredentials),
+		webauthnChallenges:  maps.Clone(d.webauthnChallenges),
+		oauthClients:        maps.Clone(d.oauthClients),
+		oauthCodes:          maps.Clone(d.oauthCodes),
+		oauthTokens:         maps.Clone(d.oauthTokens),
+		oauthSigningKeys:    maps.Clone(d.oauthSigningKeys),
+		servicePrincipals:   maps.Clone(d.servicePrincipals),
+		apiKeys:             maps.Clone(d.apiKeys),
+		idempotencyKeys:     maps.Clone(d.idempotencyKeys),
+	}
+}
+
+// memoryStore is the state shared by the memory repositories of one backend
+type memoryStore struct {
+	mu   *sync.RWMutex
+	data *memoryData
+	// inTx is set on the views handed to a transaction, which already holds the write lock
+	inTx bool
+}
+
+func (s *memoryStore) rlock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.RLock()
+	return s.mu.RUnlock
+}
+
+func (s *memoryStore) lock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// MemoryUserRepository keeps users in memory with the same semantics as SQLUserRepository:
+// generated IDs, unique emails and ErrUserNotFound for missing users. It is safe for concurrent use.
+type MemoryUserRepository struct {
+	memoryStore
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		memoryStore: memoryStore{
+			mu: &sync.RWMutex{},
+			data: &memoryData{
+				users:               make(map[int]model.User),
+				byEmail:             make(map[string]int),
+				nextID:              1,
+				passwords:           make(map[int]string),
+				sessions:            make(map[string]model.Session),
+				resetTokens:         make(map[string]model.PasswordResetToken),
+				mfa:                 make(map[int]model.MFAEnrollment),
+				recoveryCodes:       make(map[int]map[string]struct{}),
+				webauthnCredentials: make(map[string]model.WebAuthnCredential),
+				webauthnChallenges:  make(map[string]model.WebAuthnChallenge),
+				oauthClients:        make(map[string]model.OAuthClient),
+				oauthCodes:          make(map[string]model.OAuthAuthorizationCode),
+				oauthTokens:         make(map[string]model.OAuthToken),
+				oauthSigningKeys:    make(map[string]model.OAuthSigningKey),
+				servicePrincipals:   make(map[string]model.ServicePrincipal),
+				apiKeys:             make(map[string]model.APIKey),
+				idempotencyKeys:     make(map[string]model.IdempotencyKey),
+			},
+		},
+	}
+}
+
+func (mr *MemoryUserRepository) GetAllUsers() ([]model.User, error) {
+	return mr.filter(model.UserFilter{}), nil
+}
+
+func (mr *MemoryUserRepository) IterateUsers(filter model.UserFilter) (UserIterator, error) {
+	return &sliceUserIterator{users: mr.filter(filter), pos: -1}, nil
+}
+
+// filter returns a snapshot of the matching users ordered by ID
+func (mr *MemoryUserRepository) filter(filter model.UserFilter) []model.User {
+	defer mr.rlock()()
+
+	name, email := strings.ToLower(filter.Name), strings.ToLower(filter.Email)
+	var users []model.User
+	for _, user := range mr.data.users {
+		if name != "" && !strings.Contains(strings.ToLower(user.Name), name) {
+			continue
+		}
+		if email != "" && !strings.Contains(strings.ToLower(user.Email), email) {
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (mr *MemoryUserRepository) GetUserByID(id int) (*model.User, error) {
+	defer mr.rlock()()
+
+	user, ok := mr.data.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (mr *MemoryUserRepository) GetUsersByIDs(ids []int) ([]model.User, error) {
+	defer mr.rlock()()
+
+	users := []model.User{}
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if user, ok := mr.data.users[id]; ok && !seen[id] {
+			seen[id] = true
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (mr *MemoryUserRepository) GetUserByEmail(email string) (*model.User, error) {
+	defer mr.rlock()()
+
+	id, ok := mr.data.byEmail[email]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := mr.data.users[id]
+	return &user, nil
+}
+
+func (mr *MemoryUserRepository) CreateUser(user *model.User) error {
+	defer mr.lock()()
+	return mr.insert(user)
+}
+
+func (mr *MemoryUserRepository) insert(user *model.User) error {
+	if _, taken := mr.data.byEmail[user.Email]; taken {
+		return fmt.Errorf("%w: %s", ErrDuplicateEmail, user.Email)
+	}
+	user.ID = mr.data.nextID
+	user.EmailVerified = false
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
+	mr.data.nextID++
+	mr.data.users[user.ID] = *user
+	mr.data.byEmail[user.Email] = user.ID
+	return nil
+}
+
+// UpdateUser is a no-op for unknown IDs, matching an UPDATE that affects no rows
+func (mr *MemoryUserRepository) UpdateUser(user *model.User) error {
+	defer mr.lock()()
+
+	current, ok := mr.data.users[user.ID]
+	if !ok {
+		return nil
+	}
+	if owner, taken := mr.data.byEmail[user.Email]; taken && owner != user.ID {
+		return fmt.Errorf("%w: %s", ErrDuplicateEmail, user.Email)
+	}
+	updated := *user
+	updated.EmailVerified = current.EmailVerified && current.Email == user.Email
+	if updated.Role == "" {
+		updated.Role = current.Role
+	}
+	delete(mr.data.byEmail, current.Email)
+	mr.data.users[user.ID] = updated
+	mr.data.byEmail[user.Email] = user.ID
+	return nil
+}
+
+func (mr *MemoryUserRepository) DeleteUser(id int) error {
+	defer mr.lock()()
+
+	if user, ok := mr.data.users[id]; ok {
+		delete(mr.data.byEmail, user.Email)
+		delete(mr.data.users, id)
+		// Cascade like the foreign keys of the SQL backends
+		delete(mr.data.passwords, id)
+		maps.DeleteFunc(mr.data.sessions, func(_ string, s model.Session) bool { return s.UserID == id })
+		maps.DeleteFunc(mr.data.resetTokens, func(_ string, t model.PasswordResetToken) bool { return t.UserID == id })
+		delete(mr.data.mfa, id)
+		delete(mr.data.recoveryCodes, id)
+		maps.DeleteFunc(mr.data.webauthnCredentials, func(_ string, c model.WebAuthnCredential) bool { return c.UserID == id })
+		maps.DeleteFunc(mr.data.webauthnChallenges, func(_ string, c model.WebAuthnChallenge) bool { return c.UserID == id })
+		maps.DeleteFunc(mr.data.oauthCodes, func(_ string, c model.OAuthAuthorizationCode) bool { return c.UserID == id })
+		maps.DeleteFunc(mr.data.oauthTokens, func(_ string, t model.OAuthToken) bool { return t.UserID == id })
+	}
+	return nil
+}
+
+func (mr *MemoryUserRepository) MarkEmailVerified(id int, email string) error {
+	defer mr.lock()()
+
+	user, ok := mr.data.users[id]
+	if !ok || user.Email != email {
+		return ErrUserNotFound
+	}
+	user.EmailVerified = true
+	mr.data.users[id] = user
+	return nil
+}
+
+func (mr *MemoryUserRepository) UpsertUsers(users []model.User) ([]UpsertResult, error) {
+	defer mr.lock()()
+
+	snapshot := mr.data.clone()
+	results := make([]UpsertResult, 0, len(users))
+	for _, user := range users {
+		if id, ok := mr.data.byEmail[user.Email]; ok {
+			existing := mr.data.users[id]
+			existing.Name = user.Name
+			mr.data.users[id] = existing
+			results = append(results, UpsertResult{ID: id})
+			continue
+		}
+		if err := mr.insert(&user); err != nil {
+			*mr.data = *snapshot
+			return nil, err
+		}
+		results = append(results, UpsertResult{ID: user.ID, Created: true})
+	}
+	return results, nil
+}
+
+type sliceUserIterator struct {
+	users []model.User
+	pos   int
+}
+
+func (it *sliceUserIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.users)
+}
+
+func (it *sliceUserIterator) User() model.User {
+	return it.users[it.pos]
+}
+
+func (it *sliceUserIterator) Err() error {
+	return nil
+}
+
+func (it *sliceUserIterator) Close() error {
+	return nil
+}
+
+// MemoryTxManager gives transactions over a MemoryUserRepository by holding its write lock for the
+// whole closure and restoring a snapshot on failure. Like SQLite, it allows a single writer at a time.
+type MemoryTxManager struct {
+	Repo *MemoryUserRepository
+}
+
+func NewMemoryTxManager(repo *MemoryUserRepository) *MemoryTxManager {
+	return &MemoryTxManager{
+		Repo: repo,
+	}
+}
+
+type memoryTxKey struct{}
+
+func (m *MemoryTxManager) WithinTx(ctx context.Context, fn func(ctx context.Context, repos Repositories) error) (err error) {
+	view, nested := ctx.Value(memoryTxKey{}).(*MemoryUserRepository)
+	if !nested {
+		m.Repo.mu.Lock()
+		defer m.Repo.mu.Unlock()
+		view = &MemoryUserRepository{memoryStore: memoryStore{mu: m.Repo.mu, data: m.Repo.data, inTx: true}}
+		ctx = context.WithValue(ctx, memoryTxKey{}, view)
+	}
+
+	snapshot := view.data.clone()
+	restore := func() {
+		// Copy the snapshot in place so outer views keep pointing at the live data
+		*view.data = *snapshot
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			restore()
+			panic(p)
+		}
+	}()
+
+	repos := Repositories{
+		Users:       view,
+		Passwords:   &MemoryPasswordRepository{view.memoryStore},
+		Sessions:    &MemorySessionRepository{view.memoryStore},
+		ResetTokens: &MemoryPasswordResetRepository{view.memoryStore},
+		MFA:         &MemoryMFARepository{view.memoryStore},
+		WebAuthn:    &MemoryWebAuthnRepository{view.memoryStore},
+		OAuth:       &MemoryOAuthRepository{view.memoryStore},
+		APIKeys:     &MemoryAPIKeyRepository{view.memoryStore},
+	}
+	if err := fn(ctx, repos); err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// SearchUsers matches every query token as a word prefix of the name or email, scoring name
+// matches above email matches, and falls back to trigram similarity when nothing matches
+func (mr *MemoryUserRepository) SearchUsers(query SearchQuery) (*SearchResult, error) {
+	tokens := search.Tokenize(query.Text)
+	if len(tokens) == 0 {
+		return &SearchResult{Hits: []SearchHit{}}, nil
+	}
+
+	users := mr.filter(model.UserFilter{})
+
+	var hits []SearchHit
+	for _, user := range users {
+		nameWords, emailWords := search.Tokenize(user.Name), search.Tokenize(user.Email)
+		score, matched := 0.0, true
+		for _, token := range tokens {
+			switch {
+			case hasWordPrefix(nameWords, token):
+				score += 2
+			case hasWordPrefix(emailWords, token):
+				score++
+			default:
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+		hits = append(hits, SearchHit{
+			User:           user,
+			Score:          score,
+			NameHighlight:  search.Highlight(search.MarkPrefixes(user.Name, tokens)),
+			EmailHighlight: search.Highlight(search.MarkPrefixes(user.Email, tokens)),
+		})
+	}
+
+	if len(hits) == 0 {
+		return rankFuzzy(query.Text, users, query.Limit, query.Offset), nil
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	result := &SearchResult{Total: len(hits), Hits: []SearchHit{}}
+	if query.Offset < len(hits) {
+		result.Hits = hits[query.Offset:min(query.Offset+query.Limit, len(hits))]
+	}
+	return result, nil
+}
+
+func hasWordPrefix(words []string, prefix string) bool {
+	for _, word := range words {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MemoryWebAuthnRepository implements WebAuthnRepository over the data of a MemoryUserRepository
+type MemoryWebAuthnRepository struct {
+	memoryStore
+}
+
+func NewMemoryWebAuthnRepository(users *MemoryUserRepository) *MemoryWebAuthnRepository {
+	return &MemoryWebAuthnRepository{users.memoryStore}
+}
+
+func (r *MemoryWebAuthnRepository) CreateWebAuthnCredential(credential *model.WebAuthnCredential) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[credential.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := r.data.webauthnCredentials[credential.ID]; ok {
+		return ErrDuplicateCredential
+	}
+	stored := *credential
+	stored.PublicKey = slices.Clone(credential.PublicKey)
+	stored.Transports = slices.Clone(credential.Transports)
+	stored.LastUsedAt = nil
+	r.data.webauthnCredentials[credential.ID] = stored
+	return nil
+}
+
+func (r *MemoryWebAuthnRepository) GetWebAuthnCredential(id string) (*model.WebAuthnCredential, error) {
+	defer r.rlock()()
+
+	credential, ok := r.data.webauthnCredentials[id]
+	if !ok {
+		return nil, ErrCredentialNotFound
+	}
+	return &credential, nil
+}
+
+func (r *MemoryWebAuthnRepository) ListWebAuthnCredentials(userID int) ([]model.WebAuthnCredential, error) {
+	defer r.rlock()()
+
+	credentials := []model.WebAuthnCredential{}
+	for _, credential := range r.data.webauthnCredentials {
+		if credential.UserID == userID {
+			credentials = append(credentials, credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		if !credentials[i].CreatedAt.Equal(credentials[j].CreatedAt) {
+			return credentials[i].CreatedAt.Before(credentials[j].CreatedAt)
+		}
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials, nil
+}
+
+func (r *MemoryWebAuthnRepository) UpdateWebAuthnSignCount(id string, signCount uint32, usedAt time.Time) error {
+	defer r.lock()()
+
+	credential, ok := r.data.webauthnCredentials[id]
+	if !ok {
+		return ErrCredentialNotFound
+	}
+	if credential.SignCount >= signCount && (credential.SignCount != 0 || signCount != 0) {
+		return ErrSignCountStale
+	}
+	credential.SignCount = signCount
+	credential.LastUsedAt = &usedAt
+	r.data.webauthnCredentials[id] = credential
+	return nil
+}
+
+func (r *MemoryWebAuthnRepository) DeleteWebAuthnCredential(userID int, id string) error {
+	defer r.lock()()
+
+	credential, ok := r.data.webauthnCredentials[id]
+	if !ok || credential.UserID != userID {
+		return ErrCredentialNotFound
+	}
+	delete(r.data.webauthnCredentials, id)
+	return nil
+}
+
+func (r *MemoryWebAuthnRepository) CreateWebAuthnChallenge(challenge model.WebAuthnChallenge) error {
+	defer r.lock()()
+
+	if _, ok := r.data.users[challenge.UserID]; challenge.UserID != 0 && !ok {
+		return ErrUserNotFound
+	}
+	r.data.webauthnChallenges[challenge.Challenge] = challenge
+	return nil
+}
+
+func (r *MemoryWebAuthnRepository) ConsumeWebAuthnChallenge(challenge string, now time.Time) (*model.WebAuthnChallenge, error) {
+	defer r.lock()()
+
+	maps.DeleteFunc(r.data.webauthnChallenges, func(_ string, c model.WebAuthnChallenge) bool { return !now.Before(c.ExpiresAt) })
+	found, ok := r.data.webauthnChallenges[challenge]
+	if !ok {
+		return nil, ErrChallengeNotFound
+	}
+	delete(r.data.webauthnChallenges, challenge)
+	return &found, nil
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"Q4/internal/model"
+	"Q4/internal/repository"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -12,11 +13,41 @@ type MockUserRepository struct {
 
 func (m *MockUserRepository) GetAllUsers() ([]model.User, error) {
 	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
 	return args.Get(0).([]model.User), args.Error(1)
 }
 
+func (m *MockUserRepository) IterateUsers(filter model.UserFilter) (repository.UserIterator, error) {
+	args := m.Called(filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(repository.UserIterator), args.Error(1)
+}
+
 func (m *MockUserRepository) GetUserByID(id int) (*model.User, error) {
 	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.User), args.Error(1)
+}
+
+func (m *MockUserRepository) GetUsersByIDs(ids []int) ([]model.User, error) {
+	args := m.Called(ids)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.User), args.Error(1)
+}
+
+func (m *MockUserRepository) GetUserByEmail(email string) (*model.User, error) {
+	args := m.Called(email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
 	return args.Get(0).(*model.User), args.Error(1)
 }
 
@@ -34,3 +65,16 @@ func (m *MockUserRepository) DeleteUser(id int) error {
 	args := m.Called(id)
 	return args.Error(0)
 }
+
+func (m *MockUserRepository) MarkEmailVerified(id int, email string) error {
+	args := m.Called(id, email)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) UpsertUsers(users []model.User) ([]repository.UpsertResult, error) {
+	args := m.Called(users)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]repository.UpsertResult), args.Error(1)
+}
@@ -0,0 +1,241 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PostgreSQL error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation      = "23505"
+	pgForeignKeyViolation  = "23503"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+type PostgresUserRepository struct {
+	DB *sql.DB
+	tx *sql.Tx
+}
+
+func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{
+		DB: db,
+	}
+}
+
+// WithTx returns a copy of the repository whose queries run inside tx
+func (pr *PostgresUserRepository) WithTx(tx *sql.Tx) *PostgresUserRepository {
+	return &PostgresUserRepository{
+		DB: pr.DB,
+		tx: tx,
+	}
+}
+
+func (pr *PostgresUserRepository) conn() DBTX {
+	if pr.tx != nil {
+		return pr.tx
+	}
+	return pr.DB
+}
+
+func (pr *PostgresUserRepository) GetAllUsers() ([]model.User, error) {
+	it, err := pr.IterateUsers(model.UserFilter{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var users []model.User
+	for it.Next() {
+		users = append(users, it.User())
+	}
+	return users, it.Err()
+}
+
+// IterateUsers streams the users matching filter ordered by ID without loading them all into memory
+func (pr *PostgresUserRepository) IterateUsers(filter model.UserFilter) (UserIterator, error) {
+	query := "SELECT " + userColumns + " FROM users"
+	var conditions []string
+	var args []any
+	if filter.Name != "" {
+		args = append(args, "%"+escapeLike(filter.Name)+"%")
+		conditions = append(conditions, "name ILIKE $"+strconv.Itoa(len(args)))
+	}
+	if filter.Email != "" {
+		args = append(args, "%"+escapeLike(filter.Email)+"%")
+		conditions = append(conditions, "email ILIKE $"+strconv.Itoa(len(args)))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id;"
+
+	rows, err := pr.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlUserIterator{rows: rows}, nil
+}
+
+func (pr *PostgresUserRepository) GetUserByID(id int) (*model.User, error) {
+	return pr.getUser("SELECT "+userColumns+" FROM users WHERE id = $1;", id)
+}
+
+func (pr *PostgresUserRepository) GetUsersByIDs(ids []int) ([]model.User, error) {
+	rows, err := pr.conn().Query("SELECT "+userColumns+" FROM users WHERE id = ANY($1) ORDER BY id;", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []model.User{}
+	for rows.Next() {
+		var user model.User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (pr *PostgresUserRepository) GetUserByEmail(email string) (*model.User, error) {
+	return pr.getUser("SELECT "+userColumns+" FROM users WHERE email = $1;", email)
+}
+
+func (pr *PostgresUserRepository) getUser(query string, arg any) (*model.User, error) {
+	var user model.User
+	if err := scanUser(pr.conn().QueryRow(query, arg), &user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (pr *PostgresUserRepository) CreateUser(user *model.User) error {
+	user.EmailVerified = false
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
+	err := pr.conn().QueryRow("INSERT INTO users (name, email, role) VALUES ($1, $2, $3) RETURNING id;", user.Name, user.Email, user.Role).Scan(&user.ID)
+	return mapPostgresError(err)
+}
+
+// UpdateUser writes the name, email and, unless it is empty, the role; changing the email clears email_verified
+func (pr *PostgresUserRepository) UpdateUser(user *model.User) error {
+	_, err := pr.conn().Exec(`
+		UPDATE users SET
+			name = $1,
+			email = $2,
+			role = COALESCE(NULLIF($3, ''), role),
+			email_verified = email_verified AND email = $2
+		WHERE id = $4;`, user.Name, user.Email, user.Role, user.ID)
+	return mapPostgresError(err)
+}
+
+func (pr *PostgresUserRepository) DeleteUser(id int) error {
+	_, err := pr.conn().Exec("DELETE FROM users WHERE id = $1;", id)
+	return err
+}
+
+func (pr *PostgresUserRepository) MarkEmailVerified(id int, email string) error {
+	res, err := pr.conn().Exec("UPDATE users SET email_verified = TRUE WHERE id = $1 AND email = $2;", id, email)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (pr *PostgresUserRepository) UpsertUsers(users []model.User) ([]UpsertResult, error) {
+	if pr.tx != nil {
+		return upsertPostgresUsers(pr.tx, users)
+	}
+
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := upsertPostgresUsers(tx, users)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// upsertPostgresUsers relies on xmax being zero only for rows inserted by the current statement
+// to tell inserts apart from updates in a single round trip per user
+func upsertPostgresUsers(tx *sql.Tx, users []model.User) ([]UpsertResult, error) {
+	stmt, err := tx.Prepare(`
+		INSERT INTO users (name, email) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id, (xmax = 0) AS inserted;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	results := make([]UpsertResult, 0, len(users))
+	for _, user := range users {
+		var result UpsertResult
+		if err := stmt.QueryRow(user.Name, user.Email).Scan(&result.ID, &result.Created); err != nil {
+			return nil, mapPostgresError(err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// mapPostgresError translates driver errors into the repository's sentinel errors
+func mapPostgresError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return fmt.Errorf("%w: %v", ErrDuplicateEmail, err)
+	}
+	return err
+}
+
+// IsPostgresRetryable reports whether err is a serialization failure or deadlock that succeeds when retried
+func IsPostgresRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == pgSerializationFailure || pqErr.Code == pgDeadlockDetected
+}
+
+// NewPostgresTxManager returns a transaction manager for PostgreSQL that retries serialization failures
+func NewPostgresTxManager(db *sql.DB) *SQLTxManager {
+	return &SQLTxManager{
+		DB: db,
+		Bind: func(tx *sql.Tx) Repositories {
+			return Repositories{
+				Users:       NewPostgresUserRepository(db).WithTx(tx),
+				Passwords:   NewPostgresPasswordRepository(tx),
+				Sessions:    NewPostgresSessionRepository(tx),
+				ResetTokens: NewPostgresPasswordResetRepository(tx),
+				MFA:         NewPostgresMFARepository(tx),
+				WebAuthn:    NewPostgresWebAuthnRepository(tx),
+				OAuth:       NewPostgresOAuthRepository(tx),
+				APIKeys:     NewPostgresAPIKeyRepository(tx),
+			}
+		},
+		Retryable:  IsPostgresRetryable,
+		MaxRetries: DefaultTxMaxRetries,
+		RetryDelay: DefaultTxRetryDelay,
+	}
+}
@@ -0,0 +1,917 @@
+// Package repositorytest holds the conformance suite every UserRepository implementation must pass
+package repositorytest
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewStoreFunc returns an empty store; it is called once per subtest
+type NewStoreFunc func(t *testing.T) *repository.Store
+
+// RunUserRepositorySuite checks that a storage backend behaves like the SQLite one
+func RunUserRepositorySuite(t *testing.T, newStore NewStoreFunc) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store *repository.Store)
+	}{
+		{"CreateAssignsIDs", testCreateAssignsIDs},
+		{"NotFound", testNotFound},
+		{"DuplicateEmail", testDuplicateEmail},
+		{"GetUsersByIDs", testGetUsersByIDs},
+		{"UpdateAndDelete", testUpdateAndDelete},
+		{"Roles", testRoles},
+		{"IterateUsersFilter", testIterateUsersFilter},
+		{"UpsertUsers", testUpsertUsers},
+		{"EmailVerification", testEmailVerification},
+		{"Passwords", testPasswords},
+		{"Sessions", testSessions},
+		{"ResetTokens", testResetTokens},
+		{"MFA", testMFA},
+		{"RecoveryCodes", testRecoveryCodes},
+		{"WebAuthnCredentials", testWebAuthnCredentials},
+		{"WebAuthnChallenges", testWebAuthnChallenges},
+		{"OAuthClients", testOAuthClients},
+		{"OAuthCodes", testOAuthCodes},
+		{"OAuthTokens", testOAuthTokens},
+		{"OAuthSigningKeys", testOAuthSigningKeys},
+		{"ServicePrincipals", testServicePrincipals},
+		{"APIKeys", testAPIKeys},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"DeleteUserCascades", testDeleteUserCascades},
+		{"TxCoversCredentials", testTxCoversCredentials},
+		{"TxRollback", testTxRollback},
+		{"TxNestedSavepoint", testTxNestedSavepoint},
+		{"TxPanic", testTxPanic},
+		{"ConcurrentCreates", testConcurrentCreates},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStore(t))
+		})
+	}
+}
+
+func mustCreate(t *testing.T, repo repository.UserRepository, name, email string) model.User {
+	t.Helper()
+	user := model.User{Name: name, Email: email}
+	require.NoError(t, repo.CreateUser(&user))
+	return user
+}
+
+func testCreateAssignsIDs(t *testing.T, store *repository.Store) {
+	first := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	second := mustCreate(t, store.Users, "Ayse", "ayse@example.com")
+
+	assert.NotZero(t, first.ID)
+	assert.Greater(t, second.ID, first.ID)
+
+	found, err := store.Users.GetUserByID(second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, second, *found)
+
+	found, err = store.Users.GetUserByEmail("ahmet@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, first, *found)
+}
+
+func testNotFound(t *testing.T, store *repository.Store) {
+	_, err := store.Users.GetUserByID(12345)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	_, err = store.Users.GetUserByEmail("nobody@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	users, err := store.Users.GetAllUsers()
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func testDuplicateEmail(t *testing.T, store *repository.Store) {
+	mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	other := mustCreate(t, store.Users, "Ayse", "ayse@example.com")
+
+	err := store.Users.CreateUser(&model.User{Name: "Copy", Email: "ahmet@example.com"})
+	assert.ErrorIs(t, err, repository.ErrDuplicateEmail)
+
+	other.Email = "ahmet@example.com"
+	err = store.Users.UpdateUser(&other)
+	assert.ErrorIs(t, err, repository.ErrDuplicateEmail)
+}
+
+func testGetUsersByIDs(t *testing.T, store *repository.Store) {
+	ahmet := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	ayse := mustCreate(t, store.Users, "Ayşe", "ayse@example.com")
+	mustCreate(t, store.Users, "Mehmet", "mehmet@example.com")
+
+	users, err := store.Users.GetUsersByIDs([]int{ayse.ID, 12345, ahmet.ID, ayse.ID})
+	require.NoError(t, err)
+	assert.Equal(t, []model.User{ahmet, ayse}, users, "ordered by ID, without unknown IDs or repeats")
+
+	users, err = store.Users.GetUsersByIDs(nil)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func testUpdateAndDelete(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+
+	user.Name, user.Email = "Ahmet Y.", "ahmet.y@example.com"
+	require.NoError(t, store.Users.UpdateUser(&user))
+
+	found, err := store.Users.GetUserByEmail("ahmet.y@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user, *found)
+	_, err = store.Users.GetUserByEmail("ahmet@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	require.NoError(t, store.Users.DeleteUser(user.ID))
+	_, err = store.Users.GetUserByID(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	assert.NoError(t, store.Users.DeleteUser(user.ID), "deleting a missing user is not an error")
+}
+
+func testRoles(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	assert.Equal(t, model.RoleUser, user.Role, "users without a role get the default one")
+
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	require.NoError(t, store.Users.CreateUser(&admin))
+
+	admin.Name, admin.Role = "Ayse Y.", ""
+	require.NoError(t, store.Users.UpdateUser(&admin))
+	found, err := store.Users.GetUserByID(admin.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, found.Role, "updates without a role keep the current one")
+
+	found.Role = model.RoleUser
+	require.NoError(t, store.Users.UpdateUser(found))
+	found, err = store.Users.GetUserByID(admin.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleUser, found.Role)
+}
+
+func testIterateUsersFilter(t *testing.T, store *repository.Store) {
+	ahmet := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	mustCreate(t, store.Users, "Ayse", "ayse@example.org")
+	underscored := mustCreate(t, store.Users, "a_b", "ab@example.com")
+	mustCreate(t, store.Users, "axb", "axb@example.org")
+
+	collect := func(filter model.UserFilter) []model.User {
+		it, err := store.Users.IterateUsers(filter)
+		require.NoError(t, err)
+		defer it.Close()
+
+		var users []model.User
+		for it.Next() {
+			users = append(users, it.User())
+		}
+		require.NoError(t, it.Err())
+		return users
+	}
+
+	assert.Len(t, collect(model.UserFilter{}), 4)
+	assert.Equal(t, []model.User{ahmet, underscored}, collect(model.UserFilter{Email: "EXAMPLE.COM"}))
+	assert.Equal(t, []model.User{ahmet}, collect(model.UserFilter{Name: "hm", Email: ".com"}))
+	assert.Equal(t, []model.User{underscored}, collect(model.UserFilter{Name: "_"}), "wildcards must be matched literally")
+	assert.Empty(t, collect(model.UserFilter{Name: "%"}))
+}
+
+func testUpsertUsers(t *testing.T, store *repository.Store) {
+	existing := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+
+	results, err := store.Users.UpsertUsers([]model.User{
+		{Name: "Ayse", Email: "ayse@example.com"},
+		{Name: "Ahmet Y.", Email: "ahmet@example.com"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.True(t, results[0].Created)
+	assert.NotZero(t, results[0].ID)
+	assert.Equal(t, repository.UpsertResult{ID: existing.ID}, results[1])
+
+	found, err := store.Users.GetUserByID(existing.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Ahmet Y.", found.Name)
+}
+
+func testEmailVerification(t *testing.T, store *repository.Store) {
+	user := model.User{Name: "Ahmet", Email: "ahmet@example.com", EmailVerified: true}
+	require.NoError(t, store.Users.CreateUser(&user))
+	assert.False(t, user.EmailVerified, "new users start unverified")
+
+	err := store.Users.MarkEmailVerified(user.ID, "other@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound, "the email must still match")
+	err = store.Users.MarkEmailVerified(user.ID+1000, user.Email)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	require.NoError(t, store.Users.MarkEmailVerified(user.ID, user.Email))
+	found, err := store.Users.GetUserByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, found.EmailVerified)
+
+	found.Name = "Ahmet Y."
+	found.EmailVerified = false
+	require.NoError(t, store.Users.UpdateUser(found))
+	found, err = store.Users.GetUserByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, found.EmailVerified, "updates cannot clear the flag while the email is unchanged")
+
+	found.Email = "ahmet.y@example.com"
+	require.NoError(t, store.Users.UpdateUser(found))
+	found, err = store.Users.GetUserByID(user.ID)
+	require.NoError(t, err)
+	assert.False(t, found.EmailVerified, "changing the email requires verifying it again")
+}
+
+func newSession(id string, userID int, now time.Time) *model.Session {
+	return &model.Session{
+		ID:         id,
+		UserID:     userID,
+		TokenHash:  "hash-" + id,
+		Device:     "Firefox on Linux",
+		UserAgent:  "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+		IP:         "192.0.2.1",
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+}
+
+func testPasswords(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+
+	_, err := store.Passwords.GetPasswordHash(user.ID)
+	assert.ErrorIs(t, err, repository.ErrPasswordNotSet)
+
+	require.NoError(t, store.Passwords.SetPasswordHash(user.ID, "first"))
+	require.NoError(t, store.Passwords.SetPasswordHash(user.ID, "second"))
+	hash, err := store.Passwords.GetPasswordHash(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "second", hash)
+
+	err = store.Passwords.SetPasswordHash(user.ID+1000, "orphan")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func testSessions(t *testing.T, store *repository.Store) {
+	ahmet := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	ayse := mustCreate(t, store.Users, "Ayse", "ayse@example.com")
+	now := time.Unix(1700000000, 0)
+
+	for _, session := range []*model.Session{
+		newSession("a1", ahmet.ID, now),
+		newSession("a2", ahmet.ID, now),
+		newSession("a3", ahmet.ID, now),
+		newSession("b1", ayse.ID, now),
+	} {
+		require.NoError(t, store.Sessions.CreateSession(session))
+	}
+	err := store.Sessions.CreateSession(newSession("x", ahmet.ID+1000, now))
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	found, err := store.Sessions.GetSessionByTokenHash("hash-a1")
+	require.NoError(t, err)
+	assert.Equal(t, *newSession("a1", ahmet.ID, now), *found)
+
+	require.NoError(t, store.Sessions.TouchSession("a1", now.Add(time.Minute)))
+	found, err = store.Sessions.GetSessionByTokenHash("hash-a1")
+	require.NoError(t, err)
+	assert.True(t, found.LastSeenAt.Equal(now.Add(time.Minute)))
+
+	listed, err := store.Sessions.ListUserSessions(ahmet.ID)
+	require.NoError(t, err)
+	require.Len(t, listed, 3)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, []string{listed[0].ID, listed[1].ID, listed[2].ID}, "most recently seen first")
+	assert.Equal(t, "192.0.2.1", listed[1].IP)
+	listed, err = store.Sessions.ListUserSessions(ahmet.ID + 1000)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+
+	require.NoError(t, store.Sessions.DeleteSession("a2"))
+	_, err = store.Sessions.GetSessionByTokenHash("hash-a2")
+	assert.ErrorIs(t, err, repository.ErrSessionNotFound)
+
+	revoked, err := store.Sessions.DeleteUserSessions(ahmet.ID, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	_, err = store.Sessions.GetSessionByTokenHash("hash-a1")
+	assert.NoError(t, err, "the excepted session survives")
+
+	revoked, err = store.Sessions.DeleteUserSessions(ahmet.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	_, err = store.Sessions.GetSessionByTokenHash("hash-b1")
+	assert.NoError(t, err, "other users keep their sessions")
+}
+
+func testResetTokens(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+
+	for _, token := range []model.PasswordResetToken{
+		{TokenHash: "valid", UserID: user.ID, ExpiresAt: now.Add(time.Hour)},
+		{TokenHash: "expired", UserID: user.ID, ExpiresAt: now},
+		{TokenHash: "other", UserID: user.ID, ExpiresAt: now.Add(time.Hour)},
+	} {
+		require.NoError(t, store.ResetTokens.CreateResetToken(token))
+	}
+
+	userID, err := store.ResetTokens.ConsumeResetToken("valid", now)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, userID)
+
+	_, err = store.ResetTokens.ConsumeResetToken("valid", now)
+	assert.ErrorIs(t, err, repository.ErrResetTokenNotFound, "tokens are single-use")
+	_, err = store.ResetTokens.ConsumeResetToken("expired", now)
+	assert.ErrorIs(t, err, repository.ErrResetTokenNotFound)
+	_, err = store.ResetTokens.ConsumeResetToken("unknown", now)
+	assert.ErrorIs(t, err, repository.ErrResetTokenNotFound)
+
+	require.NoError(t, store.ResetTokens.DeleteUserResetTokens(user.ID))
+	_, err = store.ResetTokens.ConsumeResetToken("other", now)
+	assert.ErrorIs(t, err, repository.ErrResetTokenNotFound)
+}
+
+func testMFA(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+
+	_, err := store.MFA.GetMFAEnrollment(user.ID)
+	assert.ErrorIs(t, err, repository.ErrMFANotEnrolled)
+	err = store.MFA.SaveMFAEnrollment(model.MFAEnrollment{UserID: user.ID + 1000, Secret: "S", CreatedAt: now})
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	pending := model.MFAEnrollment{UserID: user.ID, Secret: "PENDING", CreatedAt: now}
+	require.NoError(t, store.MFA.SaveMFAEnrollment(pending))
+	found, err := store.MFA.GetMFAEnrollment(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, pending, *found)
+	assert.False(t, found.Confirmed())
+
+	confirmedAt := now.Add(time.Minute)
+	confirmed := model.MFAEnrollment{UserID: user.ID, Secret: "SECRET", ConfirmedAt: &confirmedAt, LastStep: 100, CreatedAt: now}
+	require.NoError(t, store.MFA.SaveMFAEnrollment(confirmed))
+	found, err = store.MFA.GetMFAEnrollment(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, confirmed, *found)
+
+	assert.ErrorIs(t, store.MFA.UseTOTPStep(user.ID, 100), repository.ErrTOTPStepUsed)
+	assert.ErrorIs(t, store.MFA.UseTOTPStep(user.ID, 99), repository.ErrTOTPStepUsed)
+	require.NoError(t, store.MFA.UseTOTPStep(user.ID, 101))
+	assert.ErrorIs(t, store.MFA.UseTOTPStep(user.ID, 101), repository.ErrTOTPStepUsed, "a code works once")
+	assert.ErrorIs(t, store.MFA.UseTOTPStep(user.ID+1000, 1), repository.ErrTOTPStepUsed)
+
+	require.NoError(t, store.MFA.ReplaceRecoveryCodes(user.ID, []string{"c1"}))
+	require.NoError(t, store.MFA.DeleteMFAEnrollment(user.ID))
+	_, err = store.MFA.GetMFAEnrollment(user.ID)
+	assert.ErrorIs(t, err, repository.ErrMFANotEnrolled)
+	n, err := store.MFA.CountRecoveryCodes(user.ID)
+	require.NoError(t, err)
+	assert.Zero(t, n, "disabling MFA drops the recovery codes")
+}
+
+func testRecoveryCodes(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	other := mustCreate(t, store.Users, "Ayse", "ayse@example.com")
+
+	assert.ErrorIs(t, store.MFA.ReplaceRecoveryCodes(user.ID+1000, []string{"c1"}), repository.ErrUserNotFound)
+	require.NoError(t, store.MFA.ReplaceRecoveryCodes(user.ID, []string{"c1", "c2", "c3"}))
+	require.NoError(t, store.MFA.ReplaceRecoveryCodes(other.ID, []string{"c4"}))
+
+	require.NoError(t, store.MFA.ConsumeRecoveryCode(user.ID, "c2"))
+	assert.ErrorIs(t, store.MFA.ConsumeRecoveryCode(user.ID, "c2"), repository.ErrRecoveryCodeNotFound, "codes work once")
+	assert.ErrorIs(t, store.MFA.ConsumeRecoveryCode(user.ID, "c4"), repository.ErrRecoveryCodeNotFound, "codes belong to one user")
+
+	n, err := store.MFA.CountRecoveryCodes(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	require.NoError(t, store.MFA.ReplaceRecoveryCodes(user.ID, []string{"c5"}))
+	assert.ErrorIs(t, store.MFA.ConsumeRecoveryCode(user.ID, "c1"), repository.ErrRecoveryCodeNotFound, "replacing drops the old codes")
+	assert.NoError(t, store.MFA.ConsumeRecoveryCode(user.ID, "c5"))
+}
+
+func newWebAuthnCredential(id string, userID int, now time.Time) *model.WebAuthnCredential {
+	return &model.WebAuthnCredential{
+		ID:                id,
+		UserID:            userID,
+		Name:              "Laptop",
+		PublicKey:         []byte{0xa5, 0x01, 0x02},
+		SignCount:         3,
+		AAGUID:            "00000000-0000-0000-0000-000000000000",
+		AttestationFormat: "none",
+		Transports:        []string{"internal", "hybrid"},
+		CreatedAt:         now,
+	}
+}
+
+func testWebAuthnCredentials(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	other := mustCreate(t, store.Users, "Ayse", "ayse@example.com")
+	now := time.Unix(1700000000, 0)
+
+	laptop := newWebAuthnCredential("cred1", user.ID, now)
+	require.NoError(t, store.WebAuthn.CreateWebAuthnCredential(laptop))
+	phone := newWebAuthnCredential("cred2", user.ID, now.Add(time.Minute))
+	phone.Transports = nil
+	require.NoError(t, store.WebAuthn.CreateWebAuthnCredential(phone))
+	assert.ErrorIs(t, store.WebAuthn.CreateWebAuthnCredential(newWebAuthnCredential("cred1", other.ID, now)), repository.ErrDuplicateCredential,
+		"credential IDs are unique across users")
+	assert.ErrorIs(t, store.WebAuthn.CreateWebAuthnCredential(newWebAuthnCredential("cred3", user.ID+1000, now)), repository.ErrUserNotFound)
+
+	found, err := store.WebAuthn.GetWebAuthnCredential("cred1")
+	require.NoError(t, err)
+	assert.Equal(t, *laptop, *found)
+	_, err = store.WebAuthn.GetWebAuthnCredential("missing")
+	assert.ErrorIs(t, err, repository.ErrCredentialNotFound)
+
+	list, err := store.WebAuthn.ListWebAuthnCredentials(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []model.WebAuthnCredential{*laptop, *phone}, list)
+	list, err = store.WebAuthn.ListWebAuthnCredentials(other.ID)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	usedAt := now.Add(time.Hour)
+	assert.ErrorIs(t, store.WebAuthn.UpdateWebAuthnSignCount("cred1", 3, usedAt), repository.ErrSignCountStale)
+	require.NoError(t, store.WebAuthn.UpdateWebAuthnSignCount("cred1", 4, usedAt))
+	assert.ErrorIs(t, store.WebAuthn.UpdateWebAuthnSignCount("cred1", 4, usedAt), repository.ErrSignCountStale, "a counter value is accepted once")
+	assert.ErrorIs(t, store.WebAuthn.UpdateWebAuthnSignCount("missing", 1, usedAt), repository.ErrCredentialNotFound)
+	found, err = store.WebAuthn.GetWebAuthnCredential("cred1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), found.SignCount)
+	require.NotNil(t, found.LastUsedAt)
+	assert.True(t, usedAt.Equal(*found.LastUsedAt))
+
+	phone.ID, phone.SignCount = "cred4", 0
+	require.NoError(t, store.WebAuthn.CreateWebAuthnCredential(phone))
+	require.NoError(t, store.WebAuthn.UpdateWebAuthnSignCount("cred4", 0, usedAt))
+	assert.NoError(t, store.WebAuthn.UpdateWebAuthnSignCount("cred4", 0, usedAt), "authenticators without a counter always report zero")
+
+	assert.ErrorIs(t, store.WebAuthn.DeleteWebAuthnCredential(other.ID, "cred1"), repository.ErrCredentialNotFound, "users only delete their own credentials")
+	require.NoError(t, store.WebAuthn.DeleteWebAuthnCredential(user.ID, "cred1"))
+	assert.ErrorIs(t, store.WebAuthn.DeleteWebAuthnCredential(user.ID, "cred1"), repository.ErrCredentialNotFound)
+}
+
+func testWebAuthnChallenges(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+
+	registration := model.WebAuthnChallenge{Challenge: "ch1", UserID: user.ID, Purpose: model.WebAuthnRegistration, ExpiresAt: now.Add(time.Minute)}
+	require.NoError(t, store.WebAuthn.CreateWebAuthnChallenge(registration))
+	login := model.WebAuthnChallenge{Challenge: "ch2", Purpose: model.WebAuthnLogin, ExpiresAt: now.Add(time.Minute)}
+	require.NoError(t, store.WebAuthn.CreateWebAuthnChallenge(login))
+	expired := model.WebAuthnChallenge{Challenge: "ch3", Purpose: model.WebAuthnLogin, ExpiresAt: now.Add(-time.Second)}
+	require.NoError(t, store.WebAuthn.CreateWebAuthnChallenge(expired))
+	err := store.WebAuthn.CreateWebAuthnChallenge(model.WebAuthnChallenge{Challenge: "ch4", UserID: user.ID + 1000, ExpiresAt: now})
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	found, err := store.WebAuthn.ConsumeWebAuthnChallenge("ch1", now)
+	require.NoError(t, err)
+	assert.Equal(t, registration, *found)
+	_, err = store.WebAuthn.ConsumeWebAuthnChallenge("ch1", now)
+	assert.ErrorIs(t, err, repository.ErrChallengeNotFound, "challenges work once")
+
+	found, err = store.WebAuthn.ConsumeWebAuthnChallenge("ch2", now)
+	require.NoError(t, err)
+	assert.Zero(t, found.UserID, "sign-in challenges need not name a user")
+
+	_, err = store.WebAuthn.ConsumeWebAuthnChallenge("ch3", now)
+	assert.ErrorIs(t, err, repository.ErrChallengeNotFound)
+}
+
+func newOAuthClient(id string, now time.Time) *model.OAuthClient {
+	return &model.OAuthClient{
+		ID:                      id,
+		Name:                    "Wiki",
+		SecretHash:              "secret-" + id,
+		TokenEndpointAuthMethod: "client_secret_basic",
+		RedirectURIs:            []string{"https://wiki.example.com/callback", "https://wiki.example.com/cb?x=1,2"},
+		GrantTypes:              []string{"authorization_code", "client_credentials"},
+		Scopes:                  []string{"openid", "profile", "email"},
+		CreatedAt:               now,
+	}
+}
+
+func newOAuthCode(hash, clientID string, userID int, expiresAt time.Time) model.OAuthAuthorizationCode {
+	return model.OAuthAuthorizationCode{
+		CodeHash:      hash,
+		ClientID:      clientID,
+		UserID:        userID,
+		RedirectURI:   "https://wiki.example.com/callback",
+		Scope:         "openid email",
+		Nonce:         "n-0S6_WzA2Mj",
+		CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		ExpiresAt:     expiresAt,
+	}
+}
+
+func testOAuthClients(t *testing.T, store *repository.Store) {
+	now := time.Unix(1700000000, 0)
+	_, err := store.OAuth.GetOAuthClient("missing")
+	assert.ErrorIs(t, err, repository.ErrClientNotFound)
+
+	wiki := newOAuthClient("wiki", now)
+	require.NoError(t, store.OAuth.CreateOAuthClient(wiki))
+	spa := &model.OAuthClient{ID: "spa", Name: "Dashboard", TokenEndpointAuthMethod: "none",
+		RedirectURIs: []string{"http://localhost:3000/callback"}, GrantTypes: []string{"authorization_code"}, CreatedAt: now.Add(time.Second)}
+	require.NoError(t, store.OAuth.CreateOAuthClient(spa))
+
+	found, err := store.OAuth.GetOAuthClient("wiki")
+	require.NoError(t, err)
+	assert.Equal(t, *wiki, *found)
+	found, err = store.OAuth.GetOAuthClient("spa")
+	require.NoError(t, err)
+	assert.True(t, found.Public())
+	assert.Empty(t, found.Scopes)
+
+	clients, err := store.OAuth.ListOAuthClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, "wiki", clients[0].ID, "oldest first")
+
+	require.NoError(t, store.OAuth.DeleteOAuthClient("wiki"))
+	assert.ErrorIs(t, store.OAuth.DeleteOAuthClient("wiki"), repository.ErrClientNotFound)
+	clients, err = store.OAuth.ListOAuthClients()
+	require.NoError(t, err)
+	assert.Len(t, clients, 1)
+}
+
+func testOAuthCodes(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, store.OAuth.CreateOAuthClient(newOAuthClient("wiki", now)))
+
+	code := newOAuthCode("c1", "wiki", user.ID, now.Add(time.Minute))
+	require.NoError(t, store.OAuth.CreateAuthorizationCode(code))
+	require.NoError(t, store.OAuth.CreateAuthorizationCode(newOAuthCode("c2", "wiki", user.ID, now.Add(-time.Second))))
+	assert.ErrorIs(t, store.OAuth.CreateAuthorizationCode(newOAuthCode("c3", "wiki", user.ID+1000, now)), repository.ErrUserNotFound)
+
+	found, err := store.OAuth.ConsumeAuthorizationCode("c1", now)
+	require.NoError(t, err)
+	assert.Equal(t, code, *found)
+	_, err = store.OAuth.ConsumeAuthorizationCode("c1", now)
+	assert.ErrorIs(t, err, repository.ErrAuthorizationCodeNotFound, "codes work once")
+	_, err = store.OAuth.ConsumeAuthorizationCode("c2", now)
+	assert.ErrorIs(t, err, repository.ErrAuthorizationCodeNotFound)
+
+	require.NoError(t, store.OAuth.CreateAuthorizationCode(newOAuthCode("c4", "wiki", user.ID, now.Add(time.Minute))))
+	require.NoError(t, store.OAuth.DeleteOAuthClient("wiki"))
+	_, err = store.OAuth.ConsumeAuthorizationCode("c4", now)
+	assert.ErrorIs(t, err, repository.ErrAuthorizationCodeNotFound, "deleting the client deletes its codes")
+}
+
+func testOAuthTokens(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, store.OAuth.CreateOAuthClient(newOAuthClient("wiki", now)))
+
+	userToken := model.OAuthToken{TokenHash: "t1", ClientID: "wiki", UserID: user.ID, Scope: "openid", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, store.OAuth.CreateOAuthToken(userToken))
+	clientToken := model.OAuthToken{TokenHash: "t2", ClientID: "wiki", Scope: "reports:read", IssuedAt: now, ExpiresAt: now.Add(time.Minute)}
+	require.NoError(t, store.OAuth.CreateOAuthToken(clientToken))
+	err := store.OAuth.CreateOAuthToken(model.OAuthToken{TokenHash: "t3", ClientID: "wiki", UserID: user.ID + 1000, IssuedAt: now, ExpiresAt: now})
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	found, err := store.OAuth.GetOAuthToken("t1")
+	require.NoError(t, err)
+	assert.Equal(t, userToken, *found)
+	found, err = store.OAuth.GetOAuthToken("t2")
+	require.NoError(t, err)
+	assert.Zero(t, found.UserID, "client credentials tokens have no user")
+
+	n, err := store.OAuth.DeleteExpiredOAuthTokens(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = store.OAuth.GetOAuthToken("t2")
+	assert.ErrorIs(t, err, repository.ErrOAuthTokenNotFound)
+
+	require.NoError(t, store.OAuth.DeleteOAuthToken("t1"))
+	assert.ErrorIs(t, store.OAuth.DeleteOAuthToken("t1"), repository.ErrOAuthTokenNotFound)
+
+	require.NoError(t, store.OAuth.CreateOAuthToken(userToken))
+	require.NoError(t, store.OAuth.CreateOAuthToken(clientToken))
+	n, err = store.OAuth.DeleteUserOAuthTokens(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = store.OAuth.GetOAuthToken("t1")
+	assert.ErrorIs(t, err, repository.ErrOAuthTokenNotFound)
+	_, err = store.OAuth.GetOAuthToken("t2")
+	assert.NoError(t, err, "client credentials tokens are not the user's")
+
+	require.NoError(t, store.OAuth.CreateOAuthToken(userToken))
+	require.NoError(t, store.OAuth.DeleteOAuthClient("wiki"))
+	_, err = store.OAuth.GetOAuthToken("t1")
+	assert.ErrorIs(t, err, repository.ErrOAuthTokenNotFound, "deleting the client revokes its tokens")
+}
+
+func testOAuthSigningKeys(t *testing.T, store *repository.Store) {
+	now := time.Unix(1700000000, 0)
+	keys, err := store.OAuth.ListSigningKeys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	older := model.OAuthSigningKey{ID: "k1", PrivateKey: []byte{1, 2, 3}, CreatedAt: now}
+	newer := model.OAuthSigningKey{ID: "k2", PrivateKey: []byte{4, 5, 6}, CreatedAt: now.Add(time.Hour)}
+	require.NoError(t, store.OAuth.CreateSigningKey(older))
+	require.NoError(t, store.OAuth.CreateSigningKey(newer))
+
+	keys, err = store.OAuth.ListSigningKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []model.OAuthSigningKey{newer, older}, keys, "newest first")
+
+	require.NoError(t, store.OAuth.DeleteSigningKey("k1"))
+	keys, err = store.OAuth.ListSigningKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []model.OAuthSigningKey{newer}, keys)
+}
+
+func newServicePrincipal(id string, now time.Time) *model.ServicePrincipal {
+	return &model.ServicePrincipal{ID: id, Name: "Nightly export", Scopes: []string{"users:read", "users:write"}, CreatedBy: 1, CreatedAt: now}
+}
+
+func testServicePrincipals(t *testing.T, store *repository.Store) {
+	now := time.Unix(1700000000, 0)
+	_, err := store.APIKeys.GetServicePrincipal("missing")
+	assert.ErrorIs(t, err, repository.ErrServicePrincipalNotFound)
+
+	export := newServicePrincipal("export", now)
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(export))
+	audit := &model.ServicePrincipal{ID: "audit", Name: "Audit", CreatedBy: 1, CreatedAt: now.Add(time.Second)}
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(audit))
+
+	found, err := store.APIKeys.GetServicePrincipal("export")
+	require.NoError(t, err)
+	assert.Equal(t, *export, *found)
+	found, err = store.APIKeys.GetServicePrincipal("audit")
+	require.NoError(t, err)
+	assert.Empty(t, found.Scopes)
+
+	principals, err := store.APIKeys.ListServicePrincipals()
+	require.NoError(t, err)
+	require.Len(t, principals, 2)
+	assert.Equal(t, "export", principals[0].ID, "oldest first")
+
+	_, err = store.APIKeys.GetServicePrincipalByCertificateSubject("")
+	assert.ErrorIs(t, err, repository.ErrServicePrincipalNotFound, "principals without a subject are not found by it")
+	sync := &model.ServicePrincipal{ID: "sync", Name: "Sync", Scopes: []string{}, CertificateSubject: "CN=sync,O=Example", CreatedBy: 1, CreatedAt: now}
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(sync))
+	found, err = store.APIKeys.GetServicePrincipalByCertificateSubject("CN=sync,O=Example")
+	require.NoError(t, err)
+	assert.Equal(t, *sync, *found)
+	duplicate := &model.ServicePrincipal{ID: "sync2", Name: "Sync", CertificateSubject: "CN=sync,O=Example", CreatedBy: 1, CreatedAt: now}
+	assert.ErrorIs(t, store.APIKeys.CreateServicePrincipal(duplicate), repository.ErrDuplicateCertificateSubject)
+
+	require.NoError(t, store.APIKeys.DeleteServicePrincipal("export"))
+	assert.ErrorIs(t, store.APIKeys.DeleteServicePrincipal("export"), repository.ErrServicePrincipalNotFound)
+}
+
+func testAPIKeys(t *testing.T, store *repository.Store) {
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(newServicePrincipal("export", now)))
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(newServicePrincipal("audit", now)))
+
+	first := model.APIKey{ID: "k1", ServicePrincipalID: "export", Prefix: "a1b2c3d4", KeyHash: "hash-1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, store.APIKeys.CreateAPIKey(&first))
+	second := model.APIKey{ID: "k2", ServicePrincipalID: "export", Prefix: "e5f6a7b8", KeyHash: "hash-2", CreatedAt: now.Add(time.Second), ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, store.APIKeys.CreateAPIKey(&second))
+	err := store.APIKeys.CreateAPIKey(&model.APIKey{ID: "k3", ServicePrincipalID: "missing", Prefix: "00000000", CreatedAt: now, ExpiresAt: now})
+	assert.ErrorIs(t, err, repository.ErrServicePrincipalNotFound)
+
+	found, err := store.APIKeys.GetAPIKeyByPrefix("a1b2c3d4")
+	require.NoError(t, err)
+	assert.Equal(t, first, *found)
+	assert.Nil(t, found.LastUsedAt)
+	_, err = store.APIKeys.GetAPIKeyByPrefix("ffffffff")
+	assert.ErrorIs(t, err, repository.ErrAPIKeyNotFound)
+	_, err = store.APIKeys.GetAPIKey("audit", "k1")
+	assert.ErrorIs(t, err, repository.ErrAPIKeyNotFound, "keys are only found under their own principal")
+
+	require.NoError(t, store.APIKeys.TouchAPIKey("k1", now.Add(time.Minute)))
+	require.NoError(t, store.APIKeys.SetAPIKeyExpiry("k1", now.Add(2*time.Minute)))
+	assert.ErrorIs(t, store.APIKeys.TouchAPIKey("missing", now), repository.ErrAPIKeyNotFound)
+	found, err = store.APIKeys.GetAPIKey("export", "k1")
+	require.NoError(t, err)
+	require.NotNil(t, found.LastUsedAt)
+	assert.Equal(t, now.Add(time.Minute), *found.LastUsedAt)
+	assert.Equal(t, now.Add(2*time.Minute), found.ExpiresAt)
+
+	keys, err := store.APIKeys.ListAPIKeys("export")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "k1", keys[0].ID, "oldest first")
+
+	assert.ErrorIs(t, store.APIKeys.DeleteAPIKey("audit", "k1"), repository.ErrAPIKeyNotFound)
+	require.NoError(t, store.APIKeys.DeleteAPIKey("export", "k1"))
+	require.NoError(t, store.APIKeys.DeleteServicePrincipal("export"))
+	_, err = store.APIKeys.GetAPIKeyByPrefix("e5f6a7b8")
+	assert.ErrorIs(t, err, repository.ErrAPIKeyNotFound, "deleting the principal deletes its keys")
+
+	sync := &model.ServicePrincipal{ID: "sync", Name: "Sync", CreatedBy: 2, CreatedAt: now}
+	require.NoError(t, store.APIKeys.CreateServicePrincipal(sync))
+	require.NoError(t, store.APIKeys.CreateAPIKey(&model.APIKey{ID: "k4", ServicePrincipalID: "audit", Prefix: "11111111", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, store.APIKeys.CreateAPIKey(&model.APIKey{ID: "k5", ServicePrincipalID: "sync", Prefix: "22222222", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	n, err := store.APIKeys.DeleteAPIKeysCreatedBy(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = store.APIKeys.GetAPIKeyByPrefix("11111111")
+	assert.ErrorIs(t, err, repository.ErrAPIKeyNotFound)
+	_, err = store.APIKeys.GetAPIKeyByPrefix("22222222")
+	assert.NoError(t, err, "keys of principals other users created stay")
+	_, err = store.APIKeys.GetServicePrincipal("audit")
+	assert.NoError(t, err, "the principal itself stays")
+}
+
+func testIdempotencyKeys(t *testing.T, store *repository.Store) {
+	now := time.Unix(1700000000, 0)
+	claim := func(scope string, at time.Time) *model.IdempotencyKey {
+		return &model.IdempotencyKey{Scope: scope, Key: "retry-1", Fingerprint: "fp", CreatedAt: at, ExpiresAt: at.Add(time.Minute)}
+	}
+
+	first := claim("user:1", now)
+	require.NoError(t, store.IdempotencyKeys.CreateIdempotencyKey(first))
+	assert.ErrorIs(t, store.IdempotencyKeys.CreateIdempotencyKey(claim("user:1", now)), repository.ErrDuplicateIdempotencyKey)
+	require.NoError(t, store.IdempotencyKeys.CreateIdempotencyKey(claim("user:2", now)), "keys are scoped to their caller")
+	_, err := store.IdempotencyKeys.GetIdempotencyKey("user:3", "retry-1")
+	assert.ErrorIs(t, err, repository.ErrIdempotencyKeyNotFound)
+
+	completed := *first
+	completed.Status = 201
+	completed.Header = map[string]string{"Content-Type": "application/json"}
+	completed.Body = []byte(`{"message":"User created successfully"}`)
+	completed.ExpiresAt = now.Add(24 * time.Hour)
+	require.NoError(t, store.IdempotencyKeys.CompleteIdempotencyKey(&completed))
+	assert.ErrorIs(t, store.IdempotencyKeys.CompleteIdempotencyKey(&completed), repository.ErrIdempotencyKeyNotFound, "responses are stored once")
+	found, err := store.IdempotencyKeys.GetIdempotencyKey("user:1", "retry-1")
+	require.NoError(t, err)
+	assert.Equal(t, completed, *found)
+	assert.ErrorIs(t, store.IdempotencyKeys.ReleaseIdempotencyKey(first), repository.ErrIdempotencyKeyNotFound, "completed keys are not released")
+
+	// The claim of user:2 expired without a response, so a later request takes the key over
+	later := claim("user:2", now.Add(time.Minute))
+	require.NoError(t, store.IdempotencyKeys.CreateIdempotencyKey(later))
+	stale := claim("user:2", now)
+	assert.ErrorIs(t, store.IdempotencyKeys.CompleteIdempotencyKey(stale), repository.ErrIdempotencyKeyNotFound, "the expired request no longer holds the key")
+	assert.ErrorIs(t, store.IdempotencyKeys.ReleaseIdempotencyKey(stale), repository.ErrIdempotencyKeyNotFound)
+	require.NoError(t, store.IdempotencyKeys.ReleaseIdempotencyKey(later))
+	_, err = store.IdempotencyKeys.GetIdempotencyKey("user:2", "retry-1")
+	assert.ErrorIs(t, err, repository.ErrIdempotencyKeyNotFound)
+
+	require.NoError(t, store.IdempotencyKeys.CreateIdempotencyKey(claim("user:3", now.Add(25*time.Hour))))
+	_, err = store.IdempotencyKeys.GetIdempotencyKey("user:1", "retry-1")
+	assert.ErrorIs(t, err, repository.ErrIdempotencyKeyNotFound, "expired records are cleared out")
+}
+
+func testDeleteUserCascades(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, store.Passwords.SetPasswordHash(user.ID, "hash"))
+	require.NoError(t, store.Sessions.CreateSession(newSession("s1", user.ID, now)))
+	require.NoError(t, store.ResetTokens.CreateResetToken(model.PasswordResetToken{TokenHash: "t1", UserID: user.ID, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, store.MFA.SaveMFAEnrollment(model.MFAEnrollment{UserID: user.ID, Secret: "S", CreatedAt: now}))
+	require.NoError(t, store.MFA.ReplaceRecoveryCodes(user.ID, []string{"c1"}))
+	require.NoError(t, store.WebAuthn.CreateWebAuthnCredential(newWebAuthnCredential("cred1", user.ID, now)))
+	require.NoError(t, store.WebAuthn.CreateWebAuthnChallenge(model.WebAuthnChallenge{Challenge: "ch1", UserID: user.ID, Purpose: model.WebAuthnRegistration, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, store.OAuth.CreateOAuthClient(newOAuthClient("wiki", now)))
+	require.NoError(t, store.OAuth.CreateAuthorizationCode(newOAuthCode("code1", "wiki", user.ID, now.Add(time.Hour))))
+	require.NoError(t, store.OAuth.CreateOAuthToken(model.OAuthToken{TokenHash: "tok1", ClientID: "wiki", UserID: user.ID, IssuedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	require.NoError(t, store.Users.DeleteUser(user.ID))
+
+	_, err := store.Passwords.GetPasswordHash(user.ID)
+	assert.ErrorIs(t, err, repository.ErrPasswordNotSet)
+	_, err = store.Sessions.GetSessionByTokenHash("hash-s1")
+	assert.ErrorIs(t, err, repository.ErrSessionNotFound)
+	_, err = store.ResetTokens.ConsumeResetToken("t1", now)
+	assert.ErrorIs(t, err, repository.ErrResetTokenNotFound)
+	_, err = store.MFA.GetMFAEnrollment(user.ID)
+	assert.ErrorIs(t, err, repository.ErrMFANotEnrolled)
+	n, err := store.MFA.CountRecoveryCodes(user.ID)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	_, err = store.WebAuthn.GetWebAuthnCredential("cred1")
+	assert.ErrorIs(t, err, repository.ErrCredentialNotFound)
+	_, err = store.WebAuthn.ConsumeWebAuthnChallenge("ch1", now)
+	assert.ErrorIs(t, err, repository.ErrChallengeNotFound)
+	_, err = store.OAuth.ConsumeAuthorizationCode("code1", now)
+	assert.ErrorIs(t, err, repository.ErrAuthorizationCodeNotFound)
+	_, err = store.OAuth.GetOAuthToken("tok1")
+	assert.ErrorIs(t, err, repository.ErrOAuthTokenNotFound)
+	_, err = store.OAuth.GetOAuthClient("wiki")
+	assert.NoError(t, err, "clients do not belong to users")
+}
+
+func testTxCoversCredentials(t *testing.T, store *repository.Store) {
+	user := mustCreate(t, store.Users, "Ahmet", "ahmet@example.com")
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, store.Sessions.CreateSession(newSession("s1", user.ID, now)))
+
+	err := store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		require.NoError(t, repos.Passwords.SetPasswordHash(user.ID, "hash"))
+		_, err := repos.Sessions.DeleteUserSessions(user.ID, "")
+		require.NoError(t, err)
+		return errors.New("abort")
+	})
+	assert.Error(t, err)
+
+	_, err = store.Passwords.GetPasswordHash(user.ID)
+	assert.ErrorIs(t, err, repository.ErrPasswordNotSet)
+	_, err = store.Sessions.GetSessionByTokenHash("hash-s1")
+	assert.NoError(t, err, "the rolled back transaction kept the session")
+}
+
+func testTxRollback(t *testing.T, store *repository.Store) {
+	failure := errors.New("boom")
+	err := store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		mustCreate(t, repos.Users, "Ahmet", "ahmet@example.com")
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	err = store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		mustCreate(t, repos.Users, "Ayse", "ayse@example.com")
+		return nil
+	})
+	require.NoError(t, err)
+
+	users, err := store.Users.GetAllUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "Ayse", users[0].Name)
+}
+
+func testTxNestedSavepoint(t *testing.T, store *repository.Store) {
+	err := store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		mustCreate(t, repos.Users, "Ahmet", "ahmet@example.com")
+
+		inner := store.Tx.WithinTx(ctx, func(ctx context.Context, repos repository.Repositories) error {
+			mustCreate(t, repos.Users, "Ayse", "ayse@example.com")
+			return errors.New("inner failure")
+		})
+		assert.Error(t, inner)
+
+		_, err := repos.Users.GetUserByEmail("ayse@example.com")
+		assert.ErrorIs(t, err, repository.ErrUserNotFound)
+		return nil
+	})
+	require.NoError(t, err)
+
+	users, err := store.Users.GetAllUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "Ahmet", users[0].Name)
+}
+
+func testTxPanic(t *testing.T, store *repository.Store) {
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+			mustCreate(t, repos.Users, "Ahmet", "ahmet@example.com")
+			panic("boom")
+		})
+	})
+
+	users, err := store.Users.GetAllUsers()
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func testConcurrentCreates(t *testing.T, store *repository.Store) {
+	const writers = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Users.CreateUser(&model.User{Name: "User", Email: fmt.Sprintf("user%d@example.com", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	users, err := store.Users.GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, writers)
+
+	ids := make(map[int]bool)
+	for _, user := range users {
+		ids[user.ID] = true
+	}
+	assert.Len(t, ids, writers, "IDs must be unique")
+}
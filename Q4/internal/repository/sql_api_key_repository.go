@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLAPIKeyRepository implements APIKeyRepository on SQLite or PostgreSQL
+type SQLAPIKeyRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLAPIKeyRepository(db DBTX) *SQLAPIKeyRepository {
+	return &SQLAPIKeyRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresAPIKeyRepository(db DBTX) *SQLAPIKeyRepository {
+	return &SQLAPIKeyRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+const (
+	servicePrincipalColumns = "id, name, scopes, certificate_subject, created_by, created_at"
+	apiKeyColumns           = "id, service_principal_id, prefix, key_hash, created_at, expires_at, last_used_at"
+)
+
+func scanServicePrincipal(row rowScanner) (*model.ServicePrincipal, error) {
+	var principal model.ServicePrincipal
+	var scopes string
+	var subject sql.NullString
+	var createdAt int64
+	if err := row.Scan(&principal.ID, &principal.Name, &scopes, &subject, &principal.CreatedBy, &createdAt); err != nil {
+		return nil, err
+	}
+	principal.Scopes = strings.Fields(scopes)
+	principal.CertificateSubject = subject.String
+	principal.CreatedAt = time.Unix(createdAt, 0)
+	return &principal, nil
+}
+
+func scanAPIKey(row rowScanner) (*model.APIKey, error) {
+	var key model.APIKey
+	var createdAt, expiresAt int64
+	var lastUsedAt sql.NullInt64
+	err := row.Scan(&key.ID, &key.ServicePrincipalID, &key.Prefix, &key.KeyHash, &createdAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Unix(createdAt, 0)
+	key.ExpiresAt = time.Unix(expiresAt, 0)
+	if lastUsedAt.Valid {
+		t := time.Unix(lastUsedAt.Int64, 0)
+		key.LastUsedAt = &t
+	}
+	return &key, nil
+}
+
+func (r *SQLAPIKeyRepository) CreateServicePrincipal(principal *model.ServicePrincipal) error {
+	// Principals without a subject store NULL, which the unique index does not compare
+	subject := sql.NullString{String: principal.CertificateSubject, Valid: principal.CertificateSubject != ""}
+	_, err := r.exec("INSERT INTO service_principals ("+servicePrincipalColumns+") VALUES (?, ?, ?, ?, ?, ?);",
+		principal.ID, principal.Name, strings.Join(principal.Scopes, " "), subject, principal.CreatedBy, principal.CreatedAt.Unix())
+	// IDs are random, so the subject is the only unique column that can collide
+	if isUniqueViolation(err) && subject.Valid {
+		return fmt.Errorf("%w: %v", ErrDuplicateCertificateSubject, err)
+	}
+	return err
+}
+
+func (r *SQLAPIKeyRepository) GetServicePrincipal(id string) (*model.ServicePrincipal, error) {
+	principal, err := scanServicePrincipal(r.queryRow("SELECT "+servicePrincipalColumns+" FROM service_principals WHERE id = ?;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrServicePrincipalNotFound
+	}
+	return principal, err
+}
+
+func (r *SQLAPIKeyRepository) GetServicePrincipalByCertificateSubject(subject string) (*model.ServicePrincipal, error) {
+	principal, err := scanServicePrincipal(r.queryRow("SELECT "+servicePrincipalColumns+" FROM service_principals WHERE certificate_subject = ?;", subject))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrServicePrincipalNotFound
+	}
+	return principal, err
+}
+
+func (r *SQLAPIKeyRepository) ListServicePrincipals() ([]model.ServicePrincipal, error) {
+	rows, err := r.query("SELECT " + servicePrincipalColumns + " FROM service_principals ORDER BY created_at, id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	principals := []model.ServicePrincipal{}
+	for rows.Next() {
+		principal, err := scanServicePrincipal(rows)
+		if err != nil {
+			return nil, err
+		}
+		principals = append(principals, *principal)
+	}
+	return principals, rows.Err()
+}
+
+func (r *SQLAPIKeyRepository) DeleteServicePrincipal(id string) error {
+	res, err := r.exec("DELETE FROM service_principals WHERE id = ?;", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrServicePrincipalNotFound
+	}
+	return nil
+}
+
+func (r *SQLAPIKeyRepository) CreateAPIKey(key *model.APIKey) error {
+	_, err := r.exec("INSERT INTO api_keys ("+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, NULL);",
+		key.ID, key.ServicePrincipalID, key.Prefix, key.KeyHash, key.CreatedAt.Unix(), key.ExpiresAt.Unix())
+	// The only foreign key is the principal's
+	if errors.Is(mapForeignKeyError(err), ErrUserNotFound) {
+		return ErrServicePrincipalNotFound
+	}
+	return err
+}
+
+func (r *SQLAPIKeyRepository) GetAPIKey(servicePrincipalID, id string) (*model.APIKey, error) {
+	key, err := scanAPIKey(r.queryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ? AND service_principal_id = ?;", id, servicePrincipalID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (r *SQLAPIKeyRepository) GetAPIKeyByPrefix(prefix string) (*model.APIKey, error) {
+	key, err := scanAPIKey(r.queryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = ?;", prefix))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (r *SQLAPIKeyRepository) ListAPIKeys(servicePrincipalID string) ([]model.APIKey, error) {
+	rows, err := r.query("SELECT "+apiKeyColumns+" FROM api_keys WHERE service_principal_id = ? ORDER BY created_at, id;", servicePrincipalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []model.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (r *SQLAPIKeyRepository) SetAPIKeyExpiry(id string, expiresAt time.Time) error {
+	return r.updateAPIKey("UPDATE api_keys SET expires_at = ? WHERE id = ?;", expiresAt.Unix(), id)
+}
+
+func (r *SQLAPIKeyRepository) TouchAPIKey(id string, usedAt time.Time) error {
+	return r.updateAPIKey("UPDATE api_keys SET last_used_at = ? WHERE id = ?;", usedAt.Unix(), id)
+}
+
+func (r *SQLAPIKeyRepository) DeleteAPIKey(servicePrincipalID, id string) error {
+	return r.updateAPIKey("DELETE FROM api_keys WHERE id = ? AND service_principal_id = ?;", id, servicePrincipalID)
+}
+
+func (r *SQLAPIKeyRepository) DeleteAPIKeysCreatedBy(userID int) (int, error) {
+	res, err := r.exec("DELETE FROM api_keys WHERE service_principal_id IN (SELECT id FROM service_principals WHERE created_by = ?);", userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// updateAPIKey runs a statement that changes a single key and reports ErrAPIKeyNotFound if it matched none
+func (r *SQLAPIKeyRepository) updateAPIKey(query string, args ...any) error {
+	res, err := r.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqlDialect adapts queries written with ? placeholders to the target database, so that the
+// auth repositories share one implementation between SQLite and PostgreSQL
+type sqlDialect int
+
+const (
+	dialectSQLite sqlDialect = iota
+	dialectPostgres
+)
+
+func (d sqlDialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqliteConstraintForeignKey is SQLite's extended result code for a foreign key violation
+const sqliteConstraintForeignKey = 787
+
+// mapForeignKeyError reports writes that reference a missing user as ErrUserNotFound
+func mapForeignKeyError(err error) error {
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) && coded.Code() == sqliteConstraintForeignKey {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+	return err
+}
+
+// sqliteConstraintPrimaryKey is SQLite's extended result code for a duplicate primary key
+const sqliteConstraintPrimaryKey = 1555
+
+// isUniqueViolation reports whether err is a duplicate primary key or unique column
+func isUniqueViolation(err error) bool {
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		return coded.Code() == sqliteConstraintPrimaryKey || coded.Code() == sqliteConstraintUnique
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation
+}
+
+type sqlAuthConn struct {
+	db      DBTX
+	dialect sqlDialect
+}
+
+func (c sqlAuthConn) exec(query string, args ...any) (sql.Result, error) {
+	return c.db.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c sqlAuthConn) query(query string, args ...any) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.rebind(query), args...)
+}
+
+func (c sqlAuthConn) queryRow(query string, args ...any) *sql.Row {
+	return c.db.QueryRow(c.dialect.rebind(query), args...)
+}
+
+// SQLPasswordRepository implements PasswordRepository on SQLite or PostgreSQL
+type SQLPasswordRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLPasswordRepository(db DBTX) *SQLPasswordRepository {
+	return &SQLPasswordRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresPasswordRepository(db DBTX) *SQLPasswordRepository {
+	return &SQLPasswordRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+func (r *SQLPasswordRepository) GetPasswordHash(userID int) (string, error) {
+	var hash string
+	err := r.queryRow("SELECT hash FROM user_passwords WHERE user_id = ?;", userID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrPasswordNotSet
+	}
+	return hash, err
+}
+
+func (r *SQLPasswordRepository) SetPasswordHash(userID int, hash string) error {
+	_, err := r.exec(`
+		INSERT INTO user_passwords (user_id, hash, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET hash = excluded.hash, updated_at = excluded.updated_at;`,
+		userID, hash, time.Now().Unix())
+	return mapForeignKeyError(err)
+}
+
+// SQLSessionRepository implements SessionRepository on SQLite or PostgreSQL
+type SQLSessionRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLSessionRepository(db DBTX) *SQLSessionRepository {
+	return &SQLSessionRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresSessionRepository(db DBTX) *SQLSessionRepository {
+	return &SQLSessionRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+const sessionColumns = "id, user_id, token_hash, device, user_agent, ip, created_at, last_seen_at, expires_at"
+
+func (r *SQLSessionRepository) CreateSession(session *model.Session) error {
+	_, err := r.exec("INSERT INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		session.ID, session.UserID, session.TokenHash, session.Device, session.UserAgent, session.IP,
+		session.CreatedAt.Unix(), session.LastSeenAt.Unix(), session.ExpiresAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func scanSession(row rowScanner) (*model.Session, error) {
+	var session model.Session
+	var createdAt, lastSeenAt, expiresAt int64
+	err := row.Scan(&session.ID, &session.UserID, &session.TokenHash, &session.Device, &session.UserAgent, &session.IP,
+		&createdAt, &lastSeenAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	session.CreatedAt = time.Unix(createdAt, 0)
+	session.LastSeenAt = time.Unix(lastSeenAt, 0)
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	return &session, nil
+}
+
+func (r *SQLSessionRepository) GetSessionByTokenHash(tokenHash string) (*model.Session, error) {
+	session, err := scanSession(r.queryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ?;", tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (r *SQLSessionRepository) ListUserSessions(userID int) ([]model.Session, error) {
+	rows, err := r.query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC, id;", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *SQLSessionRepository) TouchSession(id string, lastSeenAt time.Time) error {
+	_, err := r.exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?;", lastSeenAt.Unix(), id)
+	return err
+}
+
+func (r *SQLSessionRepository) DeleteSession(id string) error {
+	_, err := r.exec("DELETE FROM sessions WHERE id = ?;", id)
+	return err
+}
+
+func (r *SQLSessionRepository) DeleteUserSessions(userID int, exceptID string) (int, error) {
+	res, err := r.exec("DELETE FROM sessions WHERE user_id = ? AND id <> ?;", userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// SQLPasswordResetRepository implements PasswordResetRepository on SQLite or PostgreSQL
+type SQLPasswordResetRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLPasswordResetRepository(db DBTX) *SQLPasswordResetRepository {
+	return &SQLPasswordResetRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresPasswordResetRepository(db DBTX) *SQLPasswordResetRepository {
+	return &SQLPasswordResetRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+func (r *SQLPasswordResetRepository) CreateResetToken(token model.PasswordResetToken) error {
+	_, err := r.exec("INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES (?, ?, ?);",
+		token.TokenHash, token.UserID, token.ExpiresAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLPasswordResetRepository) ConsumeResetToken(tokenHash string, now time.Time) (int, error) {
+	var userID int
+	var expiresAt int64
+	err := r.queryRow("SELECT user_id, expires_at FROM password_reset_tokens WHERE token_hash = ?;", tokenHash).
+		Scan(&userID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the caller whose DELETE removes the row may use the token
+	res, err := r.exec("DELETE FROM password_reset_tokens WHERE token_hash = ?;", tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 || now.Unix() >= expiresAt {
+		return 0, ErrResetTokenNotFound
+	}
+	return userID, nil
+}
+
+func (r *SQLPasswordResetRepository) DeleteUserResetTokens(userID int) error {
+	_, err := r.exec("DELETE FROM password_reset_tokens WHERE user_id = ?;", userID)
+	return err
+}
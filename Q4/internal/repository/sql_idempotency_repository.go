@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SQLIdempotencyKeyRepository implements IdempotencyKeyRepository on SQLite or PostgreSQL
+type SQLIdempotencyKeyRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLIdempotencyKeyRepository(db DBTX) *SQLIdempotencyKeyRepository {
+	return &SQLIdempotencyKeyRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresIdempotencyKeyRepository(db DBTX) *SQLIdempotencyKeyRepository {
+	return &SQLIdempotencyKeyRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+func (r *SQLIdempotencyKeyRepository) CreateIdempotencyKey(key *model.IdempotencyKey) error {
+	// Keys of one-off requests are never looked up again, so clear out the expired ones here
+	if _, err := r.exec("DELETE FROM idempotency_keys WHERE expires_at <= ?;", key.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	_, err := r.exec("INSERT INTO idempotency_keys (scope, idempotency_key, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?);",
+		key.Scope, key.Key, key.Fingerprint, key.CreatedAt.Unix(), key.ExpiresAt.Unix())
+	// The primary key makes concurrent requests with the same key race for this insert
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicateIdempotencyKey, err)
+	}
+	return err
+}
+
+func (r *SQLIdempotencyKeyRepository) GetIdempotencyKey(scope, key string) (*model.IdempotencyKey, error) {
+	found := model.IdempotencyKey{Scope: scope, Key: key}
+	var header string
+	var createdAt, expiresAt int64
+	err := r.queryRow("SELECT fingerprint, response_status, response_header, response_body, created_at, expires_at FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?;", scope, key).
+		Scan(&found.Fingerprint, &found.Status, &header, &found.Body, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(header), &found.Header); err != nil {
+		return nil, fmt.Errorf("decoding response header of idempotency key %s: %w", key, err)
+	}
+	found.CreatedAt = time.Unix(createdAt, 0)
+	found.ExpiresAt = time.Unix(expiresAt, 0)
+	return &found, nil
+}
+
+func (r *SQLIdempotencyKeyRepository) CompleteIdempotencyKey(key *model.IdempotencyKey) error {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return err
+	}
+	res, err := r.exec("UPDATE idempotency_keys SET response_status = ?, response_header = ?, response_body = ?, expires_at = ? "+
+		"WHERE scope = ? AND idempotency_key = ? AND response_status = 0 AND created_at = ?;",
+		key.Status, string(header), key.Body, key.ExpiresAt.Unix(), key.Scope, key.Key, key.CreatedAt.Unix())
+	return requireIdempotencyKeyRow(res, err)
+}
+
+func (r *SQLIdempotencyKeyRepository) ReleaseIdempotencyKey(key *model.IdempotencyKey) error {
+	res, err := r.exec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND response_status = 0 AND created_at = ?;",
+		key.Scope, key.Key, key.CreatedAt.Unix())
+	return requireIdempotencyKeyRow(res, err)
+}
+
+func requireIdempotencyKeyRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SQLMFARepository implements MFARepository on SQLite or PostgreSQL
+type SQLMFARepository struct {
+	sqlAuthConn
+}
+
+func NewSQLMFARepository(db DBTX) *SQLMFARepository {
+	return &SQLMFARepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresMFARepository(db DBTX) *SQLMFARepository {
+	return &SQLMFARepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+func (r *SQLMFARepository) GetMFAEnrollment(userID int) (*model.MFAEnrollment, error) {
+	enrollment := model.MFAEnrollment{UserID: userID}
+	var confirmedAt sql.NullInt64
+	var createdAt int64
+	err := r.queryRow("SELECT secret, confirmed_at, last_step, created_at FROM user_mfa WHERE user_id = ?;", userID).
+		Scan(&enrollment.Secret, &confirmedAt, &enrollment.LastStep, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		t := time.Unix(confirmedAt.Int64, 0)
+		enrollment.ConfirmedAt = &t
+	}
+	enrollment.CreatedAt = time.Unix(createdAt, 0)
+	return &enrollment, nil
+}
+
+func (r *SQLMFARepository) SaveMFAEnrollment(enrollment model.MFAEnrollment) error {
+	var confirmedAt sql.NullInt64
+	if enrollment.ConfirmedAt != nil {
+		confirmedAt = sql.NullInt64{Int64: enrollment.ConfirmedAt.Unix(), Valid: true}
+	}
+	_, err := r.exec(`
+		INSERT INTO user_mfa (user_id, secret, confirmed_at, last_step, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			secret = excluded.secret,
+			confirmed_at = excluded.confirmed_at,
+			last_step = excluded.last_step,
+			created_at = excluded.created_at;`,
+		enrollment.UserID, enrollment.Secret, confirmedAt, enrollment.LastStep, enrollment.CreatedAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLMFARepository) UseTOTPStep(userID int, step int64) error {
+	// The condition makes the check and the update one statement, so two requests racing
+	// with the same code cannot both succeed
+	res, err := r.exec("UPDATE user_mfa SET last_step = ? WHERE user_id = ? AND last_step < ?;", step, userID, step)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPStepUsed
+	}
+	return nil
+}
+
+func (r *SQLMFARepository) DeleteMFAEnrollment(userID int) error {
+	if _, err := r.exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?;", userID); err != nil {
+		return err
+	}
+	_, err := r.exec("DELETE FROM user_mfa WHERE user_id = ?;", userID)
+	return err
+}
+
+// ReplaceRecoveryCodes runs several statements; call it inside a transaction so that a failure
+// cannot leave the user with a partial set
+func (r *SQLMFARepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	if _, err := r.exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?;", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := r.exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?);", userID, hash); err != nil {
+			return mapForeignKeyError(err)
+		}
+	}
+	return nil
+}
+
+func (r *SQLMFARepository) ConsumeRecoveryCode(userID int, codeHash string) error {
+	res, err := r.exec("DELETE FROM mfa_recovery_codes WHERE user_id = ? AND code_hash = ?;", userID, codeHash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (r *SQLMFARepository) CountRecoveryCodes(userID int) (int, error) {
+	var n int
+	err := r.queryRow("SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = ?;", userID).Scan(&n)
+	return n, err
+}
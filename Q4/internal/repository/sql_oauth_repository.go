@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SQLOAuthRepository implements OAuthRepository on SQLite or PostgreSQL
+type SQLOAuthRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLOAuthRepository(db DBTX) *SQLOAuthRepository {
+	return &SQLOAuthRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresOAuthRepository(db DBTX) *SQLOAuthRepository {
+	return &SQLOAuthRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+const oauthClientColumns = "id, name, secret_hash, token_endpoint_auth_method, redirect_uris, grant_types, scopes, created_at"
+
+func scanOAuthClient(row interface{ Scan(dest ...any) error }) (*model.OAuthClient, error) {
+	var client model.OAuthClient
+	var redirectURIs, grantTypes, scopes string
+	var createdAt int64
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash, &client.TokenEndpointAuthMethod,
+		&redirectURIs, &grantTypes, &scopes, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.GrantTypes = strings.Fields(grantTypes)
+	client.Scopes = strings.Fields(scopes)
+	client.CreatedAt = time.Unix(createdAt, 0)
+	return &client, nil
+}
+
+func (r *SQLOAuthRepository) CreateOAuthClient(client *model.OAuthClient) error {
+	_, err := r.exec("INSERT INTO oauth_clients ("+oauthClientColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		client.ID, client.Name, client.SecretHash, client.TokenEndpointAuthMethod, strings.Join(client.RedirectURIs, " "),
+		strings.Join(client.GrantTypes, " "), strings.Join(client.Scopes, " "), client.CreatedAt.Unix())
+	return err
+}
+
+func (r *SQLOAuthRepository) GetOAuthClient(id string) (*model.OAuthClient, error) {
+	client, err := scanOAuthClient(r.queryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE id = ?;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrClientNotFound
+	}
+	return client, err
+}
+
+func (r *SQLOAuthRepository) ListOAuthClients() ([]model.OAuthClient, error) {
+	rows, err := r.query("SELECT " + oauthClientColumns + " FROM oauth_clients ORDER BY created_at, id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []model.OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *client)
+	}
+	return clients, rows.Err()
+}
+
+func (r *SQLOAuthRepository) DeleteOAuthClient(id string) error {
+	res, err := r.exec("DELETE FROM oauth_clients WHERE id = ?;", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (r *SQLOAuthRepository) CreateAuthorizationCode(code model.OAuthAuthorizationCode) error {
+	_, err := r.exec(`
+		INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+		code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, code.ExpiresAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLOAuthRepository) ConsumeAuthorizationCode(codeHash string, now time.Time) (*model.OAuthAuthorizationCode, error) {
+	// Codes of abandoned sign-ins are never consumed, so clear out the expired ones here
+	if _, err := r.exec("DELETE FROM oauth_authorization_codes WHERE expires_at <= ?;", now.Unix()); err != nil {
+		return nil, err
+	}
+
+	code := model.OAuthAuthorizationCode{CodeHash: codeHash}
+	var expiresAt int64
+	err := r.queryRow(`
+		SELECT client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at
+		FROM oauth_authorization_codes WHERE code_hash = ?;`, codeHash).
+		Scan(&code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.Nonce, &code.CodeChallenge, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the caller whose DELETE removes the row may redeem the code
+	res, err := r.exec("DELETE FROM oauth_authorization_codes WHERE code_hash = ?;", codeHash)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || now.Unix() >= expiresAt {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	code.ExpiresAt = time.Unix(expiresAt, 0)
+	return &code, nil
+}
+
+func (r *SQLOAuthRepository) CreateOAuthToken(token model.OAuthToken) error {
+	var userID sql.NullInt64
+	if token.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(token.UserID), Valid: true}
+	}
+	_, err := r.exec("INSERT INTO oauth_tokens (token_hash, client_id, user_id, scope, issued_at, expires_at) VALUES (?, ?, ?, ?, ?, ?);",
+		token.TokenHash, token.ClientID, userID, token.Scope, token.IssuedAt.Unix(), token.ExpiresAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLOAuthRepository) GetOAuthToken(tokenHash string) (*model.OAuthToken, error) {
+	token := model.OAuthToken{TokenHash: tokenHash}
+	var userID sql.NullInt64
+	var issuedAt, expiresAt int64
+	err := r.queryRow("SELECT client_id, user_id, scope, issued_at, expires_at FROM oauth_tokens WHERE token_hash = ?;", tokenHash).
+		Scan(&token.ClientID, &userID, &token.Scope, &issuedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOAuthTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.UserID = int(userID.Int64)
+	token.IssuedAt = time.Unix(issuedAt, 0)
+	token.ExpiresAt = time.Unix(expiresAt, 0)
+	return &token, nil
+}
+
+func (r *SQLOAuthRepository) DeleteOAuthToken(tokenHash string) error {
+	res, err := r.exec("DELETE FROM oauth_tokens WHERE token_hash = ?;", tokenHash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrOAuthTokenNotFound
+	}
+	return nil
+}
+
+func (r *SQLOAuthRepository) DeleteUserOAuthTokens(userID int) (int, error) {
+	res, err := r.exec("DELETE FROM oauth_tokens WHERE user_id = ?;", userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *SQLOAuthRepository) DeleteExpiredOAuthTokens(now time.Time) (int, error) {
+	res, err := r.exec("DELETE FROM oauth_tokens WHERE expires_at <= ?;", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *SQLOAuthRepository) ListSigningKeys() ([]model.OAuthSigningKey, error) {
+	rows, err := r.query("SELECT id, private_key, created_at FROM oauth_signing_keys ORDER BY created_at DESC, id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []model.OAuthSigningKey{}
+	for rows.Next() {
+		var key model.OAuthSigningKey
+		var createdAt int64
+		if err := rows.Scan(&key.ID, &key.PrivateKey, &createdAt); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r *SQLOAuthRepository) CreateSigningKey(key model.OAuthSigningKey) error {
+	_, err := r.exec("INSERT INTO oauth_signing_keys (id, private_key, created_at) VALUES (?, ?, ?);",
+		key.ID, key.PrivateKey, key.CreatedAt.Unix())
+	return err
+}
+
+func (r *SQLOAuthRepository) DeleteSigningKey(id string) error {
+	_, err := r.exec("DELETE FROM oauth_signing_keys WHERE id = ?;", id)
+	return err
+}
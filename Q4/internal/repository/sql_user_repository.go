@@ -3,10 +3,33 @@ package repository
 import (
 	"Q4/internal/model"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 )
 
+// DBTX is the subset of *sql.DB and *sql.Tx used by the SQL repositories
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// userColumns lists the users columns in the order scanUser reads them
+const userColumns = "id, name, email, role, email_verified"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner, user *model.User) error {
+	return row.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified)
+}
+
 type SQLUserRepository struct {
 	DB *sql.DB
+	tx *sql.Tx
 }
 
 func NewSQLUserRepository(db *sql.DB) *SQLUserRepository {
@@ -15,8 +38,23 @@ func NewSQLUserRepository(db *sql.DB) *SQLUserRepository {
 	}
 }
 
+// WithTx returns a copy of the repository whose queries run inside tx
+func (ur *SQLUserRepository) WithTx(tx *sql.Tx) *SQLUserRepository {
+	return &SQLUserRepository{
+		DB: ur.DB,
+		tx: tx,
+	}
+}
+
+func (ur *SQLUserRepository) conn() DBTX {
+	if ur.tx != nil {
+		return ur.tx
+	}
+	return ur.DB
+}
+
 func (ur *SQLUserRepository) GetAllUsers() ([]model.User, error) {
-	rows, err := ur.DB.Query("SELECT * FROM users;")
+	rows, err := ur.conn().Query("SELECT " + userColumns + " FROM users;")
 	if err != nil {
 		return nil, err
 	}
@@ -30,7 +68,7 @@ func (ur *SQLUserRepository) GetAllUsers() ([]model.User, error) {
 	var users []model.User
 	for rows.Next() {
 		var user model.User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email); err != nil {
+		if err := scanUser(rows, &user); err != nil {
 			return nil, err
 		}
 		users = append(users, user)
@@ -39,11 +77,79 @@ func (ur *SQLUserRepository) GetAllUsers() ([]model.User, error) {
 	return users, nil
 }
 
+// IterateUsers streams the users matching filter ordered by ID without loading them all into memory
+func (ur *SQLUserRepository) IterateUsers(filter model.UserFilter) (UserIterator, error) {
+	query := "SELECT " + userColumns + " FROM users"
+	var conditions []string
+	var args []any
+	if filter.Name != "" {
+		conditions = append(conditions, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(filter.Name)+"%")
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, `email LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(filter.Email)+"%")
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id;"
+
+	rows, err := ur.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlUserIterator{rows: rows}, nil
+}
+
 func (ur *SQLUserRepository) GetUserByID(id int) (*model.User, error) {
-	row := ur.DB.QueryRow("SELECT * FROM users WHERE id = ?", id)
+	row := ur.conn().QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id)
+
+	var user model.User
+	if err := scanUser(row, &user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (ur *SQLUserRepository) GetUsersByIDs(ids []int) ([]model.User, error) {
+	users := []model.User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := ur.conn().Query("SELECT "+userColumns+" FROM users WHERE id IN ("+placeholders+") ORDER BY id;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user model.User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (ur *SQLUserRepository) GetUserByEmail(email string) (*model.User, error) {
+	row := ur.conn().QueryRow("SELECT "+userColumns+" FROM users WHERE email = ?", email)
 
 	var user model.User
-	if err := row.Scan(&user.ID, &user.Name, &user.Email); err != nil {
+	if err := scanUser(row, &user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 
@@ -51,16 +157,175 @@ func (ur *SQLUserRepository) GetUserByID(id int) (*model.User, error) {
 }
 
 func (ur *SQLUserRepository) CreateUser(user *model.User) error {
-	_, err := ur.DB.Exec("INSERT INTO users (name, email) VALUES (?, ?);", user.Name, user.Email)
-	return err
+	user.EmailVerified = false
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
+	res, err := ur.conn().Exec("INSERT INTO users (name, email, role) VALUES (?, ?, ?);", user.Name, user.Email, user.Role)
+	if err != nil {
+		return mapSQLiteError(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = int(id)
+	return nil
 }
 
+// UpdateUser writes the name, email and, unless it is empty, the role; changing the email clears email_verified
 func (ur *SQLUserRepository) UpdateUser(user *model.User) error {
-	_, err := ur.DB.Exec("UPDATE users SET name = ?, email = ? WHERE id = ?;", user.Name, user.Email, user.ID)
-	return err
+	_, err := ur.conn().Exec(`
+		UPDATE users SET
+			name = ?,
+			email = ?,
+			role = COALESCE(NULLIF(?, ''), role),
+			email_verified = CASE WHEN email = ? THEN email_verified ELSE 0 END
+		WHERE id = ?;`, user.Name, user.Email, user.Role, user.Email, user.ID)
+	return mapSQLiteError(err)
 }
 
 func (ur *SQLUserRepository) DeleteUser(id int) error {
-	_, err := ur.DB.Exec("DELETE FROM users WHERE id = ?;", id)
+	_, err := ur.conn().Exec("DELETE FROM users WHERE id = ?;", id)
+	return err
+}
+
+func (ur *SQLUserRepository) MarkEmailVerified(id int, email string) error {
+	res, err := ur.conn().Exec("UPDATE users SET email_verified = 1 WHERE id = ? AND email = ?;", id, email)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (ur *SQLUserRepository) UpsertUsers(users []model.User) ([]UpsertResult, error) {
+	if ur.tx != nil {
+		return upsertUsers(ur.tx, users)
+	}
+
+	tx, err := ur.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := upsertUsers(tx, users)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func upsertUsers(tx *sql.Tx, users []model.User) ([]UpsertResult, error) {
+	selectStmt, err := tx.Prepare("SELECT id FROM users WHERE email = ?;")
+	if err != nil {
+		return nil, err
+	}
+	defer selectStmt.Close()
+
+	insertStmt, err := tx.Prepare("INSERT INTO users (name, email) VALUES (?, ?);")
+	if err != nil {
+		return nil, err
+	}
+	defer insertStmt.Close()
+
+	updateStmt, err := tx.Prepare("UPDATE users SET name = ? WHERE id = ?;")
+	if err != nil {
+		return nil, err
+	}
+	defer updateStmt.Close()
+
+	results := make([]UpsertResult, 0, len(users))
+	for _, user := range users {
+		var id int
+		err := selectStmt.QueryRow(user.Email).Scan(&id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			res, err := insertStmt.Exec(user.Name, user.Email)
+			if err != nil {
+				return nil, mapSQLiteError(err)
+			}
+			lastID, err := res.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, UpsertResult{ID: int(lastID), Created: true})
+		case err != nil:
+			return nil, err
+		default:
+			if _, err := updateStmt.Exec(user.Name, id); err != nil {
+				return nil, err
+			}
+			results = append(results, UpsertResult{ID: id})
+		}
+	}
+
+	return results, nil
+}
+
+type sqlUserIterator struct {
+	rows *sql.Rows
+	user model.User
+	err  error
+}
+
+func (it *sqlUserIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+	it.err = scanUser(it.rows, &it.user)
+	return it.err == nil
+}
+
+func (it *sqlUserIterator) User() model.User {
+	return it.user
+}
+
+func (it *sqlUserIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *sqlUserIterator) Close() error {
+	return it.rows.Close()
+}
+
+// SQLite result codes for constraint violations
+const (
+	sqliteConstraint       = 19
+	sqliteConstraintUnique = 2067
+)
+
+// mapSQLiteError translates driver errors into the repository's sentinel errors
+func mapSQLiteError(err error) error {
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		code := coded.Code()
+		if code == sqliteConstraintUnique || (code == sqliteConstraint && strings.Contains(err.Error(), "UNIQUE")) {
+			return fmt.Errorf("%w: %v", ErrDuplicateEmail, err)
+		}
+	}
 	return err
 }
+
+// requireAffected returns ErrUserNotFound when an UPDATE matched no rows
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/search"
+	"strings"
+)
+
+// SearchUsers queries the users_fts index, ranking with bm25 and weighting name matches above
+// email matches. If no user matches it falls back to trigram similarity over candidates that
+// share at least one trigram with the query.
+func (ur *SQLUserRepository) SearchUsers(query SearchQuery) (*SearchResult, error) {
+	tokens := search.Tokenize(query.Text)
+	if len(tokens) == 0 {
+		return &SearchResult{Hits: []SearchHit{}}, nil
+	}
+
+	match := make([]string, len(tokens))
+	for i, token := range tokens {
+		match[i] = ftsQuote(token) + "*"
+	}
+	expr := strings.Join(match, " ")
+
+	result := &SearchResult{Hits: []SearchHit{}}
+	if err := ur.conn().QueryRow("SELECT count(*) FROM users_fts WHERE users_fts MATCH ?;", expr).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+	if result.Total == 0 {
+		return ur.searchFuzzy(query)
+	}
+
+	rows, err := ur.conn().Query(`
+		SELECT u.id, u.name, u.email, u.role, u.email_verified,
+			highlight(users_fts, 0, ?, ?),
+			highlight(users_fts, 1, ?, ?),
+			bm25(users_fts, 10.0, 5.0) AS rank
+		FROM users_fts
+		JOIN users u ON u.id = users_fts.rowid
+		WHERE users_fts MATCH ?
+		ORDER BY rank, u.id
+		LIMIT ? OFFSET ?;`,
+		search.MarkStart, search.MarkEnd, search.MarkStart, search.MarkEnd, expr, query.Limit, query.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hit SearchHit
+		var rank float64
+		if err := rows.Scan(&hit.User.ID, &hit.User.Name, &hit.User.Email, &hit.User.Role, &hit.User.EmailVerified, &hit.NameHighlight, &hit.EmailHighlight, &rank); err != nil {
+			return nil, err
+		}
+		// bm25 is negative with better matches further from zero
+		hit.Score = -rank
+		hit.NameHighlight = search.Highlight(hit.NameHighlight)
+		hit.EmailHighlight = search.Highlight(hit.EmailHighlight)
+		result.Hits = append(result.Hits, hit)
+	}
+	return result, rows.Err()
+}
+
+func (ur *SQLUserRepository) searchFuzzy(query SearchQuery) (*SearchResult, error) {
+	var grams []string
+	for gram := range search.Trigrams(query.Text) {
+		// The trigram tokenizer does not index the padding used for word boundaries
+		if !strings.Contains(gram, " ") {
+			grams = append(grams, ftsQuote(gram))
+		}
+	}
+	if len(grams) == 0 {
+		return &SearchResult{Fuzzy: true, Hits: []SearchHit{}}, nil
+	}
+
+	rows, err := ur.conn().Query(`
+		SELECT u.id, u.name, u.email, u.role, u.email_verified
+		FROM users_trigram
+		JOIN users u ON u.id = users_trigram.rowid
+		WHERE users_trigram MATCH ?
+		ORDER BY rank
+		LIMIT ?;`, strings.Join(grams, " OR "), fuzzyCandidateLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []model.User
+	for rows.Next() {
+		var user model.User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rankFuzzy(query.Text, candidates, query.Limit, query.Offset), nil
+}
+
+// ftsQuote makes s an FTS5 string literal so that operators and punctuation are matched literally
+func ftsQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLWebAuthnRepository implements WebAuthnRepository on SQLite or PostgreSQL
+type SQLWebAuthnRepository struct {
+	sqlAuthConn
+}
+
+func NewSQLWebAuthnRepository(db DBTX) *SQLWebAuthnRepository {
+	return &SQLWebAuthnRepository{sqlAuthConn{db: db, dialect: dialectSQLite}}
+}
+
+func NewPostgresWebAuthnRepository(db DBTX) *SQLWebAuthnRepository {
+	return &SQLWebAuthnRepository{sqlAuthConn{db: db, dialect: dialectPostgres}}
+}
+
+const webAuthnCredentialColumns = "id, user_id, name, public_key, sign_count, aaguid, attestation_format, transports, created_at, last_used_at"
+
+func scanWebAuthnCredential(row interface{ Scan(dest ...any) error }) (*model.WebAuthnCredential, error) {
+	var credential model.WebAuthnCredential
+	var transports string
+	var signCount, createdAt int64
+	var lastUsedAt sql.NullInt64
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.Name, &credential.PublicKey, &signCount,
+		&credential.AAGUID, &credential.AttestationFormat, &transports, &createdAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	credential.SignCount = uint32(signCount)
+	if transports != "" {
+		credential.Transports = strings.Split(transports, ",")
+	}
+	credential.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsedAt.Valid {
+		t := time.Unix(lastUsedAt.Int64, 0)
+		credential.LastUsedAt = &t
+	}
+	return &credential, nil
+}
+
+func (r *SQLWebAuthnRepository) CreateWebAuthnCredential(credential *model.WebAuthnCredential) error {
+	_, err := r.exec("INSERT INTO webauthn_credentials ("+webAuthnCredentialColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL);",
+		credential.ID, credential.UserID, credential.Name, credential.PublicKey, int64(credential.SignCount),
+		credential.AAGUID, credential.AttestationFormat, strings.Join(credential.Transports, ","), credential.CreatedAt.Unix())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicateCredential, err)
+	}
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLWebAuthnRepository) GetWebAuthnCredential(id string) (*model.WebAuthnCredential, error) {
+	credential, err := scanWebAuthnCredential(r.queryRow("SELECT "+webAuthnCredentialColumns+" FROM webauthn_credentials WHERE id = ?;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCredentialNotFound
+	}
+	return credential, err
+}
+
+func (r *SQLWebAuthnRepository) ListWebAuthnCredentials(userID int) ([]model.WebAuthnCredential, error) {
+	rows, err := r.query("SELECT "+webAuthnCredentialColumns+" FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at, id;", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []model.WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (r *SQLWebAuthnRepository) UpdateWebAuthnSignCount(id string, signCount uint32, usedAt time.Time) error {
+	// Checking the counter in the statement keeps two sign-ins racing with the same counter
+	// value from both succeeding
+	res, err := r.exec(`
+		UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ?
+		WHERE id = ? AND (sign_count < ? OR (sign_count = 0 AND sign_count = ?));`,
+		int64(signCount), usedAt.Unix(), id, int64(signCount), int64(signCount))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := r.GetWebAuthnCredential(id); err != nil {
+			return err
+		}
+		return ErrSignCountStale
+	}
+	return nil
+}
+
+func (r *SQLWebAuthnRepository) DeleteWebAuthnCredential(userID int, id string) error {
+	res, err := r.exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?;", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+func (r *SQLWebAuthnRepository) CreateWebAuthnChallenge(challenge model.WebAuthnChallenge) error {
+	var userID sql.NullInt64
+	if challenge.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(challenge.UserID), Valid: true}
+	}
+	_, err := r.exec("INSERT INTO webauthn_challenges (challenge, user_id, purpose, expires_at) VALUES (?, ?, ?, ?);",
+		challenge.Challenge, userID, challenge.Purpose, challenge.ExpiresAt.Unix())
+	return mapForeignKeyError(err)
+}
+
+func (r *SQLWebAuthnRepository) ConsumeWebAuthnChallenge(challenge string, now time.Time) (*model.WebAuthnChallenge, error) {
+	// Challenges of abandoned ceremonies are never consumed, so clear out the expired ones here
+	if _, err := r.exec("DELETE FROM webauthn_challenges WHERE expires_at <= ?;", now.Unix()); err != nil {
+		return nil, err
+	}
+
+	found := model.WebAuthnChallenge{Challenge: challenge}
+	var userID sql.NullInt64
+	var expiresAt int64
+	err := r.queryRow("SELECT user_id, purpose, expires_at FROM webauthn_challenges WHERE challenge = ?;", challenge).
+		Scan(&userID, &found.Purpose, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the caller whose DELETE removes the row may use the challenge
+	res, err := r.exec("DELETE FROM webauthn_challenges WHERE challenge = ?;", challenge)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || now.Unix() >= expiresAt {
+		return nil, ErrChallengeNotFound
+	}
+	found.UserID = int(userID.Int64)
+	found.ExpiresAt = time.Unix(expiresAt, 0)
+	return &found, nil
+}
@@ -0,0 +1,73 @@
+package repository
+
+import "database/sql"
+
+// Store bundles the repositories and transaction manager of one storage backend
+type Store struct {
+	Users       UserRepository
+	Passwords   PasswordRepository
+	Sessions    SessionRepository
+	ResetTokens PasswordResetRepository
+	MFA         MFARepository
+	WebAuthn    WebAuthnRepository
+	OAuth       OAuthRepository
+	APIKeys     APIKeyRepository
+	// IdempotencyKeys records are written outside of transactions, which would otherwise hide a
+	// claimed key from concurrent requests
+	IdempotencyKeys IdempotencyKeyRepository
+	Tx              TxManager
+	// Close releases the resources held by the backend, such as its connection pool
+	Close func() error
+}
+
+// NewSQLiteStore returns the repositories of a SQLite database opened with database.Open
+func NewSQLiteStore(db *sql.DB) *Store {
+	return &Store{
+		Users:           NewSQLUserRepository(db),
+		Passwords:       NewSQLPasswordRepository(db),
+		Sessions:        NewSQLSessionRepository(db),
+		ResetTokens:     NewSQLPasswordResetRepository(db),
+		MFA:             NewSQLMFARepository(db),
+		WebAuthn:        NewSQLWebAuthnRepository(db),
+		OAuth:           NewSQLOAuthRepository(db),
+		APIKeys:         NewSQLAPIKeyRepository(db),
+		IdempotencyKeys: NewSQLIdempotencyKeyRepository(db),
+		Tx:              NewSQLTxManager(db),
+		Close:           db.Close,
+	}
+}
+
+// NewPostgresStore returns the repositories of a migrated PostgreSQL database
+func NewPostgresStore(db *sql.DB) *Store {
+	return &Store{
+		Users:           NewPostgresUserRepository(db),
+		Passwords:       NewPostgresPasswordRepository(db),
+		Sessions:        NewPostgresSessionRepository(db),
+		ResetTokens:     NewPostgresPasswordResetRepository(db),
+		MFA:             NewPostgresMFARepository(db),
+		WebAuthn:        NewPostgresWebAuthnRepository(db),
+		OAuth:           NewPostgresOAuthRepository(db),
+		APIKeys:         NewPostgresAPIKeyRepository(db),
+		IdempotencyKeys: NewPostgresIdempotencyKeyRepository(db),
+		Tx:              NewPostgresTxManager(db),
+		Close:           db.Close,
+	}
+}
+
+// NewMemoryStore returns an empty in-memory store whose data is lost when the process exits
+func NewMemoryStore() *Store {
+	users := NewMemoryUserRepository()
+	return &Store{
+		Users:           users,
+		Passwords:       NewMemoryPasswordRepository(users),
+		Sessions:        NewMemorySessionRepository(users),
+		ResetTokens:     NewMemoryPasswordResetRepository(users),
+		MFA:             NewMemoryMFARepository(users),
+		WebAuthn:        NewMemoryWebAuthnRepository(users),
+		OAuth:           NewMemoryOAuthRepository(users),
+		APIKeys:         NewMemoryAPIKeyRepository(users),
+		IdempotencyKeys: NewMemoryIdempotencyKeyRepository(users),
+		Tx:              NewMemoryTxManager(users),
+		Close:           func() error { return nil },
+	}
+}
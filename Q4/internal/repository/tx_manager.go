@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SQLite result codes that mean another connection holds a conflicting lock
+const (
+	sqliteBusy   = 5
+	sqliteLocked = 6
+)
+
+const (
+	DefaultTxMaxRetries = 5
+	DefaultTxRetryDelay = 20 * time.Millisecond
+)
+
+// Repositories groups every repository bound to the same transaction
+type Repositories struct {
+	Users       UserRepository
+	Passwords   PasswordRepository
+	Sessions    SessionRepository
+	ResetTokens PasswordResetRepository
+	MFA         MFARepository
+	WebAuthn    WebAuthnRepository
+	OAuth       OAuthRepository
+	APIKeys     APIKeyRepository
+}
+
+// TxManager runs closures inside a database transaction
+type TxManager interface {
+	// WithinTx commits when fn returns nil and rolls back when it returns an error or panics.
+	// Calling WithinTx again with the ctx passed to fn opens a savepoint in the same transaction.
+	WithinTx(ctx context.Context, fn func(ctx context.Context, repos Repositories) error) error
+}
+
+type SQLTxManager struct {
+	DB *sql.DB
+	// Bind returns the repositories that run their queries inside tx
+	Bind func(tx *sql.Tx) Repositories
+	// Retryable reports whether a failed transaction should be retried from the start.
+	// Retrying re-runs fn, so it must not have side effects outside the transaction.
+	Retryable  func(err error) bool
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+// NewSQLTxManager returns a transaction manager for SQLite that retries when the database is busy
+func NewSQLTxManager(db *sql.DB) *SQLTxManager {
+	return &SQLTxManager{
+		DB: db,
+		Bind: func(tx *sql.Tx) Repositories {
+			return Repositories{
+				Users:       NewSQLUserRepository(db).WithTx(tx),
+				Passwords:   NewSQLPasswordRepository(tx),
+				Sessions:    NewSQLSessionRepository(tx),
+				ResetTokens: NewSQLPasswordResetRepository(tx),
+				MFA:         NewSQLMFARepository(tx),
+				WebAuthn:    NewSQLWebAuthnRepository(tx),
+				OAuth:       NewSQLOAuthRepository(tx),
+				APIKeys:     NewSQLAPIKeyRepository(tx),
+			}
+		},
+		Retryable:  IsBusy,
+		MaxRetries: DefaultTxMaxRetries,
+		RetryDelay: DefaultTxRetryDelay,
+	}
+}
+
+type txKey struct{}
+
+type txState struct {
+	tx         *sql.Tx
+	repos      Repositories
+	savepoints int
+}
+
+func (m *SQLTxManager) WithinTx(ctx context.Context, fn func(ctx context.Context, repos Repositories) error) error {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok {
+		return m.withinSavepoint(ctx, state, fn)
+	}
+
+	delay := m.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := m.runTx(ctx, fn)
+		if err == nil || m.Retryable == nil || !m.Retryable(err) || attempt >= m.MaxRetries {
+			return err
+		}
+
+		logrus.Warnf("Transaction conflict, retrying transaction (attempt %d of %d): %v", attempt+1, m.MaxRetries, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (m *SQLTxManager) runTx(ctx context.Context, fn func(ctx context.Context, repos Repositories) error) (err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	state := &txState{
+		tx:    tx,
+		repos: m.Bind(tx),
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, txKey{}, state), state.repos); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *SQLTxManager) withinSavepoint(ctx context.Context, state *txState, fn func(ctx context.Context, repos Repositories) error) (err error) {
+	state.savepoints++
+	name := fmt.Sprintf("sp_%d", state.savepoints)
+
+	if _, err := state.tx.ExecContext(ctx, "SAVEPOINT "+name+";"); err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_, _ = state.tx.Exec("ROLLBACK TO SAVEPOINT " + name + ";")
+			panic(p)
+		}
+	}()
+
+	if err := fn(ctx, state.repos); err != nil {
+		if _, rbErr := state.tx.Exec("ROLLBACK TO SAVEPOINT " + name + ";"); rbErr != nil {
+			return fmt.Errorf("%w (rollback to savepoint failed: %v)", err, rbErr)
+		}
+		_, _ = state.tx.Exec("RELEASE SAVEPOINT " + name + ";")
+		return err
+	}
+
+	_, err = state.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name+";")
+	return err
+}
+
+// IsBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED, including their extended codes
+func IsBusy(err error) bool {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return false
+	}
+	primary := coded.Code() & 0xff
+	return primary == sqliteBusy || primary == sqliteLocked
+}
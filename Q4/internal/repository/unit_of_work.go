@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Transaction gives access to repositories bound to a single unit of work
+type Transaction interface {
+	Users() UserRepository
+	Passwords() PasswordRepository
+	// Savepoint runs fn so that its changes are undone if it fails, without aborting the transaction
+	Savepoint(fn func() error) error
+}
+
+// UnitOfWork runs a group of repository operations atomically
+type UnitOfWork interface {
+	// Do commits when fn returns nil and rolls every change back otherwise
+	Do(fn func(tx Transaction) error) error
+}
+
+// SQLUnitOfWork adapts a TxManager to the UnitOfWork interface
+type SQLUnitOfWork struct {
+	Tx TxManager
+}
+
+func NewSQLUnitOfWork(db *sql.DB) *SQLUnitOfWork {
+	return NewTxUnitOfWork(NewSQLTxManager(db))
+}
+
+func NewTxUnitOfWork(tx TxManager) *SQLUnitOfWork {
+	return &SQLUnitOfWork{
+		Tx: tx,
+	}
+}
+
+func (uow *SQLUnitOfWork) Do(fn func(tx Transaction) error) error {
+	return uow.Tx.WithinTx(context.Background(), func(ctx context.Context, repos Repositories) error {
+		return fn(&txTransaction{ctx: ctx, repos: repos, manager: uow.Tx})
+	})
+}
+
+type txTransaction struct {
+	ctx     context.Context
+	repos   Repositories
+	manager TxManager
+}
+
+func (t *txTransaction) Users() UserRepository {
+	return t.repos.Users
+}
+
+func (t *txTransaction) Passwords() PasswordRepository {
+	return t.repos.Passwords
+}
+
+func (t *txTransaction) Savepoint(fn func() error) error {
+	return t.manager.WithinTx(t.ctx, func(context.Context, Repositories) error {
+		return fn()
+	})
+}
@@ -1,12 +1,48 @@
 package repository
 
-import "Q4/internal/model"
+import (
+	"Q4/internal/model"
+	"errors"
+)
+
+var (
+	// ErrUserNotFound is returned when no user matches the requested lookup
+	ErrUserNotFound = errors.New("user not found")
+	// ErrDuplicateEmail is returned when a write would give two users the same email
+	ErrDuplicateEmail = errors.New("email already in use")
+)
+
+// UpsertResult describes the outcome of upserting a single user
+type UpsertResult struct {
+	ID      int
+	Created bool
+}
+
+// UserIterator streams users one row at a time; callers must always Close it
+type UserIterator interface {
+	Next() bool
+	User() model.User
+	Err() error
+	Close() error
+}
 
 // UserRepository defines the methods for user operations
 type UserRepository interface {
 	GetAllUsers() ([]model.User, error)
+	IterateUsers(filter model.UserFilter) (UserIterator, error)
 	GetUserByID(id int) (*model.User, error)
+	// GetUsersByIDs returns the users with the given IDs in one lookup, ordered by ID. Unknown IDs
+	// are left out.
+	GetUsersByIDs(ids []int) ([]model.User, error)
+	GetUserByEmail(email string) (*model.User, error)
 	CreateUser(user *model.User) error
 	UpdateUser(user *model.User) error
 	DeleteUser(id int) error
+	// MarkEmailVerified marks the user as verified if their email is still email, so that a
+	// verification link sent before an email change cannot verify the new address.
+	// It returns ErrUserNotFound when no user has that ID and email.
+	MarkEmailVerified(id int, email string) error
+	// UpsertUsers creates or updates the given users by email inside a single
+	// transaction and returns one result per user, in the same order
+	UpsertUsers(users []model.User) ([]UpsertResult, error)
 }
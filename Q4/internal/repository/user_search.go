@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/search"
+	"errors"
+	"sort"
+)
+
+// ErrSearchUnsupported is returned by services whose repository does not implement UserSearcher
+var ErrSearchUnsupported = errors.New("search is not supported by this storage backend")
+
+// Typo-tolerant matching only considers this many candidates and keeps those at least this similar
+const (
+	fuzzyCandidateLimit = 200
+	fuzzyMinSimilarity  = 0.3
+)
+
+type SearchQuery struct {
+	Text   string
+	Limit  int
+	Offset int
+}
+
+// SearchHit is a matching user; highlights are HTML-escaped with matches wrapped in <mark>
+type SearchHit struct {
+	User           model.User `json:"user"`
+	Score          float64    `json:"score"`
+	NameHighlight  string     `json:"name_highlight"`
+	EmailHighlight string     `json:"email_highlight"`
+}
+
+type SearchResult struct {
+	Total int         `json:"total"`
+	Fuzzy bool        `json:"fuzzy"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+// UserSearcher is implemented by repositories that support full-text search.
+// Every query token is matched as a word prefix; when nothing matches, implementations
+// fall back to trigram similarity so that misspelled names still find candidates.
+type UserSearcher interface {
+	SearchUsers(query SearchQuery) (*SearchResult, error)
+}
+
+// rankFuzzy scores candidates by trigram similarity and returns the requested page of matches
+func rankFuzzy(text string, candidates []model.User, limit, offset int) *SearchResult {
+	result := &SearchResult{Fuzzy: true, Hits: []SearchHit{}}
+
+	var hits []SearchHit
+	for _, user := range candidates {
+		score := search.BestSimilarity(text, user.Name, user.Email)
+		if score < fuzzyMinSimilarity {
+			continue
+		}
+		hits = append(hits, SearchHit{
+			User:           user,
+			Score:          score,
+			NameHighlight:  search.Highlight(user.Name),
+			EmailHighlight: search.Highlight(user.Email),
+		})
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+
+	result.Total = len(hits)
+	if offset < len(hits) {
+		end := min(offset+limit, len(hits))
+		result.Hits = hits[offset:end]
+	}
+	return result
+}
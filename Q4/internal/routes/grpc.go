@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"Q4/config"
+	"Q4/internal/repository"
+	"Q4/internal/rpc"
+	"Q4/internal/service"
+
+	"google.golang.org/grpc"
+)
+
+// SetupGRPC builds the gRPC server of services, from NewUserService. Calls authenticate with the
+// same sessions, API keys and client certificates as the HTTP API; opts add server options such
+// as TLS credentials.
+func SetupGRPC(store *repository.Store, services *service.UserService, cfg config.Config, opts ...grpc.ServerOption) *grpc.Server {
+	// Only Authenticate and AuthenticateCertificate are used, which send no mail
+	authService := service.NewAuthService(store, nil, "")
+	authService.APIKeys = service.NewAPIKeyService(store)
+	users := rpc.NewUserServer(services, services.Events)
+	users.WatchBuffer = cfg.EventBuffer
+	return rpc.NewServer(users, authService, opts...)
+}
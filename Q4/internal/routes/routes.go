@@ -2,32 +2,264 @@ package routes
 
 import (
 	"Q4/config"
+	"Q4/internal/auth"
+	"Q4/internal/cors"
+	"Q4/internal/gql"
 	"Q4/internal/handler"
+	"Q4/internal/idempotency"
+	"Q4/internal/mail"
+	"Q4/internal/middleware"
+	"Q4/internal/ratelimit"
 	"Q4/internal/repository"
 	"Q4/internal/service"
-	"database/sql"
+	"Q4/internal/webauthn"
+	"Q4/internal/ws"
+	"expvar"
 	"github.com/gorilla/mux"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"net/http"
+	"strings"
+	"time"
 )
 
-func SetupRouter(db *sql.DB) *mux.Router {
-	repo := repository.NewSQLUserRepository(db)
-	services := service.NewUserService(repo)
+// NewUserService returns the user service that the HTTP API and the gRPC server share, so that
+// both send verification links that either can check. Changes to users are published to events.
+func NewUserService(store *repository.Store, mailer mail.Mailer, events *service.UserEvents, cfg config.Config) *service.UserService {
+	publicURL := strings.TrimRight(cfg.PublicURL, "/")
+	verification := service.NewEmailVerificationService(store.Users, mailer, auth.NewSigner(cfg.TokenSecret), publicURL+"/verify-email")
+	verification.TTL = cfg.EmailVerificationTTL
+	return &service.UserService{Repo: store.Users, Verification: verification, Tx: store.Tx, Passwords: store.Passwords, Events: events}
+}
+
+// NewHub returns the WebSocket hub for the changes published to events. Main runs it with Run and
+// stops it with Shutdown.
+func NewHub(events *service.UserEvents, cfg config.Config) *ws.Hub {
+	hub := ws.NewHub(events)
+	hub.Buffer = cfg.EventBuffer
+	hub.PingInterval = cfg.WebSocketPingInterval
+	return hub
+}
+
+// SetupRouter builds the API on top of services, from NewUserService. Per-route rate limits keep
+// their counters in limits, next to the server-wide limit that main applies. WebSocket clients are
+// handed to hub, from NewHub.
+func SetupRouter(store *repository.Store, services *service.UserService, hub *ws.Hub, mailer mail.Mailer, limits ratelimit.Store, cfg config.Config) *mux.Router {
+	repo := store.Users
+	signer := auth.NewSigner(cfg.TokenSecret)
+
+	publicURL := strings.TrimRight(cfg.PublicURL, "/")
+
+	verification := services.Verification
+	authService := service.NewAuthService(store, mailer, publicURL+"/reset-password")
+	authService.SessionTTL = cfg.SessionTTL
+	authService.ResetTTL = cfg.PasswordResetTTL
+	authService.AccountLockout = ratelimit.NewLockout(cfg.LockoutThreshold, cfg.LockoutDuration)
+	authService.IPLockout = ratelimit.NewLockout(cfg.LockoutIPThreshold, cfg.LockoutDuration)
+	mfaService := service.NewMFAService(store, signer, cfg.MFAIssuer, cfg.MFARequiredRoles)
+	authService.MFA = mfaService
+	apiKeyService := service.NewAPIKeyService(store)
+	apiKeyService.TTL = cfg.APIKeyTTL
+	apiKeyService.RotationOverlap = cfg.APIKeyRotationOverlap
+	authService.APIKeys = apiKeyService
+	apiKeyHandlers := handler.NewAPIKeyHandler(apiKeyService)
+	cookies := auth.SessionCookies{Secure: cfg.SessionCookieSecure, SameSite: cfg.SessionCookieSameSite}
+	authHandlers := handler.NewAuthHandler(verification, authService)
+	authHandlers.Cookies = cookies
+	mfaHandlers := handler.NewMFAHandler(mfaService)
+	webAuthnService := service.NewWebAuthnService(store, authService, &webauthn.RelyingParty{
+		ID:      cfg.WebAuthnRPID,
+		Name:    cfg.MFAIssuer,
+		Origins: cfg.WebAuthnOrigins,
+	})
+	if cfg.TokenSecret != "" {
+		// Keeps the placeholders listed for emails without passkeys the same across restarts
+		webAuthnService.PlaceholderKey = []byte(cfg.TokenSecret)
+	}
+	webAuthnHandlers := handler.NewWebAuthnHandler(webAuthnService)
+	webAuthnHandlers.Cookies = cookies
+	sessionHandlers := handler.NewSessionHandler(service.NewSessionService(store))
+	// The issuer is the public URL itself, so that discovery lives at <public-url>/.well-known/openid-configuration
+	oidcService := service.NewOIDCService(store, publicURL, cfg.OIDCAuthorizeURL)
+	oidcService.TokenTTL = cfg.OIDCTokenTTL
+	oidcService.KeyRotation = cfg.OIDCKeyRotation
+	oidcHandlers := handler.NewOIDCHandler(oidcService)
+
 	handlers := handler.NewUserHandler(services)
+	importService := service.NewImportService(repo)
+	importService.Events = services.Events
+	importHandlers := handler.NewImportHandler(importService)
+	batchService := service.NewBatchService(repository.NewTxUnitOfWork(store.Tx))
+	batchService.Events = services.Events
+	batchHandlers := handler.NewBatchHandler(batchService)
+	schema, err := gql.NewSchema(services, cfg.GraphQLMaxDepth)
+	if err != nil {
+		// The schema is embedded, so this only fails for a broken build
+		panic(err)
+	}
+	schema.MaxComplexity = cfg.GraphQLMaxComplexity
+	graphQLHandlers := handler.NewGraphQLHandler(schema)
+	eventHandlers := handler.NewUserEventHandler(services.Events)
+	eventHandlers.Buffer = cfg.EventBuffer
+	eventHandlers.Heartbeat = cfg.EventHeartbeat
+	webSocketHandlers := handler.NewWebSocketHandler(hub, cfg.CORS)
+
+	// Stricter limits for the routes that are costly or attractive to abuse
+	limitSignups := middleware.RateLimit(middleware.RateLimitPolicy{
+		Name:    "signup",
+		Limiter: ratelimit.NewSlidingWindowCounter(limits, 20, time.Hour),
+		Key:     middleware.KeyByUser,
+	})
+	limitLogins := middleware.RateLimit(middleware.RateLimitPolicy{
+		Name:    "login",
+		Limiter: ratelimit.NewTokenBucket(limits, 30, time.Minute),
+		Key:     middleware.KeyByIP,
+	})
+	limitBulk := middleware.RateLimit(middleware.RateLimitPolicy{
+		Name:    "bulk",
+		Limiter: ratelimit.NewSlidingWindowCounter(limits, 10, time.Minute),
+		Key:     middleware.KeyByUser,
+	})
+	limitGraphQL := middleware.RateLimit(middleware.RateLimitPolicy{
+		Name:    "graphql",
+		Limiter: ratelimit.NewSlidingWindowCounter(limits, 300, time.Minute),
+		Key:     middleware.KeyByUser,
+	})
+
+	// Retries of creates with an Idempotency-Key get the first response instead of a duplicate.
+	// Routes whose responses hold secrets, such as issued API keys, are left out so that those are
+	// never stored.
+	idempotencyKeys := idempotency.NewKeys(store.IdempotencyKeys)
+	idempotencyKeys.TTL = cfg.IdempotencyTTL
+	idempotent := middleware.Idempotency(idempotencyKeys)
 
 	router := mux.NewRouter()
 
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
-	apiRouter.Use(config.CorsMiddleware)
+	apiRouter.Use(middleware.AuthMiddleware(authService))
+
+	// API keys reach the user routes only within the scopes of their service principal
+	readUsers := middleware.RequireScope(auth.ScopeUsersRead)
+	writeUsers := middleware.RequireScope(auth.ScopeUsersWrite)
+	apiRouter.Handle("/users:import", writeUsers(limitBulk(http.HandlerFunc(importHandlers.ImportUsers)))).Methods("POST")
+	apiRouter.Handle("/users:import/{jobId}", readUsers(http.HandlerFunc(importHandlers.GetImportJob))).Methods("GET")
+	apiRouter.Handle("/users:export", readUsers(http.HandlerFunc(handlers.ExportUsers))).Methods("GET")
+	apiRouter.Handle("/users:batch", writeUsers(idempotent(limitBulk(http.HandlerFunc(batchHandlers.BatchUsers))))).Methods("POST")
+
+	apiRouter.Handle("/users", readUsers(http.HandlerFunc(handlers.GetAllUsers))).Methods("GET")
+	// Registered before /users/{id} so that "search" and "events" are not taken for IDs
+	apiRouter.Handle("/users/search", readUsers(http.HandlerFunc(handlers.SearchUsers))).Methods("GET")
+	apiRouter.Handle("/users/events", readUsers(http.HandlerFunc(eventHandlers.StreamUserEvents))).Methods("GET")
+	apiRouter.Handle("/users/{id}", readUsers(http.HandlerFunc(handlers.GetUserByID))).Methods("GET")
+	apiRouter.Handle("/users", writeUsers(idempotent(limitSignups(http.HandlerFunc(handlers.CreateUser))))).Methods("POST")
+	apiRouter.Handle("/users/{id}", writeUsers(http.HandlerFunc(handlers.UpdateUser))).Methods("PUT")
+	apiRouter.Handle("/users/{id}", writeUsers(http.HandlerFunc(handlers.DeleteUser))).Methods("DELETE")
+	apiRouter.Handle("/users/{id}/sessions", middleware.RequireAuth(http.HandlerFunc(sessionHandlers.ListUserSessions))).Methods("GET")
+	apiRouter.Handle("/users/{id}/sessions", middleware.RequireAuth(http.HandlerFunc(sessionHandlers.RevokeUserSessions))).Methods("DELETE")
+	apiRouter.Handle("/users/{id}/unlock", middleware.RequireAuth(http.HandlerFunc(authHandlers.UnlockUser))).Methods("POST")
+	apiRouter.Handle("/users/{id}/sessions/{sessionId}", middleware.RequireAuth(http.HandlerFunc(sessionHandlers.RevokeUserSession))).Methods("DELETE")
 
-	apiRouter.HandleFunc("/users", handlers.GetAllUsers).Methods("GET")
-	apiRouter.HandleFunc("/users/{id}", handlers.GetUserByID).Methods("GET")
-	apiRouter.HandleFunc("/users", handlers.CreateUser).Methods("POST")
-	apiRouter.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-	apiRouter.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+	apiRouter.HandleFunc("/auth/verify-email", authHandlers.VerifyEmail).Methods("POST")
+	apiRouter.HandleFunc("/auth/verify-email/resend", authHandlers.ResendVerification).Methods("POST")
+	apiRouter.Handle("/auth/login", limitLogins(http.HandlerFunc(authHandlers.Login))).Methods("POST")
+	apiRouter.Handle("/auth/logout", middleware.RequireAuth(http.HandlerFunc(authHandlers.Logout))).Methods("POST")
+	apiRouter.Handle("/auth/unlock-ip", middleware.RequireAuth(http.HandlerFunc(authHandlers.UnlockIP))).Methods("POST")
+	apiRouter.HandleFunc("/auth/password/forgot", authHandlers.ForgotPassword).Methods("POST")
+	apiRouter.HandleFunc("/auth/password/reset", authHandlers.ResetPassword).Methods("POST")
+	apiRouter.HandleFunc("/auth/mfa/verify", authHandlers.VerifyMFA).Methods("POST")
+	apiRouter.Handle("/auth/mfa", middleware.RequireAuth(http.HandlerFunc(mfaHandlers.GetMFAStatus))).Methods("GET")
+	// Enrollment also accepts the MFA token of users the policy keeps from signing in, so it checks auth itself
+	apiRouter.HandleFunc("/auth/mfa/enroll", mfaHandlers.BeginMFAEnrollment).Methods("POST")
+	apiRouter.Handle("/auth/mfa/enroll/confirm", middleware.RequireAuth(http.HandlerFunc(mfaHandlers.ConfirmMFAEnrollment))).Methods("POST")
+	apiRouter.Handle("/auth/mfa/recovery-codes", middleware.RequireAuth(http.HandlerFunc(mfaHandlers.RegenerateRecoveryCodes))).Methods("POST")
+	apiRouter.Handle("/auth/mfa/disable", middleware.RequireAuth(http.HandlerFunc(mfaHandlers.DisableMFA))).Methods("POST")
+	apiRouter.Handle("/auth/webauthn/register/begin", middleware.RequireAuth(http.HandlerFunc(webAuthnHandlers.BeginWebAuthnRegistration))).Methods("POST")
+	apiRouter.Handle("/auth/webauthn/register/finish", middleware.RequireAuth(http.HandlerFunc(webAuthnHandlers.FinishWebAuthnRegistration))).Methods("POST")
+	apiRouter.HandleFunc("/auth/webauthn/login/begin", webAuthnHandlers.BeginWebAuthnLogin).Methods("POST")
+	apiRouter.Handle("/auth/webauthn/login/finish", limitLogins(http.HandlerFunc(webAuthnHandlers.FinishWebAuthnLogin))).Methods("POST")
+	apiRouter.Handle("/auth/webauthn/credentials", middleware.RequireAuth(http.HandlerFunc(webAuthnHandlers.ListWebAuthnCredentials))).Methods("GET")
+	apiRouter.Handle("/auth/webauthn/credentials/{id}", middleware.RequireAuth(http.HandlerFunc(webAuthnHandlers.DeleteWebAuthnCredential))).Methods("DELETE")
 
-	router.PathPrefix("/swagger/").Handler(httpSwagger.Handler(
-		httpSwagger.URL("/swagger/doc.json")))
+	apiRouter.Handle("/oauth/clients", middleware.RequireAuth(http.HandlerFunc(oidcHandlers.RegisterOAuthClient))).Methods("POST")
+	apiRouter.Handle("/oauth/clients", middleware.RequireAuth(http.HandlerFunc(oidcHandlers.ListOAuthClients))).Methods("GET")
+	apiRouter.Handle("/oauth/clients/{id}", middleware.RequireAuth(http.HandlerFunc(oidcHandlers.DeleteOAuthClient))).Methods("DELETE")
+	apiRouter.Handle("/oauth/keys/rotate", middleware.RequireAuth(http.HandlerFunc(oidcHandlers.RotateSigningKey))).Methods("POST")
+	apiRouter.Handle("/oauth/authorize", middleware.RequireAuth(http.HandlerFunc(oidcHandlers.Authorize))).Methods("POST")
+	apiRouter.Handle("/service-principals", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.CreateServicePrincipal))).Methods("POST")
+	apiRouter.Handle("/service-principals", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.ListServicePrincipals))).Methods("GET")
+	apiRouter.Handle("/service-principals/{id}", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.DeleteServicePrincipal))).Methods("DELETE")
+	apiRouter.Handle("/service-principals/{id}/keys", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.IssueAPIKey))).Methods("POST")
+	apiRouter.Handle("/service-principals/{id}/keys", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.ListAPIKeys))).Methods("GET")
+	apiRouter.Handle("/service-principals/{id}/keys/{keyId}/rotate", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.RotateAPIKey))).Methods("POST")
+	apiRouter.Handle("/service-principals/{id}/keys/{keyId}", middleware.RequireAuth(http.HandlerFunc(apiKeyHandlers.RevokeAPIKey))).Methods("DELETE")
+
+	// The OAuth protocol endpoints authenticate clients and access tokens themselves, so they are
+	// mounted outside apiRouter and its session middleware
+	router.HandleFunc("/.well-known/openid-configuration", oidcHandlers.Discovery).Methods("GET")
+	oauthRouter := router.PathPrefix("/oauth").Subrouter()
+	oauthRouter.HandleFunc("/jwks", oidcHandlers.JWKS).Methods("GET")
+	oauthRouter.Handle("/token", limitLogins(http.HandlerFunc(oidcHandlers.Token))).Methods("POST")
+	oauthRouter.HandleFunc("/introspect", oidcHandlers.Introspect).Methods("POST")
+	oauthRouter.HandleFunc("/revoke", oidcHandlers.Revoke).Methods("POST")
+	oauthRouter.HandleFunc("/userinfo", oidcHandlers.UserInfo).Methods("GET", "POST")
+
+	// GraphQL resolvers check the scopes of API keys themselves, field by field
+	router.Handle("/graphql", middleware.AuthMiddleware(authService)(limitGraphQL(http.HandlerFunc(graphQLHandlers.Query)))).Methods("POST")
+	if cfg.GraphiQL {
+		router.Handle("/graphql", middleware.SecurityHeaders(handler.GraphiQLContentSecurityPolicy)(http.HandlerFunc(graphQLHandlers.GraphiQL))).Methods("GET")
+	}
+
+	router.Handle("/ws", middleware.AuthMiddleware(authService)(readUsers(http.HandlerFunc(webSocketHandlers.Subscribe)))).Methods("GET")
+
+	// The runtime metrics are for operators: admins and monitoring with a metrics:read API key
+	requireAdmin := middleware.RequireAdmin(store.Users, auth.ScopeMetricsRead)
+	router.Handle("/debug/vars", middleware.AuthMiddleware(authService)(requireAdmin(expvar.Handler()))).Methods("GET")
+
+	router.PathPrefix("/swagger/").Handler(middleware.SecurityHeaders(swaggerCSP)(httpSwagger.Handler(
+		httpSwagger.URL("/swagger/doc.json"))))
 
 	return router
 }
+
+// swaggerCSP lets the documentation page run the inline script and styles of Swagger UI
+const swaggerCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'none'"
+
+// Harden adds the security headers to every response and bounds requests: the API and GraphQL
+// take JSON bodies up to the configured size, user imports CSV or NDJSON up to their own larger size, and
+// the OAuth endpoints forms. main wraps it around the server-wide rate limit.
+func Harden(cfg config.Config) func(http.Handler) http.Handler {
+	headers := middleware.SecurityHeaders(middleware.APIContentSecurityPolicy)
+	limits := middleware.LimitRequests(cfg.MaxURLLength,
+		// The import handler checks the format, which the format parameter may also give
+		middleware.RequestLimits{PathPrefix: "/api/v1/users:import", MaxBodyBytes: cfg.MaxImportBytes},
+		middleware.RequestLimits{PathPrefix: "/api/v1", MaxBodyBytes: cfg.MaxBodyBytes, ContentTypes: []string{"application/json"}},
+		middleware.RequestLimits{PathPrefix: "/graphql", MaxBodyBytes: cfg.MaxBodyBytes, ContentTypes: []string{"application/json"}},
+		middleware.RequestLimits{PathPrefix: "/oauth", MaxBodyBytes: cfg.MaxBodyBytes, ContentTypes: []string{"application/x-www-form-urlencoded"}},
+		middleware.RequestLimits{PathPrefix: "/", MaxBodyBytes: cfg.MaxBodyBytes},
+	)
+	return func(next http.Handler) http.Handler {
+		return headers(limits(next))
+	}
+}
+
+// publicCORS lets apps on any origin use the OpenID Connect endpoints. They authenticate with
+// client credentials and access tokens rather than cookies, so no credentials are allowed.
+var publicCORS = cors.MustNew(cors.Options{
+	Origins: []string{"*"},
+	Methods: []string{http.MethodGet, http.MethodPost},
+	Headers: []string{"Authorization", "Content-Type"},
+	MaxAge:  24 * time.Hour,
+})
+
+// CORS applies the cross-origin policies: the configured one for the API and GraphQL and publicCORS for the
+// OpenID Connect endpoints. main wraps it around the server-wide rate limit too, so that browsers
+// can read 429 responses.
+func CORS(cfg config.Config) func(http.Handler) http.Handler {
+	return middleware.CORS(
+		// Only confidential clients introspect tokens, from their servers
+		middleware.CORSRoute{PathPrefix: "/oauth/introspect"},
+		middleware.CORSRoute{PathPrefix: "/oauth", Policy: publicCORS},
+		middleware.CORSRoute{PathPrefix: "/.well-known/openid-configuration", Policy: publicCORS},
+		middleware.CORSRoute{PathPrefix: "/api/v1", Policy: cfg.CORS},
+		middleware.CORSRoute{PathPrefix: "/graphql", Policy: cfg.CORS},
+	)
+}
@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/metrics"
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// APIKeyMetadata carries the API key of clients that do not send it in the authorization metadata
+const APIKeyMetadata = "x-api-key"
+
+// Authenticator resolves bearer tokens and client certificates to the principal they belong to,
+// like middleware.AuthMiddleware expects. Rejected credentials produce an error wrapping
+// auth.ErrUnauthenticated.
+type Authenticator interface {
+	Authenticate(token string) (*auth.Principal, error)
+	AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error)
+}
+
+func UnaryLogging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	logrus.Infof("Started %s", info.FullMethod)
+	resp, err := handler(ctx, req)
+	logrus.Infof("Completed %s with %s in %v", info.FullMethod, status.Code(err), time.Since(start))
+	return resp, err
+}
+
+func StreamLogging(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	logrus.Infof("Started %s", info.FullMethod)
+	err := handler(srv, stream)
+	logrus.Infof("Completed %s with %s in %v", info.FullMethod, status.Code(err), time.Since(start))
+	return err
+}
+
+// UnaryMetrics counts calls in grpc_requests_total and those that fail in grpc_errors_total
+func UnaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	countCall(err)
+	return resp, err
+}
+
+// StreamMetrics counts streams like UnaryMetrics counts calls
+func StreamMetrics(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, stream)
+	countCall(err)
+	return err
+}
+
+func countCall(err error) {
+	metrics.Counter("grpc_requests_total").Add(1)
+	if err != nil {
+		metrics.Counter("grpc_errors_total").Add(1)
+	}
+}
+
+// UnaryAuth attaches the caller to the context of each call, like middleware.AuthMiddleware does
+// for HTTP requests. The token comes from the authorization metadata ("Bearer <token>") or, for API
+// keys, from x-api-key; without one, a client certificate verified over mutual TLS authenticates
+// the call. Calls without either continue anonymously; calls with credentials that do not
+// authenticate are rejected with UNAUTHENTICATED.
+func UnaryAuth(authenticator Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, authenticator, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuth authenticates streams like UnaryAuth authenticates calls
+func StreamAuth(authenticator Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(stream.Context(), authenticator, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// contextStream replaces the context of a stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func authenticate(ctx context.Context, authenticator Authenticator, method string) (context.Context, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var principal *auth.Principal
+	cert := clientCertificate(ctx)
+	switch {
+	case token != "":
+		principal, err = authenticator.Authenticate(token)
+	case cert != nil:
+		principal, err = authenticator.AuthenticateCertificate(cert)
+	default:
+		return ctx, nil
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrUnauthenticated) && token == "" {
+			logrus.Warnf("Rejected client certificate %q for %s", cert.Subject, method)
+			return nil, status.Error(codes.Unauthenticated, "the client certificate is not mapped to a service principal")
+		}
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			logrus.Warnf("Rejected bearer token for %s", method)
+			return nil, status.Error(codes.Unauthenticated, "the token is invalid or has expired")
+		}
+		logrus.Errorf("Failed to authenticate gRPC call: %v", err)
+		return nil, status.Error(codes.Internal, "failed to authenticate the call")
+	}
+	return auth.WithPrincipal(ctx, principal), nil
+}
+
+// bearerToken returns the token in the metadata of ctx, or "" for anonymous calls
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		scheme, token, ok := strings.Cut(values[0], " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", status.Error(codes.Unauthenticated, `the authorization metadata must be "Bearer <token>"`)
+		}
+		return token, nil
+	}
+	if values := md.Get(APIKeyMetadata); len(values) > 0 {
+		return values[0], nil
+	}
+	return "", nil
+}
+
+// clientCertificate returns the client certificate verified during the TLS handshake, if any
+func clientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
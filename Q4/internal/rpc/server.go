@@ -0,0 +1,266 @@
+// Package rpc serves users over gRPC, as defined in proto/user/v1. Like the REST handlers it goes
+// through service.UserServiceInterface.
+package rpc
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	userv1 "Q4/proto/user/v1"
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// UserServer implements userv1.UserServiceServer on top of the user service
+type UserServer struct {
+	userv1.UnimplementedUserServiceServer
+
+	Users service.UserServiceInterface
+	// Events feeds WatchUsers; without it WatchUsers answers UNIMPLEMENTED
+	Events *service.UserEvents
+	// WatchBuffer is how many events a WatchUsers stream may fall behind before it is ended
+	WatchBuffer int
+}
+
+func NewUserServer(users service.UserServiceInterface, events *service.UserEvents) *UserServer {
+	return &UserServer{
+		Users:       users,
+		Events:      events,
+		WatchBuffer: service.DefaultEventBuffer,
+	}
+}
+
+// NewServer returns a gRPC server with users registered, behind the logging, metrics and auth
+// interceptors. opts add to them, for example with TLS credentials.
+func NewServer(users *UserServer, authenticator Authenticator, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(UnaryLogging, UnaryMetrics, UnaryAuth(authenticator)),
+		grpc.ChainStreamInterceptor(StreamLogging, StreamMetrics, StreamAuth(authenticator)),
+	)
+	server := grpc.NewServer(opts...)
+	userv1.RegisterUserServiceServer(server, users)
+	return server
+}
+
+func (s *UserServer) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.User, error) {
+	if err := requireScope(ctx, auth.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	id, err := userID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.Users.GetUserByID(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	return toProto(*user), nil
+}
+
+func (s *UserServer) ListUsers(req *userv1.ListUsersRequest, stream grpc.ServerStreamingServer[userv1.User]) error {
+	if err := requireScope(stream.Context(), auth.ScopeUsersRead); err != nil {
+		return err
+	}
+	it, err := s.Users.IterateUsers(model.UserFilter{Name: req.GetName(), Email: req.GetEmail()})
+	if err != nil {
+		return userError(err)
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if err := stream.Send(toProto(it.User())); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return userError(err)
+	}
+	return nil
+}
+
+// CreateUser refuses anonymous calls: sign-ups go through POST /users, where they are rate limited
+func (s *UserServer) CreateUser(ctx context.Context, req *userv1.CreateUserRequest) (*userv1.User, error) {
+	if auth.PrincipalFrom(ctx) == nil {
+		return nil, status.Error(codes.Unauthenticated, "sign up through POST /api/v1/users")
+	}
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	if req.GetName() == "" || req.GetEmail() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name and email are required")
+	}
+	user := model.User{Name: req.GetName(), Email: req.GetEmail(), Role: req.GetRole(), Password: req.GetPassword()}
+	if err := s.Users.CreateUser(auth.PrincipalFrom(ctx), &user); err != nil {
+		return nil, userError(err)
+	}
+	logrus.Infof("User with ID %d created over gRPC", user.ID)
+	return s.reload(user.ID)
+}
+
+func (s *UserServer) UpdateUser(ctx context.Context, req *userv1.UpdateUserRequest) (*userv1.User, error) {
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	id, err := userID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.Users.GetUserByID(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	if req.Name != nil {
+		user.Name = req.GetName()
+	}
+	if req.Email != nil {
+		user.Email = req.GetEmail()
+	}
+	if req.Role != nil {
+		user.Role = req.GetRole()
+	}
+	user.CurrentPassword = req.GetCurrentPassword()
+	if user.Name == "" || user.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "name and email must not be empty")
+	}
+	if err := s.Users.UpdateUser(auth.PrincipalFrom(ctx), user); err != nil {
+		return nil, userError(err)
+	}
+	logrus.Infof("User with ID %d updated over gRPC", id)
+	return s.reload(id)
+}
+
+func (s *UserServer) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequest) (*userv1.DeleteUserResponse, error) {
+	if err := requireScope(ctx, auth.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	id, err := userID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Users.GetUserByID(id); err != nil {
+		return nil, userError(err)
+	}
+	if err := s.Users.DeleteUser(auth.PrincipalFrom(ctx), id); err != nil {
+		return nil, userError(err)
+	}
+	logrus.Infof("User with ID %d deleted over gRPC", id)
+	return &userv1.DeleteUserResponse{}, nil
+}
+
+func (s *UserServer) WatchUsers(req *userv1.WatchUsersRequest, stream grpc.ServerStreamingServer[userv1.UserEvent]) error {
+	if err := requireScope(stream.Context(), auth.ScopeUsersRead); err != nil {
+		return err
+	}
+	if s.Events == nil {
+		return status.Error(codes.Unimplemented, "user events are not enabled on this server")
+	}
+	ids := req.GetUserIds()
+
+	sub := s.Events.Subscribe(s.WatchBuffer)
+	defer sub.Close()
+	// Sending the headers right away tells clients that they will see every change from now on
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-sub.Events():
+			if !ok {
+				logrus.Warnf("Ended WatchUsers stream that fell behind: %v", sub.Err())
+				return status.Error(codes.ResourceExhausted, "the stream fell too far behind the user events")
+			}
+			if len(ids) > 0 && !slices.Contains(ids, int64(event.User.ID)) {
+				continue
+			}
+			if err := stream.Send(eventToProto(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reload returns the user as stored, with the role and verification state the store gave them
+func (s *UserServer) reload(id int) (*userv1.User, error) {
+	user, err := s.Users.GetUserByID(id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	return toProto(*user), nil
+}
+
+// requireScope keeps API keys to the scopes of their service principal, like
+// middleware.RequireScope does for the REST routes
+func requireScope(ctx context.Context, scope string) error {
+	if principal := auth.PrincipalFrom(ctx); principal != nil && !principal.HasScope(scope) {
+		logrus.Warnf("Rejected gRPC call by service principal %s without scope %s", principal.ServicePrincipalID, scope)
+		return status.Error(codes.PermissionDenied, "the API key needs the "+scope+" scope")
+	}
+	return nil
+}
+
+func userID(id int64) (int, error) {
+	if id <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid user ID %d", id)
+	}
+	return int(id), nil
+}
+
+// userError turns the errors of the user service into statuses. Unexpected errors are logged and
+// reported without their details.
+func userError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		return status.Error(codes.AlreadyExists, "another user already has this email address")
+	case errors.Is(err, service.ErrInvalidRole), errors.Is(err, auth.ErrWeakPassword):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, "sign in to change users")
+	case errors.Is(err, service.ErrRoleDenied), errors.Is(err, service.ErrUserAccessDenied),
+		errors.Is(err, service.ErrPasswordConfirmation), errors.Is(err, service.ErrAdminEmailDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	logrus.Errorf("gRPC call failed: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+func toProto(user model.User) *userv1.User {
+	role := user.Role
+	if role == "" {
+		role = model.RoleUser
+	}
+	return &userv1.User{
+		Id:            int64(user.ID),
+		Name:          user.Name,
+		Email:         user.Email,
+		Role:          role,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+var eventTypes = map[string]userv1.UserEvent_Type{
+	model.UserCreated: userv1.UserEvent_TYPE_CREATED,
+	model.UserUpdated: userv1.UserEvent_TYPE_UPDATED,
+	model.UserDeleted: userv1.UserEvent_TYPE_DELETED,
+}
+
+func eventToProto(event model.UserEvent) *userv1.UserEvent {
+	return &userv1.UserEvent{
+		Id:   event.ID,
+		Type: eventTypes[event.Type],
+		User: toProto(event.User),
+		Time: timestamppb.New(event.Time),
+	}
+}
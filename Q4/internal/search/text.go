@@ -0,0 +1,100 @@
+// Package search holds the text helpers shared by the user search implementations
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Highlight markers used by the storage layer; Highlight turns them into escaped HTML
+const (
+	MarkStart = "\x02"
+	MarkEnd   = "\x03"
+)
+
+// Tokenize lower-cases s and splits it into words of letters and digits
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Trigrams returns the distinct three-rune substrings of each word in s, with the
+// word padded by spaces so that short words and word boundaries still produce trigrams
+func Trigrams(s string) map[string]struct{} {
+	grams := make(map[string]struct{})
+	for _, word := range Tokenize(s) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			grams[string(runes[i:i+3])] = struct{}{}
+		}
+	}
+	return grams
+}
+
+// Similarity is the Jaccard index of the trigram sets of a and b, between 0 and 1
+func Similarity(a, b string) float64 {
+	ga, gb := Trigrams(a), Trigrams(b)
+	if len(ga) == 0 || len(gb) == 0 {
+		return 0
+	}
+	shared := 0
+	for gram := range ga {
+		if _, ok := gb[gram]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ga)+len(gb)-shared)
+}
+
+// BestSimilarity compares query with the whole of each field and with every word in it
+func BestSimilarity(query string, fields ...string) float64 {
+	best := 0.0
+	for _, field := range fields {
+		candidates := append([]string{field}, Tokenize(field)...)
+		for _, candidate := range candidates {
+			if score := Similarity(query, candidate); score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// Highlight HTML-escapes s and wraps the marked ranges in <mark> elements
+func Highlight(s string) string {
+	escaped := html.EscapeString(s)
+	return strings.NewReplacer(MarkStart, "<mark>", MarkEnd, "</mark>").Replace(escaped)
+}
+
+// MarkPrefixes marks every word of s that starts with one of the query tokens
+func MarkPrefixes(s string, tokens []string) string {
+	var b strings.Builder
+	word := []rune{}
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		lower := strings.ToLower(string(word))
+		for _, token := range tokens {
+			if strings.HasPrefix(lower, token) {
+				b.WriteString(MarkStart + string(word) + MarkEnd)
+				word = word[:0]
+				return
+			}
+		}
+		b.WriteString(string(word))
+		word = word[:0]
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteRune(r)
+	}
+	flush()
+	return b.String()
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidAPIKey is returned for API keys that are unknown, revoked or expired
+	ErrInvalidAPIKey = fmt.Errorf("%w: invalid or expired api key", auth.ErrUnauthenticated)
+	// ErrAPIKeyAdminRequired is returned when a user who is not an admin manages service principals
+	ErrAPIKeyAdminRequired = errors.New("only admins can manage service principals and api keys")
+	// ErrInvalidAPIKeyRequest is wrapped by the errors of requests with invalid names, scopes or lifetimes
+	ErrInvalidAPIKeyRequest = errors.New("invalid api key request")
+	// ErrUnknownCertificate is returned for client certificates no service principal is mapped to
+	ErrUnknownCertificate = fmt.Errorf("%w: client certificate not mapped to a service principal", auth.ErrUnauthenticated)
+)
+
+const (
+	DefaultAPIKeyTTL = 90 * 24 * time.Hour
+	// MaxAPIKeyTTL caps the lifetime of a key, so that forgotten keys do not stay valid forever
+	MaxAPIKeyTTL = 366 * 24 * time.Hour
+	// DefaultAPIKeyRotationOverlap is how long a rotated key keeps working next to its replacement,
+	// for the jobs using it to pick up the new one
+	DefaultAPIKeyRotationOverlap = 24 * time.Hour
+	// apiKeyTouchInterval limits how often a busy key writes its last-used time
+	apiKeyTouchInterval     = time.Minute
+	maxServicePrincipalName = 100
+	maxCertificateSubject   = 1024
+)
+
+// CreateServicePrincipalRequest describes a new service principal
+type CreateServicePrincipalRequest struct {
+	Name string `json:"name"`
+	// Scopes are what the principal's keys may do: "users:read", "users:write" and "metrics:read"
+	Scopes []string `json:"scopes"`
+	// CertificateSubject optionally lets clients with a certificate of this subject, such as
+	// "CN=nightly-export,O=Example", sign in as the principal over mutual TLS
+	CertificateSubject string `json:"certificate_subject,omitempty"`
+}
+
+// IssueAPIKeyRequest sets the lifetime of a new key
+type IssueAPIKeyRequest struct {
+	// ExpiresIn is the lifetime of the key in seconds; zero uses the default of 90 days
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// RotateAPIKeyRequest sets the lifetime of the replacement key and how long the old one keeps working
+type RotateAPIKeyRequest struct {
+	// ExpiresIn is the lifetime of the new key in seconds; zero uses the default of 90 days
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// Overlap is how many seconds the old key keeps working; zero uses the default of a day
+	Overlap int64 `json:"overlap,omitempty"`
+}
+
+// IssuedAPIKey is a new key with its secret, which is not shown again
+type IssuedAPIKey struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+type APIKeyServiceInterface interface {
+	CreateServicePrincipal(adminID int, request CreateServicePrincipalRequest) (*model.ServicePrincipal, error)
+	ListServicePrincipals(adminID int) ([]model.ServicePrincipal, error)
+	// DeleteServicePrincipal deletes the principal and revokes its keys
+	DeleteServicePrincipal(adminID int, id string) error
+	IssueAPIKey(adminID int, servicePrincipalID string, request IssueAPIKeyRequest) (*IssuedAPIKey, error)
+	ListAPIKeys(adminID int, servicePrincipalID string) ([]model.APIKey, error)
+	// RotateAPIKey issues a replacement for the key and lets the old one expire after the overlap
+	RotateAPIKey(adminID int, servicePrincipalID, keyID string, request RotateAPIKeyRequest) (*IssuedAPIKey, error)
+	RevokeAPIKey(adminID int, servicePrincipalID, keyID string) error
+}
+
+// APIKeyService issues API keys to service principals and authenticates requests made with them
+type APIKeyService struct {
+	Store *repository.Store
+	// TTL is the lifetime of keys issued without an explicit one
+	TTL time.Duration
+	// RotationOverlap is how long a rotated key keeps working unless the rotation says otherwise
+	RotationOverlap time.Duration
+
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+}
+
+func NewAPIKeyService(store *repository.Store) *APIKeyService {
+	return &APIKeyService{
+		Store:           store,
+		TTL:             DefaultAPIKeyTTL,
+		RotationOverlap: DefaultAPIKeyRotationOverlap,
+		Now:             time.Now,
+	}
+}
+
+func (s *APIKeyService) requireAdmin(userID int) error {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Role != model.RoleAdmin {
+		return ErrAPIKeyAdminRequired
+	}
+	return nil
+}
+
+func (s *APIKeyService) CreateServicePrincipal(adminID int, request CreateServicePrincipalRequest) (*model.ServicePrincipal, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len([]rune(name)) > maxServicePrincipalName {
+		return nil, fmt.Errorf("%w: name is required and at most %d characters", ErrInvalidAPIKeyRequest, maxServicePrincipalName)
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(auth.APIKeyScopes, scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKeyRequest, scope)
+		}
+	}
+
+	subject := strings.TrimSpace(request.CertificateSubject)
+	if len(subject) > maxCertificateSubject {
+		return nil, fmt.Errorf("%w: certificate_subject is at most %d bytes", ErrInvalidAPIKeyRequest, maxCertificateSubject)
+	}
+
+	principal := &model.ServicePrincipal{
+		ID:                 auth.NewID(),
+		Name:               name,
+		Scopes:             slices.Compact(slices.Sorted(slices.Values(request.Scopes))),
+		CertificateSubject: subject,
+		CreatedBy:          adminID,
+		CreatedAt:          s.Now(),
+	}
+	if principal.Scopes == nil {
+		principal.Scopes = []string{}
+	}
+	if err := s.Store.APIKeys.CreateServicePrincipal(principal); err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d created service principal %s (%s) with scopes %v", adminID, principal.ID, principal.Name, principal.Scopes)
+	return principal, nil
+}
+
+func (s *APIKeyService) ListServicePrincipals(adminID int) ([]model.ServicePrincipal, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	return s.Store.APIKeys.ListServicePrincipals()
+}
+
+func (s *APIKeyService) DeleteServicePrincipal(adminID int, id string) error {
+	if err := s.requireAdmin(adminID); err != nil {
+		return err
+	}
+	if err := s.Store.APIKeys.DeleteServicePrincipal(id); err != nil {
+		return err
+	}
+	logrus.Infof("User %d deleted service principal %s and revoked its API keys", adminID, id)
+	return nil
+}
+
+func (s *APIKeyService) IssueAPIKey(adminID int, servicePrincipalID string, request IssueAPIKeyRequest) (*IssuedAPIKey, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	ttl, err := s.keyTTL(request.ExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := s.issue(s.Store.APIKeys, servicePrincipalID, ttl)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d issued API key %s to service principal %s", adminID, issued.ID, servicePrincipalID)
+	return issued, nil
+}
+
+// keyTTL returns the lifetime for a request's expires_in
+func (s *APIKeyService) keyTTL(expiresIn int64) (time.Duration, error) {
+	if expiresIn == 0 {
+		return s.TTL, nil
+	}
+	if expiresIn < 0 || expiresIn > int64(MaxAPIKeyTTL/time.Second) {
+		return 0, fmt.Errorf("%w: expires_in must be between 1 and %d seconds", ErrInvalidAPIKeyRequest, int64(MaxAPIKeyTTL/time.Second))
+	}
+	return time.Duration(expiresIn) * time.Second, nil
+}
+
+func (s *APIKeyService) issue(repo repository.APIKeyRepository, servicePrincipalID string, ttl time.Duration) (*IssuedAPIKey, error) {
+	key, lookup, hash := auth.NewAPIKey()
+	now := s.Now()
+	issued := &IssuedAPIKey{
+		APIKey: model.APIKey{
+			ID:                 auth.NewID(),
+			ServicePrincipalID: servicePrincipalID,
+			Prefix:             lookup,
+			KeyHash:            hash,
+			CreatedAt:          now,
+			ExpiresAt:          now.Add(ttl),
+		},
+		Key: key,
+	}
+	if err := repo.CreateAPIKey(&issued.APIKey); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+func (s *APIKeyService) ListAPIKeys(adminID int, servicePrincipalID string) ([]model.APIKey, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	if _, err := s.Store.APIKeys.GetServicePrincipal(servicePrincipalID); err != nil {
+		return nil, err
+	}
+	return s.Store.APIKeys.ListAPIKeys(servicePrincipalID)
+}
+
+func (s *APIKeyService) RotateAPIKey(adminID int, servicePrincipalID, keyID string, request RotateAPIKeyRequest) (*IssuedAPIKey, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	ttl, err := s.keyTTL(request.ExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	overlap := s.RotationOverlap
+	if request.Overlap < 0 || request.Overlap > int64(MaxAPIKeyTTL/time.Second) {
+		return nil, fmt.Errorf("%w: overlap must be between 0 and %d seconds", ErrInvalidAPIKeyRequest, int64(MaxAPIKeyTTL/time.Second))
+	}
+	if request.Overlap > 0 {
+		overlap = time.Duration(request.Overlap) * time.Second
+	}
+
+	var issued *IssuedAPIKey
+	err = s.Store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		old, err := repos.APIKeys.GetAPIKey(servicePrincipalID, keyID)
+		if err != nil {
+			return err
+		}
+		// Rotating never extends the old key, such as when it was about to expire anyway
+		if expiresAt := s.Now().Add(overlap); expiresAt.Before(old.ExpiresAt) {
+			if err := repos.APIKeys.SetAPIKeyExpiry(old.ID, expiresAt); err != nil {
+				return err
+			}
+		}
+		issued, err = s.issue(repos.APIKeys, servicePrincipalID, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d rotated API key %s of service principal %s to %s", adminID, keyID, servicePrincipalID, issued.ID)
+	return issued, nil
+}
+
+func (s *APIKeyService) RevokeAPIKey(adminID int, servicePrincipalID, keyID string) error {
+	if err := s.requireAdmin(adminID); err != nil {
+		return err
+	}
+	if err := s.Store.APIKeys.DeleteAPIKey(servicePrincipalID, keyID); err != nil {
+		return err
+	}
+	logrus.Infof("User %d revoked API key %s of service principal %s", adminID, keyID, servicePrincipalID)
+	return nil
+}
+
+// Authenticate resolves an API key to its service principal and the principal's scopes
+func (s *APIKeyService) Authenticate(key string) (*auth.Principal, error) {
+	lookup, ok := auth.ParseAPIKey(key)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	stored, err := s.Store.APIKeys.GetAPIKeyByPrefix(lookup)
+	if errors.Is(err, repository.ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.KeyHash), []byte(auth.HashOpaqueToken(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := s.Now()
+	if !now.Before(stored.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	principal, err := s.Store.APIKeys.GetServicePrincipal(stored.ServicePrincipalID)
+	if errors.Is(err, repository.ErrServicePrincipalNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.Store.APIKeys.TouchAPIKey(stored.ID, now); err != nil {
+			logrus.Warnf("Failed to update last-used time of API key %s: %v", stored.ID, err)
+		}
+	}
+
+	return &auth.Principal{ServicePrincipalID: principal.ID, APIKeyID: stored.ID, Scopes: principal.Scopes}, nil
+}
+
+// AuthenticateCertificate resolves a verified client certificate to the service principal its
+// subject is mapped to. Certificates are checked against the trusted CAs during the handshake.
+func (s *APIKeyService) AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error) {
+	principal, err := s.Store.APIKeys.GetServicePrincipalByCertificateSubject(cert.Subject.String())
+	if errors.Is(err, repository.ErrServicePrincipalNotFound) {
+		return nil, ErrUnknownCertificate
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Principal{ServicePrincipalID: principal.ID, Scopes: principal.Scopes}, nil
+}
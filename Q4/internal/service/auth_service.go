@@ -0,0 +1,491 @@
+package service
+
+import (
+	"Q4/internal/audit"
+	"Q4/internal/auth"
+	"Q4/internal/mail"
+	"Q4/internal/metrics"
+	"Q4/internal/model"
+	"Q4/internal/ratelimit"
+	"Q4/internal/repository"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidCredentials is returned for unknown emails and wrong passwords alike
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrInvalidSession is returned for bearer tokens that are unknown, revoked or expired
+	ErrInvalidSession = fmt.Errorf("%w: invalid or expired session", auth.ErrUnauthenticated)
+	// ErrInvalidResetToken is returned for password reset tokens that are unknown, used or expired
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	// ErrRateLimited matches every RateLimitError
+	ErrRateLimited = errors.New("too many requests")
+	// ErrUnlockDenied is returned when a user who is not an admin lifts a lockout
+	ErrUnlockDenied = errors.New("only admins can unlock sign-ins")
+)
+
+// RateLimitError is returned when a caller exceeded a rate limit
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrRateLimited, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+const (
+	DefaultSessionTTL       = 24 * time.Hour
+	DefaultPasswordResetTTL = time.Hour
+	// DefaultLockoutThreshold is the number of failed sign-ins that locks an account
+	DefaultLockoutThreshold = 5
+	// DefaultIPLockoutThreshold is the number of failed sign-ins that locks a client address,
+	// across every account it tries
+	DefaultIPLockoutThreshold = 50
+	DefaultLockoutDuration    = 15 * time.Minute
+	// sessionTouchInterval limits how often a busy session writes its last-seen time
+	sessionTouchInterval = time.Minute
+)
+
+type LoginResult struct {
+	// Token is the session's bearer token; it is empty while MFARequired is set
+	Token string `json:"token,omitempty"`
+	// ExpiresAt is when the session or, with MFARequired, the MFA token expires
+	ExpiresAt time.Time   `json:"expires_at"`
+	User      *model.User `json:"user,omitempty"`
+	// MFARequired asks the client to send MFAToken with a code to /auth/mfa/verify
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+	// MFAEnrollmentRequired is set with MFARequired when the user's role requires MFA and they have
+	// none yet; MFAToken then also authorizes /auth/mfa/enroll
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
+	// RecoveryCodes are returned once, when signing in completed an enrollment the policy forced
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// CSRFToken replaces Token for browser sessions, whose token is kept in a cookie
+	CSRFToken string `json:"csrf_token,omitempty"`
+}
+
+// ClientInfo describes the client a session is started from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+type AuthServiceInterface interface {
+	// Login checks the password and either starts a session or, for users with MFA, returns the token for VerifyMFA
+	Login(email, password string, client ClientInfo) (*LoginResult, error)
+	// VerifyMFA completes a Login that required MFA with a TOTP or recovery code
+	VerifyMFA(mfaToken, code string, client ClientInfo) (*LoginResult, error)
+	Logout(principal *auth.Principal) error
+	// Authenticate resolves a bearer token, a session token or an API key, to its principal
+	Authenticate(token string) (*auth.Principal, error)
+	// AuthenticateCertificate resolves a verified client certificate to the service principal it is mapped to
+	AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error)
+	// ForgotPassword emails a reset link if email belongs to a user. It answers the same way
+	// and in the same time whether or not the account exists.
+	ForgotPassword(email, ip string) error
+	// ResetPassword sets a new password with a token from ForgotPassword and signs the user out everywhere.
+	// It also revokes the OAuth tokens issued for the user and the API keys of the principals they created.
+	ResetPassword(token, password, ip string) error
+	// UnlockAccount lifts the sign-in lockout of a user and reports whether there was one. Admins only.
+	UnlockAccount(adminID, userID int) (bool, error)
+	// UnlockIP lifts the sign-in lockout of a client address and reports whether there was one. Admins only.
+	UnlockIP(adminID int, ip string) (bool, error)
+}
+
+type AuthService struct {
+	Store      *repository.Store
+	Mailer     mail.Mailer
+	SessionTTL time.Duration
+	ResetTTL   time.Duration
+	// ResetURL is the page reset links point at; the token is added as the token query parameter
+	ResetURL string
+	// MFA, when set, adds a second step to Login for users with an authenticator or whose role requires one
+	MFA *MFAService
+	// APIKeys authenticates bearer tokens that are API keys; without it only sessions are accepted
+	APIKeys *APIKeyService
+
+	// ForgotPerAccount and ForgotPerIP limit reset emails; ResetPerIP limits attempts to redeem tokens
+	ForgotPerAccount *ratelimit.SlidingWindow
+	ForgotPerIP      *ratelimit.SlidingWindow
+	ResetPerIP       *ratelimit.SlidingWindow
+	// AccountLockout and IPLockout slow down and then lock out repeated failed sign-ins. Accounts
+	// are tracked by the email as typed, so unknown addresses lock out like real ones.
+	AccountLockout *ratelimit.Lockout
+	IPLockout      *ratelimit.Lockout
+	Audit          audit.Logger
+
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+	// Background runs work that must not delay the response; tests make it synchronous
+	Background func(func())
+	// Sleep holds back the answers to failed sign-ins; tests record the delays instead
+	Sleep func(time.Duration)
+}
+
+func NewAuthService(store *repository.Store, mailer mail.Mailer, resetURL string) *AuthService {
+	return &AuthService{
+		Store:            store,
+		Mailer:           mailer,
+		SessionTTL:       DefaultSessionTTL,
+		ResetTTL:         DefaultPasswordResetTTL,
+		ResetURL:         resetURL,
+		ForgotPerAccount: ratelimit.NewSlidingWindow(3, time.Hour),
+		ForgotPerIP:      ratelimit.NewSlidingWindow(20, time.Hour),
+		ResetPerIP:       ratelimit.NewSlidingWindow(10, 15*time.Minute),
+		AccountLockout:   ratelimit.NewLockout(DefaultLockoutThreshold, DefaultLockoutDuration),
+		IPLockout:        ratelimit.NewLockout(DefaultIPLockoutThreshold, DefaultLockoutDuration),
+		Audit:            audit.LogLogger{},
+		Now:              time.Now,
+		Background:       func(fn func()) { go fn() },
+		Sleep:            time.Sleep,
+	}
+}
+
+func (s *AuthService) Login(email, password string, client ClientInfo) (*LoginResult, error) {
+	account := lockoutKey(email)
+	if err := s.checkLockout(account, client.IP); err != nil {
+		return nil, err
+	}
+
+	user, hash, err := s.lookupCredentials(email)
+	if err != nil {
+		return nil, err
+	}
+	// CheckPassword spends the same time on a missing hash, so unknown emails are not faster
+	if !auth.CheckPassword(hash, password) || user == nil {
+		s.loginFailed(account, client.IP)
+		return nil, ErrInvalidCredentials
+	}
+	s.AccountLockout.Reset(account)
+
+	if s.MFA != nil {
+		challenge, err := s.MFA.challenge(*user)
+		if err != nil {
+			return nil, err
+		}
+		if challenge != nil {
+			logrus.Infof("User %d passed the password step; waiting for MFA", user.ID)
+			return challenge, nil
+		}
+	}
+	return s.startSession(user, client)
+}
+
+// lockoutKey is the key AccountLockout tracks the account with email under
+func lockoutKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLockout refuses sign-ins from a locked address or to a locked account without checking the password
+func (s *AuthService) checkLockout(account, ip string) error {
+	lockedFor := s.IPLockout.Locked(ip)
+	if lockedFor == 0 {
+		lockedFor = s.AccountLockout.Locked(account)
+	}
+	if lockedFor == 0 {
+		return nil
+	}
+	metrics.Counter("login_blocked_total").Add(1)
+	s.Audit.Record(audit.Event{Type: audit.LoginBlocked, Time: s.Now(), Email: account, IP: ip,
+		Detail: "locked for another " + lockedFor.Round(time.Second).String()})
+	return &RateLimitError{RetryAfter: lockedFor}
+}
+
+// loginFailed counts a failed sign-in against the account and the address, and holds back the answer
+func (s *AuthService) loginFailed(account, ip string) {
+	now := s.Now()
+	metrics.Counter("login_failures_total").Add(1)
+	s.Audit.Record(audit.Event{Type: audit.LoginFailed, Time: now, Email: account, IP: ip})
+
+	accountDelay, accountLocked := s.AccountLockout.Fail(account)
+	if accountLocked > 0 {
+		metrics.Counter("login_account_lockouts_total").Add(1)
+		s.Audit.Record(audit.Event{Type: audit.AccountLocked, Time: now, Email: account, IP: ip,
+			Detail: "locked for " + accountLocked.String()})
+	}
+	ipDelay, ipLocked := s.IPLockout.Fail(ip)
+	if ipLocked > 0 {
+		metrics.Counter("login_ip_lockouts_total").Add(1)
+		s.Audit.Record(audit.Event{Type: audit.IPLocked, Time: now, IP: ip,
+			Detail: "locked for " + ipLocked.String()})
+	}
+	s.Sleep(max(accountDelay, ipDelay))
+}
+
+func (s *AuthService) UnlockAccount(adminID, userID int) (bool, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return false, err
+	}
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return false, err
+	}
+
+	unlocked := s.AccountLockout.Reset(lockoutKey(user.Email))
+	if unlocked {
+		metrics.Counter("login_unlocks_total").Add(1)
+		s.Audit.Record(audit.Event{Type: audit.AccountUnlocked, Time: s.Now(), ActorID: adminID, Email: lockoutKey(user.Email)})
+	}
+	return unlocked, nil
+}
+
+func (s *AuthService) UnlockIP(adminID int, ip string) (bool, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return false, err
+	}
+
+	unlocked := s.IPLockout.Reset(ip)
+	if unlocked {
+		metrics.Counter("login_unlocks_total").Add(1)
+		s.Audit.Record(audit.Event{Type: audit.IPUnlocked, Time: s.Now(), ActorID: adminID, IP: ip})
+	}
+	return unlocked, nil
+}
+
+func (s *AuthService) requireAdmin(userID int) error {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Role != model.RoleAdmin {
+		return ErrUnlockDenied
+	}
+	return nil
+}
+
+func (s *AuthService) VerifyMFA(mfaToken, code string, client ClientInfo) (*LoginResult, error) {
+	if s.MFA == nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	userID, recoveryCodes, err := s.MFA.verifyChallenge(mfaToken, code)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.startSession(user, client)
+	if err != nil {
+		return nil, err
+	}
+	result.RecoveryCodes = recoveryCodes
+	return result, nil
+}
+
+func (s *AuthService) startSession(user *model.User, client ClientInfo) (*LoginResult, error) {
+	token, tokenHash := auth.NewOpaqueToken()
+	now := s.Now()
+	session := &model.Session{
+		ID:         auth.NewID(),
+		UserID:     user.ID,
+		TokenHash:  tokenHash,
+		Device:     deviceName(client.UserAgent),
+		UserAgent:  truncate(client.UserAgent, maxUserAgentLength),
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.SessionTTL),
+	}
+	if err := s.Store.Sessions.CreateSession(session); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("User %d signed in with session %s from %s", user.ID, session.ID, session.IP)
+	return &LoginResult{Token: token, ExpiresAt: session.ExpiresAt, User: user}, nil
+}
+
+// lookupCredentials returns the user with email and their password hash. A missing user or
+// password is not an error; the user is nil or the hash empty.
+func (s *AuthService) lookupCredentials(email string) (*model.User, string, error) {
+	user, err := s.Store.Users.GetUserByEmail(email)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := s.Store.Passwords.GetPasswordHash(user.ID)
+	if errors.Is(err, repository.ErrPasswordNotSet) {
+		return user, "", nil
+	}
+	return user, hash, err
+}
+
+func (s *AuthService) Logout(principal *auth.Principal) error {
+	if err := s.Store.Sessions.DeleteSession(principal.SessionID); err != nil {
+		return err
+	}
+	logrus.Infof("User %d signed out of session %s", principal.UserID, principal.SessionID)
+	return nil
+}
+
+func (s *AuthService) Authenticate(token string) (*auth.Principal, error) {
+	if s.APIKeys != nil && auth.IsAPIKey(token) {
+		return s.APIKeys.Authenticate(token)
+	}
+	session, err := s.Store.Sessions.GetSessionByTokenHash(auth.HashOpaqueToken(token))
+	if errors.Is(err, repository.ErrSessionNotFound) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Now()
+	if !now.Before(session.ExpiresAt) {
+		if err := s.Store.Sessions.DeleteSession(session.ID); err != nil {
+			logrus.Warnf("Failed to delete expired session %s: %v", session.ID, err)
+		}
+		return nil, ErrInvalidSession
+	}
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		if err := s.Store.Sessions.TouchSession(session.ID, now); err != nil {
+			logrus.Warnf("Failed to update last-seen time of session %s: %v", session.ID, err)
+		}
+	}
+
+	return &auth.Principal{UserID: session.UserID, SessionID: session.ID}, nil
+}
+
+func (s *AuthService) AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error) {
+	if s.APIKeys == nil {
+		return nil, ErrUnknownCertificate
+	}
+	return s.APIKeys.AuthenticateCertificate(cert)
+}
+
+func (s *AuthService) ForgotPassword(email, ip string) error {
+	if ok, retryAfter := s.ForgotPerIP.Allow(ip); !ok {
+		logrus.Warnf("Rate limited password reset requests from %s", ip)
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+	// Going over the per-account limit is not reported, since that would confirm the account exists
+	if ok, _ := s.ForgotPerAccount.Allow(strings.ToLower(email)); !ok {
+		logrus.Warnf("Suppressed password reset email to %s: too many requests for this address", email)
+		return nil
+	}
+
+	// The lookup and the email happen after responding so that timing does not reveal the account
+	s.Background(func() {
+		if err := s.sendPasswordReset(email); err != nil {
+			logrus.Errorf("Failed to send password reset email to %s: %v", email, err)
+		}
+	})
+	return nil
+}
+
+func (s *AuthService) sendPasswordReset(email string) error {
+	user, err := s.Store.Users.GetUserByEmail(email)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		logrus.Infof("Skipped password reset for unknown email %s", email)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, tokenHash := auth.NewOpaqueToken()
+	err = s.Store.ResetTokens.CreateResetToken(model.PasswordResetToken{
+		TokenHash: tokenHash,
+		UserID:    user.ID,
+		ExpiresAt: s.Now().Add(s.ResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.ResetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg, err := mail.Render("password_reset", user.Email, map[string]any{
+		"Name":      user.Name,
+		"Link":      link.String(),
+		"ExpiresIn": formatDuration(s.ResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Mailer.Send(msg)
+}
+
+func (s *AuthService) ResetPassword(token, password, ip string) error {
+	if ok, retryAfter := s.ResetPerIP.Allow(ip); !ok {
+		logrus.Warnf("Rate limited password reset attempts from %s", ip)
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+	// Validate before touching the token so that a rejected password does not use it up
+	if err := auth.ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	var userID, revoked int
+	var email string
+	err = s.Store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		id, err := repos.ResetTokens.ConsumeResetToken(auth.HashOpaqueToken(token), s.Now())
+		if errors.Is(err, repository.ErrResetTokenNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		userID = id
+
+		user, err := repos.Users.GetUserByID(userID)
+		if err != nil {
+			return err
+		}
+		email = user.Email
+		if err := repos.Passwords.SetPasswordHash(userID, hash); err != nil {
+			return err
+		}
+		if err := repos.ResetTokens.DeleteUserResetTokens(userID); err != nil {
+			return err
+		}
+		n, err := repos.Sessions.DeleteUserSessions(userID, "")
+		if err != nil {
+			return err
+		}
+		revoked = n
+		// Whoever knew the old password may have used it to get other credentials; they go too
+		if _, err := repos.OAuth.DeleteUserOAuthTokens(userID); err != nil {
+			return err
+		}
+		if _, err := repos.APIKeys.DeleteAPIKeysCreatedBy(userID); err != nil {
+			return err
+		}
+		// Following the emailed link proves the user reads this mailbox
+		return repos.Users.MarkEmailVerified(userID, user.Email)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The user proved they own the account, so earlier failed sign-ins no longer count against it
+	s.AccountLockout.Reset(lockoutKey(email))
+	logrus.Infof("User %d reset their password; revoked %d sessions", userID, revoked)
+	return nil
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxBatchOperations bounds how many operations a single batch may contain
+const MaxBatchOperations = 1000
+
+// Batch modes
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+)
+
+// Batch operation kinds
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Batch operation statuses
+const (
+	OpSucceeded  = "succeeded"
+	OpFailed     = "failed"
+	OpRolledBack = "rolled_back"
+	OpSkipped    = "skipped"
+)
+
+var (
+	ErrInvalidBatch = errors.New("invalid batch")
+	errOpInvalid    = errors.New("invalid operation")
+)
+
+type BatchOperation struct {
+	Op   string      `json:"op"`
+	ID   int         `json:"id,omitempty"`
+	User *model.User `json:"user,omitempty"`
+}
+
+type BatchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchOperationResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status string `json:"status"`
+	UserID int    `json:"user_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode      string                 `json:"mode"`
+	Committed bool                   `json:"committed"`
+	Results   []BatchOperationResult `json:"results"`
+}
+
+type BatchServiceInterface interface {
+	// Execute runs req for caller, nil for anonymous requests. Only admins and service principals
+	// may run batches, and like UserService, only admins may change roles. Creates store the
+	// hash of their password, if any; updates may not carry one.
+	Execute(caller *auth.Principal, req BatchRequest) (*BatchResponse, error)
+}
+
+type BatchService struct {
+	UnitOfWork repository.UnitOfWork
+	// Events, when set, announces the changes of every batch that commits, once it has
+	Events *UserEvents
+}
+
+func NewBatchService(uow repository.UnitOfWork) *BatchService {
+	return &BatchService{
+		UnitOfWork: uow,
+	}
+}
+
+// Execute runs every operation in order inside one transaction. In atomic mode the first failure
+// rolls the whole batch back; in best-effort mode each operation runs in its own savepoint so a
+// failure only undoes that operation.
+func (s *BatchService) Execute(caller *auth.Principal, req BatchRequest) (*BatchResponse, error) {
+	if req.Mode == "" {
+		req.Mode = BatchAtomic
+	}
+	if req.Mode != BatchAtomic && req.Mode != BatchBestEffort {
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidBatch, req.Mode)
+	}
+	if len(req.Operations) == 0 {
+		return nil, fmt.Errorf("%w: no operations", ErrInvalidBatch)
+	}
+	if len(req.Operations) > MaxBatchOperations {
+		return nil, fmt.Errorf("%w: at most %d operations are allowed", ErrInvalidBatch, MaxBatchOperations)
+	}
+
+	// Authorize before hashing, so that callers who may not run batches cannot make the server hash
+	var admin bool
+	err := s.UnitOfWork.Do(func(tx repository.Transaction) (err error) {
+		if err := authorizeBulk(tx.Users(), caller); err != nil {
+			return err
+		}
+		admin, err = isAdmin(tx.Users(), caller)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Hashing is slow, so it happens before the transaction rather than while it holds its locks
+	passwords := hashBatchPasswords(req.Operations)
+
+	resp := &BatchResponse{Mode: req.Mode, Results: make([]BatchOperationResult, len(req.Operations))}
+	errAborted := errors.New("batch aborted")
+	var changes []userChange
+	err = s.UnitOfWork.Do(func(tx repository.Transaction) error {
+		// The transaction may be retried from the start when the database is busy
+		changes = changes[:0]
+		for i, op := range req.Operations {
+			resp.Results[i] = BatchOperationResult{Index: i, Op: op.Op, Status: OpSkipped}
+		}
+
+		for i, op := range req.Operations {
+			result := &resp.Results[i]
+
+			var change userChange
+			var opErr error
+			if req.Mode == BatchBestEffort {
+				opErr = tx.Savepoint(func() (err error) {
+					change, err = applyBatchOperation(tx, admin, op, passwords[i], result)
+					return err
+				})
+			} else {
+				change, opErr = applyBatchOperation(tx, admin, op, passwords[i], result)
+			}
+
+			if opErr == nil {
+				result.Status = OpSucceeded
+				changes = append(changes, change)
+				continue
+			}
+			if repository.IsBusy(opErr) {
+				// Not a failure of the operation; returning it as is lets the transaction be retried
+				return opErr
+			}
+			result.Status = OpFailed
+			result.Error = opErr.Error()
+			if req.Mode == BatchAtomic {
+				return errAborted
+			}
+		}
+		if s.Events == nil {
+			return nil
+		}
+		// Load the users before committing, as the transaction sees them, and announce them after
+		var err error
+		changes, err = loadChanges(tx.Users(), changes)
+		return err
+	})
+
+	if err != nil && !errors.Is(err, errAborted) {
+		return nil, err
+	}
+
+	resp.Committed = err == nil
+	if !resp.Committed {
+		for i := range resp.Results {
+			if resp.Results[i].Status == OpSucceeded {
+				resp.Results[i].Status = OpRolledBack
+			}
+		}
+		return resp, nil
+	}
+	s.Events.publishChanges(changes)
+	return resp, nil
+}
+
+// batchPassword is the hashed password of a create operation, or why it was rejected
+type batchPassword struct {
+	hash string
+	err  error
+}
+
+// hashBatchPasswords validates and hashes the password of every create operation that has one
+func hashBatchPasswords(ops []BatchOperation) []batchPassword {
+	passwords := make([]batchPassword, len(ops))
+	for i, op := range ops {
+		if op.Op != OpCreate || op.User == nil || op.User.Password == "" {
+			continue
+		}
+		if err := auth.ValidatePassword(op.User.Password); err != nil {
+			passwords[i].err = err
+			continue
+		}
+		passwords[i].hash, passwords[i].err = auth.HashPassword(op.User.Password)
+	}
+	return passwords
+}
+
+// applyBatchOperation runs op and returns the change to announce; admin tells whether the caller
+// may change roles, and password is the one hashBatchPasswords gave op
+func applyBatchOperation(tx repository.Transaction, admin bool, op BatchOperation, password batchPassword, result *BatchOperationResult) (userChange, error) {
+	users := tx.Users()
+	switch op.Op {
+	case OpCreate:
+		if op.User == nil {
+			return userChange{}, fmt.Errorf("%w: create requires a user", errOpInvalid)
+		}
+		user := *op.User
+		user.ID = 0
+		user.Password, user.CurrentPassword = "", ""
+		if errs := validateUser(user); len(errs) > 0 {
+			return userChange{}, fmt.Errorf("%w: %s", errOpInvalid, strings.Join(errs, ", "))
+		}
+		if !admin && user.Role != "" && user.Role != model.RoleUser {
+			return userChange{}, ErrRoleDenied
+		}
+		if password.err != nil {
+			return userChange{}, password.err
+		}
+		if err := users.CreateUser(&user); err != nil {
+			return userChange{}, err
+		}
+		if password.hash != "" {
+			if err := tx.Passwords().SetPasswordHash(user.ID, password.hash); err != nil {
+				return userChange{}, err
+			}
+		}
+		result.UserID = user.ID
+		return userChange{Type: model.UserCreated, ID: user.ID}, nil
+
+	case OpUpdate:
+		if op.User == nil {
+			return userChange{}, fmt.Errorf("%w: update requires a user", errOpInvalid)
+		}
+		if op.User.Password != "" {
+			return userChange{}, fmt.Errorf("%w: passwords are changed through a password reset", errOpInvalid)
+		}
+		user := *op.User
+		user.ID = op.ID
+		user.CurrentPassword = ""
+		if user.ID <= 0 {
+			return userChange{}, fmt.Errorf("%w: update requires a positive id", errOpInvalid)
+		}
+		if errs := validateUser(user); len(errs) > 0 {
+			return userChange{}, fmt.Errorf("%w: %s", errOpInvalid, strings.Join(errs, ", "))
+		}
+		current, err := users.GetUserByID(user.ID)
+		if err != nil {
+			return userChange{}, err
+		}
+		if !admin && user.Role != "" && user.Role != current.Role {
+			return userChange{}, ErrRoleDenied
+		}
+		if !admin && current.Role == model.RoleAdmin && user.Email != current.Email {
+			return userChange{}, ErrAdminEmailDenied
+		}
+		if err := users.UpdateUser(&user); err != nil {
+			return userChange{}, err
+		}
+		result.UserID = user.ID
+		return userChange{Type: model.UserUpdated, ID: user.ID}, nil
+
+	case OpDelete:
+		if op.ID <= 0 {
+			return userChange{}, fmt.Errorf("%w: delete requires a positive id", errOpInvalid)
+		}
+		before, err := users.GetUserByID(op.ID)
+		if err != nil {
+			return userChange{}, err
+		}
+		if err := users.DeleteUser(op.ID); err != nil {
+			return userChange{}, err
+		}
+		result.UserID = op.ID
+		return userChange{Type: model.UserDeleted, ID: op.ID, User: *before}, nil
+
+	default:
+		return userChange{}, fmt.Errorf("%w: unknown op %q", errOpInvalid, op.Op)
+	}
+}
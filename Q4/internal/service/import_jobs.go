@@ -0,0 +1,156 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Import job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// importJobRetention is how long finished jobs stay available to the progress endpoint
+const importJobRetention = time.Hour
+
+var ErrImportJobNotFound = errors.New("import job not found")
+
+type ImportJob struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"`
+	Processed  int           `json:"processed"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Report     *ImportReport `json:"report,omitempty"`
+}
+
+type importFunc func(r io.Reader, opts ImportOptions, progress func(processed int)) (*ImportReport, error)
+
+// ImportJobManager runs imports in the background and tracks their progress in memory
+type ImportJobManager struct {
+	mu     sync.RWMutex
+	jobs   map[string]*ImportJob
+	run    importFunc
+	TmpDir string
+}
+
+func NewImportJobManager(run importFunc) *ImportJobManager {
+	return &ImportJobManager{
+		jobs: make(map[string]*ImportJob),
+		run:  run,
+	}
+}
+
+// Start spools r to a temporary file so the caller can return immediately, then imports it asynchronously
+func (m *ImportJobManager) Start(r io.Reader, opts ImportOptions) (*ImportJob, error) {
+	file, err := os.CreateTemp(m.TmpDir, "user-import-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+
+	job := &ImportJob{
+		ID:        newJobID(),
+		Status:    JobPending,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	go m.execute(job.ID, file, opts)
+
+	return m.Get(job.ID)
+}
+
+// Get returns a snapshot of the job so callers never observe it mid-update
+func (m *ImportJobManager) Get(id string) (*ImportJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrImportJobNotFound
+	}
+	snapshot := *job
+	return &snapshot, nil
+}
+
+func (m *ImportJobManager) execute(id string, file *os.File, opts ImportOptions) {
+	defer func() {
+		_ = file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			logrus.Warnf("Failed to remove import spool file %s: %v", file.Name(), err)
+		}
+	}()
+
+	m.update(id, func(job *ImportJob) { job.Status = JobRunning })
+
+	report, err := m.run(file, opts, func(processed int) {
+		m.update(id, func(job *ImportJob) { job.Processed = processed })
+	})
+
+	m.update(id, func(job *ImportJob) {
+		finished := time.Now().UTC()
+		job.FinishedAt = &finished
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = JobCompleted
+		job.Processed = report.Total
+		job.Report = report
+	})
+
+	if err != nil {
+		logrus.Errorf("Import job %s failed: %v", id, err)
+		return
+	}
+	logrus.Infof("Import job %s completed: %d rows processed", id, report.Total)
+}
+
+func (m *ImportJobManager) update(id string, fn func(job *ImportJob)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job, ok := m.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+func (m *ImportJobManager) pruneLocked() {
+	cutoff := time.Now().Add(-importJobRetention)
+	for id, job := range m.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func newJobID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
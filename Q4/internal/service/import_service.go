@@ -0,0 +1,241 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/importer"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultImportBatchSize = 500
+
+// Row statuses reported by an import
+const (
+	RowCreated = "created"
+	RowUpdated = "updated"
+	RowInvalid = "invalid"
+	RowFailed  = "failed"
+)
+
+type ImportOptions struct {
+	Format    importer.Format
+	Mapping   importer.ColumnMapping
+	DryRun    bool
+	BatchSize int
+}
+
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	Email  string   `json:"email,omitempty"`
+	Status string   `json:"status"`
+	UserID int      `json:"user_id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Invalid int               `json:"invalid"`
+	Failed  int               `json:"failed"`
+	Results []ImportRowResult `json:"results"`
+}
+
+type ImportServiceInterface interface {
+	// Import and StartImportJob act for caller, nil for anonymous requests. Only admins and service
+	// principals may import users.
+	Import(caller *auth.Principal, r io.Reader, opts ImportOptions) (*ImportReport, error)
+	StartImportJob(caller *auth.Principal, r io.Reader, opts ImportOptions) (*ImportJob, error)
+	GetImportJob(id string) (*ImportJob, error)
+}
+
+type ImportService struct {
+	Repo repository.UserRepository
+	Jobs *ImportJobManager
+	// Events, when set, announces the users of every batch of rows once it is stored
+	Events *UserEvents
+}
+
+func NewImportService(repo repository.UserRepository) *ImportService {
+	s := &ImportService{
+		Repo: repo,
+	}
+	s.Jobs = NewImportJobManager(s.importWithProgress)
+	return s
+}
+
+// Import reads every record from r, validates it and upserts the valid rows by email in batches.
+// In dry-run mode nothing is written and each row reports what would have happened.
+func (s *ImportService) Import(caller *auth.Principal, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	if err := authorizeBulk(s.Repo, caller); err != nil {
+		return nil, err
+	}
+	return s.importWithProgress(r, opts, nil)
+}
+
+func (s *ImportService) StartImportJob(caller *auth.Principal, r io.Reader, opts ImportOptions) (*ImportJob, error) {
+	if err := authorizeBulk(s.Repo, caller); err != nil {
+		return nil, err
+	}
+	return s.Jobs.Start(r, opts)
+}
+
+func (s *ImportService) GetImportJob(id string) (*ImportJob, error) {
+	return s.Jobs.Get(id)
+}
+
+func (s *ImportService) importWithProgress(r io.Reader, opts ImportOptions, progress func(processed int)) (*ImportReport, error) {
+	if opts.Mapping == nil {
+		opts.Mapping = importer.DefaultMapping()
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultImportBatchSize
+	}
+
+	reader, err := importer.NewReader(opts.Format, r, opts.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: opts.DryRun, Results: []ImportRowResult{}}
+	seen := make(map[string]int)
+	var batch []model.User
+	var batchRows []int
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		results, err := s.Repo.UpsertUsers(batch)
+		if err == nil {
+			s.announce(results)
+		}
+		for i, idx := range batchRows {
+			row := &report.Results[idx]
+			switch {
+			case err != nil:
+				row.Status = RowFailed
+				row.Errors = []string{err.Error()}
+			case results[i].Created:
+				row.Status = RowCreated
+				row.UserID = results[i].ID
+			default:
+				row.Status = RowUpdated
+				row.UserID = results[i].ID
+			}
+		}
+		batch, batchRows = batch[:0], batchRows[:0]
+		if progress != nil {
+			progress(len(report.Results))
+		}
+	}
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		user, errs := validateImportRecord(record)
+		result := ImportRowResult{Row: record.Row, Email: user.Email, Errors: errs}
+		if len(errs) == 0 {
+			if first, dup := seen[user.Email]; dup {
+				result.Errors = []string{fmt.Sprintf("duplicate email, already imported from row %d", first)}
+			} else {
+				seen[user.Email] = record.Row
+			}
+		}
+
+		if len(result.Errors) > 0 {
+			result.Status = RowInvalid
+			report.Results = append(report.Results, result)
+			continue
+		}
+
+		if opts.DryRun {
+			existing, err := s.Repo.GetUserByEmail(user.Email)
+			switch {
+			case errors.Is(err, repository.ErrUserNotFound):
+				result.Status = RowCreated
+			case err != nil:
+				result.Status = RowFailed
+				result.Errors = []string{err.Error()}
+			default:
+				result.Status = RowUpdated
+				result.UserID = existing.ID
+			}
+			report.Results = append(report.Results, result)
+			continue
+		}
+
+		report.Results = append(report.Results, result)
+		batch = append(batch, user)
+		batchRows = append(batchRows, len(report.Results)-1)
+		if len(batch) >= opts.BatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	for _, row := range report.Results {
+		report.Total++
+		switch row.Status {
+		case RowCreated:
+			report.Created++
+		case RowUpdated:
+			report.Updated++
+		case RowInvalid:
+			report.Invalid++
+		case RowFailed:
+			report.Failed++
+		}
+	}
+	if progress != nil {
+		progress(report.Total)
+	}
+
+	return report, nil
+}
+
+// announce publishes the users of a stored batch of rows
+func (s *ImportService) announce(results []repository.UpsertResult) {
+	if s.Events == nil {
+		return
+	}
+	changes := make([]userChange, len(results))
+	for i, result := range results {
+		changes[i] = userChange{Type: model.UserUpdated, ID: result.ID}
+		if result.Created {
+			changes[i].Type = model.UserCreated
+		}
+	}
+	changes, err := loadChanges(s.Repo, changes)
+	if err != nil {
+		// The rows are stored already; only their announcement is lost
+		logrus.Errorf("Failed to load imported users to announce them: %v", err)
+		return
+	}
+	s.Events.publishChanges(changes)
+}
+
+func validateImportRecord(record importer.Record) (model.User, []string) {
+	if record.Err != nil {
+		return model.User{}, []string{record.Err.Error()}
+	}
+
+	user := model.User{
+		Name:  strings.TrimSpace(record.Fields["name"]),
+		Email: strings.TrimSpace(record.Fields["email"]),
+	}
+	return user, validateUser(user)
+}
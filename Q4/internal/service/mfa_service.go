@@ -0,0 +1,364 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/ratelimit"
+	"Q4/internal/repository"
+	"context"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrMFAAlreadyEnabled is returned when enrolling a user whose authenticator is already confirmed
+	ErrMFAAlreadyEnabled = errors.New("multi-factor authentication is already enabled")
+	// ErrMFANotEnabled is returned for operations that need a confirmed, or for confirmation a pending, authenticator
+	ErrMFANotEnabled = errors.New("multi-factor authentication is not enabled")
+	// ErrInvalidMFACode is returned for wrong, reused or expired TOTP codes and unknown recovery codes
+	ErrInvalidMFACode = errors.New("invalid authentication code")
+	// ErrInvalidMFAChallenge is returned for MFA tokens from Login that are invalid or expired
+	ErrInvalidMFAChallenge = errors.New("invalid or expired mfa token")
+	// ErrMFARequiredByPolicy is returned when disabling MFA for a role that must use it
+	ErrMFARequiredByPolicy = errors.New("multi-factor authentication is required for this role")
+)
+
+const (
+	DefaultMFAChallengeTTL = 5 * time.Minute
+	mfaChallengePurpose    = "mfa-challenge"
+	// mfaQRCodeSize is the width and height of enrollment QR codes in pixels
+	mfaQRCodeSize = 256
+)
+
+// MFASetup is what a user needs to add their account to an authenticator app
+type MFASetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	// QRCode is a PNG of URI as a data: URL, ready for an <img> tag
+	QRCode string `json:"qr_code"`
+}
+
+type MFAStatus struct {
+	Enabled bool `json:"enabled"`
+	// Required is set when the user's role must use MFA
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type MFAServiceInterface interface {
+	Status(userID int) (*MFAStatus, error)
+	// EnrollmentChallengeUser returns the user an enrollment token from Login was issued to
+	EnrollmentChallengeUser(token string) (int, error)
+	// BeginEnrollment generates a new secret. It guards nothing until ConfirmEnrollment.
+	BeginEnrollment(userID int) (*MFASetup, error)
+	// ConfirmEnrollment checks a code from the new authenticator, turns MFA on and returns
+	// recovery codes, which are not shown again
+	ConfirmEnrollment(userID int, code string) ([]string, error)
+	RegenerateRecoveryCodes(userID int, code string) ([]string, error)
+	Disable(userID int, code string) error
+}
+
+// MFAService manages TOTP authenticators and recovery codes and issues the MFA step of sign-in
+type MFAService struct {
+	Store  *repository.Store
+	Signer *auth.Signer
+	// Issuer names the service in authenticator apps
+	Issuer string
+	// RequiredRoles lists the roles that cannot sign in or disable MFA without an authenticator
+	RequiredRoles []string
+	ChallengeTTL  time.Duration
+	// Attempts limits code guesses per user across sign-in and account changes
+	Attempts *ratelimit.SlidingWindow
+
+	// Now returns the current time; tests replace it to generate codes for other periods
+	Now func() time.Time
+}
+
+func NewMFAService(store *repository.Store, signer *auth.Signer, issuer string, requiredRoles []string) *MFAService {
+	return &MFAService{
+		Store:         store,
+		Signer:        signer,
+		Issuer:        issuer,
+		RequiredRoles: requiredRoles,
+		ChallengeTTL:  DefaultMFAChallengeTTL,
+		Attempts:      ratelimit.NewSlidingWindow(5, 5*time.Minute),
+		Now:           time.Now,
+	}
+}
+
+type mfaChallengeClaims struct {
+	UserID int  `json:"uid"`
+	Enroll bool `json:"enroll,omitempty"`
+}
+
+// Required reports whether the policy makes user use MFA
+func (s *MFAService) Required(user model.User) bool {
+	return slices.Contains(s.RequiredRoles, user.Role)
+}
+
+// challenge returns the MFA step of signing in user, or nil if their password is enough
+func (s *MFAService) challenge(user model.User) (*LoginResult, error) {
+	enrolled, err := s.confirmedEnrollment(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	claims := mfaChallengeClaims{UserID: user.ID}
+	switch {
+	case enrolled != nil:
+	case s.Required(user):
+		claims.Enroll = true
+	default:
+		return nil, nil
+	}
+
+	token, err := s.Signer.Sign(mfaChallengePurpose, claims, s.ChallengeTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		ExpiresAt:             s.Signer.Now().Add(s.ChallengeTTL),
+		MFARequired:           true,
+		MFAToken:              token,
+		MFAEnrollmentRequired: claims.Enroll,
+	}, nil
+}
+
+// verifyChallenge checks code for the MFA token from challenge and returns the user to sign in.
+// If the token was issued for a forced enrollment, the code confirms it and the new recovery
+// codes are returned.
+func (s *MFAService) verifyChallenge(token, code string) (int, []string, error) {
+	var claims mfaChallengeClaims
+	if err := s.Signer.Verify(mfaChallengePurpose, token, &claims); err != nil {
+		return 0, nil, ErrInvalidMFAChallenge
+	}
+
+	enrolled, err := s.confirmedEnrollment(claims.UserID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if enrolled != nil {
+		return claims.UserID, nil, s.checkCode(enrolled, code)
+	}
+	if !claims.Enroll {
+		// MFA was turned off after the token was issued
+		return 0, nil, ErrInvalidMFAChallenge
+	}
+	codes, err := s.ConfirmEnrollment(claims.UserID, code)
+	return claims.UserID, codes, err
+}
+
+func (s *MFAService) EnrollmentChallengeUser(token string) (int, error) {
+	var claims mfaChallengeClaims
+	if err := s.Signer.Verify(mfaChallengePurpose, token, &claims); err != nil || !claims.Enroll {
+		return 0, ErrInvalidMFAChallenge
+	}
+	return claims.UserID, nil
+}
+
+func (s *MFAService) Status(userID int) (*MFAStatus, error) {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	status := &MFAStatus{Required: s.Required(*user)}
+
+	enrolled, err := s.confirmedEnrollment(userID)
+	if err != nil || enrolled == nil {
+		return status, err
+	}
+	status.Enabled = true
+	status.RecoveryCodesLeft, err = s.Store.MFA.CountRecoveryCodes(userID)
+	return status, err
+}
+
+func (s *MFAService) BeginEnrollment(userID int) (*MFASetup, error) {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	enrolled, err := s.confirmedEnrollment(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enrolled != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret := auth.NewTOTPSecret()
+	err = s.Store.MFA.SaveMFAEnrollment(model.MFAEnrollment{UserID: userID, Secret: secret, CreatedAt: s.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	uri := auth.TOTPKeyURI(s.Issuer, user.Email, secret)
+	png, err := auth.TOTPQRCode(uri, mfaQRCodeSize)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d started MFA enrollment", userID)
+	return &MFASetup{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+func (s *MFAService) ConfirmEnrollment(userID int, code string) ([]string, error) {
+	enrollment, err := s.Store.MFA.GetMFAEnrollment(userID)
+	if errors.Is(err, repository.ErrMFANotEnrolled) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.Confirmed() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if err := s.allowAttempt(userID); err != nil {
+		return nil, err
+	}
+	now := s.Now()
+	step, ok := auth.ValidateTOTP(enrollment.Secret, code, now)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes := auth.NewRecoveryCodes(auth.RecoveryCodeCount)
+	enrollment.ConfirmedAt = &now
+	enrollment.LastStep = step
+	err = s.Store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		if err := repos.MFA.SaveMFAEnrollment(*enrollment); err != nil {
+			return err
+		}
+		return repos.MFA.ReplaceRecoveryCodes(userID, hashRecoveryCodes(codes))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Attempts.Reset(strconv.Itoa(userID))
+	logrus.Infof("User %d enabled MFA", userID)
+	return codes, nil
+}
+
+func (s *MFAService) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	enrolled, err := s.requireEnrollment(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkCode(enrolled, code); err != nil {
+		return nil, err
+	}
+
+	codes := auth.NewRecoveryCodes(auth.RecoveryCodeCount)
+	err = s.Store.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		return repos.MFA.ReplaceRecoveryCodes(userID, hashRecoveryCodes(codes))
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d regenerated their MFA recovery codes", userID)
+	return codes, nil
+}
+
+func (s *MFAService) Disable(userID int, code string) error {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if s.Required(*user) {
+		return ErrMFARequiredByPolicy
+	}
+	enrolled, err := s.requireEnrollment(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkCode(enrolled, code); err != nil {
+		return err
+	}
+
+	if err := s.Store.MFA.DeleteMFAEnrollment(userID); err != nil {
+		return err
+	}
+	logrus.Infof("User %d disabled MFA", userID)
+	return nil
+}
+
+// confirmedEnrollment returns the user's authenticator, or nil if they have none or it is still pending
+func (s *MFAService) confirmedEnrollment(userID int) (*model.MFAEnrollment, error) {
+	enrollment, err := s.Store.MFA.GetMFAEnrollment(userID)
+	if errors.Is(err, repository.ErrMFANotEnrolled) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !enrollment.Confirmed() {
+		return nil, nil
+	}
+	return enrollment, nil
+}
+
+func (s *MFAService) requireEnrollment(userID int) (*model.MFAEnrollment, error) {
+	enrolled, err := s.confirmedEnrollment(userID)
+	if err == nil && enrolled == nil {
+		err = ErrMFANotEnabled
+	}
+	return enrolled, err
+}
+
+// checkCode accepts a TOTP code that has not been used yet or an unused recovery code
+func (s *MFAService) checkCode(enrollment *model.MFAEnrollment, code string) error {
+	if err := s.allowAttempt(enrollment.UserID); err != nil {
+		return err
+	}
+
+	if step, ok := auth.ValidateTOTP(enrollment.Secret, code, s.Now()); ok {
+		err := s.Store.MFA.UseTOTPStep(enrollment.UserID, step)
+		if errors.Is(err, repository.ErrTOTPStepUsed) {
+			logrus.Warnf("Rejected reused TOTP code for user %d", enrollment.UserID)
+			return ErrInvalidMFACode
+		}
+		if err != nil {
+			return err
+		}
+		s.Attempts.Reset(strconv.Itoa(enrollment.UserID))
+		return nil
+	}
+
+	err := s.Store.MFA.ConsumeRecoveryCode(enrollment.UserID, auth.HashRecoveryCode(code))
+	if errors.Is(err, repository.ErrRecoveryCodeNotFound) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+	s.Attempts.Reset(strconv.Itoa(enrollment.UserID))
+	left, err := s.Store.MFA.CountRecoveryCodes(enrollment.UserID)
+	if err != nil {
+		return err
+	}
+	logrus.Warnf("User %d used a recovery code; %d left", enrollment.UserID, left)
+	return nil
+}
+
+func (s *MFAService) allowAttempt(userID int) error {
+	if ok, retryAfter := s.Attempts.Allow(strconv.Itoa(userID)); !ok {
+		logrus.Warnf("Rate limited MFA code attempts for user %d", userID)
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return hashes
+}
@@ -0,0 +1,706 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/oidc"
+	"Q4/internal/repository"
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrAdminRequired is returned when a user who is not an admin manages the OpenID Connect provider
+var ErrAdminRequired = errors.New("only admins can manage oauth clients and keys")
+
+const (
+	DefaultAuthorizationCodeTTL = time.Minute
+	DefaultAccessTokenTTL       = time.Hour
+	// DefaultSigningKeyRotation is how long a signing key signs before a new one replaces it
+	DefaultSigningKeyRotation = 30 * 24 * time.Hour
+	// DefaultSigningKeyRetention is how long a replaced key stays in the JWKS. It has to outlast the
+	// ID tokens the key signed and the time relying parties cache the JWKS.
+	DefaultSigningKeyRetention = 7 * 24 * time.Hour
+	maxClientNameLength        = 100
+)
+
+// ClientRegistration is the metadata of a new client, named as in RFC 7591
+type ClientRegistration struct {
+	Name string `json:"client_name"`
+	// RedirectURIs are required for the authorization code grant. They must use https, http on a
+	// loopback address, or the private-use scheme of a native app such as "com.example.app:/callback".
+	RedirectURIs []string `json:"redirect_uris"`
+	// GrantTypes defaults to ["authorization_code"]
+	GrantTypes []string `json:"grant_types,omitempty"`
+	// Scope is the space-delimited scopes the client may request; it defaults to "openid profile email"
+	// for clients of the authorization code grant
+	Scope string `json:"scope,omitempty"`
+	// TokenEndpointAuthMethod defaults to "client_secret_basic"; "none" registers a public client
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty" enums:"client_secret_basic,client_secret_post,none"`
+}
+
+// RegisteredClient is a new client with its secret, which is not shown again
+type RegisteredClient struct {
+	model.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// AuthorizationRequest holds the parameters of an authorization request (RFC 6749 section 4.1.1
+// with PKCE). The page at the authorization endpoint signs the user in and passes them on.
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	State               string `json:"state,omitempty"`
+	Nonce               string `json:"nonce,omitempty"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// AuthorizationResponse tells the page where to send the browser: back to the client with either
+// a code or an error
+type AuthorizationResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// TokenRequest holds the parameters of the token endpoint
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	Scope        string
+	ClientID     string
+	ClientSecret string
+}
+
+// TokenResponse is the successful response of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	// IDToken is only issued when the openid scope was granted
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// Introspection describes an access token as RFC 7662 defines. Inactive tokens only carry Active.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+type OIDCServiceInterface interface {
+	RegisterClient(adminID int, registration ClientRegistration) (*RegisteredClient, error)
+	ListClients(adminID int) ([]model.OAuthClient, error)
+	DeleteClient(adminID int, clientID string) error
+	// RotateSigningKey replaces the signing key at once, such as after a leak, and returns the new key ID
+	RotateSigningKey(adminID int) (string, error)
+	// Authorize issues a code to the signed-in user. Errors about the client or redirect URI are
+	// returned; others are sent to the client in the redirect, as the spec requires.
+	Authorize(userID int, request AuthorizationRequest) (*AuthorizationResponse, error)
+	Token(request TokenRequest) (*TokenResponse, error)
+	// Introspect describes token to an authenticated confidential client
+	Introspect(clientID, clientSecret, token string) (*Introspection, error)
+	// Revoke revokes token if it was issued to the client. Unknown tokens are not an error.
+	Revoke(clientID, clientSecret, token string) error
+	UserInfo(accessToken string) (*oidc.UserClaims, error)
+	Discovery() *oidc.Discovery
+	JWKS() (*oidc.JSONWebKeySet, error)
+}
+
+// OIDCService is an OAuth 2.0 authorization server and OpenID Connect provider for the users of
+// the store. Access tokens are opaque and checked by introspection; ID tokens are RS256 JWTs.
+type OIDCService struct {
+	Store *repository.Store
+	// Issuer is the URL the discovery document and the protocol endpoints are served under
+	Issuer string
+	// AuthorizationEndpoint is the page that signs the user in and calls Authorize
+	AuthorizationEndpoint string
+	CodeTTL               time.Duration
+	// TokenTTL is the lifetime of access and ID tokens
+	TokenTTL     time.Duration
+	KeyRotation  time.Duration
+	KeyRetention time.Duration
+
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+	// keyMu keeps concurrent requests of this process from rotating the key more than once
+	keyMu sync.Mutex
+}
+
+func NewOIDCService(store *repository.Store, issuer, authorizationEndpoint string) *OIDCService {
+	return &OIDCService{
+		Store:                 store,
+		Issuer:                issuer,
+		AuthorizationEndpoint: authorizationEndpoint,
+		CodeTTL:               DefaultAuthorizationCodeTTL,
+		TokenTTL:              DefaultAccessTokenTTL,
+		KeyRotation:           DefaultSigningKeyRotation,
+		KeyRetention:          DefaultSigningKeyRetention,
+		Now:                   time.Now,
+	}
+}
+
+func (s *OIDCService) requireAdmin(userID int) error {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Role != model.RoleAdmin {
+		return ErrAdminRequired
+	}
+	return nil
+}
+
+func (s *OIDCService) RegisterClient(adminID int, registration ClientRegistration) (*RegisteredClient, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	client, err := newOAuthClient(registration)
+	if err != nil {
+		return nil, err
+	}
+	client.ID = auth.NewID()
+	client.CreatedAt = s.Now()
+
+	registered := &RegisteredClient{OAuthClient: *client}
+	if client.TokenEndpointAuthMethod != oidc.AuthMethodNone {
+		registered.ClientSecret, registered.SecretHash = auth.NewOpaqueToken()
+	}
+	if err := s.Store.OAuth.CreateOAuthClient(&registered.OAuthClient); err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d registered OAuth client %s (%s)", adminID, client.ID, client.Name)
+	return registered, nil
+}
+
+// newOAuthClient validates registration and fills in its defaults
+func newOAuthClient(registration ClientRegistration) (*model.OAuthClient, error) {
+	client := &model.OAuthClient{
+		Name:                    strings.TrimSpace(registration.Name),
+		TokenEndpointAuthMethod: registration.TokenEndpointAuthMethod,
+		RedirectURIs:            registration.RedirectURIs,
+		GrantTypes:              registration.GrantTypes,
+		Scopes:                  oidc.ParseScope(registration.Scope),
+	}
+	if client.Name == "" || len([]rune(client.Name)) > maxClientNameLength {
+		return nil, oidc.Errorf(oidc.ErrInvalidClientMetadata, "client_name is required and at most %d characters", maxClientNameLength)
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case "":
+		client.TokenEndpointAuthMethod = oidc.AuthMethodClientSecretBasic
+	case oidc.AuthMethodClientSecretBasic, oidc.AuthMethodClientSecretPost, oidc.AuthMethodNone:
+	default:
+		return nil, oidc.Errorf(oidc.ErrInvalidClientMetadata, "unsupported token_endpoint_auth_method %q", client.TokenEndpointAuthMethod)
+	}
+
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{oidc.GrantAuthorizationCode}
+	}
+	for _, grant := range client.GrantTypes {
+		switch grant {
+		case oidc.GrantAuthorizationCode:
+		case oidc.GrantClientCredentials:
+			if client.TokenEndpointAuthMethod == oidc.AuthMethodNone {
+				return nil, oidc.Errorf(oidc.ErrInvalidClientMetadata, "public clients cannot use the client_credentials grant")
+			}
+		default:
+			return nil, oidc.Errorf(oidc.ErrInvalidClientMetadata, "unsupported grant type %q", grant)
+		}
+	}
+	client.GrantTypes = slices.Compact(slices.Sorted(slices.Values(client.GrantTypes)))
+
+	codeGrant := slices.Contains(client.GrantTypes, oidc.GrantAuthorizationCode)
+	if codeGrant && len(client.RedirectURIs) == 0 {
+		return nil, oidc.Errorf(oidc.ErrInvalidRedirectURI, "the authorization_code grant needs at least one redirect URI")
+	}
+	for _, uri := range client.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(client.Scopes) == 0 && codeGrant {
+		client.Scopes = oidc.UserScopes
+	}
+	for _, scope := range client.Scopes {
+		if !oidc.ValidScopeToken(scope) {
+			return nil, oidc.Errorf(oidc.ErrInvalidClientMetadata, "invalid scope %q", scope)
+		}
+	}
+	return client, nil
+}
+
+// validateRedirectURI accepts the redirect URIs RFC 9700 and RFC 8252 allow: https, http only on
+// a loopback address, and private-use schemes of native apps, which contain a dot
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || strings.ContainsAny(uri, " \t\r\n") {
+		return oidc.Errorf(oidc.ErrInvalidRedirectURI, "%q is not an absolute URI", uri)
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return oidc.Errorf(oidc.ErrInvalidRedirectURI, "%q must not have a fragment", uri)
+	}
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+	case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"):
+	case u.Scheme != "http" && u.Scheme != "https" && strings.Contains(u.Scheme, "."):
+	default:
+		return oidc.Errorf(oidc.ErrInvalidRedirectURI, "%q must use https, http on a loopback address or a private-use scheme", uri)
+	}
+	return nil
+}
+
+func (s *OIDCService) ListClients(adminID int) ([]model.OAuthClient, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	return s.Store.OAuth.ListOAuthClients()
+}
+
+func (s *OIDCService) DeleteClient(adminID int, clientID string) error {
+	if err := s.requireAdmin(adminID); err != nil {
+		return err
+	}
+	if err := s.Store.OAuth.DeleteOAuthClient(clientID); err != nil {
+		return err
+	}
+	logrus.Infof("User %d deleted OAuth client %s and revoked its tokens", adminID, clientID)
+	return nil
+}
+
+func (s *OIDCService) Authorize(userID int, request AuthorizationRequest) (*AuthorizationResponse, error) {
+	client, err := s.Store.OAuth.GetOAuthClient(request.ClientID)
+	if errors.Is(err, repository.ErrClientNotFound) {
+		return nil, oidc.Errorf(oidc.ErrInvalidRequest, "unknown client_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// An unchecked redirect URI would make this an open redirector, so its errors are not redirected
+	redirectURI := request.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return nil, oidc.Errorf(oidc.ErrInvalidRequest, "redirect_uri is not registered for the client")
+	}
+
+	params := url.Values{}
+	code, err := s.issueCode(userID, client, redirectURI, request)
+	var oauthErr *oidc.Error
+	switch {
+	case errors.As(err, &oauthErr):
+		params.Set("error", oauthErr.Code)
+		if oauthErr.Description != "" {
+			params.Set("error_description", oauthErr.Description)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		params.Set("code", code)
+	}
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	params.Set("iss", s.Issuer)
+	return &AuthorizationResponse{RedirectTo: withQuery(redirectURI, params)}, nil
+}
+
+func (s *OIDCService) issueCode(userID int, client *model.OAuthClient, redirectURI string, request AuthorizationRequest) (string, error) {
+	if request.ResponseType != oidc.ResponseTypeCode {
+		return "", oidc.Errorf(oidc.ErrUnsupportedResponseType, "only the code response type is supported")
+	}
+	if !slices.Contains(client.GrantTypes, oidc.GrantAuthorizationCode) {
+		return "", oidc.Errorf(oidc.ErrUnauthorizedClient, "the client may not use the authorization code grant")
+	}
+	// PKCE is required of every client, confidential ones included, as RFC 9700 recommends
+	if request.CodeChallengeMethod != oidc.CodeChallengeS256 || !oidc.ValidCodeChallenge(request.CodeChallenge) {
+		return "", oidc.Errorf(oidc.ErrInvalidRequest, "an S256 code_challenge is required")
+	}
+	scopes, err := grantedScopes(client, request.Scope, client.Scopes)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Store.Users.GetUserByID(userID); err != nil {
+		return "", err
+	}
+
+	code, codeHash := auth.NewOpaqueToken()
+	err = s.Store.OAuth.CreateAuthorizationCode(model.OAuthAuthorizationCode{
+		CodeHash:      codeHash,
+		ClientID:      client.ID,
+		UserID:        userID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		ExpiresAt:     s.Now().Add(s.CodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("User %d authorized OAuth client %s for %q", userID, client.ID, strings.Join(scopes, " "))
+	return code, nil
+}
+
+// grantedScopes returns the requested scopes, or defaults when none are requested, after checking
+// that the client may have each of them
+func grantedScopes(client *model.OAuthClient, requested string, defaults []string) ([]string, error) {
+	scopes := oidc.ParseScope(requested)
+	if len(scopes) == 0 {
+		scopes = defaults
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, oidc.Errorf(oidc.ErrInvalidScope, "the client may not request %q", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// withQuery adds params to the query of uri, keeping the parameters it already has
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (s *OIDCService) Token(request TokenRequest) (*TokenResponse, error) {
+	client, err := s.authenticateClient(request.ClientID, request.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch request.GrantType {
+	case oidc.GrantAuthorizationCode:
+		if !slices.Contains(client.GrantTypes, oidc.GrantAuthorizationCode) {
+			return nil, oidc.Errorf(oidc.ErrUnauthorizedClient, "the client may not use the authorization code grant")
+		}
+		return s.redeemCode(client, request)
+	case oidc.GrantClientCredentials:
+		if !slices.Contains(client.GrantTypes, oidc.GrantClientCredentials) || client.Public() {
+			return nil, oidc.Errorf(oidc.ErrUnauthorizedClient, "the client may not use the client credentials grant")
+		}
+		// Without a user there are no user claims to release
+		defaults := slices.DeleteFunc(slices.Clone(client.Scopes), func(scope string) bool { return slices.Contains(oidc.UserScopes, scope) })
+		scopes, err := grantedScopes(client, request.Scope, defaults)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(scopes, func(scope string) bool { return slices.Contains(oidc.UserScopes, scope) }) {
+			return nil, oidc.Errorf(oidc.ErrInvalidScope, "user scopes cannot be granted to a client acting for itself")
+		}
+		response, _, err := s.issueAccessToken(client.ID, 0, scopes)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Issued a client credentials token to OAuth client %s", client.ID)
+		return response, nil
+	case "":
+		return nil, oidc.Errorf(oidc.ErrInvalidRequest, "grant_type is required")
+	default:
+		return nil, oidc.Errorf(oidc.ErrUnsupportedGrantType, "grant type %q is not supported", request.GrantType)
+	}
+}
+
+func (s *OIDCService) redeemCode(client *model.OAuthClient, request TokenRequest) (*TokenResponse, error) {
+	if request.Code == "" {
+		return nil, oidc.Errorf(oidc.ErrInvalidRequest, "code is required")
+	}
+	code, err := s.Store.OAuth.ConsumeAuthorizationCode(auth.HashOpaqueToken(request.Code), s.Now())
+	if errors.Is(err, repository.ErrAuthorizationCodeNotFound) {
+		return nil, oidc.Errorf(oidc.ErrInvalidGrant, "the code is invalid, expired or already used")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code.ClientID != client.ID {
+		logrus.Warnf("OAuth client %s tried to redeem a code issued to %s", client.ID, code.ClientID)
+		return nil, oidc.Errorf(oidc.ErrInvalidGrant, "the code was issued to another client")
+	}
+	if request.RedirectURI != "" && request.RedirectURI != code.RedirectURI {
+		return nil, oidc.Errorf(oidc.ErrInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+	if !oidc.VerifyCodeChallenge(request.CodeVerifier, code.CodeChallenge) {
+		return nil, oidc.Errorf(oidc.ErrInvalidGrant, "code_verifier does not match the code_challenge")
+	}
+
+	user, err := s.Store.Users.GetUserByID(code.UserID)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		return nil, oidc.Errorf(oidc.ErrInvalidGrant, "the user no longer exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := strings.Fields(code.Scope)
+	response, issuedAt, err := s.issueAccessToken(client.ID, user.ID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(scopes, oidc.ScopeOpenID) {
+		key, err := s.signingKey()
+		if err != nil {
+			return nil, err
+		}
+		response.IDToken, err = key.Sign(oidc.IDTokenClaims{
+			Issuer:          s.Issuer,
+			Audience:        client.ID,
+			ExpiresAt:       issuedAt.Add(s.TokenTTL).Unix(),
+			IssuedAt:        issuedAt.Unix(),
+			Nonce:           code.Nonce,
+			AuthorizedParty: client.ID,
+			UserClaims:      oidc.ClaimsForUser(user, scopes),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("Issued tokens for user %d to OAuth client %s", user.ID, client.ID)
+	return response, nil
+}
+
+func (s *OIDCService) issueAccessToken(clientID string, userID int, scopes []string) (*TokenResponse, time.Time, error) {
+	now := s.Now()
+	// Expired tokens are never looked up again, so clear them out while issuing new ones
+	if _, err := s.Store.OAuth.DeleteExpiredOAuthTokens(now); err != nil {
+		logrus.Warnf("Failed to delete expired OAuth tokens: %v", err)
+	}
+
+	token, tokenHash := auth.NewOpaqueToken()
+	err := s.Store.OAuth.CreateOAuthToken(model.OAuthToken{
+		TokenHash: tokenHash,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scope:     strings.Join(scopes, " "),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.TokenTTL),
+	})
+	if err != nil {
+		return nil, now, err
+	}
+	return &TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.TokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, now, nil
+}
+
+// authenticateClient checks the credentials of a client. Public clients only name themselves;
+// sending a secret for one is an error, since it means the client is misconfigured.
+func (s *OIDCService) authenticateClient(clientID, clientSecret string) (*model.OAuthClient, error) {
+	if clientID == "" {
+		return nil, oidc.Errorf(oidc.ErrInvalidClient, "client authentication is required")
+	}
+	client, err := s.Store.OAuth.GetOAuthClient(clientID)
+	if errors.Is(err, repository.ErrClientNotFound) {
+		return nil, oidc.Errorf(oidc.ErrInvalidClient, "unknown client or wrong secret")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		if clientSecret != "" {
+			return nil, oidc.Errorf(oidc.ErrInvalidClient, "public clients have no secret")
+		}
+		return client, nil
+	}
+	if clientSecret == "" || subtle.ConstantTimeCompare([]byte(auth.HashOpaqueToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		logrus.Warnf("Rejected the credentials of OAuth client %s", clientID)
+		return nil, oidc.Errorf(oidc.ErrInvalidClient, "unknown client or wrong secret")
+	}
+	return client, nil
+}
+
+// activeToken returns the stored token for token, or nil when it is unknown, revoked or expired
+func (s *OIDCService) activeToken(token string) (*model.OAuthToken, error) {
+	stored, err := s.Store.OAuth.GetOAuthToken(auth.HashOpaqueToken(token))
+	if errors.Is(err, repository.ErrOAuthTokenNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.Now().Before(stored.ExpiresAt) {
+		return nil, nil
+	}
+	return stored, nil
+}
+
+func (s *OIDCService) Introspect(clientID, clientSecret, token string) (*Introspection, error) {
+	client, err := s.authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	// Public clients cannot authenticate, so anyone could introspect as one
+	if client.Public() {
+		return nil, oidc.Errorf(oidc.ErrInvalidClient, "public clients cannot introspect tokens")
+	}
+	stored, err := s.activeToken(token)
+	if err != nil || stored == nil {
+		return &Introspection{Active: false}, err
+	}
+
+	introspection := &Introspection{
+		Active:    true,
+		Scope:     stored.Scope,
+		ClientID:  stored.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.IssuedAt.Unix(),
+		Issuer:    s.Issuer,
+	}
+	if stored.UserID != 0 {
+		introspection.Subject = strconv.Itoa(stored.UserID)
+	}
+	return introspection, nil
+}
+
+func (s *OIDCService) Revoke(clientID, clientSecret, token string) error {
+	client, err := s.authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return err
+	}
+	tokenHash := auth.HashOpaqueToken(token)
+	stored, err := s.Store.OAuth.GetOAuthToken(tokenHash)
+	if errors.Is(err, repository.ErrOAuthTokenNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// RFC 7009 lets only the client a token was issued to revoke it
+	if stored.ClientID != client.ID {
+		logrus.Warnf("OAuth client %s tried to revoke a token of %s", client.ID, stored.ClientID)
+		return nil
+	}
+	if err := s.Store.OAuth.DeleteOAuthToken(tokenHash); err != nil && !errors.Is(err, repository.ErrOAuthTokenNotFound) {
+		return err
+	}
+	logrus.Infof("OAuth client %s revoked an access token", client.ID)
+	return nil
+}
+
+func (s *OIDCService) UserInfo(accessToken string) (*oidc.UserClaims, error) {
+	stored, err := s.activeToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || stored.UserID == 0 {
+		return nil, oidc.Errorf(oidc.ErrInvalidToken, "the access token is invalid, expired or not issued for a user")
+	}
+	scopes := strings.Fields(stored.Scope)
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		return nil, oidc.Errorf(oidc.ErrInvalidToken, "the access token was not granted the openid scope")
+	}
+	user, err := s.Store.Users.GetUserByID(stored.UserID)
+	if err != nil {
+		return nil, err
+	}
+	claims := oidc.ClaimsForUser(user, scopes)
+	return &claims, nil
+}
+
+func (s *OIDCService) Discovery() *oidc.Discovery {
+	return oidc.NewDiscovery(s.Issuer, s.AuthorizationEndpoint)
+}
+
+// JWKS returns the public keys of the signing key and of the keys it replaced within KeyRetention
+func (s *OIDCService) JWKS() (*oidc.JSONWebKeySet, error) {
+	if _, err := s.signingKey(); err != nil {
+		return nil, err
+	}
+	keys, err := s.Store.OAuth.ListSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &oidc.JSONWebKeySet{Keys: []oidc.JWK{}}
+	for i, stored := range keys {
+		// A key is retired when the next one is created, and dropped KeyRetention later
+		if i > 0 && !s.Now().Before(keys[i-1].CreatedAt.Add(s.KeyRetention)) {
+			if err := s.Store.OAuth.DeleteSigningKey(stored.ID); err != nil {
+				logrus.Warnf("Failed to delete retired signing key %s: %v", stored.ID, err)
+			}
+			continue
+		}
+		key, err := oidc.ParseSigningKey(stored.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set, nil
+}
+
+func (s *OIDCService) RotateSigningKey(adminID int) (string, error) {
+	if err := s.requireAdmin(adminID); err != nil {
+		return "", err
+	}
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	key, err := s.createSigningKey()
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("User %d rotated the OIDC signing key", adminID)
+	return key.ID, nil
+}
+
+// signingKey returns the key that signs new ID tokens, creating one when there is none yet or
+// the newest is due for rotation. Instances racing to rotate each add a key, which is harmless:
+// the newest signs and the others stay in the JWKS until they expire.
+func (s *OIDCService) signingKey() (*oidc.SigningKey, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	keys, err := s.Store.OAuth.ListSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 && s.Now().Before(keys[0].CreatedAt.Add(s.KeyRotation)) {
+		return oidc.ParseSigningKey(keys[0].PrivateKey)
+	}
+	return s.createSigningKey()
+}
+
+func (s *OIDCService) createSigningKey() (*oidc.SigningKey, error) {
+	key, err := oidc.NewSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := key.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.OAuth.CreateSigningKey(model.OAuthSigningKey{ID: key.ID, PrivateKey: der, CreatedAt: s.Now()}); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Created OIDC signing key %s", key.ID)
+	return key, nil
+}
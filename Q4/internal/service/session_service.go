@@ -0,0 +1,179 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSessionAccessDenied is returned when a user who is not an admin manages another user's sessions
+var ErrSessionAccessDenied = errors.New("only admins can manage the sessions of other users")
+
+// maxUserAgentLength caps the stored User-Agent header, which clients may make arbitrarily long
+const maxUserAgentLength = 512
+
+// UserSession is a session as shown to the user it belongs to
+type UserSession struct {
+	model.Session
+	// Current marks the session the listing was requested with
+	Current bool `json:"current"`
+}
+
+type SessionServiceInterface interface {
+	// ListSessions returns the active sessions of userID. Users may manage their own sessions and admins anyone's.
+	ListSessions(principal *auth.Principal, userID int) ([]UserSession, error)
+	// RevokeSession signs out one session of userID
+	RevokeSession(principal *auth.Principal, userID int, sessionID string) error
+	// RevokeSessions signs out every session of userID, except the caller's own if keepCurrent is set
+	RevokeSessions(principal *auth.Principal, userID int, keepCurrent bool) (int, error)
+}
+
+type SessionService struct {
+	Store *repository.Store
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+}
+
+func NewSessionService(store *repository.Store) *SessionService {
+	return &SessionService{
+		Store: store,
+		Now:   time.Now,
+	}
+}
+
+// authorize checks that the caller may manage the sessions of userID, and that the user exists
+func (s *SessionService) authorize(principal *auth.Principal, userID int) error {
+	if principal.UserID == userID {
+		return nil
+	}
+	caller, err := s.Store.Users.GetUserByID(principal.UserID)
+	if err != nil {
+		return err
+	}
+	if caller.Role != model.RoleAdmin {
+		return ErrSessionAccessDenied
+	}
+	_, err = s.Store.Users.GetUserByID(userID)
+	return err
+}
+
+func (s *SessionService) ListSessions(principal *auth.Principal, userID int) ([]UserSession, error) {
+	if err := s.authorize(principal, userID); err != nil {
+		return nil, err
+	}
+	sessions, err := s.Store.Sessions.ListUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Now()
+	active := []UserSession{}
+	for _, session := range sessions {
+		// Expired sessions are only deleted when they are next used
+		if now.Before(session.ExpiresAt) {
+			active = append(active, UserSession{Session: session, Current: session.ID == principal.SessionID})
+		}
+	}
+	return active, nil
+}
+
+func (s *SessionService) RevokeSession(principal *auth.Principal, userID int, sessionID string) error {
+	if err := s.authorize(principal, userID); err != nil {
+		return err
+	}
+	sessions, err := s.Store.Sessions.ListUserSessions(userID)
+	if err != nil {
+		return err
+	}
+	// Looking the session up among the user's own keeps a session ID from being revoked through another user
+	found := false
+	for _, session := range sessions {
+		found = found || session.ID == sessionID
+	}
+	if !found {
+		return repository.ErrSessionNotFound
+	}
+
+	if err := s.Store.Sessions.DeleteSession(sessionID); err != nil {
+		return err
+	}
+	logrus.Infof("User %d revoked session %s of user %d", principal.UserID, sessionID, userID)
+	return nil
+}
+
+func (s *SessionService) RevokeSessions(principal *auth.Principal, userID int, keepCurrent bool) (int, error) {
+	if err := s.authorize(principal, userID); err != nil {
+		return 0, err
+	}
+	exceptID := ""
+	if keepCurrent && principal.UserID == userID {
+		exceptID = principal.SessionID
+	}
+
+	revoked, err := s.Store.Sessions.DeleteUserSessions(userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	logrus.Infof("User %d revoked %d sessions of user %d", principal.UserID, revoked, userID)
+	return revoked, nil
+}
+
+// deviceName summarizes a User-Agent header as the browser and operating system, such as
+// "Firefox on Windows", for users to recognize their sessions by
+func deviceName(userAgent string) string {
+	var browser, system string
+	for _, b := range []struct{ token, name string }{
+		// Edge and Opera also claim to be Chrome, and Chrome claims to be Safari, so they come first
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	default:
+		return "Unknown device"
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
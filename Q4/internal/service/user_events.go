@@ -0,0 +1,233 @@
+package service
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEventBuffer is how many events a subscriber may fall behind before it is dropped
+	DefaultEventBuffer = 64
+	// DefaultEventReplay is how many past events UserEvents keeps for subscribers that resume
+	DefaultEventReplay = 1000
+)
+
+// ErrSubscriberTooSlow ends subscriptions that fell further behind than their buffer
+var ErrSubscriberTooSlow = errors.New("subscriber fell too far behind the user events")
+
+// UserEvents fans out the changes UserService, BatchService and ImportService make to users.
+// Publishing never waits for subscribers: one whose buffer is full is dropped instead, so that a
+// slow reader cannot hold up the writes of everyone else. The latest events are kept so that
+// subscribers can resume after the last event they saw.
+type UserEvents struct {
+	Now func() time.Time
+
+	mu          sync.Mutex
+	lastID      uint64
+	subscribers map[*UserSubscription]struct{}
+	// replay holds the latest events in a ring; next is where the following event goes
+	replay []model.UserEvent
+	next   int
+	full   bool
+	// done is closed by Shutdown
+	done chan struct{}
+}
+
+// NewUserEvents returns UserEvents that keep the last replaySize events, DefaultEventReplay if
+// replaySize is not positive
+func NewUserEvents(replaySize int) *UserEvents {
+	if replaySize <= 0 {
+		replaySize = DefaultEventReplay
+	}
+	return &UserEvents{
+		Now: time.Now,
+		// IDs continue from the current time in microseconds rather than from zero, so that they
+		// keep increasing across restarts and a client resuming from an earlier process is told
+		// it missed events instead of being replayed unrelated ones
+		lastID:      uint64(time.Now().UnixMicro()),
+		subscribers: make(map[*UserSubscription]struct{}),
+		replay:      make([]model.UserEvent, replaySize),
+		done:        make(chan struct{}),
+	}
+}
+
+// Shutdown tells the subscribers that serve long-lived streams, through Done, to end them. The
+// subscriptions themselves stay open. It may be called more than once.
+func (e *UserEvents) Shutdown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+}
+
+// Done is closed once Shutdown is called
+func (e *UserEvents) Done() <-chan struct{} {
+	return e.done
+}
+
+// Publish announces a change of the given type to user and returns the event
+func (e *UserEvents) Publish(eventType string, user model.User) model.UserEvent {
+	user.Password = ""
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastID++
+	event := model.UserEvent{ID: e.lastID, Type: eventType, User: user, Time: e.Now().UTC()}
+	e.replay[e.next] = event
+	e.next = (e.next + 1) % len(e.replay)
+	e.full = e.full || e.next == 0
+	for sub := range e.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			e.drop(sub, ErrSubscriberTooSlow)
+		}
+	}
+	return event
+}
+
+// Subscribe returns a subscription to the events published from now on. It holds up to buffer
+// undelivered events, DefaultEventBuffer if buffer is not positive.
+func (e *UserEvents) Subscribe(buffer int) *UserSubscription {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.subscribe(buffer, nil)
+}
+
+// Resume returns a subscription that first delivers the kept events published after the one
+// with ID lastID, then the new ones. It reports false if some of those events are no longer
+// kept, or lastID is unknown, in which case the subscription starts with the events from now on.
+// The buffer is enlarged to hold the replayed events.
+func (e *UserEvents) Resume(lastID uint64, buffer int) (*UserSubscription, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kept := e.kept()
+	var missed []model.UserEvent
+	complete := lastID == e.lastID
+	if !complete && len(kept) > 0 && lastID >= kept[0].ID-1 && lastID < e.lastID {
+		// IDs are consecutive, so the events after lastID are the tail of kept
+		missed = kept[len(kept)-int(e.lastID-lastID):]
+		complete = true
+	}
+
+	return e.subscribe(buffer, missed), complete
+}
+
+// subscribe adds a subscriber that starts with the events in missed; e.mu must be held
+func (e *UserEvents) subscribe(buffer int, missed []model.UserEvent) *UserSubscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+	sub := &UserSubscription{hub: e, events: make(chan model.UserEvent, max(buffer, len(missed)))}
+	for _, event := range missed {
+		sub.events <- event
+	}
+	e.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// kept returns the kept events, oldest first; e.mu must be held
+func (e *UserEvents) kept() []model.UserEvent {
+	if !e.full {
+		return e.replay[:e.next]
+	}
+	return append(append([]model.UserEvent(nil), e.replay[e.next:]...), e.replay[:e.next]...)
+}
+
+// drop ends sub with err; e.mu must be held
+func (e *UserEvents) drop(sub *UserSubscription, err error) {
+	if _, ok := e.subscribers[sub]; !ok {
+		return
+	}
+	delete(e.subscribers, sub)
+	sub.err = err
+	close(sub.events)
+}
+
+// UserSubscription receives user events until it is closed or falls behind
+type UserSubscription struct {
+	hub    *UserEvents
+	events chan model.UserEvent
+	err    error
+}
+
+// Events delivers the events in order. It is closed when the subscription ends; Err tells why.
+func (s *UserSubscription) Events() <-chan model.UserEvent {
+	return s.events
+}
+
+// Err returns ErrSubscriberTooSlow if the subscription was dropped for falling behind, and nil
+// while it lasts or after Close
+func (s *UserSubscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription. It may be called more than once.
+func (s *UserSubscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s, nil)
+}
+
+// userChange is a change to a user to announce once it is committed
+type userChange struct {
+	Type string
+	ID   int
+	// User is the user as stored after the change, or before it for deletes
+	User model.User
+}
+
+// loadChanges fills in the users of the created and updated changes from users in one lookup,
+// so that they are announced as stored. Changes to users that are gone by then, such as users
+// created and deleted by the same batch, are left out.
+func loadChanges(users repository.UserRepository, changes []userChange) ([]userChange, error) {
+	var ids []int
+	for _, change := range changes {
+		if change.Type != model.UserDeleted {
+			ids = append(ids, change.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return changes, nil
+	}
+	stored, err := users.GetUsersByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]model.User, len(stored))
+	for _, user := range stored {
+		byID[user.ID] = user
+	}
+
+	loaded := changes[:0]
+	for _, change := range changes {
+		if change.Type != model.UserDeleted {
+			user, ok := byID[change.ID]
+			if !ok {
+				continue
+			}
+			change.User = user
+		}
+		loaded = append(loaded, change)
+	}
+	return loaded, nil
+}
+
+// publishChanges announces changes in order; e may be nil
+func (e *UserEvents) publishChanges(changes []userChange) {
+	if e == nil {
+		return
+	}
+	for _, change := range changes {
+		e.Publish(change.Type, change.User)
+	}
+}
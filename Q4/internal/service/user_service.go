@@ -1,20 +1,67 @@
 package service
 
 import (
+	"Q4/internal/auth"
 	"Q4/internal/model"
 	"Q4/internal/repository"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
 )
 
 type UserServiceInterface interface {
 	GetAllUsers() ([]model.User, error)
+	ListUsers(filter model.UserFilter) ([]model.User, error)
+	IterateUsers(filter model.UserFilter) (repository.UserIterator, error)
 	GetUserByID(id int) (*model.User, error)
-	CreateUser(user *model.User) error
-	UpdateUser(user *model.User) error
-	DeleteUser(id int) error
+	// GetUsersByIDs returns the users with the given IDs, ordered by ID, leaving out unknown IDs
+	GetUsersByIDs(ids []int) ([]model.User, error)
+	// CreateUser, UpdateUser and DeleteUser act for caller, nil for anonymous requests. Anyone may
+	// create users, but only admins may give users a role other than the one they have, RoleUser
+	// for new users. Users may only be changed or deleted by themselves, admins and service
+	// principals, and only admins may change the email of an admin.
+	CreateUser(caller *auth.Principal, user *model.User) error
+	UpdateUser(caller *auth.Principal, user *model.User) error
+	DeleteUser(caller *auth.Principal, id int) error
+	Search(text string, limit, offset int) (*repository.SearchResult, error)
 }
 
+var (
+	// ErrInvalidRole is returned for users whose role is not one of the model.Role constants
+	ErrInvalidRole = fmt.Errorf("role must be %q or %q", model.RoleUser, model.RoleAdmin)
+	// ErrRoleDenied is returned when a caller who is not a signed-in admin changes a role
+	ErrRoleDenied = errors.New("only admins may set roles")
+	// ErrUserAccessDenied is returned when a signed-in user who is not an admin changes or deletes
+	// another user
+	ErrUserAccessDenied = errors.New("only admins may change other users")
+	// ErrPasswordConfirmation is returned when users change their own email without their current
+	// password, so that a stolen session cannot move an account to another address
+	ErrPasswordConfirmation = errors.New("changing your email requires your current password")
+	// ErrAdminEmailDenied is returned when a caller who is not a signed-in admin, such as an API
+	// key, changes the email of an admin. A password reset mailed to the new address would hand
+	// them the admin account.
+	ErrAdminEmailDenied = errors.New("only admins may change the email of an admin")
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
 type UserService struct {
 	Repo repository.UserRepository
+	// Verification, when set, emails a verification link to new users and to users whose email changes
+	Verification EmailVerificationServiceInterface
+	// Tx stores a new user and their password together; it is required to create users with a password
+	Tx repository.TxManager
+	// Passwords confirms the current password of users who change their own email; without it
+	// they cannot
+	Passwords repository.PasswordRepository
+	// Events, when set, announces every user created, updated or deleted through the service.
+	// BatchService and ImportService announce their changes to the same events.
+	Events *UserEvents
 }
 
 func NewUserService(repo repository.UserRepository) UserServiceInterface {
@@ -27,18 +74,303 @@ func (s *UserService) GetAllUsers() ([]model.User, error) {
 	return s.Repo.GetAllUsers()
 }
 
+func (s *UserService) ListUsers(filter model.UserFilter) ([]model.User, error) {
+	it, err := s.Repo.IterateUsers(filter)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	users := []model.User{}
+	for it.Next() {
+		users = append(users, it.User())
+	}
+	return users, it.Err()
+}
+
+func (s *UserService) IterateUsers(filter model.UserFilter) (repository.UserIterator, error) {
+	return s.Repo.IterateUsers(filter)
+}
+
 func (s *UserService) GetUserByID(id int) (*model.User, error) {
 	return s.Repo.GetUserByID(id)
 }
 
-func (s *UserService) CreateUser(user *model.User) error {
-	return s.Repo.CreateUser(user)
+func (s *UserService) GetUsersByIDs(ids []int) ([]model.User, error) {
+	return s.Repo.GetUsersByIDs(ids)
 }
 
-func (s *UserService) UpdateUser(user *model.User) error {
-	return s.Repo.UpdateUser(user)
+// CreateUser stores user and, if it carries a password, the password's hash. The plaintext
+// password is cleared from user either way.
+func (s *UserService) CreateUser(caller *auth.Principal, user *model.User) error {
+	if user.Role != "" && !model.ValidRole(user.Role) {
+		return ErrInvalidRole
+	}
+	if err := s.authorizeRole(caller, user.Role, model.RoleUser); err != nil {
+		return err
+	}
+	password := user.Password
+	user.Password, user.CurrentPassword = "", ""
+	if password == "" {
+		if err := s.Repo.CreateUser(user); err != nil {
+			return err
+		}
+		s.sendVerification(*user)
+		s.publish(model.UserCreated, user.ID)
+		return nil
+	}
+
+	if s.Tx == nil {
+		return errors.New("creating users with a password requires a transaction manager")
+	}
+	if err := auth.ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = s.Tx.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		if err := repos.Users.CreateUser(user); err != nil {
+			return err
+		}
+		return repos.Passwords.SetPasswordHash(user.ID, hash)
+	})
+	if err != nil {
+		return err
+	}
+	s.sendVerification(*user)
+	s.publish(model.UserCreated, user.ID)
+	return nil
 }
 
-func (s *UserService) DeleteUser(id int) error {
-	return s.Repo.DeleteUser(id)
+// UpdateUser saves user's name, email and role. Passwords are changed through a password reset.
+// Users who change their own email must send their current password in user.CurrentPassword,
+// and only admins may change the email of an admin.
+func (s *UserService) UpdateUser(caller *auth.Principal, user *model.User) error {
+	currentPassword := user.CurrentPassword
+	user.Password, user.CurrentPassword = "", ""
+	if user.Role != "" && !model.ValidRole(user.Role) {
+		return ErrInvalidRole
+	}
+	if err := s.authorizeUser(caller, user.ID); err != nil {
+		return err
+	}
+	before, err := s.Repo.GetUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.authorizeRole(caller, user.Role, before.Role); err != nil {
+		return err
+	}
+	if err := s.authorizeEmail(caller, before, user.Email); err != nil {
+		return err
+	}
+	if before.Email != user.Email && !caller.IsService() && caller.UserID == user.ID {
+		if err := s.confirmPassword(user.ID, currentPassword); err != nil {
+			return err
+		}
+	}
+	if err := s.Repo.UpdateUser(user); err != nil {
+		return err
+	}
+	if before.Email != user.Email {
+		s.sendVerification(*user)
+	}
+	s.publish(model.UserUpdated, user.ID)
+	return nil
+}
+
+// authorizeUser checks that caller may change or delete the user with the given ID: the user
+// themselves, an admin, or a service principal, whose scopes were checked before the call
+func (s *UserService) authorizeUser(caller *auth.Principal, id int) error {
+	if caller == nil {
+		return auth.ErrUnauthenticated
+	}
+	if caller.IsService() || caller.UserID == id {
+		return nil
+	}
+	admin, err := isAdmin(s.Repo, caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return ErrUserAccessDenied
+	}
+	return nil
+}
+
+// confirmPassword checks password against the stored hash of the user with the given ID. Users
+// without a password cannot confirm; they set one through a password reset first.
+func (s *UserService) confirmPassword(id int, password string) error {
+	if s.Passwords == nil || password == "" {
+		return ErrPasswordConfirmation
+	}
+	hash, err := s.Passwords.GetPasswordHash(id)
+	if errors.Is(err, repository.ErrPasswordNotSet) {
+		return ErrPasswordConfirmation
+	}
+	if err != nil {
+		return err
+	}
+	if !auth.CheckPassword(hash, password) {
+		return ErrPasswordConfirmation
+	}
+	return nil
+}
+
+// authorizeRole checks that caller may give a user role when their current role is current. An
+// empty role keeps the current one.
+func (s *UserService) authorizeRole(caller *auth.Principal, role, current string) error {
+	if role == "" || role == current {
+		return nil
+	}
+	admin, err := isAdmin(s.Repo, caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return ErrRoleDenied
+	}
+	return nil
+}
+
+// authorizeEmail checks that caller may move before to email. Only admins may move an admin.
+func (s *UserService) authorizeEmail(caller *auth.Principal, before *model.User, email string) error {
+	if email == before.Email || before.Role != model.RoleAdmin {
+		return nil
+	}
+	admin, err := isAdmin(s.Repo, caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return ErrAdminEmailDenied
+	}
+	return nil
+}
+
+// isAdmin reports whether caller is a signed-in admin. Service principals never are: API keys
+// act within their scopes, which do not cover roles.
+func isAdmin(users repository.UserRepository, caller *auth.Principal) (bool, error) {
+	if caller == nil || caller.IsService() {
+		return false, nil
+	}
+	user, err := users.GetUserByID(caller.UserID)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Role == model.RoleAdmin, nil
+}
+
+// authorizeBulk checks that caller may write many users at once, which only admins and service
+// principals may
+func authorizeBulk(users repository.UserRepository, caller *auth.Principal) error {
+	if caller == nil {
+		return auth.ErrUnauthenticated
+	}
+	if caller.IsService() {
+		return nil
+	}
+	admin, err := isAdmin(users, caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return ErrUserAccessDenied
+	}
+	return nil
+}
+
+// PromoteAdmins makes the users with the given emails admins, so that a new deployment can get
+// its first admin. Only verified addresses count, since anyone may sign up with any address.
+// Unknown and unverified addresses are logged and skipped.
+func (s *UserService) PromoteAdmins(emails []string) error {
+	for _, email := range emails {
+		user, err := s.Repo.GetUserByEmail(email)
+		if errors.Is(err, repository.ErrUserNotFound) {
+			logrus.Warnf("Not promoting %s to admin: no user has this email", email)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !user.EmailVerified {
+			logrus.Warnf("Not promoting user %d to admin: %s is not verified", user.ID, email)
+			continue
+		}
+		if user.Role == model.RoleAdmin {
+			continue
+		}
+		user.Role = model.RoleAdmin
+		if err := s.Repo.UpdateUser(user); err != nil {
+			return err
+		}
+		logrus.Infof("Promoted user %d to admin", user.ID)
+		s.publish(model.UserUpdated, user.ID)
+	}
+	return nil
+}
+
+// publish announces a change to the user with the given ID as stored, with the role and
+// verification state the store gave them
+func (s *UserService) publish(eventType string, id int) {
+	if s.Events == nil {
+		return
+	}
+	user, err := s.Repo.GetUserByID(id)
+	if err != nil {
+		logrus.Errorf("Failed to load user %d to announce the change: %v", id, err)
+		return
+	}
+	s.Events.Publish(eventType, *user)
+}
+
+// sendVerification emails a verification link without failing the write that triggered it;
+// users can ask for another link if this one never arrives
+func (s *UserService) sendVerification(user model.User) {
+	if s.Verification == nil {
+		return
+	}
+	if err := s.Verification.SendVerification(user); err != nil {
+		logrus.Errorf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+}
+
+func (s *UserService) DeleteUser(caller *auth.Principal, id int) error {
+	if err := s.authorizeUser(caller, id); err != nil {
+		return err
+	}
+	if s.Events == nil {
+		return s.Repo.DeleteUser(id)
+	}
+
+	before, err := s.Repo.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.Repo.DeleteUser(id); err != nil {
+		return err
+	}
+	s.Events.Publish(model.UserDeleted, *before)
+	return nil
+}
+
+// Search finds users by partial name or email. The limit is clamped to MaxSearchLimit.
+func (s *UserService) Search(text string, limit, offset int) (*repository.SearchResult, error) {
+	searcher, ok := s.Repo.(repository.UserSearcher)
+	if !ok {
+		return nil, repository.ErrSearchUnsupported
+	}
+
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxSearchLimit)
+	offset = max(offset, 0)
+
+	return searcher.SearchUsers(repository.SearchQuery{Text: text, Limit: limit, Offset: offset})
 }
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"Q4/internal/model"
+	"fmt"
+	"net/mail"
+)
+
+// validateUser checks the fields every stored user must have and returns one message per problem
+func validateUser(user model.User) []string {
+	var errs []string
+	if user.Name == "" {
+		errs = append(errs, "name is required")
+	}
+	if user.Email == "" {
+		errs = append(errs, "email is required")
+	} else if addr, err := mail.ParseAddress(user.Email); err != nil || addr.Address != user.Email {
+		errs = append(errs, "email is not a valid address")
+	}
+	if user.Role != "" && !model.ValidRole(user.Role) {
+		errs = append(errs, fmt.Sprintf("role must be %q or %q", model.RoleUser, model.RoleAdmin))
+	}
+	return errs
+}
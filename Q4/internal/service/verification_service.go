@@ -0,0 +1,197 @@
+package service
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/mail"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidVerificationToken is returned for verification tokens that are malformed, expired,
+	// or issued for an address the user no longer has
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	// ErrEmailAlreadyVerified is returned when a verification token has already been used
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+)
+
+const (
+	emailVerificationPurpose     = "verify-email"
+	DefaultEmailVerificationTTL  = 24 * time.Hour
+	DefaultVerificationResendGap = time.Minute
+)
+
+// EmailVerificationServiceInterface sends verification emails and confirms the tokens they carry
+type EmailVerificationServiceInterface interface {
+	SendVerification(user model.User) error
+	// ResendVerification sends a new link to email if it belongs to an unverified user. The lookup
+	// and the email happen in the background, and it returns nil whether or not anything is sent,
+	// so that neither its answer nor its timing lets callers probe for registered addresses.
+	ResendVerification(email string) error
+	VerifyEmail(token string) (*model.User, error)
+}
+
+type EmailVerificationService struct {
+	Repo   repository.UserRepository
+	Mailer mail.Mailer
+	Signer *auth.Signer
+	TTL    time.Duration
+	// LinkURL is the page verification links point at; the token is added as the token query parameter
+	LinkURL string
+	// ResendGap is the minimum time between two verification emails to the same address
+	ResendGap time.Duration
+	// Background runs work that must not delay the response; tests make it synchronous
+	Background func(func())
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+func NewEmailVerificationService(repo repository.UserRepository, mailer mail.Mailer, signer *auth.Signer, linkURL string) *EmailVerificationService {
+	return &EmailVerificationService{
+		Repo:       repo,
+		Mailer:     mailer,
+		Signer:     signer,
+		TTL:        DefaultEmailVerificationTTL,
+		LinkURL:    linkURL,
+		ResendGap:  DefaultVerificationResendGap,
+		Background: func(fn func()) { go fn() },
+		lastSent:   make(map[string]time.Time),
+	}
+}
+
+// verificationClaims binds a token to the address it was sent to, so that changing the
+// email or verifying it once makes every earlier token unusable
+type verificationClaims struct {
+	UserID int    `json:"uid"`
+	Email  string `json:"email"`
+}
+
+func (s *EmailVerificationService) SendVerification(user model.User) error {
+	token, err := s.Signer.Sign(emailVerificationPurpose, verificationClaims{UserID: user.ID, Email: user.Email}, s.TTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.LinkURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg, err := mail.Render("verify_email", user.Email, map[string]any{
+		"Name":      user.Name,
+		"Email":     user.Email,
+		"Link":      link.String(),
+		"ExpiresIn": formatDuration(s.TTL),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.Mailer.Send(msg); err != nil {
+		return err
+	}
+
+	now := s.Signer.Now()
+	s.mu.Lock()
+	for email, sentAt := range s.lastSent {
+		if now.Sub(sentAt) >= s.ResendGap {
+			delete(s.lastSent, email)
+		}
+	}
+	s.lastSent[user.Email] = now
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *EmailVerificationService) ResendVerification(email string) error {
+	// The lookup and the email happen after responding so that timing does not reveal the account
+	s.Background(func() {
+		if err := s.resendVerification(email); err != nil {
+			logrus.Errorf("Failed to resend verification email to %s: %v", email, err)
+		}
+	})
+	return nil
+}
+
+func (s *EmailVerificationService) resendVerification(email string) error {
+	user, err := s.Repo.GetUserByEmail(email)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		logrus.Infof("Skipped verification resend for unknown email %s", email)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		logrus.Infof("Skipped verification resend for already verified user %d", user.ID)
+		return nil
+	}
+
+	s.mu.Lock()
+	last, sent := s.lastSent[email]
+	s.mu.Unlock()
+	if sent && s.Signer.Now().Sub(last) < s.ResendGap {
+		logrus.Infof("Skipped verification resend for user %d: last email sent at %s", user.ID, last.Format(time.RFC3339))
+		return nil
+	}
+
+	return s.SendVerification(*user)
+}
+
+func (s *EmailVerificationService) VerifyEmail(token string) (*model.User, error) {
+	var claims verificationClaims
+	if err := s.Signer.Verify(emailVerificationPurpose, token, &claims); err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	user, err := s.Repo.GetUserByID(claims.UserID)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != claims.Email {
+		return nil, ErrInvalidVerificationToken
+	}
+	if user.EmailVerified {
+		return nil, ErrEmailAlreadyVerified
+	}
+
+	if err := s.Repo.MarkEmailVerified(user.ID, claims.Email); err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			// The email changed between the lookup and the update
+			return nil, ErrInvalidVerificationToken
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	delete(s.lastSent, user.Email)
+	s.mu.Unlock()
+
+	user.EmailVerified = true
+	return user, nil
+}
+
+// formatDuration renders whole hours or minutes the way they read in an email, e.g. "24 hours"
+func formatDuration(d time.Duration) string {
+	unit, n := "minute", int(d.Round(time.Minute)/time.Minute)
+	if d >= time.Hour && d%time.Hour == 0 {
+		unit, n = "hour", int(d/time.Hour)
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return strconv.Itoa(n) + " " + unit + "s"
+}
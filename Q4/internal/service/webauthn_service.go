@@ -0,0 +1,325 @@
+package service
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/webauthn"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidWebAuthnChallenge is returned for responses to challenges that are unknown, used,
+	// expired or issued for another ceremony or user
+	ErrInvalidWebAuthnChallenge = errors.New("invalid or expired webauthn challenge")
+	// ErrUnknownPasskey is returned when signing in with a credential that is not registered
+	ErrUnknownPasskey = errors.New("passkey not registered")
+)
+
+const (
+	DefaultWebAuthnChallengeTTL = 5 * time.Minute
+	// defaultPasskeyName is used when the user does not name a new credential
+	defaultPasskeyName   = "Passkey"
+	maxPasskeyNameLength = 64
+)
+
+type WebAuthnServiceInterface interface {
+	// BeginRegistration returns the options for navigator.credentials.create
+	BeginRegistration(userID int) (*webauthn.CredentialCreationOptions, error)
+	// FinishRegistration verifies the new credential and stores it under name
+	FinishRegistration(userID int, name string, credential webauthn.RegistrationCredential) (*model.WebAuthnCredential, error)
+	// BeginLogin returns the options for navigator.credentials.get. With an empty email, the
+	// browser offers the user's discoverable credentials instead of a list. Emails without
+	// passkeys, registered or not, get a placeholder list so that the answer does not tell them apart.
+	BeginLogin(email string) (*webauthn.CredentialRequestOptions, error)
+	// FinishLogin verifies the assertion and starts a session
+	FinishLogin(credential webauthn.AssertionCredential, client ClientInfo) (*LoginResult, error)
+	ListCredentials(userID int) ([]model.WebAuthnCredential, error)
+	DeleteCredential(userID int, id string) error
+}
+
+// WebAuthnService registers passkeys and signs users in with them. A passkey sign-in requires
+// user verification, a PIN or biometric on the authenticator, so it stands in for both the
+// password and the TOTP step.
+type WebAuthnService struct {
+	Store *repository.Store
+	// Auth starts the sessions of passkey sign-ins
+	Auth         *AuthService
+	RelyingParty *webauthn.RelyingParty
+	ChallengeTTL time.Duration
+	// PlaceholderKey derives the credential IDs listed for emails without passkeys. It must be
+	// secret, and stay the same across restarts so that asking twice gives the same IDs.
+	PlaceholderKey []byte
+
+	// Now returns the current time; tests replace it to move past expiries
+	Now func() time.Time
+}
+
+func NewWebAuthnService(store *repository.Store, authService *AuthService, rp *webauthn.RelyingParty) *WebAuthnService {
+	return &WebAuthnService{
+		Store:          store,
+		Auth:           authService,
+		RelyingParty:   rp,
+		ChallengeTTL:   DefaultWebAuthnChallengeTTL,
+		PlaceholderKey: randomKey(),
+		Now:            time.Now,
+	}
+}
+
+// randomKey returns a new PlaceholderKey, good until the process restarts
+func randomKey() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// userHandle is the user ID in decimal. It identifies the account in discoverable credentials
+// without putting personal data on the authenticator.
+func userHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+func (s *WebAuthnService) BeginRegistration(userID int) (*webauthn.CredentialCreationOptions, error) {
+	user, err := s.Store.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.Store.WebAuthn.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := s.newChallenge(userID, model.WebAuthnRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make([]webauthn.CredentialParameter, len(webauthn.SupportedAlgorithms))
+	for i, alg := range webauthn.SupportedAlgorithms {
+		params[i] = webauthn.CredentialParameter{Type: webauthn.CredentialType, Alg: alg}
+	}
+	return &webauthn.CredentialCreationOptions{
+		RP:   webauthn.RelyingPartyEntity{ID: s.RelyingParty.ID, Name: s.RelyingParty.Name},
+		User: webauthn.UserEntity{ID: userHandle(user.ID), Name: user.Email, DisplayName: user.Name},
+		// Listing the registered credentials stops the same authenticator from being added twice
+		ExcludeCredentials: credentialDescriptors(existing),
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            s.ChallengeTTL.Milliseconds(),
+		AuthenticatorSelection: webauthn.AuthenticatorSelection{
+			ResidentKey:      webauthn.ResidentKeyPreferred,
+			UserVerification: webauthn.UserVerificationRequired,
+		},
+		Attestation: webauthn.AttestationDirect,
+	}, nil
+}
+
+func (s *WebAuthnService) FinishRegistration(userID int, name string, credential webauthn.RegistrationCredential) (*model.WebAuthnCredential, error) {
+	challenge, err := s.consumeChallenge(credential.Response.ClientDataJSON, model.WebAuthnRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != userID {
+		return nil, ErrInvalidWebAuthnChallenge
+	}
+	raw, _ := webauthn.DecodeBase64URL(challenge.Challenge)
+	registration, err := s.RelyingParty.VerifyRegistration(raw, credential)
+	if err != nil {
+		logrus.Warnf("Rejected passkey registration of user %d: %v", userID, err)
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultPasskeyName
+	}
+	if len([]rune(name)) > maxPasskeyNameLength {
+		name = string([]rune(name)[:maxPasskeyNameLength])
+	}
+	stored := &model.WebAuthnCredential{
+		ID:                webauthn.Base64URL(registration.CredentialID).String(),
+		UserID:            userID,
+		Name:              name,
+		PublicKey:         registration.PublicKey,
+		SignCount:         registration.SignCount,
+		AAGUID:            formatAAGUID(registration.AAGUID),
+		AttestationFormat: registration.AttestationFormat,
+		Transports:        registration.Transports,
+		CreatedAt:         s.Now(),
+	}
+	if err := s.Store.WebAuthn.CreateWebAuthnCredential(stored); err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d registered passkey %s with %s attestation", userID, stored.ID, stored.AttestationFormat)
+	return stored, nil
+}
+
+func (s *WebAuthnService) BeginLogin(email string) (*webauthn.CredentialRequestOptions, error) {
+	var userID int
+	var credentials []model.WebAuthnCredential
+	if email != "" {
+		user, err := s.Store.Users.GetUserByEmail(email)
+		switch {
+		case err == nil:
+			userID = user.ID
+			if credentials, err = s.Store.WebAuthn.ListWebAuthnCredentials(user.ID); err != nil {
+				return nil, err
+			}
+		case !errors.Is(err, repository.ErrUserNotFound):
+			return nil, err
+		}
+	}
+
+	challenge, err := s.newChallenge(userID, model.WebAuthnLogin)
+	if err != nil {
+		return nil, err
+	}
+	allow := credentialDescriptors(credentials)
+	if email != "" && len(allow) == 0 {
+		allow = []webauthn.CredentialDescriptor{s.placeholderDescriptor(email)}
+	}
+	return &webauthn.CredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          s.ChallengeTTL.Milliseconds(),
+		RPID:             s.RelyingParty.ID,
+		AllowCredentials: allow,
+		UserVerification: webauthn.UserVerificationRequired,
+	}, nil
+}
+
+// placeholderDescriptor stands in for a passkey of email, which has none. It looks like a platform
+// passkey, and its ID is the same every time, like a real one would be, but matches no authenticator.
+func (s *WebAuthnService) placeholderDescriptor(email string) webauthn.CredentialDescriptor {
+	mac := hmac.New(sha256.New, s.PlaceholderKey)
+	mac.Write([]byte("webauthn-placeholder:" + strings.ToLower(email)))
+	return webauthn.CredentialDescriptor{
+		Type:       webauthn.CredentialType,
+		ID:         mac.Sum(nil),
+		Transports: []string{"internal", "hybrid"},
+	}
+}
+
+func (s *WebAuthnService) FinishLogin(credential webauthn.AssertionCredential, client ClientInfo) (*LoginResult, error) {
+	challenge, err := s.consumeChallenge(credential.Response.ClientDataJSON, model.WebAuthnLogin)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.Store.WebAuthn.GetWebAuthnCredential(webauthn.Base64URL(credential.RawID).String())
+	if errors.Is(err, repository.ErrCredentialNotFound) {
+		return nil, ErrUnknownPasskey
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A challenge issued for one user's credentials cannot be answered with another user's
+	if challenge.UserID != 0 && challenge.UserID != stored.UserID {
+		return nil, ErrUnknownPasskey
+	}
+	if len(credential.Response.UserHandle) > 0 && string(credential.Response.UserHandle) != string(userHandle(stored.UserID)) {
+		return nil, fmt.Errorf("%w: user handle does not match the credential", webauthn.ErrVerification)
+	}
+
+	raw, _ := webauthn.DecodeBase64URL(challenge.Challenge)
+	signCount, err := s.RelyingParty.VerifyAssertion(raw, credential, stored.PublicKey, stored.SignCount)
+	if errors.Is(err, webauthn.ErrSignCountRegression) {
+		logrus.Warnf("Passkey %s of user %d reported a counter not above %d; it may have been cloned", stored.ID, stored.UserID, stored.SignCount)
+		return nil, err
+	}
+	if err != nil {
+		logrus.Warnf("Rejected passkey sign-in of user %d: %v", stored.UserID, err)
+		return nil, err
+	}
+	err = s.Store.WebAuthn.UpdateWebAuthnSignCount(stored.ID, signCount, s.Now())
+	if errors.Is(err, repository.ErrSignCountStale) {
+		// A concurrent sign-in stored the same or a later counter first
+		return nil, webauthn.ErrSignCountRegression
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.Store.Users.GetUserByID(stored.UserID)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User %d signed in with passkey %s", user.ID, stored.ID)
+	return s.Auth.startSession(user, client)
+}
+
+func (s *WebAuthnService) ListCredentials(userID int) ([]model.WebAuthnCredential, error) {
+	return s.Store.WebAuthn.ListWebAuthnCredentials(userID)
+}
+
+func (s *WebAuthnService) DeleteCredential(userID int, id string) error {
+	if err := s.Store.WebAuthn.DeleteWebAuthnCredential(userID, id); err != nil {
+		return err
+	}
+	logrus.Infof("User %d removed passkey %s", userID, id)
+	return nil
+}
+
+func (s *WebAuthnService) newChallenge(userID int, purpose string) (webauthn.Base64URL, error) {
+	challenge := webauthn.NewChallenge()
+	err := s.Store.WebAuthn.CreateWebAuthnChallenge(model.WebAuthnChallenge{
+		Challenge: challenge.String(),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: s.Now().Add(s.ChallengeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// consumeChallenge uses up the challenge clientDataJSON answers, so that no response is accepted twice
+func (s *WebAuthnService) consumeChallenge(clientDataJSON []byte, purpose string) (*model.WebAuthnChallenge, error) {
+	raw, err := webauthn.ClientDataChallenge(clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := s.Store.WebAuthn.ConsumeWebAuthnChallenge(raw.String(), s.Now())
+	if errors.Is(err, repository.ErrChallengeNotFound) {
+		return nil, ErrInvalidWebAuthnChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if challenge.Purpose != purpose {
+		return nil, ErrInvalidWebAuthnChallenge
+	}
+	return challenge, nil
+}
+
+func credentialDescriptors(credentials []model.WebAuthnCredential) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		id, err := webauthn.DecodeBase64URL(credential.ID)
+		if err != nil {
+			continue
+		}
+		descriptors = append(descriptors, webauthn.CredentialDescriptor{
+			Type:       webauthn.CredentialType,
+			ID:         id,
+			Transports: credential.Transports,
+		})
+	}
+	return descriptors
+}
+
+// formatAAGUID writes an AAGUID in the UUID form authenticator metadata uses
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return hex.EncodeToString(aaguid)
+	}
+	h := hex.EncodeToString(aaguid)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
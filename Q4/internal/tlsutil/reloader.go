@@ -0,0 +1,97 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertReloader serves a certificate and key pair from files and picks up replacements, such as
+// renewals, without a restart
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// stamp identifies the versions of the files cert was loaded from
+	stamp string
+}
+
+// NewCertReloader loads the pair, failing if it cannot be used
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate; it fits tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Reload loads the pair again if either file changed since the last load and reports whether it
+// did. A pair that fails to load, such as while a renewal has written only one of the files,
+// leaves the previous certificate in use and is tried again on the next call.
+func (c *CertReloader) Reload() (bool, error) {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := stamp == c.stamp
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err == nil && cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		return false, fmt.Errorf("loading TLS certificate %s: %w", c.CertFile, err)
+	}
+	c.mu.Lock()
+	c.cert, c.stamp = &cert, stamp
+	c.mu.Unlock()
+	logrus.Infof("Loaded TLS certificate %s for %q, valid until %s", c.CertFile, cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return true, nil
+}
+
+// Watch reloads the pair every interval until stop is closed
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := c.Reload(); err != nil {
+				logrus.Warnf("Keeping the current TLS certificate: %v", err)
+			}
+		}
+	}
+}
+
+func (c *CertReloader) fileStamp() (string, error) {
+	var stamp string
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
@@ -0,0 +1,50 @@
+package webauthn
+
+import (
+	"crypto/sha256"
+	"slices"
+)
+
+// VerifyAssertion checks the response to CredentialRequestOptions issued with challenge, following
+// section 7.2 of the specification, against the stored public key and signature counter of the
+// credential. It returns the new counter to store. User verification is always required.
+//
+// Authenticators that do not count signatures, as most synced passkeys, always report zero.
+// Otherwise the counter has to grow, or ErrSignCountRegression is returned.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, credential AssertionCredential, publicKey []byte, storedSignCount uint32) (uint32, error) {
+	if credential.Type != CredentialType {
+		return 0, verificationError("credential type is %q, want %q", credential.Type, CredentialType)
+	}
+	response := credential.Response
+	if err := rp.verifyClientData(response.ClientDataJSON, ceremonyGet, challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := ParseAuthenticatorData(response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.verifyRPIDHash(authData.RPIDHash); err != nil {
+		return 0, err
+	}
+	if !authData.Has(FlagUserPresent) {
+		return 0, verificationError("user was not present")
+	}
+	if !authData.Has(FlagUserVerified) {
+		return 0, verificationError("user was not verified")
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(response.ClientDataJSON)
+	if err := key.Verify(slices.Concat([]byte(response.AuthenticatorData), clientDataHash[:]), response.Signature); err != nil {
+		return 0, err
+	}
+
+	if (authData.SignCount != 0 || storedSignCount != 0) && authData.SignCount <= storedSignCount {
+		return 0, ErrSignCountRegression
+	}
+	return authData.SignCount, nil
+}
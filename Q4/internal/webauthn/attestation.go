@@ -0,0 +1,179 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"slices"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Attestation statement formats that VerifyRegistration accepts
+const (
+	FormatNone   = "none"
+	FormatPacked = "packed"
+)
+
+// oidAAGUID is the certificate extension FIDO authenticators put their AAGUID in
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Registration is a verified new credential, ready to be stored
+type Registration struct {
+	CredentialID []byte
+	// PublicKey is the COSE_Key of the credential; pass it to VerifyAssertion when the user signs in
+	PublicKey []byte
+	Algorithm int64
+	SignCount uint32
+	// AAGUID identifies the authenticator model, or is all zeroes when it is not disclosed
+	AAGUID            []byte
+	AttestationFormat string
+	Transports        []string
+}
+
+type attestationObject struct {
+	Format   string                     `cbor:"fmt"`
+	AttStmt  map[string]cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte                     `cbor:"authData"`
+}
+
+// VerifyRegistration checks the response to CredentialCreationOptions issued with challenge,
+// following section 7.1 of the specification. User verification is always required.
+//
+// Packed attestation statements are checked for consistency: the signature, and for an attestation
+// certificate its required fields and AAGUID. The certificate is not chained to a trusted root,
+// since that needs the FIDO Metadata Service, so attestation proves which format an authenticator
+// used but not that it is genuine hardware.
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, credential RegistrationCredential) (*Registration, error) {
+	if credential.Type != CredentialType {
+		return nil, verificationError("credential type is %q, want %q", credential.Type, CredentialType)
+	}
+	response := credential.Response
+	if err := rp.verifyClientData(response.ClientDataJSON, ceremonyCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	var object attestationObject
+	if err := cbor.Unmarshal(response.AttestationObject, &object); err != nil {
+		return nil, verificationError("invalid attestation object: %v", err)
+	}
+	authData, err := ParseAuthenticatorData(object.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyRPIDHash(authData.RPIDHash); err != nil {
+		return nil, err
+	}
+	if !authData.Has(FlagUserPresent) {
+		return nil, verificationError("user was not present")
+	}
+	if !authData.Has(FlagUserVerified) {
+		return nil, verificationError("user was not verified")
+	}
+	attested := authData.AttestedCredential
+	if attested == nil {
+		return nil, verificationError("no attested credential data")
+	}
+	if !bytes.Equal(attested.CredentialID, credential.RawID) {
+		return nil, verificationError("credential ID does not match the attested one")
+	}
+	publicKey, err := ParsePublicKey(attested.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(response.ClientDataJSON)
+	signed := slices.Concat(object.AuthData, clientDataHash[:])
+	switch object.Format {
+	case FormatNone:
+		if len(object.AttStmt) != 0 {
+			return nil, verificationError("none attestation has a statement")
+		}
+	case FormatPacked:
+		if err := verifyPacked(object.AttStmt, signed, publicKey, attested.AAGUID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, verificationError("unsupported attestation format %q", object.Format)
+	}
+
+	return &Registration{
+		CredentialID:      attested.CredentialID,
+		PublicKey:         attested.PublicKey,
+		Algorithm:         publicKey.Algorithm,
+		SignCount:         authData.SignCount,
+		AAGUID:            attested.AAGUID,
+		AttestationFormat: object.Format,
+		Transports:        response.Transports,
+	}, nil
+}
+
+// verifyPacked checks a packed attestation statement (section 8.2), either self attestation
+// signed by the credential key or basic attestation signed by an attestation certificate
+func verifyPacked(stmt map[string]cbor.RawMessage, signed []byte, credentialKey *PublicKey, aaguid []byte) error {
+	var alg int64
+	var sig []byte
+	if err := cbor.Unmarshal(stmt["alg"], &alg); err != nil {
+		return verificationError("packed attestation has no valid alg")
+	}
+	if err := cbor.Unmarshal(stmt["sig"], &sig); err != nil {
+		return verificationError("packed attestation has no valid sig")
+	}
+
+	rawX5C, ok := stmt["x5c"]
+	if !ok {
+		if alg != credentialKey.Algorithm {
+			return verificationError("self attestation uses algorithm %d, the credential %d", alg, credentialKey.Algorithm)
+		}
+		return credentialKey.Verify(signed, sig)
+	}
+
+	var x5c [][]byte
+	if err := cbor.Unmarshal(rawX5C, &x5c); err != nil || len(x5c) == 0 {
+		return verificationError("packed attestation has no valid x5c")
+	}
+	cert, err := x509.ParseCertificate(x5c[0])
+	if err != nil {
+		return verificationError("invalid attestation certificate: %v", err)
+	}
+	if err := verifyPackedCertificate(cert, aaguid); err != nil {
+		return err
+	}
+	sigAlg, err := x509SignatureAlgorithm(alg)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(sigAlg, signed, sig); err != nil {
+		return verificationError("invalid attestation signature: %v", err)
+	}
+	return nil
+}
+
+// verifyPackedCertificate checks the requirements of section 8.2.1 on attestation certificates
+func verifyPackedCertificate(cert *x509.Certificate, aaguid []byte) error {
+	if cert.Version != 3 {
+		return verificationError("attestation certificate is version %d, want 3", cert.Version)
+	}
+	subject := cert.Subject
+	if len(subject.Country) == 0 || len(subject.Organization) == 0 || subject.CommonName == "" ||
+		!slices.Equal(subject.OrganizationalUnit, []string{"Authenticator Attestation"}) {
+		return verificationError("attestation certificate subject %q is incomplete", subject.String())
+	}
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return verificationError("attestation certificate is a CA")
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var certAAGUID []byte
+		if _, err := asn1.Unmarshal(ext.Value, &certAAGUID); err != nil || ext.Critical {
+			return verificationError("invalid AAGUID extension")
+		}
+		if !bytes.Equal(certAAGUID, aaguid) {
+			return verificationError("attestation certificate is for another authenticator model")
+		}
+	}
+	return nil
+}
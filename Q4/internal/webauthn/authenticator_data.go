@@ -0,0 +1,99 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Authenticator data flags
+const (
+	FlagUserPresent            byte = 0x01
+	FlagUserVerified           byte = 0x04
+	FlagAttestedCredentialData byte = 0x40
+	FlagExtensionData          byte = 0x80
+)
+
+// AuthenticatorData is the binary structure authenticators sign in both ceremonies
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// AttestedCredential is only present when registering
+	AttestedCredential *AttestedCredentialData
+}
+
+func (d *AuthenticatorData) Has(flag byte) bool {
+	return d.Flags&flag == flag
+}
+
+type AttestedCredentialData struct {
+	AAGUID       []byte
+	CredentialID []byte
+	// PublicKey is the COSE_Key of the credential, kept encoded for storage
+	PublicKey []byte
+}
+
+// maxCredentialIDLength is the limit WebAuthn level 2 puts on credential IDs
+const maxCredentialIDLength = 1023
+
+// ParseAuthenticatorData decodes data. Extensions are skipped; none are supported.
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, verificationError("authenticator data is %d bytes, want at least 37", len(data))
+	}
+	parsed := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if parsed.Has(FlagAttestedCredentialData) {
+		if len(rest) < 18 {
+			return nil, verificationError("attested credential data is truncated")
+		}
+		credential := &AttestedCredentialData{AAGUID: rest[:16]}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > maxCredentialIDLength || len(rest) < idLength {
+			return nil, verificationError("invalid credential ID length %d", idLength)
+		}
+		credential.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		// The key is the only part without a length prefix, so measure it by decoding it
+		n, err := cborItemLength(rest)
+		if err != nil {
+			return nil, verificationError("invalid credential public key: %v", err)
+		}
+		credential.PublicKey = rest[:n]
+		rest = rest[n:]
+		parsed.AttestedCredential = credential
+	}
+
+	if parsed.Has(FlagExtensionData) {
+		n, err := cborItemLength(rest)
+		if err != nil {
+			return nil, verificationError("invalid extension data: %v", err)
+		}
+		rest = rest[n:]
+	}
+
+	if len(rest) != 0 {
+		return nil, verificationError("%d unexpected bytes after authenticator data", len(rest))
+	}
+	return parsed, nil
+}
+
+// cborItemLength returns the length of the CBOR data item at the start of data
+func cborItemLength(data []byte) (int, error) {
+	dec := cbor.NewDecoder(bytes.NewReader(data))
+	var item cbor.RawMessage
+	if err := dec.Decode(&item); err != nil {
+		return 0, fmt.Errorf("decoding CBOR: %w", err)
+	}
+	return dec.NumBytesRead(), nil
+}
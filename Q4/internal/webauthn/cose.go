@@ -0,0 +1,162 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers (https://www.iana.org/assignments/cose) of the supported signature schemes
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// SupportedAlgorithms lists the algorithms in the order credentials should prefer them
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE_Key labels and values
+const (
+	coseKeyType      = 1
+	coseKeyAlg       = 3
+	coseCurve        = -1
+	coseX            = -2
+	coseY            = -3
+	coseRSAN         = -1
+	coseRSAE         = -2
+	coseKeyOKP       = 1
+	coseKeyEC2       = 2
+	coseKeyRSA       = 3
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// minRSABits is the smallest RSA modulus accepted
+const minRSABits = 2048
+
+// PublicKey is a decoded credential public key
+type PublicKey struct {
+	Algorithm int64
+	key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key as found in attested credential data
+func ParsePublicKey(coseKey []byte) (*PublicKey, error) {
+	var fields map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(coseKey, &fields); err != nil {
+		return nil, verificationError("invalid COSE key: %v", err)
+	}
+	var kty, alg int64
+	if err := coseField(fields, coseKeyType, &kty); err != nil {
+		return nil, err
+	}
+	if err := coseField(fields, coseKeyAlg, &alg); err != nil {
+		return nil, err
+	}
+
+	switch alg {
+	case AlgES256:
+		var crv int64
+		var x, y []byte
+		if err := coseFields(fields, map[int]any{coseCurve: &crv, coseX: &x, coseY: &y}); err != nil {
+			return nil, err
+		}
+		if kty != coseKeyEC2 || crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, verificationError("invalid ES256 key")
+		}
+		// ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{0x04}, x...), y...)); err != nil {
+			return nil, verificationError("invalid ES256 key: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return &PublicKey{Algorithm: alg, key: key}, nil
+
+	case AlgEdDSA:
+		var crv int64
+		var x []byte
+		if err := coseFields(fields, map[int]any{coseCurve: &crv, coseX: &x}); err != nil {
+			return nil, err
+		}
+		if kty != coseKeyOKP || crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, verificationError("invalid EdDSA key")
+		}
+		return &PublicKey{Algorithm: alg, key: ed25519.PublicKey(x)}, nil
+
+	case AlgRS256:
+		var n, e []byte
+		if err := coseFields(fields, map[int]any{coseRSAN: &n, coseRSAE: &e}); err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if kty != coseKeyRSA || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, verificationError("invalid RS256 key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < minRSABits {
+			return nil, verificationError("RS256 key is %d bits, want at least %d", key.N.BitLen(), minRSABits)
+		}
+		return &PublicKey{Algorithm: alg, key: key}, nil
+	}
+	return nil, verificationError("unsupported algorithm %d", alg)
+}
+
+func coseField(fields map[int]cbor.RawMessage, label int, v any) error {
+	raw, ok := fields[label]
+	if !ok {
+		return verificationError("COSE key has no label %d", label)
+	}
+	if err := cbor.Unmarshal(raw, v); err != nil {
+		return verificationError("invalid COSE key label %d: %v", label, err)
+	}
+	return nil
+}
+
+func coseFields(fields map[int]cbor.RawMessage, values map[int]any) error {
+	for label, v := range values {
+		if err := coseField(fields, label, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks sig over data with the key's algorithm
+func (k *PublicKey) Verify(data, sig []byte) error {
+	var ok bool
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return verificationError("invalid signature")
+	}
+	return nil
+}
+
+// x509SignatureAlgorithm maps a COSE algorithm to the x509 one used to check attestation signatures
+func x509SignatureAlgorithm(alg int64) (x509.SignatureAlgorithm, error) {
+	switch alg {
+	case AlgES256:
+		return x509.ECDSAWithSHA256, nil
+	case AlgEdDSA:
+		return x509.PureEd25519, nil
+	case AlgRS256:
+		return x509.SHA256WithRSA, nil
+	}
+	return x509.UnknownSignatureAlgorithm, verificationError("unsupported attestation algorithm %d", alg)
+}
@@ -0,0 +1,101 @@
+package webauthn
+
+// The types below follow the JSON serialization of PublicKeyCredentialCreationOptions,
+// PublicKeyCredentialRequestOptions and PublicKeyCredential used by
+// PublicKeyCredential.parseCreationOptionsFromJSON and PublicKeyCredential.toJSON in browsers.
+
+// User verification and resident key requirements
+const (
+	UserVerificationRequired  = "required"
+	UserVerificationPreferred = "preferred"
+	ResidentKeyRequired       = "required"
+	ResidentKeyPreferred      = "preferred"
+)
+
+// Attestation conveyance preferences
+const (
+	AttestationNone   = "none"
+	AttestationDirect = "direct"
+)
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	// ID is the user handle. Authenticators return it when signing in with a discoverable credential.
+	ID          Base64URL `json:"id" swaggertype:"string" format:"base64url"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	// Alg is a COSE algorithm identifier such as -7 for ES256
+	Alg int64 `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id" swaggertype:"string" format:"base64url"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey,omitempty"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification,omitempty"`
+}
+
+// CredentialCreationOptions is passed to navigator.credentials.create to register a credential
+type CredentialCreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Base64URL              `json:"challenge" swaggertype:"string" format:"base64url"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation,omitempty"`
+}
+
+// CredentialRequestOptions is passed to navigator.credentials.get to sign in
+type CredentialRequestOptions struct {
+	Challenge Base64URL `json:"challenge" swaggertype:"string" format:"base64url"`
+	Timeout   int64     `json:"timeout,omitempty"`
+	RPID      string    `json:"rpId"`
+	// AllowCredentials is empty when the user is not known yet, which lets the browser offer
+	// every discoverable credential of the relying party
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// RegistrationCredential is the credential returned by navigator.credentials.create
+type RegistrationCredential struct {
+	ID       string                           `json:"id"`
+	RawID    Base64URL                        `json:"rawId" swaggertype:"string" format:"base64url"`
+	Type     string                           `json:"type"`
+	Response AuthenticatorAttestationResponse `json:"response"`
+}
+
+type AuthenticatorAttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" swaggertype:"string" format:"base64url"`
+	AttestationObject Base64URL `json:"attestationObject" swaggertype:"string" format:"base64url"`
+	Transports        []string  `json:"transports,omitempty"`
+}
+
+// AssertionCredential is the credential returned by navigator.credentials.get
+type AssertionCredential struct {
+	ID       string                         `json:"id"`
+	RawID    Base64URL                      `json:"rawId" swaggertype:"string" format:"base64url"`
+	Type     string                         `json:"type"`
+	Response AuthenticatorAssertionResponse `json:"response"`
+}
+
+type AuthenticatorAssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" swaggertype:"string" format:"base64url"`
+	AuthenticatorData Base64URL `json:"authenticatorData" swaggertype:"string" format:"base64url"`
+	Signature         Base64URL `json:"signature" swaggertype:"string" format:"base64url"`
+	UserHandle        Base64URL `json:"userHandle,omitempty" swaggertype:"string" format:"base64url"`
+}
@@ -0,0 +1,144 @@
+// Package webauthn verifies the registration and authentication ceremonies of the Web
+// Authentication API (https://www.w3.org/TR/webauthn-2/), which browsers use for passkeys and
+// security keys. It covers the server side only: storing credentials and challenges is up to the caller.
+package webauthn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrVerification is wrapped by every error about a response that must not be trusted
+	ErrVerification = errors.New("webauthn verification failed")
+	// ErrSignCountRegression is returned when an authenticator reports a signature counter that is
+	// not above the stored one, which suggests the credential was cloned
+	ErrSignCountRegression = fmt.Errorf("%w: signature counter did not increase", ErrVerification)
+)
+
+func verificationError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrVerification, fmt.Sprintf(format, args...))
+}
+
+// Ceremony types found in the client data
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+)
+
+// CredentialType is the only credential type WebAuthn defines
+const CredentialType = "public-key"
+
+// Base64URL is binary data that JSON carries as unpadded base64url, the encoding browsers use
+// for WebAuthn options and responses
+type Base64URL []byte
+
+func (b Base64URL) String() string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+// UnmarshalJSON accepts padded input too, since some client libraries add it
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := DecodeBase64URL(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// DecodeBase64URL decodes s with or without padding
+func DecodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ChallengeSize is the number of random bytes in a challenge
+const ChallengeSize = 32
+
+// NewChallenge returns a random challenge for one ceremony
+func NewChallenge() Base64URL {
+	b := make([]byte, ChallengeSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RelyingParty is the server side of the ceremonies
+type RelyingParty struct {
+	// ID is the domain credentials are scoped to, such as "example.com". Browsers only hand a
+	// credential to pages on that domain or its subdomains, which is what defeats phishing.
+	ID string
+	// Name is shown by the browser while the user creates a credential
+	Name string
+	// Origins are the exact origins, such as "https://app.example.com", that may run ceremonies
+	Origins []string
+}
+
+// CollectedClientData is the JSON the browser builds and the authenticator signs a hash of
+type CollectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+// ClientDataChallenge returns the challenge in clientDataJSON without verifying anything, so that
+// callers can look up the ceremony a response belongs to before verifying it
+func ClientDataChallenge(clientDataJSON []byte) (Base64URL, error) {
+	var data CollectedClientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return nil, verificationError("invalid client data: %v", err)
+	}
+	challenge, err := DecodeBase64URL(data.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, verificationError("invalid challenge in client data")
+	}
+	return challenge, nil
+}
+
+// verifyClientData checks that raw belongs to the expected ceremony, challenge and origin
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data CollectedClientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return verificationError("invalid client data: %v", err)
+	}
+	if data.Type != ceremony {
+		return verificationError("client data type is %q, want %q", data.Type, ceremony)
+	}
+	got, err := DecodeBase64URL(data.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return verificationError("challenge does not match")
+	}
+	if !slices.Contains(rp.Origins, data.Origin) {
+		return verificationError("origin %q is not allowed", data.Origin)
+	}
+	if data.CrossOrigin {
+		return verificationError("cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+// verifyRPIDHash checks that the authenticator scoped the credential to this relying party
+func (rp *RelyingParty) verifyRPIDHash(hash []byte) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(hash, want[:]) != 1 {
+		return verificationError("credential is scoped to another relying party")
+	}
+	return nil
+}
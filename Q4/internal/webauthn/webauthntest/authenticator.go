@@ -0,0 +1,218 @@
+// Package webauthntest provides a software authenticator that runs the WebAuthn ceremonies
+// without hardware or a browser
+package webauthntest
+
+import (
+	"Q4/internal/webauthn"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Attestation selects the statement an Authenticator attaches to new credentials
+type Attestation int
+
+const (
+	// NoAttestation uses the "none" format
+	NoAttestation Attestation = iota
+	// SelfAttestation uses the "packed" format signed by the credential key
+	SelfAttestation
+	// BasicAttestation uses the "packed" format signed by a generated attestation certificate
+	BasicAttestation
+)
+
+// Authenticator is an ES256 platform authenticator holding one credential. Its exported fields
+// may be changed between ceremonies to produce responses a real authenticator would not.
+type Authenticator struct {
+	Attestation  Attestation
+	AAGUID       []byte
+	CredentialID []byte
+	Key          *ecdsa.PrivateKey
+	// SignCount is incremented before every assertion; set it back to simulate a cloned credential
+	SignCount uint32
+	// SkipUserVerification clears the UV flag, as an authenticator without a PIN or biometric would
+	SkipUserVerification bool
+	// UserHandle is remembered from registration and returned with every assertion
+	UserHandle []byte
+
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+}
+
+// New returns an authenticator with a fresh key and credential ID
+func New(attestation Attestation) *Authenticator {
+	a := &Authenticator{
+		Attestation:  attestation,
+		AAGUID:       randomBytes(16),
+		CredentialID: randomBytes(32),
+		Key:          newKey(),
+	}
+	if attestation == BasicAttestation {
+		a.attestationKey = newKey()
+		a.attestationCert = a.newAttestationCertificate()
+	}
+	return a
+}
+
+// Register answers creation options the way navigator.credentials.create would on origin
+func (a *Authenticator) Register(origin string, options webauthn.CredentialCreationOptions) webauthn.RegistrationCredential {
+	a.UserHandle = options.User.ID
+	clientData := clientDataJSON("webauthn.create", options.Challenge, origin)
+	authData := a.authenticatorData(options.RP.ID, true)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := slices.Concat(authData, clientDataHash[:])
+
+	format, stmt := webauthn.FormatNone, map[string]any{}
+	switch a.Attestation {
+	case SelfAttestation:
+		format = webauthn.FormatPacked
+		stmt = map[string]any{"alg": webauthn.AlgES256, "sig": sign(a.Key, signed)}
+	case BasicAttestation:
+		format = webauthn.FormatPacked
+		stmt = map[string]any{"alg": webauthn.AlgES256, "sig": sign(a.attestationKey, signed), "x5c": [][]byte{a.attestationCert}}
+	}
+	object := mustMarshal(map[string]any{"fmt": format, "attStmt": stmt, "authData": authData})
+
+	return webauthn.RegistrationCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  webauthn.CredentialType,
+		Response: webauthn.AuthenticatorAttestationResponse{
+			ClientDataJSON:    clientData,
+			AttestationObject: object,
+			Transports:        []string{"internal"},
+		},
+	}
+}
+
+// Login answers request options the way navigator.credentials.get would on origin
+func (a *Authenticator) Login(origin string, options webauthn.CredentialRequestOptions) webauthn.AssertionCredential {
+	a.SignCount++
+	clientData := clientDataJSON("webauthn.get", options.Challenge, origin)
+	authData := a.authenticatorData(options.RPID, false)
+	clientDataHash := sha256.Sum256(clientData)
+
+	return webauthn.AssertionCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  webauthn.CredentialType,
+		Response: webauthn.AuthenticatorAssertionResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         sign(a.Key, slices.Concat(authData, clientDataHash[:])),
+			UserHandle:        a.UserHandle,
+		},
+	}
+}
+
+// PublicKey returns the COSE_Key of the credential
+func (a *Authenticator) PublicKey() []byte {
+	point, err := a.Key.PublicKey.ECDH()
+	if err != nil {
+		panic(err)
+	}
+	raw := point.Bytes()
+	return mustMarshal(map[int]any{1: 2, 3: webauthn.AlgES256, -1: 1, -2: raw[1:33], -3: raw[33:65]})
+}
+
+func (a *Authenticator) authenticatorData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := webauthn.FlagUserPresent
+	if !a.SkipUserVerification {
+		flags |= webauthn.FlagUserVerified
+	}
+	if attested {
+		flags |= webauthn.FlagAttestedCredentialData
+	}
+	data := slices.Concat(rpIDHash[:], []byte{flags}, binary.BigEndian.AppendUint32(nil, a.SignCount))
+	if attested {
+		data = slices.Concat(data, a.AAGUID, binary.BigEndian.AppendUint16(nil, uint16(len(a.CredentialID))), a.CredentialID, a.PublicKey())
+	}
+	return data
+}
+
+// newAttestationCertificate returns a self-signed certificate meeting the packed format's requirements
+func (a *Authenticator) newAttestationCertificate() []byte {
+	aaguid, err := asn1.Marshal(a.AAGUID)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"US"},
+			Organization:       []string{"Q4 Test"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+			CommonName:         "Q4 Software Authenticator",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}, Value: aaguid}},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &a.attestationKey.PublicKey, a.attestationKey)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func clientDataJSON(ceremony string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(webauthn.CollectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func sign(key *ecdsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// encMode sorts map keys, so that the same key always encodes to the same bytes
+var encMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+func mustMarshal(v any) []byte {
+	data, err := encMode.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
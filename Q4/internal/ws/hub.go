@@ -0,0 +1,313 @@
+package ws
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/metrics"
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+	DefaultMaxTopics    = 100
+	// maxMessageBytes bounds client messages, which only name topics
+	maxMessageBytes = 4096
+	// hubBuffer is how many events the hub itself may fall behind; it never waits for clients,
+	// so it only falls behind under extreme load
+	hubBuffer = 1024
+)
+
+// Hub keeps one subscription to the user events and pushes each event to the clients subscribed
+// to one of its topics. Clients that fall behind are disconnected rather than waited for.
+type Hub struct {
+	Events *service.UserEvents
+	// Buffer is how many messages a client may fall behind before it is disconnected
+	Buffer int
+	// MaxTopics bounds the topics a client may subscribe to
+	MaxTopics int
+	// PingInterval is how often clients are pinged; those that do not answer within another
+	// interval are disconnected
+	PingInterval time.Duration
+	// WriteTimeout bounds each write to a client
+	WriteTimeout time.Duration
+
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+	shutdown bool
+	done     chan struct{}
+	// wg counts the clients still connected
+	wg sync.WaitGroup
+}
+
+func NewHub(events *service.UserEvents) *Hub {
+	return &Hub{
+		Events:       events,
+		Buffer:       service.DefaultEventBuffer,
+		MaxTopics:    DefaultMaxTopics,
+		PingInterval: DefaultPingInterval,
+		WriteTimeout: DefaultWriteTimeout,
+		clients:      make(map[*client]struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Run fans the user events out to the clients until Shutdown is called
+func (h *Hub) Run() {
+	sub := h.Events.Subscribe(hubBuffer)
+	defer func() { sub.Close() }()
+	for {
+		select {
+		case <-h.done:
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Clients miss the events that did not fit, which is still better than a hub that stops
+				logrus.Errorf("WebSocket hub fell behind the user events: %v", sub.Err())
+				sub = h.Events.Subscribe(hubBuffer)
+				continue
+			}
+			h.broadcast(event)
+		}
+	}
+}
+
+func (h *Hub) broadcast(event model.UserEvent) {
+	topics := topicsOf(event)
+	msg := ServerMessage{Type: TypeEvent, Event: &event}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.subscribed(topics) {
+			c.push(msg)
+		}
+	}
+}
+
+// Shutdown tells every client that the server is going away and waits for them to disconnect,
+// or for ctx to be done. Clients that connect afterwards are turned away.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.shutdown {
+		h.shutdown = true
+		close(h.done)
+	}
+	for c := range h.clients {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	h.mu.Unlock()
+
+	gone := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(gone)
+	}()
+	select {
+	case <-gone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Serve talks to a client over conn until either side closes the connection
+func (h *Hub) Serve(conn *websocket.Conn, principal *auth.Principal) {
+	c := &client{
+		hub:       h,
+		conn:      conn,
+		principal: principal,
+		send:      make(chan ServerMessage, max(h.Buffer, 1)),
+		quit:      make(chan struct{}),
+		topics:    make(map[string]struct{}),
+	}
+
+	h.mu.Lock()
+	if h.shutdown {
+		h.mu.Unlock()
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(h.WriteTimeout))
+		_ = conn.Close()
+		return
+	}
+	h.clients[c] = struct{}{}
+	h.wg.Add(1)
+	h.mu.Unlock()
+	metrics.Counter("websocket_connections_total").Add(1)
+
+	writerDone := make(chan struct{})
+	go func() {
+		c.writeLoop()
+		close(writerDone)
+	}()
+	c.readLoop()
+
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.close(websocket.CloseNormalClosure, "")
+	<-writerDone
+	_ = conn.Close()
+	h.wg.Done()
+}
+
+// client is one WebSocket connection
+type client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	principal *auth.Principal
+	send      chan ServerMessage
+
+	// quit is closed to make the writer send a close frame with closeCode and closeText and stop
+	quit      chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+func (c *client) subscribed(topics []string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// push queues msg for the client, disconnecting it if its queue is full
+func (c *client) push(msg ServerMessage) {
+	select {
+	case c.send <- msg:
+	default:
+		metrics.Counter("websocket_clients_dropped_total").Add(1)
+		logrus.Warnf("Disconnected WebSocket client %s that fell behind", c.name())
+		c.close(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+// close makes the writer send a close frame and stop; only the first call counts
+func (c *client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText = code, text
+		close(c.quit)
+	})
+}
+
+func (c *client) name() string {
+	switch {
+	case c.principal == nil:
+		return c.conn.RemoteAddr().String()
+	case c.principal.IsService():
+		return "of service principal " + c.principal.ServicePrincipalID
+	}
+	return "of user " + strconv.Itoa(c.principal.UserID)
+}
+
+// readLoop handles the messages of the client until the connection fails or closes
+func (c *client) readLoop() {
+	c.conn.SetReadLimit(maxMessageBytes)
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * c.hub.PingInterval))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(2 * c.hub.PingInterval))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.push(ServerMessage{Type: TypeError, Error: "messages must be JSON objects with a type and topics"})
+			continue
+		}
+		c.handle(msg)
+	}
+}
+
+func (c *client) handle(msg ClientMessage) {
+	if msg.Type != TypeSubscribe && msg.Type != TypeUnsubscribe {
+		c.push(ServerMessage{Type: TypeError, ID: msg.ID, Error: "type must be " + TypeSubscribe + " or " + TypeUnsubscribe})
+		return
+	}
+	topics := make([]string, 0, len(msg.Topics))
+	for _, topic := range msg.Topics {
+		parsed, err := ParseTopic(topic)
+		if err != nil {
+			c.push(ServerMessage{Type: TypeError, ID: msg.ID, Error: err.Error()})
+			return
+		}
+		topics = append(topics, parsed)
+	}
+
+	c.mu.Lock()
+	reply := ServerMessage{Type: TypeSubscribed, ID: msg.ID}
+	if msg.Type == TypeUnsubscribe {
+		reply.Type = TypeUnsubscribed
+		for _, topic := range topics {
+			delete(c.topics, topic)
+		}
+	} else {
+		added := make(map[string]struct{})
+		for _, topic := range topics {
+			if _, ok := c.topics[topic]; !ok {
+				added[topic] = struct{}{}
+			}
+		}
+		if len(c.topics)+len(added) > c.hub.MaxTopics {
+			reply = ServerMessage{Type: TypeError, ID: msg.ID, Error: "at most " + strconv.Itoa(c.hub.MaxTopics) + " topics per connection"}
+		} else {
+			for topic := range added {
+				c.topics[topic] = struct{}{}
+			}
+		}
+	}
+	if reply.Type != TypeError {
+		reply.Topics = make([]string, 0, len(c.topics))
+		for topic := range c.topics {
+			reply.Topics = append(reply.Topics, topic)
+		}
+		slices.Sort(reply.Topics)
+	}
+	c.mu.Unlock()
+	c.push(reply)
+}
+
+// writeLoop sends the queued messages and pings until the client is closed
+func (c *client) writeLoop() {
+	ping := time.NewTicker(c.hub.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.hub.WriteTimeout)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+			}
+		case <-c.quit:
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText), time.Now().Add(c.hub.WriteTimeout))
+			}
+			// Gives the client a moment to answer the close frame before the reader gives up
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.hub.WriteTimeout))
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package ws pushes user changes to WebSocket clients. Clients subscribe to topics with small JSON
+// messages and a Hub fans the events of service.UserEvents out to them.
+package ws
+
+import (
+	"Q4/internal/model"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Message types. Clients send subscribe and unsubscribe; the server answers with subscribed,
+// unsubscribed or error and pushes event messages.
+const (
+	TypeSubscribe    = "subscribe"
+	TypeUnsubscribe  = "unsubscribe"
+	TypeSubscribed   = "subscribed"
+	TypeUnsubscribed = "unsubscribed"
+	TypeEvent        = "event"
+	TypeError        = "error"
+)
+
+// TopicAllUsers covers every user. "user:<id>" covers one user and "role:<role>" the users with
+// that role after the change, or before it for deletions.
+const TopicAllUsers = "users"
+
+// ClientMessage is a message clients send
+type ClientMessage struct {
+	Type string `json:"type"`
+	// ID is echoed in the reply, so that clients can tell which request it answers
+	ID     string   `json:"id,omitempty"`
+	Topics []string `json:"topics"`
+}
+
+// ServerMessage is a message the server sends
+type ServerMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	// Topics are all the topics of the client after a subscribe or unsubscribe
+	Topics []string         `json:"topics,omitempty"`
+	Event  *model.UserEvent `json:"event,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// ParseTopic checks topic and returns it in its canonical form
+func ParseTopic(topic string) (string, error) {
+	topic = strings.TrimSpace(topic)
+	if topic == TopicAllUsers {
+		return topic, nil
+	}
+	kind, value, _ := strings.Cut(topic, ":")
+	switch kind {
+	case "user":
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			return "", fmt.Errorf("invalid user ID in topic %q", topic)
+		}
+		return "user:" + strconv.Itoa(id), nil
+	case "role":
+		if !model.ValidRole(value) {
+			return "", fmt.Errorf("unknown role in topic %q", topic)
+		}
+		return topic, nil
+	}
+	return "", fmt.Errorf("unknown topic %q; use %q, \"user:<id>\" or \"role:<role>\"", topic, TopicAllUsers)
+}
+
+// topicsOf returns the topics that cover event
+func topicsOf(event model.UserEvent) []string {
+	role := event.User.Role
+	if role == "" {
+		role = model.RoleUser
+	}
+	return []string{TopicAllUsers, "user:" + strconv.Itoa(event.User.ID), "role:" + role}
+}
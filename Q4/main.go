@@ -1,14 +1,28 @@
 package main
 
 import (
+	"Q4/config"
 	_ "Q4/docs"
+	"Q4/internal/cache"
 	"Q4/internal/database"
+	"Q4/internal/mail"
 	"Q4/internal/middleware"
+	"Q4/internal/ratelimit"
 	"Q4/internal/routes"
-	"database/sql"
+	"Q4/internal/service"
+	"Q4/internal/tlsutil"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -18,18 +32,163 @@ func main() {
 	})
 	logrus.SetLevel(logrus.InfoLevel)
 
-	db := database.NewConnection()
-	defer func(db *sql.DB) {
-		err := db.Close()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	store, err := database.NewStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", cfg.Storage, err)
+	}
+	defer func() {
+		err := store.Close()
 		if err != nil {
 			log.Fatal(err)
 		}
-	}(db)
+	}()
+
+	mailer, err := mail.NewMailer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up %s mail transport: %v", cfg.MailTransport, err)
+	}
+
+	var limits ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimitRedisAddr != "" {
+		redis := cache.NewRedis(cfg.RateLimitRedisAddr, "q4:ratelimit:")
+		defer redis.Close()
+		limits = ratelimit.NewRedisStore(redis)
+		log.Printf("Sharing rate limits through Redis at %s", cfg.RateLimitRedisAddr)
+	}
 
-	router := routes.SetupRouter(db)
+	users := routes.NewUserService(store, mailer, service.NewUserEvents(cfg.EventReplay), cfg)
+	if err := users.PromoteAdmins(cfg.AdminEmails); err != nil {
+		log.Fatalf("Failed to promote --admin-emails: %v", err)
+	}
+	hub := routes.NewHub(users.Events, cfg)
+	go hub.Run()
+	router := routes.SetupRouter(store, users, hub, mailer, limits, cfg)
 
-	loggedRouter := middleware.LoggingMiddleware(router)
+	var handler http.Handler = router
+	if cfg.RateLimit > 0 {
+		// This runs before the API key is checked, so every request counts against its address,
+		// and requests with a key against that key too. Made-up keys then cannot dodge the limit.
+		handler = middleware.RateLimit(middleware.RateLimitPolicy{
+			Name:    "api-key",
+			Limiter: ratelimit.NewTokenBucket(limits, cfg.RateLimit, cfg.RateLimitWindow),
+			Key:     middleware.KeyByAPIKey,
+		})(handler)
+		handler = middleware.RateLimit(middleware.RateLimitPolicy{
+			Name:    "global",
+			Limiter: ratelimit.NewTokenBucket(limits, cfg.RateLimit, cfg.RateLimitWindow),
+			Key:     middleware.KeyByIP,
+		})(handler)
+	}
+	handler = routes.Harden(cfg)(handler)
+	handler = routes.CORS(cfg)(handler)
+	if cfg.HSTSMaxAge > 0 {
+		handler = middleware.HSTS(cfg.HSTSMaxAge, cfg.HSTSIncludeSubdomains)(handler)
+	}
+	loggedRouter := middleware.LoggingMiddleware(handler)
 
-	log.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", loggedRouter))
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		certs, err := tlsutil.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		go certs.Watch(cfg.TLSReloadInterval, nil)
+		var clientCAs *x509.CertPool
+		if cfg.TLSClientCAFile != "" {
+			if clientCAs, err = tlsutil.LoadCertPool(cfg.TLSClientCAFile); err != nil {
+				log.Fatalf("Failed to load client CA certificates: %v", err)
+			}
+		}
+		tlsConfig = tlsutil.ServerConfig(certs, clientCAs)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, 3)
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = routes.SetupGRPC(store, users, cfg, opts...)
+		listener, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC on %s: %v", cfg.GRPCAddr, err)
+		}
+		go func() {
+			log.Printf("gRPC server running on %s", cfg.GRPCAddr)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+
+	server := &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        loggedRouter,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	// Shutdown waits for requests to finish, which user event streams never do on their own, so
+	// they are told to end as soon as it starts. Other requests run to completion.
+	server.RegisterOnShutdown(users.Events.Shutdown)
+
+	var redirect *http.Server
+	if tlsConfig == nil {
+		go func() {
+			log.Printf("Server running on %s using %s storage", cfg.Addr, cfg.Storage)
+			errs <- server.ListenAndServe()
+		}()
+	} else {
+		server.TLSConfig = tlsConfig
+		if cfg.HTTPRedirectAddr != "" {
+			redirect = &http.Server{Addr: cfg.HTTPRedirectAddr, Handler: tlsutil.RedirectHandler(cfg.Addr)}
+			go func() {
+				log.Printf("Redirecting HTTP on %s to HTTPS", cfg.HTTPRedirectAddr)
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+		go func() {
+			log.Printf("Server running on %s with TLS using %s storage", cfg.Addr, cfg.Storage)
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+	log.Printf("Shutting down, waiting up to %s for connections to finish", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WebSocket clients did not disconnect in time: %v", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP requests did not finish in time: %v", err)
+	}
+	if redirect != nil {
+		_ = redirect.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		// Watch streams only end when their clients hang up, so they are cut off after the timeout
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			log.Printf("gRPC calls did not finish in time")
+			grpcServer.Stop()
+		}
+	}
 }
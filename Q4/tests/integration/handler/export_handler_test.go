@@ -0,0 +1,111 @@
+package handler_test
+
+import (
+	"Q4/internal/database"
+	"Q4/internal/handler"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newExportHandler(t *testing.T) *handler.UserHandler {
+	db, err := database.Open(filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	repo := repository.NewSQLUserRepository(db)
+	for _, user := range []model.User{
+		{Name: "Ahmet", Email: "ahmet@example.com"},
+		{Name: "Ayse", Email: "ayse@example.org"},
+		{Name: "Mehmet, Jr.", Email: "mehmet@example.com"},
+	} {
+		require.NoError(t, repo.CreateUser(&user))
+	}
+	return handler.NewUserHandler(service.NewUserService(repo))
+}
+
+// TestUserHandler_ExportUsers_CSV tests filtering and column selection
+func TestUserHandler_ExportUsers_CSV(t *testing.T) {
+	userHandler := newExportHandler(t)
+
+	req := httptest.NewRequest("GET", "/users:export?email=example.com&columns=email,name", nil)
+	req.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+	userHandler.ExportUsers(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "email,name\nahmet@example.com,Ahmet\nmehmet@example.com,\"Mehmet, Jr.\"\n", rr.Body.String())
+}
+
+// TestUserHandler_ExportUsers_NDJSONGzip tests content negotiation with gzip transfer
+func TestUserHandler_ExportUsers_NDJSONGzip(t *testing.T) {
+	userHandler := newExportHandler(t)
+
+	req := httptest.NewRequest("GET", "/users:export?name=ay", nil)
+	req.Header.Set("Accept", "text/csv;q=0.5, application/x-ndjson")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	userHandler.ExportUsers(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, `{"email":"ayse@example.org","id":2,"name":"Ayse"}`+"\n", string(body))
+}
+
+// TestUserHandler_ExportUsers_XLSX tests that the workbook is a readable archive containing every row
+func TestUserHandler_ExportUsers_XLSX(t *testing.T) {
+	userHandler := newExportHandler(t)
+
+	req := httptest.NewRequest("GET", "/users:export?format=xlsx", nil)
+	rr := httptest.NewRecorder()
+	userHandler.ExportUsers(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	require.NoError(t, err)
+
+	var sheet string
+	for _, file := range archive.File {
+		if file.Name == "xl/worksheets/sheet1.xml" {
+			f, err := file.Open()
+			require.NoError(t, err)
+			data, err := io.ReadAll(f)
+			require.NoError(t, err)
+			sheet = string(data)
+		}
+	}
+	assert.Equal(t, 4, strings.Count(sheet, "<row "))
+	assert.Contains(t, sheet, `<c r="A2"><v>1</v></c>`)
+	assert.Contains(t, sheet, "Mehmet, Jr.")
+}
+
+// TestUserHandler_ExportUsers_NotAcceptable tests that unknown formats are rejected
+func TestUserHandler_ExportUsers_NotAcceptable(t *testing.T) {
+	userHandler := newExportHandler(t)
+
+	req := httptest.NewRequest("GET", "/users:export", nil)
+	req.Header.Set("Accept", "application/pdf")
+	rr := httptest.NewRecorder()
+	userHandler.ExportUsers(rr, req)
+
+	assert.Equal(t, http.StatusNotAcceptable, rr.Code)
+}
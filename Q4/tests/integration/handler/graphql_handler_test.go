@@ -0,0 +1,206 @@
+package handler_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/database"
+	"Q4/internal/gql"
+	"Q4/internal/handler"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUserService counts the batched lookups that reach the user service
+type countingUserService struct {
+	service.UserServiceInterface
+	batches atomic.Int32
+}
+
+func (s *countingUserService) GetUsersByIDs(ids []int) ([]model.User, error) {
+	s.batches.Add(1)
+	return s.UserServiceInterface.GetUsersByIDs(ids)
+}
+
+type graphQLResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func newGraphQLHandler(t *testing.T) (*handler.GraphQLHandler, *countingUserService) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	repo := repository.NewSQLUserRepository(db)
+	for _, user := range []model.User{
+		{Name: "Ahmet", Email: "ahmet@example.com"},
+		{Name: "Ayse", Email: "ayse@example.org", Role: model.RoleAdmin},
+		{Name: "Mehmet", Email: "mehmet@example.com"},
+	} {
+		require.NoError(t, repo.CreateUser(&user))
+	}
+	users := &countingUserService{UserServiceInterface: service.NewUserService(repo)}
+	schema, err := gql.NewSchema(users, 5)
+	require.NoError(t, err)
+	schema.MaxComplexity = 100
+	schema.BatchWait = 20 * time.Millisecond
+	return handler.NewGraphQLHandler(schema), users
+}
+
+func postGraphQL(t *testing.T, h *handler.GraphQLHandler, principal *auth.Principal, query string, variables map[string]interface{}) graphQLResponse {
+	body, err := json.Marshal(gql.Request{Query: query, Variables: variables})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if principal != nil {
+		req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+	}
+	rr := httptest.NewRecorder()
+	h.Query(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var response graphQLResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response
+}
+
+// TestGraphQLHandler_Queries tests lookups by ID, batching and pagination with filters
+func TestGraphQLHandler_Queries(t *testing.T) {
+	h, users := newGraphQLHandler(t)
+
+	response := postGraphQL(t, h, nil, `{
+		a: user(id: 1) { name }
+		b: user(id: 2) { name role }
+		missing: user(id: 99) { name }
+		many: usersByIds(ids: [3, 98, 1]) { email }
+	}`, nil)
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `{"name":"Ahmet"}`, string(response.Data["a"]))
+	assert.JSONEq(t, `{"name":"Ayse","role":"admin"}`, string(response.Data["b"]))
+	assert.JSONEq(t, `null`, string(response.Data["missing"]))
+	assert.JSONEq(t, `[{"email":"mehmet@example.com"},null,{"email":"ahmet@example.com"}]`, string(response.Data["many"]))
+	assert.Equal(t, int32(1), users.batches.Load(), "sibling lookups share one query")
+
+	response = postGraphQL(t, h, nil, `query Page($limit: Int) {
+		users(filter: {email: "example.com"}, limit: $limit, offset: 1) { totalCount hasNextPage nodes { id name emailVerified } }
+	}`, map[string]interface{}{"limit": 1})
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `{"totalCount":2,"hasNextPage":false,"nodes":[{"id":"3","name":"Mehmet","emailVerified":false}]}`, string(response.Data["users"]))
+}
+
+// TestGraphQLHandler_Mutations tests creating, updating and deleting users and their error codes
+func TestGraphQLHandler_Mutations(t *testing.T) {
+	h, _ := newGraphQLHandler(t)
+	admin := &auth.Principal{UserID: 2}
+	owner := &auth.Principal{UserID: 4}
+
+	response := postGraphQL(t, h, nil, `mutation { createUser(input: {name: "Zeynep", email: "zeynep@example.com"}) { id role } }`, nil)
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `{"id":"4","role":"user"}`, string(response.Data["createUser"]))
+
+	response = postGraphQL(t, h, owner, `mutation { updateUser(id: 4, input: {name: "Zeynep K."}) { name email } }`, nil)
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `{"name":"Zeynep K.","email":"zeynep@example.com"}`, string(response.Data["updateUser"]))
+
+	response = postGraphQL(t, h, nil, `mutation { updateUser(id: 4, input: {name: "Eve"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeUnauthenticated, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, &auth.Principal{UserID: 1}, `mutation { updateUser(id: 4, input: {name: "Eve"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeForbidden, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, owner, `mutation { updateUser(id: 4, input: {email: "eve@example.com"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeForbidden, response.Errors[0].Extensions["code"], "users confirm their password to change their email")
+
+	response = postGraphQL(t, h, admin, `mutation { updateUser(id: 4, input: {email: "ahmet@example.com"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeConflict, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, admin, `mutation { updateUser(id: 4, input: {role: "owner"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeBadUserInput, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, owner, `mutation { updateUser(id: 4, input: {role: "admin"}) { name } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeForbidden, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, admin, `mutation { updateUser(id: 4, input: {role: "admin"}) { role } }`, nil)
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `{"role":"admin"}`, string(response.Data["updateUser"]))
+
+	response = postGraphQL(t, h, nil, `mutation { deleteUser(id: 4) }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeUnauthenticated, response.Errors[0].Extensions["code"])
+
+	response = postGraphQL(t, h, owner, `mutation { deleteUser(id: 4) }`, nil)
+	require.Empty(t, response.Errors)
+	assert.JSONEq(t, `"4"`, string(response.Data["deleteUser"]))
+
+	response = postGraphQL(t, h, admin, `mutation { deleteUser(id: 4) }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeNotFound, response.Errors[0].Extensions["code"])
+}
+
+// TestGraphQLHandler_Limits tests that deep and costly queries are rejected before they run
+func TestGraphQLHandler_Limits(t *testing.T) {
+	h, users := newGraphQLHandler(t)
+
+	response := postGraphQL(t, h, nil, `{ users(limit: 100) { nodes { id name email } } }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeQueryTooComplex, response.Errors[0].Extensions["code"])
+
+	ids := make([]interface{}, 60)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	response = postGraphQL(t, h, nil, `query($ids: [ID!]!) { usersByIds(ids: $ids) { id name } }`, map[string]interface{}{"ids": ids})
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeQueryTooComplex, response.Errors[0].Extensions["code"])
+	assert.Zero(t, users.batches.Load())
+
+	response = postGraphQL(t, h, nil, `{ a: __schema { types { fields { type { ofType { ofType { name } } } } } } }`, nil)
+	require.NotEmpty(t, response.Errors)
+	assert.Contains(t, response.Errors[0].Message, "depth")
+}
+
+// TestGraphQLHandler_Scopes tests that API keys only read and write users within their scopes
+func TestGraphQLHandler_Scopes(t *testing.T) {
+	h, _ := newGraphQLHandler(t)
+	reader := &auth.Principal{ServicePrincipalID: "sp_1", Scopes: []string{auth.ScopeUsersRead}}
+
+	response := postGraphQL(t, h, reader, `{ user(id: 1) { name } }`, nil)
+	require.Empty(t, response.Errors)
+
+	response = postGraphQL(t, h, reader, `mutation { deleteUser(id: 1) }`, nil)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, gql.CodeForbidden, response.Errors[0].Extensions["code"])
+}
+
+// TestGraphQLHandler_InvalidRequest tests that bodies without a query get 400
+func TestGraphQLHandler_InvalidRequest(t *testing.T) {
+	h, _ := newGraphQLHandler(t)
+
+	for _, body := range []string{`{"query": 1}`, `{}`, `{"query": "{ user(id: 1) { id } }"} {}`} {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.Query(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
@@ -0,0 +1,202 @@
+package handler_test
+
+import (
+	"Q4/internal/handler"
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// sseStream reads the events of a Server-Sent Events response, skipping comments
+type sseStream struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+func openUserEvents(t *testing.T, server *httptest.Server, query string, header http.Header) *sseStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/users/events?"+query, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return &sseStream{resp: resp, scanner: bufio.NewScanner(resp.Body)}
+}
+
+func (s *sseStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if event.event != "" {
+				return event
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			event.data = value
+		}
+	}
+	require.NoError(t, s.scanner.Err())
+	t.Fatal("the stream ended")
+	return event
+}
+
+func newUserEventServer(t *testing.T) (*httptest.Server, *service.UserEvents) {
+	events := service.NewUserEvents(3)
+	h := handler.NewUserEventHandler(events)
+	h.Heartbeat = 10 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(h.StreamUserEvents))
+	t.Cleanup(server.Close)
+	return server, events
+}
+
+// TestUserEventHandler_Stream tests that events are streamed with their IDs and filtered by user and type
+func TestUserEventHandler_Stream(t *testing.T) {
+	server, events := newUserEventServer(t)
+	stream := openUserEvents(t, server, "user_id=1,2&type=updated&type=deleted", nil)
+	require.Equal(t, http.StatusOK, stream.resp.StatusCode)
+	assert.Equal(t, "text/event-stream", stream.resp.Header.Get("Content-Type"))
+
+	events.Publish(model.UserUpdated, model.User{ID: 3, Name: "Mehmet"})
+	events.Publish(model.UserCreated, model.User{ID: 1, Name: "Ahmet"})
+	updated := events.Publish(model.UserUpdated, model.User{ID: 1, Name: "Ahmet Yilmaz"})
+	events.Publish(model.UserDeleted, model.User{ID: 2, Name: "Ayse"})
+
+	event := stream.next(t)
+	assert.Equal(t, strconv.FormatUint(updated.ID, 10), event.id)
+	assert.Equal(t, model.UserUpdated, event.event)
+	var data model.UserEvent
+	require.NoError(t, json.Unmarshal([]byte(event.data), &data))
+	assert.Equal(t, "Ahmet Yilmaz", data.User.Name)
+
+	event = stream.next(t)
+	assert.Equal(t, model.UserDeleted, event.event)
+	assert.Contains(t, event.data, `"name":"Ayse"`)
+}
+
+// TestUserEventHandler_Resume tests that Last-Event-ID replays the missed events, and that a
+// reset event says when they are no longer kept
+func TestUserEventHandler_Resume(t *testing.T) {
+	server, events := newUserEventServer(t)
+	first := events.Publish(model.UserCreated, model.User{ID: 1})
+	events.Publish(model.UserCreated, model.User{ID: 2})
+	events.Publish(model.UserCreated, model.User{ID: 3})
+
+	stream := openUserEvents(t, server, "", http.Header{"Last-Event-Id": {strconv.FormatUint(first.ID, 10)}})
+	assert.Equal(t, strconv.FormatUint(first.ID+1, 10), stream.next(t).id)
+	assert.Equal(t, strconv.FormatUint(first.ID+2, 10), stream.next(t).id)
+	live := events.Publish(model.UserDeleted, model.User{ID: 1})
+	assert.Equal(t, strconv.FormatUint(live.ID, 10), stream.next(t).id)
+
+	// Only the last three events are kept, so the one after first is gone
+	events.Publish(model.UserUpdated, model.User{ID: 3})
+	stream = openUserEvents(t, server, "last_event_id="+strconv.FormatUint(first.ID, 10), nil)
+	assert.Equal(t, "reset", stream.next(t).event)
+	live = events.Publish(model.UserUpdated, model.User{ID: 2})
+	assert.Equal(t, strconv.FormatUint(live.ID, 10), stream.next(t).id)
+}
+
+// TestUserEventHandler_InvalidRequest tests that bad filters and event IDs are rejected
+func TestUserEventHandler_InvalidRequest(t *testing.T) {
+	server, _ := newUserEventServer(t)
+	for _, query := range []string{"user_id=abc", "type=renamed", "last_event_id=-1"} {
+		resp, err := http.Get(server.URL + "/users/events?" + query)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+// blockingWriter is a response writer whose client stops reading after the headers
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+	// flushed is closed by the first flush, once the headers are out
+	flushed chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Flush() {
+	w.ResponseRecorder.Flush()
+	w.once.Do(func() { close(w.flushed) })
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+// TestUserEventHandler_SlowClient tests that a client that falls behind is disconnected instead
+// of holding up the publisher
+func TestUserEventHandler_SlowClient(t *testing.T) {
+	events := service.NewUserEvents(0)
+	h := handler.NewUserEventHandler(events)
+	h.Buffer = 2
+	h.Heartbeat = time.Hour
+	w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{}), flushed: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		h.StreamUserEvents(w, httptest.NewRequest(http.MethodGet, "/users/events", nil))
+		close(done)
+	}()
+	select {
+	case <-w.flushed:
+	case <-time.After(time.Second):
+		t.Fatal("the stream did not start")
+	}
+
+	for id := 1; id <= 10; id++ {
+		events.Publish(model.UserCreated, model.User{ID: id})
+	}
+	close(w.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow client was not disconnected")
+	}
+}
+
+// TestUserEventHandler_Shutdown tests that streams end when the events shut down, so that the
+// server's shutdown does not wait for them
+func TestUserEventHandler_Shutdown(t *testing.T) {
+	server, events := newUserEventServer(t)
+	stream := openUserEvents(t, server, "", nil)
+	created := events.Publish(model.UserCreated, model.User{ID: 1})
+	assert.Equal(t, strconv.FormatUint(created.ID, 10), stream.next(t).id)
+
+	events.Shutdown()
+	events.Shutdown()
+	for stream.scanner.Scan() {
+	}
+	assert.NoError(t, stream.scanner.Err(), "the stream ends cleanly")
+}
@@ -1,6 +1,7 @@
 package handler_test
 
 import (
+	"Q4/internal/auth"
 	"Q4/internal/helpers"
 	"bytes"
 	"encoding/json"
@@ -8,10 +9,13 @@ import (
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"Q4/internal/handler"
 	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -25,6 +29,19 @@ func (m *MockUserService) GetAllUsers() ([]model.User, error) {
 	return args.Get(0).([]model.User), args.Error(1)
 }
 
+func (m *MockUserService) ListUsers(filter model.UserFilter) ([]model.User, error) {
+	args := m.Called(filter)
+	return args.Get(0).([]model.User), args.Error(1)
+}
+
+func (m *MockUserService) IterateUsers(filter model.UserFilter) (repository.UserIterator, error) {
+	args := m.Called(filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(repository.UserIterator), args.Error(1)
+}
+
 func (m *MockUserService) GetUserByID(id int) (*model.User, error) {
 	args := m.Called(id)
 	if args.Get(0) == nil {
@@ -33,21 +50,37 @@ func (m *MockUserService) GetUserByID(id int) (*model.User, error) {
 	return args.Get(0).(*model.User), args.Error(1)
 }
 
-func (m *MockUserService) CreateUser(user *model.User) error {
+func (m *MockUserService) GetUsersByIDs(ids []int) ([]model.User, error) {
+	args := m.Called(ids)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.User), args.Error(1)
+}
+
+func (m *MockUserService) CreateUser(caller *auth.Principal, user *model.User) error {
 	args := m.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockUserService) UpdateUser(user *model.User) error {
+func (m *MockUserService) UpdateUser(caller *auth.Principal, user *model.User) error {
 	args := m.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockUserService) DeleteUser(id int) error {
+func (m *MockUserService) DeleteUser(caller *auth.Principal, id int) error {
 	args := m.Called(id)
 	return args.Error(0)
 }
 
+func (m *MockUserService) Search(text string, limit, offset int) (*repository.SearchResult, error) {
+	args := m.Called(text, limit, offset)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.SearchResult), args.Error(1)
+}
+
 // Test functions remain the same...
 
 // TestUserHandler_GetAllUsers tests the GetAllUsers handler
@@ -154,6 +187,30 @@ func TestUserHandler_CreateUser(t *testing.T) {
 	assert.Equal(t, "User created successfully", response["message"])
 }
 
+// TestUserHandler_CreateUser_StrictBody tests that unknown fields, trailing data and oversized bodies are rejected
+func TestUserHandler_CreateUser_StrictBody(t *testing.T) {
+	mockService := new(MockUserService)
+	userHandler := handler.NewUserHandler(mockService)
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{`{"name":"New User","email":"new@example.com","is_admin":true}`, http.StatusBadRequest},
+		{`{"name":"New User","email":"new@example.com"}{"name":"Other"}`, http.StatusBadRequest},
+		{`{"name":"New User","email":"new@example.com"} trailing`, http.StatusBadRequest},
+		{`{"name":"` + strings.Repeat("a", 100) + `"}`, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		req.Body = http.MaxBytesReader(rr, req.Body, 64)
+		userHandler.CreateUser(rr, req)
+		assert.Equal(t, tt.status, rr.Code, tt.body)
+	}
+	mockService.AssertNotCalled(t, "CreateUser", mock.Anything)
+}
+
 // TestUserHandler_UpdateUser tests the UpdateUser handler
 func TestUserHandler_UpdateUser(t *testing.T) {
 	mockService := new(MockUserService)
@@ -240,3 +297,94 @@ func TestUserHandler_DeleteUser_NotFound(t *testing.T) {
 	assert.Equal(t, "The user with the specified ID does not exist", errorResponse.Details)
 	mockService.AssertExpectations(t)
 }
+
+// TestUserHandler_Roles tests that only signed-in admins may set roles when creating or updating users
+func TestUserHandler_Roles(t *testing.T) {
+	store := repository.NewMemoryStore()
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	member := model.User{Name: "Ahmet", Email: "ahmet@example.com", Role: model.RoleUser}
+	for _, user := range []*model.User{&admin, &member} {
+		if err := store.Users.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userHandler := handler.NewUserHandler(&service.UserService{Repo: store.Users, Tx: store.Tx})
+	router := mux.NewRouter()
+	router.HandleFunc("/users", userHandler.CreateUser).Methods("POST")
+	router.HandleFunc("/users/{id}", userHandler.UpdateUser).Methods("PUT")
+
+	send := func(principal *auth.Principal, method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if principal != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	asMember := &auth.Principal{UserID: member.ID}
+	asAdmin := &auth.Principal{UserID: admin.ID}
+
+	assert.Equal(t, http.StatusForbidden, send(nil, "POST", "/users", `{"name":"Eve","email":"eve@example.com","role":"admin"}`))
+	assert.Equal(t, http.StatusForbidden, send(asMember, "POST", "/users", `{"name":"Eve","email":"eve@example.com","role":"admin"}`))
+	assert.Equal(t, http.StatusForbidden, send(asMember, "PUT", fmt.Sprintf("/users/%d", member.ID), `{"name":"Ahmet","email":"ahmet@example.com","role":"admin"}`))
+	got, err := store.Users.GetUserByID(member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, model.RoleUser, got.Role)
+
+	assert.Equal(t, http.StatusCreated, send(nil, "POST", "/users", `{"name":"Eve","email":"eve@example.com"}`))
+	assert.Equal(t, http.StatusCreated, send(asAdmin, "POST", "/users", `{"name":"Mehmet","email":"mehmet@example.com","role":"admin"}`))
+	assert.Equal(t, http.StatusOK, send(asAdmin, "PUT", fmt.Sprintf("/users/%d", member.ID), `{"name":"Ahmet","email":"ahmet@example.com","role":"admin"}`))
+	got, err = store.Users.GetUserByID(member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, model.RoleAdmin, got.Role)
+}
+
+// TestUserHandler_Ownership tests that users may only update and delete themselves unless they are admins
+func TestUserHandler_Ownership(t *testing.T) {
+	store := repository.NewMemoryStore()
+	victim := model.User{Name: "Ahmet", Email: "ahmet@example.com", Role: model.RoleAdmin}
+	attacker := model.User{Name: "Eve", Email: "eve@example.com"}
+	for _, user := range []*model.User{&victim, &attacker} {
+		if err := store.Users.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userHandler := handler.NewUserHandler(&service.UserService{Repo: store.Users, Tx: store.Tx, Passwords: store.Passwords})
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id}", userHandler.UpdateUser).Methods("PUT")
+	router.HandleFunc("/users/{id}", userHandler.DeleteUser).Methods("DELETE")
+
+	send := func(principal *auth.Principal, method, body string) int {
+		req := httptest.NewRequest(method, fmt.Sprintf("/users/%d", victim.ID), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if principal != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	takeover := `{"name":"Ahmet","email":"eve+ahmet@example.com"}`
+
+	assert.Equal(t, http.StatusUnauthorized, send(nil, "PUT", takeover))
+	assert.Equal(t, http.StatusForbidden, send(&auth.Principal{UserID: attacker.ID}, "PUT", takeover))
+	assert.Equal(t, http.StatusForbidden, send(&auth.Principal{UserID: victim.ID}, "PUT", takeover), "email changes take the current password")
+	writeKey := &auth.Principal{ServicePrincipalID: "sp_sync", Scopes: []string{auth.ScopeUsersWrite}}
+	assert.Equal(t, http.StatusForbidden, send(writeKey, "PUT", takeover), "API keys cannot move admins")
+	assert.Equal(t, http.StatusUnauthorized, send(nil, "DELETE", ""))
+	assert.Equal(t, http.StatusForbidden, send(&auth.Principal{UserID: attacker.ID}, "DELETE", ""))
+	got, err := store.Users.GetUserByID(victim.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ahmet@example.com", got.Email)
+
+	assert.Equal(t, http.StatusOK, send(&auth.Principal{UserID: victim.ID}, "PUT", `{"name":"Ahmet Y.","email":"ahmet@example.com"}`))
+	assert.Equal(t, http.StatusOK, send(&auth.Principal{UserID: victim.ID}, "DELETE", ""))
+}
@@ -0,0 +1,256 @@
+package handler_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/cors"
+	"Q4/internal/handler"
+	"Q4/internal/importer"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"Q4/internal/ws"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newWebSocketServer serves the WebSocket handler, signing requests in as user 1 unless they
+// carry "X-Anonymous"
+func newWebSocketServer(t *testing.T, policy *cors.Policy) (*httptest.Server, *service.UserEvents, *ws.Hub) {
+	events := service.NewUserEvents(0)
+	hub := ws.NewHub(events)
+	hub.PingInterval = 50 * time.Millisecond
+	go hub.Run()
+	h := handler.NewWebSocketHandler(hub, policy)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Anonymous") == "" {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{UserID: 1}))
+		}
+		h.Subscribe(rw, r)
+	}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = hub.Shutdown(ctx)
+		server.Close()
+	})
+	return server, events, hub
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if conn != nil {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func readServerMessage(t *testing.T, conn *websocket.Conn) ws.ServerMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var msg ws.ServerMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	return msg
+}
+
+func TestWebSocketHandler_Subscribe(t *testing.T) {
+	server, events, _ := newWebSocketServer(t, nil)
+	conn, _, err := dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeSubscribe, ID: "1", Topics: []string{"user:2", "role:admin"}}))
+	msg := readServerMessage(t, conn)
+	assert.Equal(t, ws.TypeSubscribed, msg.Type)
+	assert.Equal(t, "1", msg.ID)
+	assert.Equal(t, []string{"role:admin", "user:2"}, msg.Topics)
+
+	events.Publish(model.UserCreated, model.User{ID: 3, Name: "Other", Role: model.RoleUser})
+	events.Publish(model.UserUpdated, model.User{ID: 2, Name: "Ada", Role: model.RoleUser, Password: "secret"})
+	events.Publish(model.UserCreated, model.User{ID: 4, Name: "Admin", Role: model.RoleAdmin})
+
+	msg = readServerMessage(t, conn)
+	require.Equal(t, ws.TypeEvent, msg.Type)
+	assert.Equal(t, model.UserUpdated, msg.Event.Type)
+	assert.Equal(t, 2, msg.Event.User.ID)
+	assert.Empty(t, msg.Event.User.Password)
+	msg = readServerMessage(t, conn)
+	require.Equal(t, ws.TypeEvent, msg.Type)
+	assert.Equal(t, 4, msg.Event.User.ID)
+
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeUnsubscribe, ID: "2", Topics: []string{"role:admin"}}))
+	msg = readServerMessage(t, conn)
+	assert.Equal(t, ws.TypeUnsubscribed, msg.Type)
+	assert.Equal(t, []string{"user:2"}, msg.Topics)
+
+	events.Publish(model.UserCreated, model.User{ID: 5, Role: model.RoleAdmin})
+	events.Publish(model.UserDeleted, model.User{ID: 2, Role: model.RoleUser})
+	msg = readServerMessage(t, conn)
+	require.Equal(t, ws.TypeEvent, msg.Type)
+	assert.Equal(t, model.UserDeleted, msg.Event.Type)
+	assert.Equal(t, 2, msg.Event.User.ID)
+}
+
+// TestWebSocketHandler_BulkChanges tests that users written by batches and imports reach WebSocket clients
+func TestWebSocketHandler_BulkChanges(t *testing.T) {
+	server, events, _ := newWebSocketServer(t, nil)
+	store := repository.NewMemoryStore()
+	batchService := service.NewBatchService(repository.NewTxUnitOfWork(store.Tx))
+	batchService.Events = events
+	importService := service.NewImportService(store.Users)
+	importService.Events = events
+	caller := &auth.Principal{ServicePrincipalID: "sp_sync", Scopes: []string{auth.ScopeUsersWrite}}
+
+	conn, _, err := dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeSubscribe, ID: "1", Topics: []string{"users"}}))
+	require.Equal(t, ws.TypeSubscribed, readServerMessage(t, conn).Type)
+
+	resp, err := batchService.Execute(caller, service.BatchRequest{Operations: []service.BatchOperation{
+		{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com"}},
+	}})
+	require.NoError(t, err)
+	require.True(t, resp.Committed)
+	msg := readServerMessage(t, conn)
+	require.Equal(t, ws.TypeEvent, msg.Type)
+	assert.Equal(t, model.UserCreated, msg.Event.Type)
+	assert.Equal(t, resp.Results[0].UserID, msg.Event.User.ID)
+
+	_, err = importService.Import(caller, strings.NewReader("name,email\nAyse Y.,ayse@example.com\n"), service.ImportOptions{Format: importer.FormatCSV})
+	require.NoError(t, err)
+	msg = readServerMessage(t, conn)
+	require.Equal(t, ws.TypeEvent, msg.Type)
+	assert.Equal(t, model.UserUpdated, msg.Event.Type)
+	assert.Equal(t, "Ayse Y.", msg.Event.User.Name)
+}
+
+func TestWebSocketHandler_InvalidMessages(t *testing.T) {
+	server, _, _ := newWebSocketServer(t, nil)
+	conn, _, err := dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	assert.Equal(t, ws.TypeError, readServerMessage(t, conn).Type)
+
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: "publish", ID: "1"}))
+	msg := readServerMessage(t, conn)
+	assert.Equal(t, ws.TypeError, msg.Type)
+	assert.Equal(t, "1", msg.ID)
+
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeSubscribe, ID: "2", Topics: []string{"user:2", "group:staff"}}))
+	msg = readServerMessage(t, conn)
+	assert.Equal(t, ws.TypeError, msg.Type)
+	assert.Contains(t, msg.Error, "group:staff")
+
+	// The rejected subscription must not have added any of its topics
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeSubscribe, ID: "3", Topics: []string{"users"}}))
+	msg = readServerMessage(t, conn)
+	assert.Equal(t, ws.TypeSubscribed, msg.Type)
+	assert.Equal(t, []string{"users"}, msg.Topics)
+}
+
+func TestWebSocketHandler_Upgrade(t *testing.T) {
+	policy := cors.MustNew(cors.Options{Origins: []string{"https://app.example.com"}})
+	server, _, _ := newWebSocketServer(t, policy)
+
+	t.Run("anonymous", func(t *testing.T) {
+		_, resp, err := dialWebSocket(t, server, http.Header{"X-Anonymous": {"1"}})
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		_, resp, err := dialWebSocket(t, server, http.Header{"Origin": {"https://evil.example.com"}})
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("cookie from an allowed origin without credentials", func(t *testing.T) {
+		_, resp, err := dialWebSocket(t, server, http.Header{"Origin": {"https://app.example.com"}})
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("token from an allowed origin", func(t *testing.T) {
+		_, _, err := dialWebSocket(t, server, http.Header{
+			"Origin":        {"https://app.example.com"},
+			"Authorization": {"Bearer token"},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("same origin", func(t *testing.T) {
+		_, _, err := dialWebSocket(t, server, http.Header{"Origin": {server.URL}})
+		require.NoError(t, err)
+	})
+}
+
+func TestWebSocketHandler_Keepalive(t *testing.T) {
+	server, _, _ := newWebSocketServer(t, nil)
+	conn, _, err := dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+
+	pings := make(chan struct{}, 10)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Answering pings keeps the connection open past several read deadlines
+	for range 5 {
+		select {
+		case <-pings:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the server stopped pinging")
+		}
+	}
+}
+
+func TestWebSocketHandler_Shutdown(t *testing.T) {
+	server, _, hub := newWebSocketServer(t, nil)
+	conn, _, err := dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+	// The reply shows that the hub serves the connection before it shuts down
+	require.NoError(t, conn.WriteJSON(ws.ClientMessage{Type: ws.TypeSubscribe, Topics: []string{"users"}}))
+	readServerMessage(t, conn)
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, hub.Shutdown(ctx))
+	err = <-closed
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+
+	// Clients that connect afterwards are upgraded and closed at once
+	conn, _, err = dialWebSocket(t, server, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+}
@@ -0,0 +1,36 @@
+package repository_test
+
+import (
+	"Q4/internal/cache"
+	"Q4/internal/repository"
+	"Q4/internal/repository/repositorytest"
+	"testing"
+)
+
+func TestUserRepositoryConformance_SQLite(t *testing.T) {
+	repositorytest.RunUserRepositorySuite(t, func(t *testing.T) *repository.Store {
+		return repository.NewSQLiteStore(newTestDB(t))
+	})
+}
+
+func TestUserRepositoryConformance_Memory(t *testing.T) {
+	repositorytest.RunUserRepositorySuite(t, func(t *testing.T) *repository.Store {
+		return repository.NewMemoryStore()
+	})
+}
+
+func TestUserRepositoryConformance_Postgres(t *testing.T) {
+	repositorytest.RunUserRepositorySuite(t, func(t *testing.T) *repository.Store {
+		return repository.NewPostgresStore(newPostgresDB(t))
+	})
+}
+
+func TestUserRepositoryConformance_CachedSQLite(t *testing.T) {
+	repositorytest.RunUserRepositorySuite(t, func(t *testing.T) *repository.Store {
+		store := repository.NewSQLiteStore(newTestDB(t))
+		cached := repository.NewCachedUserRepository(store.Users, cache.NewLRU(100))
+		store.Users = cached
+		store.Tx = repository.NewCachedTxManager(store.Tx, cached)
+		return store
+	})
+}
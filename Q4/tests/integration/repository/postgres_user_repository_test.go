@@ -0,0 +1,141 @@
+package repository_test
+
+import (
+	"Q4/internal/database"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPostgresDB connects to POSTGRES_TEST_DSN or, failing that, starts a throwaway cluster with the
+// initdb and pg_ctl binaries found in POSTGRES_BIN_DIR or on the PATH. The test is skipped when
+// neither is available.
+func newPostgresDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		dsn = startLocalPostgres(t)
+	}
+
+	db, err := database.OpenPostgres(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	_, err = db.Exec("TRUNCATE users RESTART IDENTITY CASCADE;")
+	require.NoError(t, err)
+	return db
+}
+
+func startLocalPostgres(t *testing.T) string {
+	t.Helper()
+
+	lookup := func(name string) string {
+		if dir := os.Getenv("POSTGRES_BIN_DIR"); dir != "" {
+			return filepath.Join(dir, name)
+		}
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return ""
+		}
+		return path
+	}
+	initdb, pgCtl := lookup("initdb"), lookup("pg_ctl")
+	if initdb == "" || pgCtl == "" {
+		t.Skip("PostgreSQL binaries not found; set POSTGRES_TEST_DSN or POSTGRES_BIN_DIR to run")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("initdb refuses to run as root; set POSTGRES_TEST_DSN to run")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	dataDir := t.TempDir()
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "-A", "trust").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	options := fmt.Sprintf("-p %d -h 127.0.0.1 -k %s", port, dataDir)
+	out, err = exec.Command(pgCtl, "-D", dataDir, "-o", options, "-w", "start").CombinedOutput()
+	require.NoError(t, err, string(out))
+	t.Cleanup(func() {
+		_ = exec.Command(pgCtl, "-D", dataDir, "-m", "immediate", "stop").Run()
+	})
+
+	return fmt.Sprintf("host=127.0.0.1 port=%d user=postgres dbname=postgres sslmode=disable", port)
+}
+
+// TestPostgresUserRepository_CRUD tests the basic operations and RETURNING generated IDs
+func TestPostgresUserRepository_CRUD(t *testing.T) {
+	repo := repository.NewPostgresUserRepository(newPostgresDB(t))
+
+	user := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&user))
+	assert.NotZero(t, user.ID)
+
+	user.Name = "Ahmet Y."
+	require.NoError(t, repo.UpdateUser(&user))
+
+	found, err := repo.GetUserByEmail("ahmet@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user, *found)
+
+	err = repo.CreateUser(&model.User{Name: "Copy", Email: "ahmet@example.com"})
+	assert.ErrorIs(t, err, repository.ErrDuplicateEmail)
+
+	require.NoError(t, repo.DeleteUser(user.ID))
+	_, err = repo.GetUserByID(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+// TestPostgresUserRepository_Upsert tests that inserts and updates are told apart
+func TestPostgresUserRepository_Upsert(t *testing.T) {
+	repo := repository.NewPostgresUserRepository(newPostgresDB(t))
+	existing := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&existing))
+
+	results, err := repo.UpsertUsers([]model.User{
+		{Name: "Ahmet Y.", Email: "ahmet@example.com"},
+		{Name: "Ayse", Email: "ayse@example.com"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, repository.UpsertResult{ID: existing.ID, Created: false}, results[0])
+	assert.True(t, results[1].Created)
+
+	users, err := repo.GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+}
+
+// TestPostgresTxManager_Rollback tests that transactions bind the PostgreSQL repository
+func TestPostgresTxManager_Rollback(t *testing.T) {
+	db := newPostgresDB(t)
+	txManager := repository.NewPostgresTxManager(db)
+
+	failure := errors.New("boom")
+	err := txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		require.NoError(t, repos.Users.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"}))
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	users, err := repository.NewPostgresUserRepository(db).GetAllUsers()
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	require.NoError(t, database.MigratePostgres(db), "migrations must be idempotent")
+}
@@ -0,0 +1,131 @@
+package repository_test
+
+import (
+	"Q4/internal/database"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+type searchableRepository interface {
+	repository.UserRepository
+	repository.UserSearcher
+}
+
+func runSearchTests(t *testing.T, newRepo func(t *testing.T) searchableRepository) {
+	seed := func(t *testing.T) searchableRepository {
+		repo := newRepo(t)
+		for _, user := range []model.User{
+			{Name: "Ahmet Yilmaz", Email: "ahmet@example.com"},
+			{Name: "Ayse Kaya", Email: "ayse.kaya@example.org"},
+			{Name: "Mehmet <b>Demir</b>", Email: "mehmet@example.com"},
+			{Name: "Zeynep Ahmetoglu", Email: "zeynep@sample.net"},
+		} {
+			require.NoError(t, repo.CreateUser(&user))
+		}
+		return repo
+	}
+	search := func(t *testing.T, repo searchableRepository, text string, limit, offset int) *repository.SearchResult {
+		result, err := repo.SearchUsers(repository.SearchQuery{Text: text, Limit: limit, Offset: offset})
+		require.NoError(t, err)
+		return result
+	}
+
+	t.Run("PrefixAndRanking", func(t *testing.T) {
+		repo := seed(t)
+		result := search(t, repo, "ahm", 10, 0)
+
+		assert.False(t, result.Fuzzy)
+		assert.Equal(t, 2, result.Total)
+		require.Len(t, result.Hits, 2)
+		assert.Equal(t, "Ahmet Yilmaz", result.Hits[0].User.Name, "a match in both name and email ranks first")
+		assert.Equal(t, "<mark>Ahmet</mark> Yilmaz", result.Hits[0].NameHighlight)
+	})
+
+	t.Run("AllTokensMustMatch", func(t *testing.T) {
+		repo := seed(t)
+		result := search(t, repo, "ayse example", 10, 0)
+		require.Equal(t, 1, result.Total)
+		assert.Equal(t, "<mark>ayse</mark>.kaya@<mark>example</mark>.org", result.Hits[0].EmailHighlight)
+	})
+
+	t.Run("HighlightsAreEscaped", func(t *testing.T) {
+		repo := seed(t)
+		result := search(t, repo, "demir", 10, 0)
+		require.Equal(t, 1, result.Total)
+		assert.Equal(t, "Mehmet &lt;b&gt;<mark>Demir</mark>&lt;/b&gt;", result.Hits[0].NameHighlight)
+	})
+
+	t.Run("TypoTolerance", func(t *testing.T) {
+		repo := seed(t)
+		result := search(t, repo, "Mehmte", 10, 0)
+		assert.True(t, result.Fuzzy)
+		require.NotEmpty(t, result.Hits)
+		assert.Equal(t, "mehmet@example.com", result.Hits[0].User.Email)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		repo := seed(t)
+		first := search(t, repo, "example", 1, 0)
+		second := search(t, repo, "example", 1, 1)
+		assert.Equal(t, 3, first.Total)
+		require.Len(t, first.Hits, 1)
+		require.Len(t, second.Hits, 1)
+		assert.NotEqual(t, first.Hits[0].User.ID, second.Hits[0].User.ID)
+		assert.Empty(t, search(t, repo, "example", 10, 10).Hits)
+	})
+
+	t.Run("IndexFollowsWrites", func(t *testing.T) {
+		repo := seed(t)
+		user, err := repo.GetUserByEmail("ahmet@example.com")
+		require.NoError(t, err)
+
+		user.Name = "Kemal Yilmaz"
+		require.NoError(t, repo.UpdateUser(user))
+		assert.Equal(t, 1, search(t, repo, "kemal", 10, 0).Total)
+		result := search(t, repo, "yilmaz ahmet", 10, 0)
+		require.Equal(t, 1, result.Total)
+		assert.Equal(t, "Kemal <mark>Yilmaz</mark>", result.Hits[0].NameHighlight)
+		assert.Equal(t, "<mark>ahmet</mark>@example.com", result.Hits[0].EmailHighlight)
+
+		require.NoError(t, repo.DeleteUser(user.ID))
+		assert.Equal(t, 0, search(t, repo, "kemal", 10, 0).Total)
+	})
+}
+
+func TestSearch_SQLite(t *testing.T) {
+	runSearchTests(t, func(t *testing.T) searchableRepository {
+		return repository.NewSQLUserRepository(newTestDB(t))
+	})
+}
+
+func TestSearch_Memory(t *testing.T) {
+	runSearchTests(t, func(t *testing.T) searchableRepository {
+		return repository.NewMemoryUserRepository()
+	})
+}
+
+// TestSearch_IndexesExistingUsers tests that users created before the search migration are searchable
+func TestSearch_IndexesExistingUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	legacy, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = legacy.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, email TEXT NOT NULL UNIQUE);
+		INSERT INTO users (name, email) VALUES ('Ahmet', 'ahmet@example.com');`)
+	require.NoError(t, err)
+	require.NoError(t, legacy.Close())
+
+	db, err := database.Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	result, err := repository.NewSQLUserRepository(db).SearchUsers(repository.SearchQuery{Text: "ahm", Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+}
@@ -0,0 +1,125 @@
+package repository_test
+
+import (
+	"Q4/internal/database"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type busyError struct{}
+
+func (busyError) Error() string { return "database is locked" }
+func (busyError) Code() int     { return 5 }
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := database.Open(filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func countUsers(t *testing.T, db *sql.DB) int {
+	users, err := repository.NewSQLUserRepository(db).GetAllUsers()
+	require.NoError(t, err)
+	return len(users)
+}
+
+// TestSQLTxManager_CommitAndRollback tests that errors undo every change made in the closure
+func TestSQLTxManager_CommitAndRollback(t *testing.T) {
+	db := newTestDB(t)
+	txManager := repository.NewSQLTxManager(db)
+
+	err := txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		return repos.Users.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"})
+	})
+	require.NoError(t, err)
+
+	failure := errors.New("boom")
+	err = txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		require.NoError(t, repos.Users.CreateUser(&model.User{Name: "Ayse", Email: "ayse@example.com"}))
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 1, countUsers(t, db))
+}
+
+// TestSQLTxManager_PanicRollsBack tests that a panic rolls back and is re-raised
+func TestSQLTxManager_PanicRollsBack(t *testing.T) {
+	db := newTestDB(t)
+	txManager := repository.NewSQLTxManager(db)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+			require.NoError(t, repos.Users.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"}))
+			panic("boom")
+		})
+	})
+	assert.Equal(t, 0, countUsers(t, db))
+}
+
+// TestSQLTxManager_NestedSavepoints tests that a failed inner call only undoes its own changes
+func TestSQLTxManager_NestedSavepoints(t *testing.T) {
+	db := newTestDB(t)
+	txManager := repository.NewSQLTxManager(db)
+
+	err := txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		require.NoError(t, repos.Users.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"}))
+
+		inner := txManager.WithinTx(ctx, func(ctx context.Context, repos repository.Repositories) error {
+			require.NoError(t, repos.Users.CreateUser(&model.User{Name: "Ayse", Email: "ayse@example.com"}))
+			return errors.New("inner failure")
+		})
+		assert.Error(t, inner)
+
+		return txManager.WithinTx(ctx, func(ctx context.Context, repos repository.Repositories) error {
+			return repos.Users.CreateUser(&model.User{Name: "Mehmet", Email: "mehmet@example.com"})
+		})
+	})
+	require.NoError(t, err)
+
+	users, err := repository.NewSQLUserRepository(db).GetAllUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "Ahmet", users[0].Name)
+	assert.Equal(t, "Mehmet", users[1].Name)
+}
+
+// TestSQLTxManager_RetriesBusy tests that SQLITE_BUSY errors retry the whole transaction
+func TestSQLTxManager_RetriesBusy(t *testing.T) {
+	db := newTestDB(t)
+	txManager := repository.NewSQLTxManager(db)
+	txManager.RetryDelay = time.Millisecond
+
+	attempts := 0
+	err := txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		attempts++
+		if err := repos.Users.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"}); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return busyError{}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 1, countUsers(t, db))
+
+	txManager.MaxRetries = 1
+	attempts = 0
+	err = txManager.WithinTx(context.Background(), func(ctx context.Context, repos repository.Repositories) error {
+		attempts++
+		return busyError{}
+	})
+	assert.True(t, repository.IsBusy(err))
+	assert.Equal(t, 2, attempts)
+}
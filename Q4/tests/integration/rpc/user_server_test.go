@@ -0,0 +1,197 @@
+package rpc_test
+
+import (
+	"Q4/config"
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/routes"
+	"Q4/internal/service"
+	userv1 "Q4/proto/user/v1"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type rpcFixture struct {
+	store  *repository.Store
+	client userv1.UserServiceClient
+	// readKey is an API key with only the users:read scope, writeKey one with both user scopes
+	readKey  string
+	writeKey string
+}
+
+func newRPCFixture(t *testing.T) *rpcFixture {
+	store := repository.NewMemoryStore()
+	users := &service.UserService{Repo: store.Users, Tx: store.Tx, Events: service.NewUserEvents(0)}
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	server := routes.SetupGRPC(store, users, cfg)
+
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	require.NoError(t, store.Users.CreateUser(&admin))
+	apiKeys := service.NewAPIKeyService(store)
+	principal, err := apiKeys.CreateServicePrincipal(admin.ID, service.CreateServicePrincipalRequest{
+		Name:   "Reporting",
+		Scopes: []string{auth.ScopeUsersRead},
+	})
+	require.NoError(t, err)
+	issued, err := apiKeys.IssueAPIKey(admin.ID, principal.ID, service.IssueAPIKeyRequest{})
+	require.NoError(t, err)
+	writer, err := apiKeys.CreateServicePrincipal(admin.ID, service.CreateServicePrincipalRequest{
+		Name:   "Directory sync",
+		Scopes: []string{auth.ScopeUsersRead, auth.ScopeUsersWrite},
+	})
+	require.NoError(t, err)
+	writeKey, err := apiKeys.IssueAPIKey(admin.ID, writer.ID, service.IssueAPIKeyRequest{})
+	require.NoError(t, err)
+
+	return &rpcFixture{store: store, client: userv1.NewUserServiceClient(conn), readKey: issued.Key, writeKey: writeKey.Key}
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+// TestUserServer_CRUD tests creating, reading, updating and deleting users over gRPC, and the
+// status codes of the service's errors
+func TestUserServer_CRUD(t *testing.T) {
+	f := newRPCFixture(t)
+	ctx := context.Background()
+	writer := withToken(f.writeKey)
+
+	_, err := f.client.CreateUser(ctx, &userv1.CreateUserRequest{Name: "Ahmet", Email: "ahmet@example.com"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "anonymous sign-ups go through the rate-limited API")
+	created, err := f.client.CreateUser(writer, &userv1.CreateUserRequest{Name: "Ahmet", Email: "ahmet@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "Ahmet", created.Name)
+	assert.Equal(t, model.RoleUser, created.Role)
+
+	_, err = f.client.CreateUser(writer, &userv1.CreateUserRequest{Name: "Other", Email: "ahmet@example.com"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = f.client.CreateUser(writer, &userv1.CreateUserRequest{Name: "Other", Email: "other@example.com", Role: "owner"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = f.client.CreateUser(writer, &userv1.CreateUserRequest{Email: "nameless@example.com"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	got, err := f.client.GetUser(ctx, &userv1.GetUserRequest{Id: created.Id})
+	require.NoError(t, err)
+	assert.Equal(t, "ahmet@example.com", got.Email)
+
+	name := "Ahmet Yilmaz"
+	_, err = f.client.UpdateUser(ctx, &userv1.UpdateUserRequest{Id: created.Id, Name: &name})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "only signed-in callers change users")
+	updated, err := f.client.UpdateUser(writer, &userv1.UpdateUserRequest{Id: created.Id, Name: &name})
+	require.NoError(t, err)
+	assert.Equal(t, name, updated.Name)
+	assert.Equal(t, "ahmet@example.com", updated.Email, "fields that are not set are left as they are")
+
+	_, err = f.client.DeleteUser(ctx, &userv1.DeleteUserRequest{Id: created.Id})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = f.client.DeleteUser(writer, &userv1.DeleteUserRequest{Id: created.Id})
+	require.NoError(t, err)
+	_, err = f.client.GetUser(ctx, &userv1.GetUserRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = f.client.DeleteUser(writer, &userv1.DeleteUserRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = f.client.GetUser(ctx, &userv1.GetUserRequest{Id: 0})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestUserServer_ListUsers tests that ListUsers streams the users that match the filter
+func TestUserServer_ListUsers(t *testing.T) {
+	f := newRPCFixture(t)
+	for _, user := range []model.User{
+		{Name: "Ahmet", Email: "ahmet@example.com"},
+		{Name: "Mehmet", Email: "mehmet@example.org"},
+	} {
+		require.NoError(t, f.store.Users.CreateUser(&user))
+	}
+
+	stream, err := f.client.ListUsers(context.Background(), &userv1.ListUsersRequest{Email: "example.com"})
+	require.NoError(t, err)
+	var names []string
+	for {
+		user, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, user.Name)
+	}
+	assert.Equal(t, []string{"Ayse", "Ahmet"}, names)
+}
+
+// TestUserServer_Auth tests that bad tokens are rejected and that API keys keep to their scopes
+func TestUserServer_Auth(t *testing.T) {
+	f := newRPCFixture(t)
+
+	_, err := f.client.GetUser(withToken("not-a-token"), &userv1.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = f.client.GetUser(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic abc"), &userv1.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	user, err := f.client.GetUser(withToken(f.readKey), &userv1.GetUserRequest{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "Ayse", user.Name)
+	user, err = f.client.GetUser(metadata.AppendToOutgoingContext(context.Background(), "x-api-key", f.readKey), &userv1.GetUserRequest{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "Ayse", user.Name)
+
+	_, err = f.client.CreateUser(withToken(f.readKey), &userv1.CreateUserRequest{Name: "Ahmet", Email: "ahmet@example.com"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// TestUserServer_WatchUsers tests that WatchUsers streams the changes to the watched users
+func TestUserServer_WatchUsers(t *testing.T) {
+	f := newRPCFixture(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := f.client.WatchUsers(ctx, &userv1.WatchUsersRequest{UserIds: []int64{1}})
+	require.NoError(t, err)
+	// The subscription starts when the server receives the call, which the response headers confirm
+	_, err = stream.Header()
+	require.NoError(t, err)
+
+	_, err = f.client.CreateUser(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.writeKey), &userv1.CreateUserRequest{Name: "Ahmet", Email: "ahmet@example.com"})
+	require.NoError(t, err)
+	name := "Ayse Kaya"
+	_, err = f.client.UpdateUser(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.writeKey), &userv1.UpdateUserRequest{Id: 1, Name: &name})
+	require.NoError(t, err)
+	_, err = f.client.DeleteUser(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.writeKey), &userv1.DeleteUserRequest{Id: 1})
+	require.NoError(t, err)
+
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, userv1.UserEvent_TYPE_UPDATED, event.Type, "events of other users are left out")
+	assert.Equal(t, name, event.User.Name)
+	first := event.Id
+
+	event, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, userv1.UserEvent_TYPE_DELETED, event.Type)
+	assert.Equal(t, name, event.User.Name)
+	assert.Greater(t, event.Id, first)
+}
@@ -0,0 +1,219 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type apiKeyFixture struct {
+	*authFixture
+	apiKeys *service.APIKeyService
+	admin   model.User
+	// principal is a service principal that may read users
+	principal *model.ServicePrincipal
+}
+
+func newAPIKeyFixture(t *testing.T) *apiKeyFixture {
+	f := &apiKeyFixture{authFixture: newAuthFixture(t)}
+	f.apiKeys = service.NewAPIKeyService(f.store)
+	f.apiKeys.Now = func() time.Time { return f.now }
+	f.auth.APIKeys = f.apiKeys
+	f.admin = model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	f.createAdmin(t, &f.admin)
+
+	var err error
+	f.principal, err = f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{
+		Name:   "Nightly export",
+		Scopes: []string{auth.ScopeUsersRead},
+	})
+	require.NoError(t, err)
+	return f
+}
+
+func (f *apiKeyFixture) issue(t *testing.T) *service.IssuedAPIKey {
+	t.Helper()
+	issued, err := f.apiKeys.IssueAPIKey(f.admin.ID, f.principal.ID, service.IssueAPIKeyRequest{})
+	require.NoError(t, err)
+	return issued
+}
+
+// TestAPIKeyService_Authenticate tests that an issued key signs in as its service principal
+func TestAPIKeyService_Authenticate(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	issued := f.issue(t)
+	assert.Equal(t, f.now.Add(service.DefaultAPIKeyTTL), issued.ExpiresAt)
+	assert.NotContains(t, issued.KeyHash, issued.Key)
+
+	principal, err := f.auth.Authenticate(issued.Key)
+	require.NoError(t, err)
+	assert.Equal(t, f.principal.ID, principal.ServicePrincipalID)
+	assert.Equal(t, issued.ID, principal.APIKeyID)
+	assert.Zero(t, principal.UserID)
+	assert.True(t, principal.HasScope(auth.ScopeUsersRead))
+	assert.False(t, principal.HasScope(auth.ScopeUsersWrite))
+
+	_, err = f.auth.Authenticate(issued.Key + "x")
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated, "a changed secret does not match the hash")
+	_, err = f.auth.Authenticate("q4k_0123456789abcdef_secret")
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated)
+}
+
+// TestAPIKeyService_Expiry tests that keys stop working when they expire
+func TestAPIKeyService_Expiry(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	issued, err := f.apiKeys.IssueAPIKey(f.admin.ID, f.principal.ID, service.IssueAPIKeyRequest{ExpiresIn: 3600})
+	require.NoError(t, err)
+
+	f.now = f.now.Add(59 * time.Minute)
+	_, err = f.apiKeys.Authenticate(issued.Key)
+	require.NoError(t, err)
+
+	f.now = f.now.Add(time.Minute)
+	_, err = f.apiKeys.Authenticate(issued.Key)
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKey)
+}
+
+// TestAPIKeyService_Rotate tests that the old key keeps working until the overlap ends
+func TestAPIKeyService_Rotate(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	old := f.issue(t)
+
+	f.now = f.now.Add(time.Hour)
+	rotated, err := f.apiKeys.RotateAPIKey(f.admin.ID, f.principal.ID, old.ID, service.RotateAPIKeyRequest{Overlap: 600})
+	require.NoError(t, err)
+	assert.NotEqual(t, old.Key, rotated.Key)
+
+	f.now = f.now.Add(9 * time.Minute)
+	_, err = f.apiKeys.Authenticate(old.Key)
+	require.NoError(t, err)
+
+	f.now = f.now.Add(time.Minute)
+	_, err = f.apiKeys.Authenticate(old.Key)
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKey)
+	_, err = f.apiKeys.Authenticate(rotated.Key)
+	assert.NoError(t, err)
+
+	keys, err := f.apiKeys.ListAPIKeys(f.admin.ID, f.principal.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, old.ID, keys[0].ID)
+
+	// Rotating again does not bring the expired key back
+	_, err = f.apiKeys.RotateAPIKey(f.admin.ID, f.principal.ID, old.ID, service.RotateAPIKeyRequest{})
+	require.NoError(t, err)
+	_, err = f.apiKeys.Authenticate(old.Key)
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKey)
+}
+
+// TestAPIKeyService_Revoke tests that revoked keys and the keys of deleted principals stop working
+func TestAPIKeyService_Revoke(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	revoked, kept := f.issue(t), f.issue(t)
+
+	require.NoError(t, f.apiKeys.RevokeAPIKey(f.admin.ID, f.principal.ID, revoked.ID))
+	_, err := f.apiKeys.Authenticate(revoked.Key)
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKey)
+	assert.ErrorIs(t, f.apiKeys.RevokeAPIKey(f.admin.ID, f.principal.ID, revoked.ID), repository.ErrAPIKeyNotFound)
+
+	require.NoError(t, f.apiKeys.DeleteServicePrincipal(f.admin.ID, f.principal.ID))
+	_, err = f.apiKeys.Authenticate(kept.Key)
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKey)
+	_, err = f.apiKeys.ListAPIKeys(f.admin.ID, f.principal.ID)
+	assert.ErrorIs(t, err, repository.ErrServicePrincipalNotFound)
+}
+
+// TestAPIKeyService_LastUsed tests that the last use is recorded, at most once a minute
+func TestAPIKeyService_LastUsed(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	issued := f.issue(t)
+
+	lastUsed := func() *time.Time {
+		keys, err := f.apiKeys.ListAPIKeys(f.admin.ID, f.principal.ID)
+		require.NoError(t, err)
+		return keys[0].LastUsedAt
+	}
+	assert.Nil(t, lastUsed())
+
+	used := f.now
+	_, err := f.apiKeys.Authenticate(issued.Key)
+	require.NoError(t, err)
+	require.NotNil(t, lastUsed())
+	assert.True(t, used.Equal(*lastUsed()))
+
+	f.now = f.now.Add(30 * time.Second)
+	_, err = f.apiKeys.Authenticate(issued.Key)
+	require.NoError(t, err)
+	assert.True(t, used.Equal(*lastUsed()))
+
+	f.now = f.now.Add(30 * time.Second)
+	_, err = f.apiKeys.Authenticate(issued.Key)
+	require.NoError(t, err)
+	assert.True(t, f.now.Equal(*lastUsed()))
+}
+
+// TestAPIKeyService_AdminOnly tests that only admins manage service principals and keys
+func TestAPIKeyService_AdminOnly(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse battery")
+
+	_, err := f.apiKeys.CreateServicePrincipal(user.ID, service.CreateServicePrincipalRequest{Name: "Mine"})
+	assert.ErrorIs(t, err, service.ErrAPIKeyAdminRequired)
+	_, err = f.apiKeys.ListServicePrincipals(user.ID)
+	assert.ErrorIs(t, err, service.ErrAPIKeyAdminRequired)
+	_, err = f.apiKeys.IssueAPIKey(user.ID, f.principal.ID, service.IssueAPIKeyRequest{})
+	assert.ErrorIs(t, err, service.ErrAPIKeyAdminRequired)
+}
+
+// TestAPIKeyService_InvalidRequests tests the validation of names, scopes and lifetimes
+func TestAPIKeyService_InvalidRequests(t *testing.T) {
+	f := newAPIKeyFixture(t)
+
+	_, err := f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{Name: " "})
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKeyRequest)
+	_, err = f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{Name: "Root", Scopes: []string{"users:admin"}})
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKeyRequest)
+	_, err = f.apiKeys.IssueAPIKey(f.admin.ID, f.principal.ID, service.IssueAPIKeyRequest{ExpiresIn: int64(2 * service.MaxAPIKeyTTL / time.Second)})
+	assert.ErrorIs(t, err, service.ErrInvalidAPIKeyRequest)
+	_, err = f.apiKeys.IssueAPIKey(f.admin.ID, "missing", service.IssueAPIKeyRequest{})
+	assert.ErrorIs(t, err, repository.ErrServicePrincipalNotFound)
+
+	principal, err := f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{
+		Name:   "Sync",
+		Scopes: []string{auth.ScopeUsersWrite, auth.ScopeUsersRead, auth.ScopeUsersWrite},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{auth.ScopeUsersRead, auth.ScopeUsersWrite}, principal.Scopes)
+}
+
+// TestAPIKeyService_AuthenticateCertificate tests that client certificates sign in as the principal of their subject
+func TestAPIKeyService_AuthenticateCertificate(t *testing.T) {
+	f := newAPIKeyFixture(t)
+	sync, err := f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{
+		Name:               "Sync",
+		Scopes:             []string{auth.ScopeUsersWrite},
+		CertificateSubject: " CN=sync,O=Example ",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "CN=sync,O=Example", sync.CertificateSubject)
+
+	principal, err := f.auth.AuthenticateCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "sync", Organization: []string{"Example"}}})
+	require.NoError(t, err)
+	assert.Equal(t, sync.ID, principal.ServicePrincipalID)
+	assert.Empty(t, principal.APIKeyID)
+	assert.True(t, principal.HasScope(auth.ScopeUsersWrite))
+
+	_, err = f.auth.AuthenticateCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "sync"}})
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated)
+
+	_, err = f.apiKeys.CreateServicePrincipal(f.admin.ID, service.CreateServicePrincipalRequest{Name: "Copy", CertificateSubject: "CN=sync,O=Example"})
+	assert.ErrorIs(t, err, repository.ErrDuplicateCertificateSubject)
+}
@@ -0,0 +1,464 @@
+package service_test
+
+import (
+	"Q4/internal/audit"
+	"Q4/internal/auth"
+	"Q4/internal/mail"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"fmt"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type authFixture struct {
+	store  *repository.Store
+	mailer *mail.MemoryMailer
+	audit  *audit.MemoryLogger
+	auth   *service.AuthService
+	users  service.UserServiceInterface
+	now    time.Time
+	// delays are the waits of failed sign-ins, which the fixture records instead of sleeping
+	delays []time.Duration
+}
+
+func newAuthFixture(t *testing.T) *authFixture {
+	previousCost := auth.PasswordCost
+	auth.PasswordCost = bcrypt.MinCost
+	t.Cleanup(func() { auth.PasswordCost = previousCost })
+
+	f := &authFixture{
+		store:  repository.NewSQLiteStore(newTestDB(t)),
+		mailer: mail.NewMemoryMailer(),
+		audit:  audit.NewMemoryLogger(),
+		now:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	f.auth = service.NewAuthService(f.store, f.mailer, "https://app.example.com/reset-password")
+	f.auth.Now = func() time.Time { return f.now }
+	f.auth.AccountLockout.Now = f.auth.Now
+	f.auth.IPLockout.Now = f.auth.Now
+	f.auth.Audit = f.audit
+	f.auth.Background = func(fn func()) { fn() }
+	f.auth.Sleep = func(d time.Duration) { f.delays = append(f.delays, d) }
+	f.users = &service.UserService{Repo: f.store.Users, Tx: f.store.Tx, Passwords: f.store.Passwords}
+	return f
+}
+
+func (f *authFixture) createUser(t *testing.T, email, password string) model.User {
+	t.Helper()
+	user := model.User{Name: "Ahmet", Email: email, Password: password}
+	require.NoError(t, f.users.CreateUser(nil, &user))
+	assert.Empty(t, user.Password, "the plaintext password is not kept on the user")
+	return user
+}
+
+// createAdmin signs user up and makes them an admin, as --admin-emails would
+func (f *authFixture) createAdmin(t *testing.T, user *model.User) {
+	t.Helper()
+	user.Role = ""
+	require.NoError(t, f.users.CreateUser(nil, user))
+	user.Role = model.RoleAdmin
+	require.NoError(t, f.store.Users.UpdateUser(user))
+}
+
+// testClient is the browser the tests sign in from
+var testClient = service.ClientInfo{
+	UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+	IP:        "192.0.2.10",
+}
+
+var resetLinkPattern = regexp.MustCompile(`https://app\.example\.com/reset-password\?token=\S+`)
+
+// lastResetToken extracts the token from the link in the most recent email
+func (f *authFixture) lastResetToken(t *testing.T) string {
+	t.Helper()
+	messages := f.mailer.Messages()
+	require.NotEmpty(t, messages)
+	link, err := url.Parse(resetLinkPattern.FindString(messages[len(messages)-1].Text))
+	require.NoError(t, err)
+	token := link.Query().Get("token")
+	require.NotEmpty(t, token)
+	return token
+}
+
+// TestAuthService_Login tests that only the right password yields a session token
+func TestAuthService_Login(t *testing.T) {
+	f := newAuthFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	require.NoError(t, f.users.CreateUser(nil, &model.User{Name: "No Password", Email: "nopass@example.com"}))
+
+	_, err := f.auth.Login("ahmet@example.com", "wrong horse", testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidCredentials)
+	_, err = f.auth.Login("nobody@example.com", "correct horse", testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidCredentials)
+	_, err = f.auth.Login("nopass@example.com", "", testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidCredentials)
+
+	result, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, result.User.ID)
+	assert.Equal(t, f.now.Add(service.DefaultSessionTTL), result.ExpiresAt)
+
+	principal, err := f.auth.Authenticate(result.Token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, principal.UserID)
+
+	require.NoError(t, f.auth.Logout(principal))
+	_, err = f.auth.Authenticate(result.Token)
+	assert.ErrorIs(t, err, service.ErrInvalidSession)
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated)
+}
+
+// TestAuthService_SessionExpiry tests that sessions stop working after their TTL
+func TestAuthService_SessionExpiry(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+
+	result, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+
+	f.now = f.now.Add(service.DefaultSessionTTL)
+	_, err = f.auth.Authenticate(result.Token)
+	assert.ErrorIs(t, err, service.ErrInvalidSession)
+}
+
+// TestAuthService_WeakPasswordOnCreate tests that a rejected password does not leave a user behind
+func TestAuthService_WeakPasswordOnCreate(t *testing.T) {
+	f := newAuthFixture(t)
+
+	err := f.users.CreateUser(nil, &model.User{Name: "Ahmet", Email: "ahmet@example.com", Password: "short"})
+	assert.ErrorIs(t, err, auth.ErrWeakPassword)
+
+	_, err = f.store.Users.GetUserByEmail("ahmet@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+// TestAuthService_ResetPassword tests the full reset flow: single-use token, new password,
+// revoked sessions and a verified email
+func TestAuthService_ResetPassword(t *testing.T) {
+	f := newAuthFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+
+	first, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	second, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+
+	require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.1"))
+	messages := f.mailer.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "ahmet@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Text, "The link expires in 1 hour and works once.")
+	token := f.lastResetToken(t)
+
+	err = f.auth.ResetPassword(token, "short", "10.0.0.1")
+	assert.ErrorIs(t, err, auth.ErrWeakPassword)
+
+	require.NoError(t, f.auth.ResetPassword(token, "battery staple", "10.0.0.1"), "a weak password does not use up the token")
+	err = f.auth.ResetPassword(token, "another staple", "10.0.0.1")
+	assert.ErrorIs(t, err, service.ErrInvalidResetToken, "tokens work once")
+
+	for _, session := range []*service.LoginResult{first, second} {
+		_, err := f.auth.Authenticate(session.Token)
+		assert.ErrorIs(t, err, service.ErrInvalidSession, "existing sessions are revoked")
+	}
+
+	_, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidCredentials)
+	_, err = f.auth.Login("ahmet@example.com", "battery staple", testClient)
+	assert.NoError(t, err)
+
+	stored, err := f.store.Users.GetUserByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.EmailVerified, "following the emailed link verifies the address")
+}
+
+// TestAuthService_ResetRevokesCredentials tests that a reset also revokes the OAuth tokens of the
+// user and the API keys of the principals they created
+func TestAuthService_ResetRevokesCredentials(t *testing.T) {
+	f := newAuthFixture(t)
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Password: "correct horse"}
+	f.createAdmin(t, &admin)
+	other := f.createUser(t, "ahmet@example.com", "correct horse")
+
+	require.NoError(t, f.store.OAuth.CreateOAuthClient(&model.OAuthClient{ID: "wiki", Name: "Wiki", CreatedAt: f.now}))
+	for hash, userID := range map[string]int{"admin-token": admin.ID, "other-token": other.ID} {
+		token := model.OAuthToken{TokenHash: hash, ClientID: "wiki", UserID: userID, Scope: "openid", IssuedAt: f.now, ExpiresAt: f.now.Add(time.Hour)}
+		require.NoError(t, f.store.OAuth.CreateOAuthToken(token))
+	}
+	require.NoError(t, f.store.APIKeys.CreateServicePrincipal(&model.ServicePrincipal{ID: "export", Name: "Export", CreatedBy: admin.ID, CreatedAt: f.now}))
+	key := model.APIKey{ID: "k1", ServicePrincipalID: "export", Prefix: "a1b2c3d4", KeyHash: "hash", CreatedAt: f.now, ExpiresAt: f.now.Add(time.Hour)}
+	require.NoError(t, f.store.APIKeys.CreateAPIKey(&key))
+
+	require.NoError(t, f.auth.ForgotPassword(admin.Email, "10.0.0.1"))
+	require.NoError(t, f.auth.ResetPassword(f.lastResetToken(t), "battery staple", "10.0.0.1"))
+
+	_, err := f.store.OAuth.GetOAuthToken("admin-token")
+	assert.ErrorIs(t, err, repository.ErrOAuthTokenNotFound)
+	_, err = f.store.OAuth.GetOAuthToken("other-token")
+	assert.NoError(t, err, "other users keep their tokens")
+	_, err = f.store.APIKeys.GetAPIKeyByPrefix("a1b2c3d4")
+	assert.ErrorIs(t, err, repository.ErrAPIKeyNotFound)
+	_, err = f.store.APIKeys.GetServicePrincipal("export")
+	assert.NoError(t, err, "the principal stays so that a new key can be issued")
+}
+
+// TestAuthService_ResetTokenExpiry tests that expired tokens and tokens superseded by a reset are rejected
+func TestAuthService_ResetTokenExpiry(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+
+	require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.1"))
+	expired := f.lastResetToken(t)
+	f.now = f.now.Add(service.DefaultPasswordResetTTL)
+	err := f.auth.ResetPassword(expired, "battery staple", "10.0.0.1")
+	assert.ErrorIs(t, err, service.ErrInvalidResetToken)
+
+	require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.1"))
+	older := f.lastResetToken(t)
+	require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.1"))
+	newer := f.lastResetToken(t)
+
+	require.NoError(t, f.auth.ResetPassword(newer, "battery staple", "10.0.0.1"))
+	err = f.auth.ResetPassword(older, "another staple", "10.0.0.1")
+	assert.ErrorIs(t, err, service.ErrInvalidResetToken, "a reset invalidates the user's other tokens")
+}
+
+// TestAuthService_ForgotPasswordLimits tests that unknown and throttled addresses answer like known ones,
+// while a flood from one address is refused
+func TestAuthService_ForgotPasswordLimits(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+
+	require.NoError(t, f.auth.ForgotPassword("nobody@example.com", "10.0.0.1"))
+	assert.Empty(t, f.mailer.Messages())
+
+	for range 5 {
+		require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.2"))
+	}
+	assert.Len(t, f.mailer.Messages(), 3, "emails beyond the per-account limit are dropped silently")
+
+	f.auth.ForgotPerIP.Limit = 2
+	require.NoError(t, f.auth.ForgotPassword("nobody@example.com", "10.0.0.3"))
+	require.NoError(t, f.auth.ForgotPassword("nobody@example.com", "10.0.0.3"))
+	err := f.auth.ForgotPassword("nobody@example.com", "10.0.0.3")
+	require.ErrorIs(t, err, service.ErrRateLimited)
+	var limited *service.RateLimitError
+	require.ErrorAs(t, err, &limited)
+	assert.Positive(t, limited.RetryAfter)
+}
+
+// auditTypes returns the types of the audit events recorded so far
+func (f *authFixture) auditTypes() []string {
+	var types []string
+	for _, event := range f.audit.Events() {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// TestAuthService_AccountLockout tests that repeated failures slow down and then lock out an account,
+// the same way for unknown addresses
+func TestAuthService_AccountLockout(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+
+	for i, email := range []string{"ahmet@example.com", "nobody@example.com"} {
+		// Each account is attacked from its own address, so that only the account counts the failures
+		client := service.ClientInfo{IP: fmt.Sprintf("198.51.100.%d", i)}
+		f.delays = nil
+		for range service.DefaultLockoutThreshold {
+			_, err := f.auth.Login(email, "wrong horse", client)
+			require.ErrorIs(t, err, service.ErrInvalidCredentials)
+		}
+		assert.Equal(t, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second}, f.delays)
+
+		_, err := f.auth.Login(email, "correct horse", client)
+		var limited *service.RateLimitError
+		require.ErrorAs(t, err, &limited, "a locked account refuses even the right password")
+		assert.Equal(t, service.DefaultLockoutDuration, limited.RetryAfter)
+	}
+	_, err := f.auth.Login("AHMET@example.com ", "correct horse", testClient)
+	assert.ErrorIs(t, err, service.ErrRateLimited, "the lockout does not depend on how the address is typed")
+
+	f.now = f.now.Add(service.DefaultLockoutDuration)
+	_, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+
+	for range service.DefaultLockoutThreshold {
+		_, err = f.auth.Login("nobody@example.com", "wrong horse", testClient)
+		require.ErrorIs(t, err, service.ErrInvalidCredentials)
+	}
+	_, err = f.auth.Login("nobody@example.com", "wrong horse", testClient)
+	var limited *service.RateLimitError
+	require.ErrorAs(t, err, &limited)
+	assert.Equal(t, 2*service.DefaultLockoutDuration, limited.RetryAfter, "locking out again soon after doubles the lockout")
+
+	types := f.auditTypes()
+	assert.Contains(t, types, audit.AccountLocked)
+	assert.Contains(t, types, audit.LoginBlocked)
+	assert.Equal(t, 3*service.DefaultLockoutThreshold, countOf(types, audit.LoginFailed))
+}
+
+func countOf(values []string, value string) int {
+	n := 0
+	for _, v := range values {
+		if v == value {
+			n++
+		}
+	}
+	return n
+}
+
+// TestAuthService_SuccessResetsFailures tests that signing in or resetting the password forgives earlier failures
+func TestAuthService_SuccessResetsFailures(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+
+	for range 3 {
+		for range service.DefaultLockoutThreshold - 1 {
+			_, err := f.auth.Login("ahmet@example.com", "wrong horse", testClient)
+			require.ErrorIs(t, err, service.ErrInvalidCredentials)
+		}
+		_, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+		require.NoError(t, err)
+	}
+
+	for range service.DefaultLockoutThreshold {
+		_, _ = f.auth.Login("ahmet@example.com", "wrong horse", testClient)
+	}
+	require.NoError(t, f.auth.ForgotPassword("ahmet@example.com", "10.0.0.1"))
+	require.NoError(t, f.auth.ResetPassword(f.lastResetToken(t), "battery staple", "10.0.0.1"))
+	_, err := f.auth.Login("ahmet@example.com", "battery staple", testClient)
+	assert.NoError(t, err)
+}
+
+// TestAuthService_IPLockout tests that one address guessing across many accounts gets locked out
+func TestAuthService_IPLockout(t *testing.T) {
+	f := newAuthFixture(t)
+	f.createUser(t, "ahmet@example.com", "correct horse")
+	f.auth.IPLockout.Threshold = 3
+	attacker := service.ClientInfo{IP: "203.0.113.9"}
+
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		_, err := f.auth.Login(email, "123456", attacker)
+		require.ErrorIs(t, err, service.ErrInvalidCredentials)
+	}
+	_, err := f.auth.Login("ahmet@example.com", "correct horse", attacker)
+	assert.ErrorIs(t, err, service.ErrRateLimited)
+	_, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	assert.NoError(t, err, "other addresses are not affected")
+	assert.Contains(t, f.auditTypes(), audit.IPLocked)
+}
+
+// TestAuthService_Unlock tests that admins, and only admins, lift lockouts
+func TestAuthService_Unlock(t *testing.T) {
+	f := newAuthFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	admin := model.User{Name: "Admin", Email: "admin@example.com", Role: model.RoleAdmin}
+	f.createAdmin(t, &admin)
+	f.auth.IPLockout.Threshold = service.DefaultLockoutThreshold
+
+	for range service.DefaultLockoutThreshold {
+		_, _ = f.auth.Login("Ahmet@Example.com", "wrong horse", testClient)
+	}
+	_, err := f.auth.Login("ahmet@example.com", "correct horse", service.ClientInfo{IP: "198.51.100.1"})
+	require.ErrorIs(t, err, service.ErrRateLimited)
+
+	_, err = f.auth.UnlockAccount(user.ID, user.ID)
+	assert.ErrorIs(t, err, service.ErrUnlockDenied, "users cannot lift their own lockout")
+	_, err = f.auth.UnlockAccount(admin.ID, user.ID+1000)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	unlocked, err := f.auth.UnlockAccount(admin.ID, user.ID)
+	require.NoError(t, err)
+	assert.True(t, unlocked)
+	unlocked, err = f.auth.UnlockAccount(admin.ID, user.ID)
+	require.NoError(t, err)
+	assert.False(t, unlocked, "there is nothing left to unlock")
+
+	_, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.ErrorIs(t, err, service.ErrRateLimited, "the address that failed is still locked")
+	unlocked, err = f.auth.UnlockIP(admin.ID, testClient.IP)
+	require.NoError(t, err)
+	assert.True(t, unlocked)
+	_, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+
+	events := f.audit.Events()
+	last := events[len(events)-1]
+	assert.Equal(t, audit.IPUnlocked, last.Type)
+	assert.Equal(t, admin.ID, last.ActorID)
+}
+
+// TestAuth_UserOwnership tests that users may only change and delete themselves unless they are
+// admins, and that changing their own email takes their current password
+func TestAuth_UserOwnership(t *testing.T) {
+	f := newAuthFixture(t)
+	victim := f.createUser(t, "ahmet@example.com", "correct horse")
+	attacker := f.createUser(t, "eve@example.com", "battery staple")
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com"}
+	f.createAdmin(t, &admin)
+
+	takeover := victim
+	takeover.Email = "eve+ahmet@example.com"
+	assert.ErrorIs(t, f.users.UpdateUser(nil, &takeover), auth.ErrUnauthenticated)
+	assert.ErrorIs(t, f.users.UpdateUser(&auth.Principal{UserID: attacker.ID}, &takeover), service.ErrUserAccessDenied)
+	assert.ErrorIs(t, f.users.DeleteUser(nil, victim.ID), auth.ErrUnauthenticated)
+	assert.ErrorIs(t, f.users.DeleteUser(&auth.Principal{UserID: attacker.ID}, victim.ID), service.ErrUserAccessDenied)
+
+	owner := &auth.Principal{UserID: victim.ID}
+	assert.ErrorIs(t, f.users.UpdateUser(owner, &takeover), service.ErrPasswordConfirmation, "a session alone cannot move the account")
+	takeover.CurrentPassword = "wrong horse"
+	assert.ErrorIs(t, f.users.UpdateUser(owner, &takeover), service.ErrPasswordConfirmation)
+	stored, err := f.store.Users.GetUserByID(victim.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ahmet@example.com", stored.Email)
+
+	rename := victim
+	rename.Name = "Ahmet Y."
+	require.NoError(t, f.users.UpdateUser(owner, &rename), "other fields need no password")
+	moved := rename
+	moved.Email = "ahmet.new@example.com"
+	moved.CurrentPassword = "correct horse"
+	require.NoError(t, f.users.UpdateUser(owner, &moved))
+	assert.Empty(t, moved.CurrentPassword)
+
+	moved.Email = "ahmet@example.com"
+	require.NoError(t, f.users.UpdateUser(&auth.Principal{UserID: admin.ID}, &moved), "admins change other users without their password")
+	require.NoError(t, f.users.DeleteUser(&auth.Principal{UserID: attacker.ID}, attacker.ID))
+}
+
+// TestAuth_APIKeyCannotMoveAdmin tests that an API key allowed to write users cannot move an
+// admin to an address it controls and take the account over with a password reset
+func TestAuth_APIKeyCannotMoveAdmin(t *testing.T) {
+	f := newAuthFixture(t)
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Password: "correct horse"}
+	f.createAdmin(t, &admin)
+	member := f.createUser(t, "ahmet@example.com", "correct horse")
+	key := &auth.Principal{ServicePrincipalID: "sp_sync", Scopes: []string{auth.ScopeUsersWrite}}
+
+	takeover := admin
+	takeover.Email = "eve@example.com"
+	assert.ErrorIs(t, f.users.UpdateUser(key, &takeover), service.ErrAdminEmailDenied)
+	stored, err := f.store.Users.GetUserByID(admin.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ayse@example.com", stored.Email)
+
+	require.NoError(t, f.auth.ForgotPassword("eve@example.com", "10.0.0.1"))
+	assert.Empty(t, f.mailer.Messages(), "no reset link reaches the attacker")
+
+	rename := admin
+	rename.Name = "Ayse Y."
+	require.NoError(t, f.users.UpdateUser(key, &rename), "other fields of admins stay writable")
+	moved := member
+	moved.Email = "ahmet.new@example.com"
+	require.NoError(t, f.users.UpdateUser(key, &moved), "keys may still move users who are not admins")
+}
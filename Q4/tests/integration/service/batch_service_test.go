@@ -0,0 +1,257 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBatchService_AtomicRollback tests that one failing operation undoes the whole batch
+func TestBatchService_AtomicRollback(t *testing.T) {
+	db := newTestDB(t)
+	repo := repository.NewSQLUserRepository(db)
+	existing := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&existing))
+
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(db))
+	resp, err := batchService.Execute(bulkWriter, service.BatchRequest{
+		Operations: []service.BatchOperation{
+			{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com"}},
+			{Op: service.OpUpdate, ID: existing.ID, User: &model.User{Name: "Ahmet Y.", Email: "ahmet@example.com"}},
+			{Op: service.OpDelete, ID: 999},
+			{Op: service.OpCreate, User: &model.User{Name: "Mehmet", Email: "mehmet@example.com"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.False(t, resp.Committed)
+	assert.Equal(t, service.BatchAtomic, resp.Mode)
+	assert.Equal(t, service.OpRolledBack, resp.Results[0].Status)
+	assert.Equal(t, service.OpRolledBack, resp.Results[1].Status)
+	assert.Equal(t, service.OpFailed, resp.Results[2].Status)
+	assert.Equal(t, service.OpSkipped, resp.Results[3].Status)
+
+	users, err := repo.GetAllUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []model.User{existing}, users)
+}
+
+// TestBatchService_BestEffort tests that failed operations are undone individually
+func TestBatchService_BestEffort(t *testing.T) {
+	db := newTestDB(t)
+	repo := repository.NewSQLUserRepository(db)
+
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(db))
+	resp, err := batchService.Execute(bulkWriter, service.BatchRequest{
+		Mode: service.BatchBestEffort,
+		Operations: []service.BatchOperation{
+			{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com"}},
+			{Op: service.OpCreate, User: &model.User{Name: "Ayse Again", Email: "ayse@example.com"}},
+			{Op: service.OpCreate, User: &model.User{Name: "", Email: "bad"}},
+			{Op: "rename"},
+			{Op: service.OpCreate, User: &model.User{Name: "Mehmet", Email: "mehmet@example.com"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, resp.Committed)
+	statuses := make([]string, len(resp.Results))
+	for i, result := range resp.Results {
+		statuses[i] = result.Status
+	}
+	assert.Equal(t, []string{service.OpSucceeded, service.OpFailed, service.OpFailed, service.OpFailed, service.OpSucceeded}, statuses)
+	assert.NotZero(t, resp.Results[0].UserID)
+
+	users, err := repo.GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+}
+
+// TestBatchService_InvalidRequest tests validation of the batch itself
+func TestBatchService_InvalidRequest(t *testing.T) {
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(newTestDB(t)))
+
+	_, err := batchService.Execute(bulkWriter, service.BatchRequest{})
+	assert.ErrorIs(t, err, service.ErrInvalidBatch)
+
+	_, err = batchService.Execute(bulkWriter, service.BatchRequest{Mode: "eventually", Operations: []service.BatchOperation{{Op: service.OpDelete, ID: 1}}})
+	assert.ErrorIs(t, err, service.ErrInvalidBatch)
+}
+
+// TestBatchService_Authorization tests that only admins and service principals may run batches,
+// and that only admins may change roles in them
+func TestBatchService_Authorization(t *testing.T) {
+	db := newTestDB(t)
+	repo := repository.NewSQLUserRepository(db)
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	member := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&admin))
+	require.NoError(t, repo.CreateUser(&member))
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(db))
+	rename := service.BatchRequest{Operations: []service.BatchOperation{
+		{Op: service.OpUpdate, ID: admin.ID, User: &model.User{Name: "Eve", Email: "eve@example.com"}},
+	}}
+
+	_, err := batchService.Execute(nil, rename)
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated)
+	_, err = batchService.Execute(&auth.Principal{UserID: member.ID}, rename)
+	assert.ErrorIs(t, err, service.ErrUserAccessDenied)
+
+	promote := service.BatchRequest{Operations: []service.BatchOperation{
+		{Op: service.OpUpdate, ID: member.ID, User: &model.User{Name: "Ahmet", Email: "ahmet@example.com", Role: model.RoleAdmin}},
+	}}
+	resp, err := batchService.Execute(bulkWriter, promote)
+	require.NoError(t, err)
+	assert.False(t, resp.Committed, "service principals may not change roles")
+	resp, err = batchService.Execute(&auth.Principal{UserID: admin.ID}, promote)
+	require.NoError(t, err)
+	assert.True(t, resp.Committed)
+
+	moveAdmin := service.BatchRequest{Operations: []service.BatchOperation{
+		{Op: service.OpUpdate, ID: admin.ID, User: &model.User{Name: "Ayse", Email: "eve@example.com"}},
+	}}
+	resp, err = batchService.Execute(bulkWriter, moveAdmin)
+	require.NoError(t, err)
+	assert.False(t, resp.Committed, "service principals may not change the email of an admin")
+	assert.Equal(t, service.ErrAdminEmailDenied.Error(), resp.Results[0].Error)
+	resp, err = batchService.Execute(&auth.Principal{UserID: admin.ID}, moveAdmin)
+	require.NoError(t, err)
+	assert.True(t, resp.Committed)
+}
+
+// pending returns the events sub has received so far
+func pending(sub *service.UserSubscription) []model.UserEvent {
+	var events []model.UserEvent
+	for {
+		select {
+		case event := <-sub.Events():
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// TestBatchService_Events tests that committed batches are announced and rolled back ones are not
+func TestBatchService_Events(t *testing.T) {
+	db := newTestDB(t)
+	repo := repository.NewSQLUserRepository(db)
+	existing := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&existing))
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(db))
+	batchService.Events = service.NewUserEvents(0)
+	sub := batchService.Events.Subscribe(0)
+	defer sub.Close()
+
+	_, err := batchService.Execute(bulkWriter, service.BatchRequest{Operations: []service.BatchOperation{
+		{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com"}},
+		{Op: service.OpDelete, ID: 999},
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, pending(sub), "rolled back batches are not announced")
+
+	resp, err := batchService.Execute(bulkWriter, service.BatchRequest{Mode: service.BatchBestEffort, Operations: []service.BatchOperation{
+		{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com"}},
+		{Op: service.OpCreate, User: &model.User{Name: "Ayse Again", Email: "ayse@example.com"}},
+		{Op: service.OpUpdate, ID: existing.ID, User: &model.User{Name: "Ahmet Y.", Email: "ahmet@example.com"}},
+		{Op: service.OpDelete, ID: existing.ID},
+	}})
+	require.NoError(t, err)
+	require.True(t, resp.Committed)
+
+	events := pending(sub)
+	require.Len(t, events, 2, "failed operations and users gone by the commit are not announced")
+	assert.Equal(t, model.UserCreated, events[0].Type)
+	assert.Equal(t, resp.Results[0].UserID, events[0].User.ID)
+	assert.Equal(t, model.RoleUser, events[0].User.Role, "users are announced as stored")
+	assert.Equal(t, model.UserDeleted, events[1].Type)
+	assert.Equal(t, "Ahmet Y.", events[1].User.Name, "deleted users are announced as they were")
+}
+
+// TestBatchService_Passwords tests that passwords of created users are stored hashed, and that
+// rejected passwords fail their operation
+func TestBatchService_Passwords(t *testing.T) {
+	db := newTestDB(t)
+	repo := repository.NewSQLUserRepository(db)
+	existing := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&existing))
+	batchService := service.NewBatchService(repository.NewSQLUnitOfWork(db))
+
+	resp, err := batchService.Execute(bulkWriter, service.BatchRequest{Mode: service.BatchBestEffort, Operations: []service.BatchOperation{
+		{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: "ayse@example.com", Password: "correct horse"}},
+		{Op: service.OpCreate, User: &model.User{Name: "Mehmet", Email: "mehmet@example.com", Password: "short"}},
+		{Op: service.OpUpdate, ID: existing.ID, User: &model.User{Name: "Ahmet", Email: "ahmet@example.com", Password: "correct horse"}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, service.OpSucceeded, resp.Results[0].Status)
+	assert.Equal(t, service.OpFailed, resp.Results[1].Status)
+	assert.Contains(t, resp.Results[1].Error, auth.ErrWeakPassword.Error())
+	assert.Equal(t, service.OpFailed, resp.Results[2].Status, "passwords are not changed through batches")
+
+	hash, err := repository.NewSQLPasswordRepository(db).GetPasswordHash(resp.Results[0].UserID)
+	require.NoError(t, err)
+	assert.True(t, auth.CheckPassword(hash, "correct horse"))
+	_, err = repository.NewSQLPasswordRepository(db).GetPasswordHash(existing.ID)
+	assert.Error(t, err)
+}
+
+// busyError looks like SQLITE_BUSY to repository.IsBusy
+type busyError struct{}
+
+func (busyError) Error() string { return "database is locked" }
+func (busyError) Code() int     { return 5 }
+
+// busyUserRepository fails the first creates with busyError, as a database locked by another writer would
+type busyUserRepository struct {
+	repository.UserRepository
+	failures *int
+}
+
+func (r *busyUserRepository) CreateUser(user *model.User) error {
+	if *r.failures > 0 {
+		*r.failures--
+		return busyError{}
+	}
+	return r.UserRepository.CreateUser(user)
+}
+
+// TestBatchService_RetriesBusy tests that a busy database retries the batch instead of failing it
+func TestBatchService_RetriesBusy(t *testing.T) {
+	db := newTestDB(t)
+	failures := 1
+	manager := repository.NewSQLTxManager(db)
+	manager.RetryDelay = time.Millisecond
+	bind := manager.Bind
+	manager.Bind = func(tx *sql.Tx) repository.Repositories {
+		repos := bind(tx)
+		repos.Users = &busyUserRepository{UserRepository: repos.Users, failures: &failures}
+		return repos
+	}
+	batchService := service.NewBatchService(repository.NewTxUnitOfWork(manager))
+
+	for _, mode := range []string{service.BatchAtomic, service.BatchBestEffort} {
+		failures = 1
+		resp, err := batchService.Execute(bulkWriter, service.BatchRequest{Mode: mode, Operations: []service.BatchOperation{
+			{Op: service.OpCreate, User: &model.User{Name: "Ayse", Email: mode + "-ayse@example.com"}},
+			{Op: service.OpCreate, User: &model.User{Name: "Mehmet", Email: mode + "-mehmet@example.com"}},
+		}})
+		require.NoError(t, err, mode)
+		assert.Zero(t, failures, mode)
+		assert.True(t, resp.Committed, mode)
+		for _, result := range resp.Results {
+			assert.Equal(t, service.OpSucceeded, result.Status, mode)
+			assert.Empty(t, result.Error, mode)
+		}
+	}
+
+	users, err := repository.NewSQLUserRepository(db).GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 4)
+}
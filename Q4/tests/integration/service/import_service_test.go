@@ -0,0 +1,178 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/database"
+	"Q4/internal/importer"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := database.Open(filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// bulkWriter is an API key allowed to write users, as imports and batches require
+var bulkWriter = &auth.Principal{ServicePrincipalID: "sp_sync", Scopes: []string{auth.ScopeUsersWrite}}
+
+// TestImportService_CSVWithMapping tests upsert-by-email semantics and row validation
+func TestImportService_CSVWithMapping(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+	require.NoError(t, repo.CreateUser(&model.User{Name: "Old Name", Email: "ahmet@example.com"}))
+
+	mapping, err := importer.ParseColumnMapping("name:Full Name,email:Mail")
+	require.NoError(t, err)
+
+	csv := "Full Name,Mail,Team\n" +
+		"Ahmet,ahmet@example.com,core\n" +
+		"Ayse,ayse@example.com,core\n" +
+		",missing@example.com,core\n" +
+		"Mehmet,not-an-email,core\n" +
+		"Ayse Again,ayse@example.com,core\n"
+
+	importService := service.NewImportService(repo)
+	report, err := importService.Import(bulkWriter, strings.NewReader(csv), service.ImportOptions{
+		Format:    importer.FormatCSV,
+		Mapping:   mapping,
+		BatchSize: 2,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, report.Total)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, 3, report.Invalid)
+	assert.Equal(t, service.RowUpdated, report.Results[0].Status)
+	assert.Equal(t, service.RowCreated, report.Results[1].Status)
+	assert.Contains(t, report.Results[2].Errors, "name is required")
+	assert.Contains(t, report.Results[3].Errors, "email is not a valid address")
+	assert.Equal(t, service.RowInvalid, report.Results[4].Status)
+
+	updated, err := repo.GetUserByEmail("ahmet@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Ahmet", updated.Name)
+
+	users, err := repo.GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+}
+
+// TestImportService_Events tests that stored rows are announced and dry runs are not
+func TestImportService_Events(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+	require.NoError(t, repo.CreateUser(&model.User{Name: "Old Name", Email: "ahmet@example.com"}))
+	importService := service.NewImportService(repo)
+	importService.Events = service.NewUserEvents(0)
+	sub := importService.Events.Subscribe(0)
+	defer sub.Close()
+
+	csv := "name,email\nAhmet,ahmet@example.com\nAyse,ayse@example.com\n,invalid@example.com\n"
+	_, err := importService.Import(bulkWriter, strings.NewReader(csv), service.ImportOptions{Format: importer.FormatCSV, DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, pending(sub))
+
+	_, err = importService.Import(bulkWriter, strings.NewReader(csv), service.ImportOptions{Format: importer.FormatCSV, BatchSize: 1})
+	require.NoError(t, err)
+	events := pending(sub)
+	require.Len(t, events, 2)
+	assert.Equal(t, model.UserUpdated, events[0].Type)
+	assert.Equal(t, "Ahmet", events[0].User.Name)
+	assert.Equal(t, model.UserCreated, events[1].Type)
+	assert.Equal(t, "ayse@example.com", events[1].User.Email)
+}
+
+// TestImportService_DryRun tests that a dry run reports outcomes without writing
+func TestImportService_DryRun(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+	require.NoError(t, repo.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"}))
+
+	ndjson := `{"name": "Ahmet", "email": "ahmet@example.com"}
+{"name": "Ayse", "email": "ayse@example.com"}
+{not json}
+`
+	importService := service.NewImportService(repo)
+	report, err := importService.Import(bulkWriter, strings.NewReader(ndjson), service.ImportOptions{
+		Format: importer.FormatNDJSON,
+		DryRun: true,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Invalid)
+
+	users, err := repo.GetAllUsers()
+	require.NoError(t, err)
+	assert.Len(t, users, 1)
+}
+
+// TestImportService_MissingColumn tests that an unmapped header aborts the import
+func TestImportService_MissingColumn(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+
+	importService := service.NewImportService(repo)
+	_, err := importService.Import(bulkWriter, strings.NewReader("name,mail\nAhmet,ahmet@example.com\n"), service.ImportOptions{
+		Format: importer.FormatCSV,
+	})
+	assert.ErrorIs(t, err, importer.ErrMissingColumn)
+}
+
+// TestImportService_AsyncJob tests that a background job reports progress and its final report
+func TestImportService_AsyncJob(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+
+	var csv strings.Builder
+	csv.WriteString("name,email\n")
+	for i := 0; i < 25; i++ {
+		csv.WriteString("User,user" + string(rune('a'+i)) + "@example.com\n")
+	}
+
+	importService := service.NewImportService(repo)
+	job, err := importService.StartImportJob(bulkWriter, strings.NewReader(csv.String()), service.ImportOptions{
+		Format:    importer.FormatCSV,
+		BatchSize: 10,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, err = importService.GetImportJob(job.ID)
+		return err == nil && job.Status == service.JobCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 25, job.Processed)
+	assert.Equal(t, 25, job.Report.Created)
+
+	_, err = importService.GetImportJob("unknown")
+	assert.ErrorIs(t, err, service.ErrImportJobNotFound)
+}
+
+// TestImportService_Authorization tests that only admins and service principals may import
+func TestImportService_Authorization(t *testing.T) {
+	repo := repository.NewSQLUserRepository(newTestDB(t))
+	member := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, repo.CreateUser(&member))
+	importService := service.NewImportService(repo)
+	csv := "name,email\nAyse,ahmet@example.com\n"
+
+	_, err := importService.Import(nil, strings.NewReader(csv), service.ImportOptions{Format: importer.FormatCSV})
+	assert.ErrorIs(t, err, auth.ErrUnauthenticated)
+	_, err = importService.StartImportJob(&auth.Principal{UserID: member.ID}, strings.NewReader(csv), service.ImportOptions{Format: importer.FormatCSV})
+	assert.ErrorIs(t, err, service.ErrUserAccessDenied)
+
+	got, err := repo.GetUserByID(member.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Ahmet", got.Name)
+}
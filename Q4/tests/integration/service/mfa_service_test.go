@@ -0,0 +1,175 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mfaFixture struct {
+	*authFixture
+	signer *auth.Signer
+	mfa    *service.MFAService
+}
+
+func newMFAFixture(t *testing.T) *mfaFixture {
+	f := &mfaFixture{authFixture: newAuthFixture(t), signer: auth.NewSigner("test-secret")}
+	f.signer.Now = func() time.Time { return f.now }
+	f.mfa = service.NewMFAService(f.store, f.signer, "Q4", []string{model.RoleAdmin})
+	f.mfa.Now = func() time.Time { return f.now }
+	f.auth.MFA = f.mfa
+	return f
+}
+
+// code returns the current TOTP code for secret and moves the clock to the next period,
+// since each code is accepted once
+func (f *mfaFixture) code(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := auth.TOTPCode(secret, auth.TOTPStep(f.now))
+	require.NoError(t, err)
+	f.now = f.now.Add(auth.TOTPPeriod)
+	return code
+}
+
+// enroll turns MFA on for user and returns the secret and recovery codes
+func (f *mfaFixture) enroll(t *testing.T, userID int) (string, []string) {
+	t.Helper()
+	setup, err := f.mfa.BeginEnrollment(userID)
+	require.NoError(t, err)
+	codes, err := f.mfa.ConfirmEnrollment(userID, f.code(t, setup.Secret))
+	require.NoError(t, err)
+	return setup.Secret, codes
+}
+
+// TestMFA_EnrollAndSignIn tests that confirmed MFA turns login into a two-step flow
+func TestMFA_EnrollAndSignIn(t *testing.T) {
+	f := newMFAFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+
+	setup, err := f.mfa.BeginEnrollment(user.ID)
+	require.NoError(t, err)
+	assert.Contains(t, setup.URI, "otpauth://totp/Q4:ahmet@example.com?")
+	assert.Contains(t, setup.QRCode, "data:image/png;base64,")
+
+	result, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.Token, "a pending enrollment does not guard sign-in")
+
+	_, err = f.mfa.ConfirmEnrollment(user.ID, "000000")
+	assert.ErrorIs(t, err, service.ErrInvalidMFACode)
+	codes, err := f.mfa.ConfirmEnrollment(user.ID, f.code(t, setup.Secret))
+	require.NoError(t, err)
+	assert.Len(t, codes, auth.RecoveryCodeCount)
+
+	_, err = f.mfa.BeginEnrollment(user.ID)
+	assert.ErrorIs(t, err, service.ErrMFAAlreadyEnabled, "a password alone cannot replace the authenticator")
+
+	result, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.True(t, result.MFARequired)
+	assert.False(t, result.MFAEnrollmentRequired)
+	assert.Empty(t, result.Token)
+	assert.Nil(t, result.User)
+
+	code := f.code(t, setup.Secret)
+	session, err := f.auth.VerifyMFA(result.MFAToken, code, testClient)
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.Token)
+	assert.Equal(t, user.ID, session.User.ID)
+
+	_, err = f.auth.VerifyMFA(result.MFAToken, code, testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidMFACode, "codes cannot be replayed")
+
+	f.now = f.now.Add(service.DefaultMFAChallengeTTL)
+	_, err = f.auth.VerifyMFA(result.MFAToken, f.code(t, setup.Secret), testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidMFAChallenge, "MFA tokens expire")
+}
+
+// TestMFA_RecoveryCodes tests that each recovery code signs in once and that regenerating replaces them
+func TestMFA_RecoveryCodes(t *testing.T) {
+	f := newMFAFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	secret, codes := f.enroll(t, user.ID)
+
+	result, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	_, err = f.auth.VerifyMFA(result.MFAToken, codes[0], testClient)
+	require.NoError(t, err)
+	_, err = f.auth.VerifyMFA(result.MFAToken, codes[0], testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidMFACode, "recovery codes work once")
+
+	status, err := f.mfa.Status(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, service.MFAStatus{Enabled: true, RecoveryCodesLeft: auth.RecoveryCodeCount - 1}, *status)
+
+	_, err = f.mfa.RegenerateRecoveryCodes(user.ID, "000000")
+	assert.ErrorIs(t, err, service.ErrInvalidMFACode)
+	fresh, err := f.mfa.RegenerateRecoveryCodes(user.ID, f.code(t, secret))
+	require.NoError(t, err)
+	_, err = f.auth.VerifyMFA(result.MFAToken, codes[1], testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidMFACode, "regenerating invalidates the old codes")
+	_, err = f.auth.VerifyMFA(result.MFAToken, fresh[0], testClient)
+	assert.NoError(t, err)
+
+	require.NoError(t, f.mfa.Disable(user.ID, f.code(t, secret)))
+	result, err = f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.Token, "disabling MFA restores password-only sign-in")
+}
+
+// TestMFA_RequiredRole tests that the policy forces enrollment during sign-in and keeps MFA on
+func TestMFA_RequiredRole(t *testing.T) {
+	f := newMFAFixture(t)
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin, Password: "correct horse"}
+	f.createAdmin(t, &admin)
+
+	result, err := f.auth.Login("ayse@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.True(t, result.MFARequired)
+	assert.True(t, result.MFAEnrollmentRequired)
+	assert.Empty(t, result.Token)
+
+	_, err = f.auth.VerifyMFA(result.MFAToken, "123456", testClient)
+	assert.ErrorIs(t, err, service.ErrMFANotEnabled, "the authenticator has to be set up first")
+
+	userID, err := f.mfa.EnrollmentChallengeUser(result.MFAToken)
+	require.NoError(t, err)
+	assert.Equal(t, admin.ID, userID)
+	setup, err := f.mfa.BeginEnrollment(userID)
+	require.NoError(t, err)
+
+	session, err := f.auth.VerifyMFA(result.MFAToken, f.code(t, setup.Secret), testClient)
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.Token)
+	assert.Len(t, session.RecoveryCodes, auth.RecoveryCodeCount)
+
+	err = f.mfa.Disable(admin.ID, f.code(t, setup.Secret))
+	assert.ErrorIs(t, err, service.ErrMFARequiredByPolicy)
+
+	result, err = f.auth.Login("ayse@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	assert.False(t, result.MFAEnrollmentRequired)
+	_, err = f.mfa.EnrollmentChallengeUser(result.MFAToken)
+	assert.ErrorIs(t, err, service.ErrInvalidMFAChallenge, "only enrollment tokens authorize enrollment")
+}
+
+// TestMFA_AttemptLimit tests that guessing codes is cut off per user
+func TestMFA_AttemptLimit(t *testing.T) {
+	f := newMFAFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	secret, _ := f.enroll(t, user.ID)
+
+	result, err := f.auth.Login("ahmet@example.com", "correct horse", testClient)
+	require.NoError(t, err)
+	for range 5 {
+		_, err := f.auth.VerifyMFA(result.MFAToken, "000000", testClient)
+		require.ErrorIs(t, err, service.ErrInvalidMFACode)
+	}
+	_, err = f.auth.VerifyMFA(result.MFAToken, f.code(t, secret), testClient)
+	assert.ErrorIs(t, err, service.ErrRateLimited, "even a correct code is refused once the limit is hit")
+}
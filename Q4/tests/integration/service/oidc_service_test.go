@@ -0,0 +1,386 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/oidc"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	oidcIssuer    = "https://id.example.com"
+	wikiCallback  = "https://wiki.example.com/callback"
+	codeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	codeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+type oidcFixture struct {
+	*authFixture
+	oidc  *service.OIDCService
+	admin model.User
+}
+
+func newOIDCFixture(t *testing.T) *oidcFixture {
+	f := &oidcFixture{authFixture: newAuthFixture(t)}
+	f.oidc = service.NewOIDCService(f.store, oidcIssuer, oidcIssuer+"/authorize")
+	f.oidc.Now = func() time.Time { return f.now }
+	f.admin = model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin}
+	f.createAdmin(t, &f.admin)
+	return f
+}
+
+// register adds a client with the given metadata and returns it with its secret
+func (f *oidcFixture) register(t *testing.T, registration service.ClientRegistration) *service.RegisteredClient {
+	t.Helper()
+	if registration.Name == "" {
+		registration.Name = "Wiki"
+	}
+	client, err := f.oidc.RegisterClient(f.admin.ID, registration)
+	require.NoError(t, err)
+	return client
+}
+
+// authorize runs the authorization request of client for userID and returns the parameters of the redirect
+func (f *oidcFixture) authorize(t *testing.T, userID int, client *service.RegisteredClient, scope string) url.Values {
+	t.Helper()
+	response, err := f.oidc.Authorize(userID, service.AuthorizationRequest{
+		ResponseType:        "code",
+		ClientID:            client.ID,
+		RedirectURI:         wikiCallback,
+		Scope:               scope,
+		State:               "xyz",
+		Nonce:               "n-0S6_WzA2Mj",
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: "S256",
+	})
+	require.NoError(t, err)
+	redirect, err := url.Parse(response.RedirectTo)
+	require.NoError(t, err)
+	assert.Equal(t, wikiCallback, redirect.Scheme+"://"+redirect.Host+redirect.Path)
+	assert.Equal(t, "xyz", redirect.Query().Get("state"))
+	assert.Equal(t, oidcIssuer, redirect.Query().Get("iss"))
+	return redirect.Query()
+}
+
+func (f *oidcFixture) exchange(client *service.RegisteredClient, code, verifier string) (*service.TokenResponse, error) {
+	return f.oidc.Token(service.TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         code,
+		RedirectURI:  wikiCallback,
+		CodeVerifier: verifier,
+		ClientID:     client.ID,
+		ClientSecret: client.ClientSecret,
+	})
+}
+
+// TestOIDC_AuthorizationCodeFlow tests the full sign-in of a confidential client and the ID token it gets
+func TestOIDC_AuthorizationCodeFlow(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	assert.NotEmpty(t, client.ClientSecret)
+	assert.Equal(t, oidc.UserScopes, client.Scopes)
+
+	params := f.authorize(t, user.ID, client, "openid email")
+	require.NotEmpty(t, params.Get("code"))
+	tokens, err := f.exchange(client, params.Get("code"), codeVerifier)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, int64(time.Hour.Seconds()), tokens.ExpiresIn)
+	assert.Equal(t, "openid email", tokens.Scope)
+
+	keys, err := f.oidc.JWKS()
+	require.NoError(t, err)
+	var claims oidc.IDTokenClaims
+	require.NoError(t, oidc.Verify(tokens.IDToken, keys, &claims))
+	assert.Equal(t, oidcIssuer, claims.Issuer)
+	assert.Equal(t, client.ID, claims.Audience)
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(t, f.now.Add(time.Hour).Unix(), claims.ExpiresAt)
+	assert.Equal(t, oidc.ClaimsForUser(&user, []string{"openid", "email"}), claims.UserClaims)
+	assert.Empty(t, claims.Name, "the profile scope was not requested")
+
+	info, err := f.oidc.UserInfo(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, claims.UserClaims, *info)
+
+	_, err = f.exchange(client, params.Get("code"), codeVerifier)
+	assert.ErrorIs(t, err, oidc.ErrInvalidGrant, "codes are single-use")
+}
+
+// TestOIDC_PublicClientWithoutOpenID tests a public client and a plain OAuth request without an ID token
+func TestOIDC_PublicClientWithoutOpenID(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}, TokenEndpointAuthMethod: "none"})
+	assert.Empty(t, client.ClientSecret)
+
+	params := f.authorize(t, user.ID, client, "profile")
+	tokens, err := f.exchange(client, params.Get("code"), codeVerifier)
+	require.NoError(t, err)
+	assert.Empty(t, tokens.IDToken)
+	_, err = f.oidc.UserInfo(tokens.AccessToken)
+	assert.ErrorIs(t, err, oidc.ErrInvalidToken, "userinfo needs the openid scope")
+
+	_, err = f.oidc.Token(service.TokenRequest{GrantType: "authorization_code", ClientID: client.ID, ClientSecret: "guess"})
+	assert.ErrorIs(t, err, oidc.ErrInvalidClient, "public clients have no secret")
+}
+
+// TestOIDC_CodeRedemptionChecks tests PKCE, expiry and that codes only work for their own client
+func TestOIDC_CodeRedemptionChecks(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	other := f.register(t, service.ClientRegistration{Name: "Other", RedirectURIs: []string{wikiCallback}})
+
+	params := f.authorize(t, user.ID, client, "openid")
+	_, err := f.exchange(client, params.Get("code"), strings.Repeat("a", 43))
+	assert.ErrorIs(t, err, oidc.ErrInvalidGrant, "a stolen code is useless without the verifier")
+
+	params = f.authorize(t, user.ID, client, "openid")
+	_, err = f.exchange(other, params.Get("code"), codeVerifier)
+	assert.ErrorIs(t, err, oidc.ErrInvalidGrant)
+
+	params = f.authorize(t, user.ID, client, "openid")
+	f.now = f.now.Add(service.DefaultAuthorizationCodeTTL)
+	_, err = f.exchange(client, params.Get("code"), codeVerifier)
+	assert.ErrorIs(t, err, oidc.ErrInvalidGrant, "codes expire")
+
+	params = f.authorize(t, user.ID, client, "openid")
+	_, err = f.oidc.Token(service.TokenRequest{GrantType: "authorization_code", Code: params.Get("code"), CodeVerifier: codeVerifier,
+		ClientID: client.ID, ClientSecret: "wrong"})
+	assert.ErrorIs(t, err, oidc.ErrInvalidClient)
+}
+
+// TestOIDC_AuthorizationErrors tests which errors are returned and which are sent back to the client
+func TestOIDC_AuthorizationErrors(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	valid := service.AuthorizationRequest{ResponseType: "code", ClientID: client.ID, CodeChallenge: codeChallenge, CodeChallengeMethod: "S256"}
+
+	request := valid
+	request.ClientID = "unknown"
+	_, err := f.oidc.Authorize(user.ID, request)
+	assert.ErrorIs(t, err, oidc.ErrInvalidRequest)
+	request = valid
+	request.RedirectURI = "https://evil.example.net/callback"
+	_, err = f.oidc.Authorize(user.ID, request)
+	assert.ErrorIs(t, err, oidc.ErrInvalidRequest, "unregistered redirect URIs are never redirected to")
+
+	for name, tc := range map[string]struct {
+		change func(*service.AuthorizationRequest)
+		error  string
+	}{
+		"no PKCE":            {func(r *service.AuthorizationRequest) { r.CodeChallenge = "" }, "invalid_request"},
+		"plain PKCE":         {func(r *service.AuthorizationRequest) { r.CodeChallengeMethod = "plain" }, "invalid_request"},
+		"implicit flow":      {func(r *service.AuthorizationRequest) { r.ResponseType = "token" }, "unsupported_response_type"},
+		"unregistered scope": {func(r *service.AuthorizationRequest) { r.Scope = "openid admin" }, "invalid_scope"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request := valid
+			tc.change(&request)
+			response, err := f.oidc.Authorize(user.ID, request)
+			require.NoError(t, err)
+			redirect, err := url.Parse(response.RedirectTo)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(response.RedirectTo, wikiCallback+"?"), "the only registered URI is the default")
+			assert.Equal(t, tc.error, redirect.Query().Get("error"))
+			assert.Empty(t, redirect.Query().Get("code"))
+		})
+	}
+}
+
+// TestOIDC_ClientCredentials tests tokens that clients get for themselves
+func TestOIDC_ClientCredentials(t *testing.T) {
+	f := newOIDCFixture(t)
+	client := f.register(t, service.ClientRegistration{GrantTypes: []string{"client_credentials"}, Scope: "reports:read reports:write"})
+	request := service.TokenRequest{GrantType: "client_credentials", ClientID: client.ID, ClientSecret: client.ClientSecret}
+
+	tokens, err := f.oidc.Token(request)
+	require.NoError(t, err)
+	assert.Equal(t, "reports:read reports:write", tokens.Scope)
+	assert.Empty(t, tokens.IDToken)
+
+	request.Scope = "reports:read"
+	tokens, err = f.oidc.Token(request)
+	require.NoError(t, err)
+	assert.Equal(t, "reports:read", tokens.Scope)
+
+	introspection, err := f.oidc.Introspect(client.ID, client.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Empty(t, introspection.Subject, "the token acts for the client, not a user")
+	assert.Equal(t, client.ID, introspection.ClientID)
+
+	request.Scope = "reports:delete"
+	_, err = f.oidc.Token(request)
+	assert.ErrorIs(t, err, oidc.ErrInvalidScope)
+
+	request = service.TokenRequest{GrantType: "authorization_code", ClientID: client.ID, ClientSecret: client.ClientSecret}
+	_, err = f.oidc.Token(request)
+	assert.ErrorIs(t, err, oidc.ErrUnauthorizedClient, "the client did not register the code grant")
+	request.GrantType = "password"
+	_, err = f.oidc.Token(request)
+	assert.ErrorIs(t, err, oidc.ErrUnsupportedGrantType)
+}
+
+// TestOIDC_IntrospectAndRevoke tests that revoked and expired tokens turn inactive
+func TestOIDC_IntrospectAndRevoke(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	api := f.register(t, service.ClientRegistration{Name: "Reports API", GrantTypes: []string{"client_credentials"}})
+	public := f.register(t, service.ClientRegistration{Name: "SPA", RedirectURIs: []string{wikiCallback}, TokenEndpointAuthMethod: "none"})
+
+	tokens, err := f.exchange(client, f.authorize(t, user.ID, client, "openid").Get("code"), codeVerifier)
+	require.NoError(t, err)
+
+	introspection, err := f.oidc.Introspect(api.ID, api.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err, "resource servers introspect tokens of other clients")
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "openid", introspection.Scope)
+	assert.Equal(t, "2", introspection.Subject)
+	assert.Equal(t, oidcIssuer, introspection.Issuer)
+	_, err = f.oidc.Introspect(public.ID, "", tokens.AccessToken)
+	assert.ErrorIs(t, err, oidc.ErrInvalidClient, "public clients cannot introspect")
+
+	require.NoError(t, f.oidc.Revoke(api.ID, api.ClientSecret, tokens.AccessToken))
+	introspection, err = f.oidc.Introspect(api.ID, api.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, introspection.Active, "only the client a token was issued to may revoke it")
+
+	require.NoError(t, f.oidc.Revoke(client.ID, client.ClientSecret, tokens.AccessToken))
+	introspection, err = f.oidc.Introspect(api.ID, api.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, service.Introspection{Active: false}, *introspection)
+	require.NoError(t, f.oidc.Revoke(client.ID, client.ClientSecret, tokens.AccessToken), "revoking twice is not an error")
+	_, err = f.oidc.UserInfo(tokens.AccessToken)
+	assert.ErrorIs(t, err, oidc.ErrInvalidToken)
+
+	tokens, err = f.exchange(client, f.authorize(t, user.ID, client, "openid").Get("code"), codeVerifier)
+	require.NoError(t, err)
+	f.now = f.now.Add(time.Hour)
+	introspection, err = f.oidc.Introspect(api.ID, api.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.False(t, introspection.Active, "tokens expire")
+}
+
+// TestOIDC_DeletingRevokes tests that deleting a client or user ends the access they had
+func TestOIDC_DeletingRevokes(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	api := f.register(t, service.ClientRegistration{Name: "Reports API", GrantTypes: []string{"client_credentials"}})
+
+	tokens, err := f.exchange(client, f.authorize(t, user.ID, client, "openid").Get("code"), codeVerifier)
+	require.NoError(t, err)
+	require.NoError(t, f.users.DeleteUser(&auth.Principal{UserID: user.ID}, user.ID))
+	introspection, err := f.oidc.Introspect(api.ID, api.ClientSecret, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.False(t, introspection.Active)
+
+	assert.ErrorIs(t, f.oidc.DeleteClient(user.ID, api.ID), repository.ErrUserNotFound)
+	require.NoError(t, f.oidc.DeleteClient(f.admin.ID, api.ID))
+	_, err = f.oidc.Token(service.TokenRequest{GrantType: "client_credentials", ClientID: api.ID, ClientSecret: api.ClientSecret})
+	assert.ErrorIs(t, err, oidc.ErrInvalidClient)
+	assert.ErrorIs(t, f.oidc.DeleteClient(f.admin.ID, api.ID), repository.ErrClientNotFound)
+}
+
+// TestOIDC_RegisterClient tests that only admins register clients and that the metadata is checked
+func TestOIDC_RegisterClient(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+
+	_, err := f.oidc.RegisterClient(user.ID, service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{wikiCallback}})
+	assert.ErrorIs(t, err, service.ErrAdminRequired)
+	_, err = f.oidc.ListClients(user.ID)
+	assert.ErrorIs(t, err, service.ErrAdminRequired)
+
+	for name, tc := range map[string]struct {
+		registration service.ClientRegistration
+		error        *oidc.Error
+	}{
+		"no name":             {service.ClientRegistration{RedirectURIs: []string{wikiCallback}}, oidc.ErrInvalidClientMetadata},
+		"no redirect URI":     {service.ClientRegistration{Name: "Wiki"}, oidc.ErrInvalidRedirectURI},
+		"plain http":          {service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{"http://wiki.example.com/cb"}}, oidc.ErrInvalidRedirectURI},
+		"fragment":            {service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{wikiCallback + "#x"}}, oidc.ErrInvalidRedirectURI},
+		"relative":            {service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{"/callback"}}, oidc.ErrInvalidRedirectURI},
+		"implicit grant":      {service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{wikiCallback}, GrantTypes: []string{"implicit"}}, oidc.ErrInvalidClientMetadata},
+		"public machine":      {service.ClientRegistration{Name: "Wiki", GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "none"}, oidc.ErrInvalidClientMetadata},
+		"unknown auth method": {service.ClientRegistration{Name: "Wiki", RedirectURIs: []string{wikiCallback}, TokenEndpointAuthMethod: "private_key_jwt"}, oidc.ErrInvalidClientMetadata},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := f.oidc.RegisterClient(f.admin.ID, tc.registration)
+			assert.ErrorIs(t, err, tc.error)
+		})
+	}
+
+	for _, uri := range []string{"http://localhost:8400/callback", "http://127.0.0.1/cb", "com.example.wiki:/callback"} {
+		f.register(t, service.ClientRegistration{RedirectURIs: []string{uri}, TokenEndpointAuthMethod: "none"})
+	}
+	clients, err := f.oidc.ListClients(f.admin.ID)
+	require.NoError(t, err)
+	assert.Len(t, clients, 3)
+}
+
+// TestOIDC_KeyRotation tests that a new key signs after rotation while the old one stays published for a while
+func TestOIDC_KeyRotation(t *testing.T) {
+	f := newOIDCFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	client := f.register(t, service.ClientRegistration{RedirectURIs: []string{wikiCallback}})
+	signIn := func() string {
+		tokens, err := f.exchange(client, f.authorize(t, user.ID, client, "openid").Get("code"), codeVerifier)
+		require.NoError(t, err)
+		return tokens.IDToken
+	}
+
+	before := signIn()
+	keys, err := f.oidc.JWKS()
+	require.NoError(t, err)
+	require.Len(t, keys.Keys, 1)
+	first := keys.Keys[0].KeyID
+
+	f.now = f.now.Add(service.DefaultSigningKeyRotation)
+	after := signIn()
+	keys, err = f.oidc.JWKS()
+	require.NoError(t, err)
+	require.Len(t, keys.Keys, 2, "the replaced key is still published")
+	assert.NotEqual(t, first, keys.Keys[0].KeyID, "the new key comes first")
+	var claims oidc.IDTokenClaims
+	require.NoError(t, oidc.Verify(before, keys, &claims), "tokens of the old key still verify")
+	require.NoError(t, oidc.Verify(after, keys, &claims))
+
+	f.now = f.now.Add(service.DefaultSigningKeyRetention)
+	keys, err = f.oidc.JWKS()
+	require.NoError(t, err)
+	require.Len(t, keys.Keys, 1)
+	assert.ErrorIs(t, oidc.Verify(before, keys, &claims), oidc.ErrInvalidJWT, "retired keys are dropped")
+
+	_, err = f.oidc.RotateSigningKey(user.ID)
+	assert.ErrorIs(t, err, service.ErrAdminRequired)
+	kid, err := f.oidc.RotateSigningKey(f.admin.ID)
+	require.NoError(t, err)
+	keys, err = f.oidc.JWKS()
+	require.NoError(t, err)
+	assert.Equal(t, kid, keys.Keys[0].KeyID)
+}
+
+// TestOIDC_Discovery tests that the metadata points at the issuer's endpoints
+func TestOIDC_Discovery(t *testing.T) {
+	f := newOIDCFixture(t)
+	discovery := f.oidc.Discovery()
+	assert.Equal(t, oidcIssuer, discovery.Issuer)
+	assert.Equal(t, oidcIssuer+"/authorize", discovery.AuthorizationEndpoint)
+	assert.Equal(t, oidcIssuer+"/oauth/token", discovery.TokenEndpoint)
+	assert.Equal(t, oidcIssuer+"/oauth/jwks", discovery.JWKSURI)
+	assert.Equal(t, []string{"S256"}, discovery.CodeChallengeMethodsSupported)
+}
@@ -0,0 +1,123 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sessionFixture struct {
+	*authFixture
+	sessions *service.SessionService
+}
+
+func newSessionFixture(t *testing.T) *sessionFixture {
+	f := &sessionFixture{authFixture: newAuthFixture(t)}
+	f.sessions = service.NewSessionService(f.store)
+	f.sessions.Now = func() time.Time { return f.now }
+	return f
+}
+
+// signIn starts a session from client and returns its token and principal
+func (f *sessionFixture) signIn(t *testing.T, email string, client service.ClientInfo) (string, *auth.Principal) {
+	t.Helper()
+	result, err := f.auth.Login(email, "correct horse", client)
+	require.NoError(t, err)
+	principal, err := f.auth.Authenticate(result.Token)
+	require.NoError(t, err)
+	return result.Token, principal
+}
+
+// TestSessionService_ListSessions tests that sessions show where they were started and which one is current
+func TestSessionService_ListSessions(t *testing.T) {
+	f := newSessionFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	_, laptop := f.signIn(t, "ahmet@example.com", testClient)
+	f.now = f.now.Add(time.Hour)
+	_, phone := f.signIn(t, "ahmet@example.com", service.ClientInfo{
+		UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+		IP:        "198.51.100.7",
+	})
+
+	sessions, err := f.sessions.ListSessions(phone, user.ID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, phone.SessionID, sessions[0].ID, "most recently seen first")
+	assert.Equal(t, "Safari on iOS", sessions[0].Device)
+	assert.Equal(t, "198.51.100.7", sessions[0].IP)
+	assert.True(t, sessions[0].Current)
+	assert.Equal(t, laptop.SessionID, sessions[1].ID)
+	assert.Equal(t, "Firefox on Windows", sessions[1].Device)
+	assert.Equal(t, testClient.UserAgent, sessions[1].UserAgent)
+	assert.False(t, sessions[1].Current)
+
+	f.now = f.now.Add(service.DefaultSessionTTL - time.Hour)
+	sessions, err = f.sessions.ListSessions(phone, user.ID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1, "expired sessions are not listed")
+}
+
+// TestSessionService_Access tests that users manage their own sessions and admins everyone's
+func TestSessionService_Access(t *testing.T) {
+	f := newSessionFixture(t)
+	ahmet := f.createUser(t, "ahmet@example.com", "correct horse")
+	ayse := f.createUser(t, "ayse@example.com", "correct horse")
+	admin := model.User{Name: "Admin", Email: "admin@example.com", Password: "correct horse", Role: model.RoleAdmin}
+	f.createAdmin(t, &admin)
+	_, ahmetSession := f.signIn(t, "ahmet@example.com", testClient)
+	_, ayseSession := f.signIn(t, "ayse@example.com", testClient)
+	adminSession := &auth.Principal{UserID: admin.ID}
+
+	_, err := f.sessions.ListSessions(ahmetSession, ayse.ID)
+	assert.ErrorIs(t, err, service.ErrSessionAccessDenied)
+	_, err = f.sessions.ListSessions(ahmetSession, ayse.ID+1000)
+	assert.ErrorIs(t, err, service.ErrSessionAccessDenied, "users cannot probe for other accounts")
+	assert.ErrorIs(t, f.sessions.RevokeSession(ahmetSession, ayse.ID, ayseSession.SessionID), service.ErrSessionAccessDenied)
+	_, err = f.sessions.RevokeSessions(ahmetSession, ayse.ID, false)
+	assert.ErrorIs(t, err, service.ErrSessionAccessDenied)
+
+	sessions, err := f.sessions.ListSessions(adminSession, ahmet.ID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.False(t, sessions[0].Current)
+	_, err = f.sessions.ListSessions(adminSession, ahmet.ID+1000)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	err = f.sessions.RevokeSession(adminSession, ahmet.ID, ayseSession.SessionID)
+	assert.ErrorIs(t, err, repository.ErrSessionNotFound, "a session is only found under its own user")
+	require.NoError(t, f.sessions.RevokeSession(adminSession, ayse.ID, ayseSession.SessionID))
+}
+
+// TestSessionService_Revoke tests that revoked tokens stop authenticating at once
+func TestSessionService_Revoke(t *testing.T) {
+	f := newSessionFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	first, current := f.signIn(t, "ahmet@example.com", testClient)
+	second, other := f.signIn(t, "ahmet@example.com", testClient)
+	third, _ := f.signIn(t, "ahmet@example.com", testClient)
+
+	require.NoError(t, f.sessions.RevokeSession(current, user.ID, other.SessionID))
+	_, err := f.auth.Authenticate(second)
+	assert.ErrorIs(t, err, service.ErrInvalidSession)
+	assert.ErrorIs(t, f.sessions.RevokeSession(current, user.ID, other.SessionID), repository.ErrSessionNotFound)
+
+	revoked, err := f.sessions.RevokeSessions(current, user.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	_, err = f.auth.Authenticate(third)
+	assert.ErrorIs(t, err, service.ErrInvalidSession)
+	_, err = f.auth.Authenticate(first)
+	assert.NoError(t, err, "keep_current spares the caller's session")
+
+	revoked, err = f.sessions.RevokeSessions(current, user.ID, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	_, err = f.auth.Authenticate(first)
+	assert.ErrorIs(t, err, service.ErrInvalidSession)
+}
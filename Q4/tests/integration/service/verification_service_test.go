@@ -0,0 +1,163 @@
+package service_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/mail"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type verificationFixture struct {
+	repo         *repository.SQLUserRepository
+	mailer       *mail.MemoryMailer
+	signer       *auth.Signer
+	verification *service.EmailVerificationService
+	users        service.UserServiceInterface
+	now          time.Time
+}
+
+func newVerificationFixture(t *testing.T) *verificationFixture {
+	f := &verificationFixture{
+		repo:   repository.NewSQLUserRepository(newTestDB(t)),
+		mailer: mail.NewMemoryMailer(),
+		signer: auth.NewSigner("test-secret"),
+		now:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	f.signer.Now = func() time.Time { return f.now }
+	f.verification = service.NewEmailVerificationService(f.repo, f.mailer, f.signer, "https://app.example.com/verify-email")
+	f.verification.Background = func(fn func()) { fn() }
+	f.users = &service.UserService{Repo: f.repo, Verification: f.verification}
+	return f
+}
+
+var linkPattern = regexp.MustCompile(`https://app\.example\.com/verify-email\?token=\S+`)
+
+// lastToken extracts the token from the link in the most recent email
+func (f *verificationFixture) lastToken(t *testing.T) string {
+	t.Helper()
+	messages := f.mailer.Messages()
+	require.NotEmpty(t, messages)
+	link, err := url.Parse(linkPattern.FindString(messages[len(messages)-1].Text))
+	require.NoError(t, err)
+	token := link.Query().Get("token")
+	require.NotEmpty(t, token)
+	return token
+}
+
+// TestEmailVerification_CreateAndVerify tests that new users get a link that verifies them exactly once
+func TestEmailVerification_CreateAndVerify(t *testing.T) {
+	f := newVerificationFixture(t)
+
+	user := model.User{Name: "Ahmet <Admin>", Email: "ahmet@example.com", EmailVerified: true}
+	require.NoError(t, f.users.CreateUser(nil, &user))
+	assert.False(t, user.EmailVerified)
+
+	messages := f.mailer.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "ahmet@example.com", messages[0].To)
+	assert.Equal(t, "Confirm your email address", messages[0].Subject)
+	assert.Contains(t, messages[0].Text, "The link expires in 24 hours.")
+	assert.Contains(t, messages[0].HTML, "Hello Ahmet &lt;Admin&gt;,")
+
+	token := f.lastToken(t)
+	verified, err := f.verification.VerifyEmail(token)
+	require.NoError(t, err)
+	assert.True(t, verified.EmailVerified)
+
+	stored, err := f.repo.GetUserByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.EmailVerified)
+
+	_, err = f.verification.VerifyEmail(token)
+	assert.ErrorIs(t, err, service.ErrEmailAlreadyVerified)
+}
+
+// TestEmailVerification_RejectedTokens tests expired, tampered and stale tokens
+func TestEmailVerification_RejectedTokens(t *testing.T) {
+	f := newVerificationFixture(t)
+
+	user := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, f.users.CreateUser(nil, &user))
+	token := f.lastToken(t)
+
+	payload, signature, _ := strings.Cut(token, ".")
+	_, err := f.verification.VerifyEmail(payload + "x." + signature)
+	assert.ErrorIs(t, err, service.ErrInvalidVerificationToken)
+
+	other, err := auth.NewSigner("other-secret").Sign("verify-email", map[string]any{"uid": user.ID, "email": user.Email}, time.Hour)
+	require.NoError(t, err)
+	_, err = f.verification.VerifyEmail(other)
+	assert.ErrorIs(t, err, service.ErrInvalidVerificationToken)
+
+	f.now = f.now.Add(25 * time.Hour)
+	_, err = f.verification.VerifyEmail(token)
+	assert.ErrorIs(t, err, service.ErrInvalidVerificationToken)
+	f.now = f.now.Add(-25 * time.Hour)
+
+	user.Email = "ahmet.new@example.com"
+	require.NoError(t, f.users.UpdateUser(&auth.Principal{ServicePrincipalID: "sp_1"}, &user))
+	require.Len(t, f.mailer.Messages(), 2, "changing the email sends a new link")
+	assert.Equal(t, "ahmet.new@example.com", f.mailer.Messages()[1].To)
+
+	_, err = f.verification.VerifyEmail(token)
+	assert.ErrorIs(t, err, service.ErrInvalidVerificationToken, "links for the old address stop working")
+
+	_, err = f.verification.VerifyEmail(f.lastToken(t))
+	assert.NoError(t, err)
+}
+
+// TestEmailVerification_ResendInBackground tests that resending answers before looking the address up
+func TestEmailVerification_ResendInBackground(t *testing.T) {
+	f := newVerificationFixture(t)
+	user := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, f.users.CreateUser(nil, &user))
+	f.now = f.now.Add(2 * time.Minute)
+
+	var pending []func()
+	f.verification.Background = func(fn func()) { pending = append(pending, fn) }
+	require.NoError(t, f.verification.ResendVerification(user.Email))
+	require.NoError(t, f.verification.ResendVerification("nobody@example.com"))
+	assert.Len(t, f.mailer.Messages(), 1, "nothing is sent before the response")
+	require.Len(t, pending, 2, "known and unknown addresses take the same path")
+
+	for _, fn := range pending {
+		fn()
+	}
+	require.Len(t, f.mailer.Messages(), 2)
+	assert.Equal(t, user.Email, f.mailer.Messages()[1].To)
+}
+
+// TestEmailVerification_Resend tests that resending is silent for unknown or verified users and throttled
+func TestEmailVerification_Resend(t *testing.T) {
+	f := newVerificationFixture(t)
+
+	require.NoError(t, f.verification.ResendVerification("nobody@example.com"))
+	assert.Empty(t, f.mailer.Messages())
+
+	user := model.User{Name: "Ahmet", Email: "ahmet@example.com"}
+	require.NoError(t, f.users.CreateUser(nil, &user))
+	require.Len(t, f.mailer.Messages(), 1)
+
+	require.NoError(t, f.verification.ResendVerification(user.Email))
+	assert.Len(t, f.mailer.Messages(), 1, "a second email within the resend gap is suppressed")
+
+	f.now = f.now.Add(2 * time.Minute)
+	require.NoError(t, f.verification.ResendVerification(user.Email))
+	require.Len(t, f.mailer.Messages(), 2)
+
+	_, err := f.verification.VerifyEmail(f.lastToken(t))
+	require.NoError(t, err)
+
+	f.now = f.now.Add(2 * time.Minute)
+	require.NoError(t, f.verification.ResendVerification(user.Email))
+	assert.Len(t, f.mailer.Messages(), 2, "verified users are not sent another link")
+}
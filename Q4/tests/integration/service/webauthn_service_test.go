@@ -0,0 +1,212 @@
+package service_test
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	"Q4/internal/service"
+	"Q4/internal/webauthn"
+	"Q4/internal/webauthn/webauthntest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const webAuthnOrigin = "https://app.example.com"
+
+type webAuthnFixture struct {
+	*mfaFixture
+	webauthn *service.WebAuthnService
+}
+
+func newWebAuthnFixture(t *testing.T) *webAuthnFixture {
+	f := &webAuthnFixture{mfaFixture: newMFAFixture(t)}
+	rp := &webauthn.RelyingParty{ID: "example.com", Name: "Q4", Origins: []string{webAuthnOrigin}}
+	f.webauthn = service.NewWebAuthnService(f.store, f.auth, rp)
+	f.webauthn.Now = func() time.Time { return f.now }
+	return f
+}
+
+// register adds a passkey from a new software authenticator to user
+func (f *webAuthnFixture) register(t *testing.T, userID int, attestation webauthntest.Attestation) (*webauthntest.Authenticator, *model.WebAuthnCredential) {
+	t.Helper()
+	a := webauthntest.New(attestation)
+	options, err := f.webauthn.BeginRegistration(userID)
+	require.NoError(t, err)
+	credential, err := f.webauthn.FinishRegistration(userID, "Laptop", a.Register(webAuthnOrigin, *options))
+	require.NoError(t, err)
+	return a, credential
+}
+
+// login runs a passkey sign-in with a, naming email when it is not empty
+func (f *webAuthnFixture) login(t *testing.T, a *webauthntest.Authenticator, email string) (*service.LoginResult, error) {
+	t.Helper()
+	options, err := f.webauthn.BeginLogin(email)
+	require.NoError(t, err)
+	return f.webauthn.FinishLogin(a.Login(webAuthnOrigin, *options), testClient)
+}
+
+// TestWebAuthn_RegisterAndSignIn tests the full flow for every attestation format
+func TestWebAuthn_RegisterAndSignIn(t *testing.T) {
+	for name, attestation := range map[string]webauthntest.Attestation{
+		"none":         webauthntest.NoAttestation,
+		"packed self":  webauthntest.SelfAttestation,
+		"packed basic": webauthntest.BasicAttestation,
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newWebAuthnFixture(t)
+			user := f.createUser(t, "ahmet@example.com", "correct horse")
+
+			a, credential := f.register(t, user.ID, attestation)
+			assert.Equal(t, "Laptop", credential.Name)
+			assert.Equal(t, []string{"internal"}, credential.Transports)
+
+			result, err := f.login(t, a, "ahmet@example.com")
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, result.User.ID)
+			principal, err := f.auth.Authenticate(result.Token)
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, principal.UserID)
+
+			credentials, err := f.webauthn.ListCredentials(user.ID)
+			require.NoError(t, err)
+			require.Len(t, credentials, 1)
+			assert.Equal(t, uint32(1), credentials[0].SignCount)
+			assert.NotNil(t, credentials[0].LastUsedAt)
+		})
+	}
+}
+
+// TestWebAuthn_DiscoverableSignIn tests signing in without naming the account
+func TestWebAuthn_DiscoverableSignIn(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	a, _ := f.register(t, user.ID, webauthntest.NoAttestation)
+
+	options, err := f.webauthn.BeginLogin("")
+	require.NoError(t, err)
+	assert.Empty(t, options.AllowCredentials)
+	result, err := f.webauthn.FinishLogin(a.Login(webAuthnOrigin, *options), testClient)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, result.User.ID)
+}
+
+// TestWebAuthn_BeginLoginHidesAccounts tests that emails without passkeys, registered or not,
+// get options shaped like those of an account with one
+func TestWebAuthn_BeginLoginHidesAccounts(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	f.register(t, user.ID, webauthntest.NoAttestation)
+	f.createUser(t, "ayse@example.com", "correct horse")
+
+	allowed := func(email string) []webauthn.CredentialDescriptor {
+		options, err := f.webauthn.BeginLogin(email)
+		require.NoError(t, err)
+		require.Len(t, options.AllowCredentials, 1, email)
+		assert.Equal(t, webauthn.CredentialType, options.AllowCredentials[0].Type)
+		assert.NotEmpty(t, options.AllowCredentials[0].Transports)
+		return options.AllowCredentials
+	}
+	allowed("ahmet@example.com")
+	withoutPasskeys := allowed("ayse@example.com")
+	unknown := allowed("nobody@example.com")
+
+	assert.Equal(t, unknown, allowed("nobody@example.com"), "asking again gives the same placeholder")
+	assert.Equal(t, unknown, allowed("Nobody@Example.com"))
+	assert.NotEqual(t, unknown, withoutPasskeys)
+}
+
+// TestWebAuthn_SkipsTOTP tests that a passkey sign-in does not ask users with MFA for a code
+func TestWebAuthn_SkipsTOTP(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	admin := model.User{Name: "Ayse", Email: "ayse@example.com", Role: model.RoleAdmin, Password: "correct horse"}
+	f.createAdmin(t, &admin)
+	f.enroll(t, admin.ID)
+	a, _ := f.register(t, admin.ID, webauthntest.NoAttestation)
+
+	result, err := f.login(t, a, "ayse@example.com")
+	require.NoError(t, err)
+	assert.False(t, result.MFARequired)
+	assert.NotEmpty(t, result.Token)
+}
+
+// TestWebAuthn_ChallengeReuse tests that each challenge is answered once, by the ceremony it was issued for
+func TestWebAuthn_ChallengeReuse(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	a, _ := f.register(t, user.ID, webauthntest.NoAttestation)
+
+	options, err := f.webauthn.BeginLogin("ahmet@example.com")
+	require.NoError(t, err)
+	assertion := a.Login(webAuthnOrigin, *options)
+	_, err = f.webauthn.FinishLogin(assertion, testClient)
+	require.NoError(t, err)
+	_, err = f.webauthn.FinishLogin(assertion, testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidWebAuthnChallenge, "a captured response cannot be replayed")
+
+	options, err = f.webauthn.BeginLogin("ahmet@example.com")
+	require.NoError(t, err)
+	f.now = f.now.Add(service.DefaultWebAuthnChallengeTTL)
+	_, err = f.webauthn.FinishLogin(a.Login(webAuthnOrigin, *options), testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidWebAuthnChallenge, "challenges expire")
+
+	registration, err := f.webauthn.BeginRegistration(user.ID)
+	require.NoError(t, err)
+	login := webauthn.CredentialRequestOptions{Challenge: registration.Challenge, RPID: registration.RP.ID}
+	_, err = f.webauthn.FinishLogin(a.Login(webAuthnOrigin, login), testClient)
+	assert.ErrorIs(t, err, service.ErrInvalidWebAuthnChallenge, "registration challenges do not sign in")
+
+	other := f.createUser(t, "ayse@example.com", "correct horse")
+	registration, err = f.webauthn.BeginRegistration(user.ID)
+	require.NoError(t, err)
+	_, err = f.webauthn.FinishRegistration(other.ID, "", webauthntest.New(webauthntest.NoAttestation).Register(webAuthnOrigin, *registration))
+	assert.ErrorIs(t, err, service.ErrInvalidWebAuthnChallenge, "challenges belong to the user they were issued to")
+}
+
+// TestWebAuthn_Rejections tests wrong origins, cloned authenticators and credentials of other users
+func TestWebAuthn_Rejections(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	other := f.createUser(t, "ayse@example.com", "correct horse")
+	a, _ := f.register(t, user.ID, webauthntest.NoAttestation)
+	b, _ := f.register(t, other.ID, webauthntest.NoAttestation)
+
+	options, err := f.webauthn.BeginLogin("ahmet@example.com")
+	require.NoError(t, err)
+	_, err = f.webauthn.FinishLogin(a.Login("https://app.example.com.evil.net", *options), testClient)
+	assert.ErrorIs(t, err, webauthn.ErrVerification, "a phishing origin is refused")
+
+	_, err = f.login(t, a, "ahmet@example.com")
+	require.NoError(t, err)
+	a.SignCount = 0
+	_, err = f.login(t, a, "ahmet@example.com")
+	assert.ErrorIs(t, err, webauthn.ErrSignCountRegression)
+
+	_, err = f.login(t, b, "ahmet@example.com")
+	assert.ErrorIs(t, err, service.ErrUnknownPasskey, "a challenge for one account cannot sign in to another")
+	_, err = f.login(t, webauthntest.New(webauthntest.NoAttestation), "")
+	assert.ErrorIs(t, err, service.ErrUnknownPasskey)
+
+	registration, err := f.webauthn.BeginRegistration(other.ID)
+	require.NoError(t, err)
+	_, err = f.webauthn.FinishRegistration(other.ID, "", a.Register(webAuthnOrigin, *registration))
+	assert.ErrorIs(t, err, repository.ErrDuplicateCredential)
+}
+
+// TestWebAuthn_DeleteCredential tests that users remove only their own passkeys and that removed ones stop working
+func TestWebAuthn_DeleteCredential(t *testing.T) {
+	f := newWebAuthnFixture(t)
+	user := f.createUser(t, "ahmet@example.com", "correct horse")
+	other := f.createUser(t, "ayse@example.com", "correct horse")
+	a, credential := f.register(t, user.ID, webauthntest.NoAttestation)
+
+	registration, err := f.webauthn.BeginRegistration(user.ID)
+	require.NoError(t, err)
+	require.Len(t, registration.ExcludeCredentials, 1, "registered passkeys are excluded from registering again")
+
+	assert.ErrorIs(t, f.webauthn.DeleteCredential(other.ID, credential.ID), repository.ErrCredentialNotFound)
+	require.NoError(t, f.webauthn.DeleteCredential(user.ID, credential.ID))
+	_, err = f.login(t, a, "")
+	assert.ErrorIs(t, err, service.ErrUnknownPasskey)
+}
@@ -0,0 +1,105 @@
+package auth_test
+
+import (
+	"Q4/internal/auth"
+	"bytes"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCode_RFC6238Vectors tests the codes against the RFC 6238 appendix, truncated to six digits
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := auth.TOTPCode(rfc6238Secret, auth.TOTPStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+
+	_, err := auth.TOTPCode("not base32!", 1)
+	assert.Error(t, err)
+}
+
+// TestValidateTOTP tests the accepted clock drift and that the matched step is reported
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := auth.TOTPStep(now)
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code, err := auth.TOTPCode(rfc6238Secret, step+offset)
+		require.NoError(t, err)
+		matched, ok := auth.ValidateTOTP(rfc6238Secret, code, now)
+		assert.True(t, ok, "offset %d", offset)
+		assert.Equal(t, step+offset, matched)
+	}
+
+	for _, offset := range []int64{-2, 2} {
+		code, err := auth.TOTPCode(rfc6238Secret, step+offset)
+		require.NoError(t, err)
+		_, ok := auth.ValidateTOTP(rfc6238Secret, code, now)
+		assert.False(t, ok, "offset %d is outside the allowed drift", offset)
+	}
+
+	code, err := auth.TOTPCode(rfc6238Secret, step)
+	require.NoError(t, err)
+	_, ok := auth.ValidateTOTP(rfc6238Secret, code[:3]+" "+code[3:], now)
+	assert.True(t, ok, "spaces are ignored")
+	_, ok = auth.ValidateTOTP(rfc6238Secret, "12345", now)
+	assert.False(t, ok)
+}
+
+// TestTOTPKeyURI tests the otpauth URI and that its QR code is a PNG
+func TestTOTPKeyURI(t *testing.T) {
+	secret := auth.NewTOTPSecret()
+	assert.Len(t, secret, 32)
+
+	uri := auth.TOTPKeyURI("Q4 Staging", "ayşe@example.com", secret)
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", parsed.Scheme)
+	assert.Equal(t, "totp", parsed.Host)
+	assert.Equal(t, "/Q4 Staging:ayşe@example.com", parsed.Path)
+	assert.Equal(t, secret, parsed.Query().Get("secret"))
+	assert.Equal(t, "Q4 Staging", parsed.Query().Get("issuer"))
+	assert.Equal(t, "6", parsed.Query().Get("digits"))
+	assert.Equal(t, "30", parsed.Query().Get("period"))
+
+	image, err := auth.TOTPQRCode(uri, 256)
+	require.NoError(t, err)
+	config, err := png.DecodeConfig(bytes.NewReader(image))
+	require.NoError(t, err)
+	assert.Equal(t, 256, config.Width)
+}
+
+// TestRecoveryCodes tests that codes are unique and hash the same however they are typed
+func TestRecoveryCodes(t *testing.T) {
+	codes := auth.NewRecoveryCodes(auth.RecoveryCodeCount)
+	require.Len(t, codes, auth.RecoveryCodeCount)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, code)
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+
+	code := codes[0]
+	typed := strings.ToUpper(strings.ReplaceAll(code, "-", " "))
+	assert.Equal(t, auth.HashRecoveryCode(code), auth.HashRecoveryCode(typed))
+	assert.NotEqual(t, auth.HashRecoveryCode(code), auth.HashRecoveryCode(codes[1]))
+}
@@ -0,0 +1,207 @@
+package cache_test
+
+import (
+	"Q4/internal/cache"
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLRU_EvictsLeastRecentlyUsed tests that reading an entry protects it from eviction
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	lru := cache.NewLRU(2)
+	lru.Set("a", []byte("1"), time.Minute)
+	lru.Set("b", []byte("2"), time.Minute)
+
+	_, ok := lru.Get("a")
+	require.True(t, ok)
+	lru.Set("c", []byte("3"), time.Minute)
+
+	_, ok = lru.Get("b")
+	assert.False(t, ok)
+	value, ok := lru.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+	assert.Equal(t, 2, lru.Len())
+}
+
+// TestLRU_Expiry tests that expired entries are treated as missing
+func TestLRU_Expiry(t *testing.T) {
+	lru := cache.NewLRU(10)
+	lru.Set("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := lru.Get("a")
+	assert.False(t, ok)
+
+	lru.Set("b", []byte("2"), time.Minute)
+	lru.Delete("b")
+	_, ok = lru.Get("b")
+	assert.False(t, ok)
+}
+
+// fakeRedis implements just enough of RESP (GET, SET, DEL) to act as a local stand-in
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string]string
+	// ttls holds the PX argument of the last SET of each key
+	ttls map[string]string
+	// block, when set before connecting, holds every GET until it is closed; waiting counts those held
+	block   chan struct{}
+	waiting int
+}
+
+func startFakeRedis(t *testing.T) (string, *fakeRedis) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &fakeRedis{data: make(map[string]string), ttls: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return listener.Addr().String(), server
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		args := make([]string, count)
+		for i := range args {
+			sizeLine, _ := reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(sizeLine[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+
+		if f.block != nil && strings.ToUpper(args[0]) == "GET" {
+			f.mu.Lock()
+			f.waiting++
+			f.mu.Unlock()
+			<-f.block
+		}
+
+		f.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if value, ok := f.data[args[1]]; ok {
+				_, _ = conn.Write([]byte("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"))
+			} else {
+				_, _ = conn.Write([]byte("$-1\r\n"))
+			}
+		case "SET":
+			f.data[args[1]] = args[2]
+			if len(args) == 5 {
+				f.ttls[args[1]] = args[4]
+			}
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		case "DEL":
+			for _, key := range args[1:] {
+				delete(f.data, key)
+			}
+			_, _ = conn.Write([]byte(":" + strconv.Itoa(len(args)-1) + "\r\n"))
+		default:
+			_, _ = conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+		f.mu.Unlock()
+	}
+}
+
+// TestRedis_RoundTrip tests the RESP backend against a local stand-in server
+func TestRedis_RoundTrip(t *testing.T) {
+	addr, server := startFakeRedis(t)
+	backend := cache.NewRedis(addr, "test:")
+	defer backend.Close()
+
+	backend.Set("user:1", []byte(`{"id":1}`), time.Minute)
+	value, ok := backend.Get("user:1")
+	require.True(t, ok)
+	assert.Equal(t, `{"id":1}`, string(value))
+
+	server.mu.Lock()
+	assert.Contains(t, server.data, "test:user:1")
+	server.mu.Unlock()
+
+	backend.Delete("user:1")
+	_, ok = backend.Get("user:1")
+	assert.False(t, ok)
+}
+
+// TestRedis_ShortTTL tests that TTLs under a millisecond are sent as one, since PX must be positive
+func TestRedis_ShortTTL(t *testing.T) {
+	addr, server := startFakeRedis(t)
+	backend := cache.NewRedis(addr, "")
+	defer backend.Close()
+
+	backend.Set("a", []byte("1"), 500*time.Microsecond)
+	backend.Set("b", []byte("2"), 0)
+	backend.Set("c", []byte("3"), time.Minute)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, map[string]string{"a": "1", "b": "1", "c": "60000"}, server.ttls)
+}
+
+// TestRedis_Pool tests that calls run side by side on up to PoolSize connections
+func TestRedis_Pool(t *testing.T) {
+	addr, server := startFakeRedis(t)
+	server.block = make(chan struct{})
+	backend := cache.NewRedis(addr, "")
+	backend.PoolSize = 2
+	defer backend.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend.Get("a")
+		}()
+	}
+
+	waiting := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.waiting
+	}
+	require.Eventually(t, func() bool { return waiting() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, waiting(), "the third call waits for a free connection")
+
+	close(server.block)
+	wg.Wait()
+	assert.Equal(t, 3, waiting())
+}
+
+// TestRedis_Unreachable tests that an unreachable server behaves as an empty cache
+func TestRedis_Unreachable(t *testing.T) {
+	backend := cache.NewRedis("127.0.0.1:1", "")
+	backend.Timeout = 100 * time.Millisecond
+
+	backend.Set("a", []byte("1"), time.Minute)
+	_, ok := backend.Get("a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,31 @@
+package config_test
+
+import (
+	"Q4/config"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoad_Secrets tests that secrets come from the environment or files, never from flags
+func TestLoad_Secrets(t *testing.T) {
+	t.Setenv("TOKEN_SECRET", "from-env")
+	file := filepath.Join(t.TempDir(), "smtp-password")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	t.Setenv("SMTP_PASSWORD_FILE", file)
+
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", cfg.TokenSecret)
+	assert.Equal(t, "from-file", cfg.SMTPPassword)
+
+	_, err = config.Load([]string{"--token-secret=from-flag"})
+	assert.Error(t, err, "secrets have no flags")
+
+	t.Setenv("SMTP_PASSWORD", "from-env")
+	_, err = config.Load(nil)
+	assert.Error(t, err, "a secret may not come from both")
+}
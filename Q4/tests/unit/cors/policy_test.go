@@ -0,0 +1,66 @@
+package cors_test
+
+import (
+	"Q4/internal/cors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPolicy_Origins tests exact origins, wildcards and patterns
+func TestPolicy_Origins(t *testing.T) {
+	policy, err := cors.New(cors.Options{
+		Origins:        []string{"https://app.example.com/", "https://*.example.org", "http://localhost:*"},
+		OriginPatterns: []string{`https://pr-[0-9]+\.preview\.example\.net`},
+	})
+	require.NoError(t, err)
+
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":                true,
+		"HTTPS://APP.EXAMPLE.COM":                true,
+		"http://app.example.com":                 false,
+		"https://app.example.com:8443":           false,
+		"https://app.example.com.evil.net":       false,
+		"https://a.example.org":                  true,
+		"https://a.b.example.org":                true,
+		"https://example.org":                    false,
+		"https://evil.net/.example.org":          false,
+		"http://localhost:3000":                  true,
+		"http://localhost":                       false,
+		"https://pr-12.preview.example.net":      true,
+		"https://pr-12.preview.example.net.evil": false,
+		"null":                                   false,
+	} {
+		assert.Equal(t, allowed, policy.AllowsOrigin(origin), origin)
+	}
+	assert.Equal(t, "https://a.example.org", policy.AllowOriginHeader("https://a.example.org"))
+}
+
+// TestPolicy_MethodsAndHeaders tests the defaults preflights are checked against
+func TestPolicy_MethodsAndHeaders(t *testing.T) {
+	policy, err := cors.New(cors.Options{Origins: []string{"*"}})
+	require.NoError(t, err)
+	assert.True(t, policy.AllowsOrigin("null"))
+	assert.Equal(t, "*", policy.AllowOriginHeader("https://app.example.com"))
+
+	assert.True(t, policy.AllowsMethod("DELETE"))
+	assert.False(t, policy.AllowsMethod("PATCH"))
+	assert.True(t, policy.AllowsHeaders("content-type, authorization,X-CSRF-Token"))
+	assert.True(t, policy.AllowsHeaders(""))
+	assert.False(t, policy.AllowsHeaders("content-type, x-debug"))
+}
+
+// TestPolicy_Invalid tests that misconfigurations are refused
+func TestPolicy_Invalid(t *testing.T) {
+	for name, opts := range map[string]cors.Options{
+		"any origin with credentials": {Origins: []string{"*"}, AllowCredentials: true},
+		"path":                        {Origins: []string{"https://app.example.com/login"}},
+		"no scheme":                   {Origins: []string{"app.example.com"}},
+		"wildcard in the middle":      {Origins: []string{"https://app.*.example.com"}},
+		"bad pattern":                 {OriginPatterns: []string{"https://(app"}},
+	} {
+		_, err := cors.New(opts)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,58 @@
+package gql_test
+
+import (
+	"Q4/internal/gql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestComplexity tests that list fields multiply the cost of their selections by their size
+func TestComplexity(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]interface{}
+		want      int
+	}{
+		{"one user", `{ user(id: 1) { id name } }`, "", nil, 3},
+		{"aliases count each", `{ a: user(id: 1) { id } b: user(id: "2") { id } }`, "", nil, 4},
+		{"default page", `{ users { nodes { id } } }`, "", nil, 1 + 20*2},
+		{"page size", `{ users(limit: 5, filter: {name: "a"}) { totalCount nodes { id email } } }`, "", nil, 1 + 5*(1+1+2)},
+		{"page size capped", `{ users(limit: 1000) { totalCount } }`, "", nil, 1 + 100},
+		{"page size from variable", `query Q($n: Int) { users(limit: $n) { totalCount } }`, "", map[string]interface{}{"n": float64(7)}, 8},
+		{"variable default", `query Q($n: Int = 50) { users(limit: $n) { totalCount } }`, "", nil, 51},
+		{"ids", `{ usersByIds(ids: [1, 2, 3]) { id name } }`, "", nil, 1 + 3*2},
+		{"ids from variable", `query($ids: [ID!]!) { usersByIds(ids: $ids) { id } }`, "", map[string]interface{}{"ids": []interface{}{"1", "2"}}, 3},
+		{
+			"fragments",
+			`query { users(limit: 2) { nodes { ...F ... on User { role } } } } fragment F on User { id name }`,
+			"", nil, 1 + 2*(1+3),
+		},
+		{
+			"named operation",
+			"# comment\nquery A { user(id: 1) { id } }\nmutation B { deleteUser(id: 1) }",
+			"B", nil, 1,
+		},
+		{"strings and directives", `{ user(id: """1""") @include(if: true) { name @skip(if: false) } }`, "", nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := gql.Complexity(tt.query, tt.operation, tt.variables)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestComplexity_Errors tests that unparsable queries and unknown operations are errors
+func TestComplexity_Errors(t *testing.T) {
+	_, err := gql.Complexity(`{ user(id: 1) { id }`, "", nil)
+	assert.Error(t, err)
+	_, err = gql.Complexity(`query A { user(id: 1) { id } }`, "B", nil)
+	assert.Error(t, err)
+	_, err = gql.Complexity(`query A { user(id: 1) { id } } query B { user(id: 2) { id } }`, "", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package gql_test
+
+import (
+	"Q4/internal/gql"
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchService records the GetUsersByIDs calls it answers from users
+type batchService struct {
+	service.UserServiceInterface
+	mu    sync.Mutex
+	users map[int]model.User
+	calls [][]int
+	err   error
+}
+
+func (s *batchService) GetUsersByIDs(ids []int) ([]model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, ids)
+	if s.err != nil {
+		return nil, s.err
+	}
+	users := []model.User{}
+	for _, id := range ids {
+		if user, ok := s.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func newBatchService() *batchService {
+	return &batchService{users: map[int]model.User{
+		1: {ID: 1, Name: "Ada"},
+		2: {ID: 2, Name: "Grace"},
+		3: {ID: 3, Name: "Linus"},
+	}}
+}
+
+// TestUserLoader_Batches tests that concurrent lookups are answered by one call and repeated ones by none
+func TestUserLoader_Batches(t *testing.T) {
+	users := newBatchService()
+	loader := gql.NewUserLoader(users)
+	loader.Wait = 20 * time.Millisecond
+
+	var wg sync.WaitGroup
+	results := make([]*model.User, 4)
+	for i, id := range []int{3, 1, 3, 9} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := loader.Load(id)
+			assert.NoError(t, err)
+			results[i] = user
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, users.calls, 1)
+	assert.Equal(t, []int{1, 3, 9}, users.calls[0])
+	assert.Equal(t, "Linus", results[0].Name)
+	assert.Equal(t, "Ada", results[1].Name)
+	assert.Equal(t, "Linus", results[2].Name)
+	assert.Nil(t, results[3], "unknown IDs load as nil")
+
+	many, err := loader.LoadMany([]int{1, 2})
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", many[0].Name)
+	assert.Equal(t, "Grace", many[1].Name)
+	require.Len(t, users.calls, 2)
+	assert.Equal(t, []int{2}, users.calls[1], "users loaded before are not fetched again")
+}
+
+// TestUserLoader_MaxBatch tests that a full batch is fetched without waiting
+func TestUserLoader_MaxBatch(t *testing.T) {
+	users := newBatchService()
+	loader := gql.NewUserLoader(users)
+	loader.Wait = time.Hour
+	loader.MaxBatch = 2
+
+	many, err := loader.LoadMany([]int{1, 2})
+	require.NoError(t, err)
+	assert.Len(t, many, 2)
+	assert.Len(t, users.calls, 1)
+}
+
+// TestUserLoader_Error tests that a failed fetch fails every lookup of the batch
+func TestUserLoader_Error(t *testing.T) {
+	users := newBatchService()
+	users.err = errors.New("database is down")
+	loader := gql.NewUserLoader(users)
+
+	_, err := loader.LoadMany([]int{1, 2})
+	assert.ErrorIs(t, err, users.err)
+}
@@ -1,44 +1,17 @@
 package handler_test
 
 import (
+	"Q4/internal/auth"
 	"Q4/internal/model"
+	repomock "Q4/internal/repository/mock"
 	"Q4/internal/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
 )
 
-type MockUserRepository struct {
-	mock.Mock
-}
-
-func (m *MockUserRepository) GetAllUsers() ([]model.User, error) {
-	args := m.Called()
-	return args.Get(0).([]model.User), args.Error(1)
-}
-
-func (m *MockUserRepository) GetUserByID(id int) (*model.User, error) {
-	args := m.Called(id)
-	return args.Get(0).(*model.User), args.Error(1)
-}
-
-func (m *MockUserRepository) CreateUser(user *model.User) error {
-	args := m.Called(user)
-	return args.Error(0)
-}
-
-func (m *MockUserRepository) UpdateUser(user *model.User) error {
-	args := m.Called(user)
-	return args.Error(0)
-}
-
-func (m *MockUserRepository) DeleteUser(id int) error {
-	args := m.Called(id)
-	return args.Error(0)
-}
-
 func TestUserService_GetAllUsers(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+	mockRepo := new(repomock.MockUserRepository)
 	mockRepo.On("GetAllUsers").Return([]model.User{
 		{ID: 1, Name: "Ahmet", Email: "ahmet@example.com"},
 	}, nil)
@@ -53,18 +26,18 @@ func TestUserService_GetAllUsers(t *testing.T) {
 }
 
 func TestUserService_CreateUser(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+	mockRepo := new(repomock.MockUserRepository)
 	mockRepo.On("CreateUser", mock.Anything).Return(nil)
 
 	userService := service.NewUserService(mockRepo)
-	err := userService.CreateUser(&model.User{Name: "Ahmet", Email: "ahmet@example.com"})
+	err := userService.CreateUser(nil, &model.User{Name: "Ahmet", Email: "ahmet@example.com"})
 
 	assert.NoError(t, err)
 	mockRepo.AssertExpectations(t)
 }
 
 func TestUserService_GetUserByID(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+	mockRepo := new(repomock.MockUserRepository)
 	mockRepo.On("GetUserByID", 1).Return(&model.User{ID: 1, Name: "Ahmet", Email: "ahmet@example.com"}, nil)
 
 	userService := service.NewUserService(mockRepo)
@@ -76,11 +49,11 @@ func TestUserService_GetUserByID(t *testing.T) {
 }
 
 func TestUserService_DeleteUser(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+	mockRepo := new(repomock.MockUserRepository)
 	mockRepo.On("DeleteUser", 1).Return(nil)
 
 	userService := service.NewUserService(mockRepo)
-	err := userService.DeleteUser(1)
+	err := userService.DeleteUser(&auth.Principal{UserID: 1}, 1)
 
 	assert.NoError(t, err)
 	mockRepo.AssertExpectations(t)
@@ -0,0 +1,166 @@
+package mail_test
+
+import (
+	"Q4/internal/mail"
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer accepts a single session and records the envelope and message data
+type fakeSMTPServer struct {
+	ln       net.Listener
+	commands chan string
+	data     chan string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	s := &fakeSMTPServer{ln: ln, commands: make(chan string, 16), data: make(chan string, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		s.commands <- cmd
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var body strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				body.WriteString(line)
+			}
+			s.data <- body.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func sampleMessage() mail.Message {
+	return mail.Message{
+		To:      `"Ayşe" <ayse@example.com>`,
+		Subject: "Doğrulama",
+		Text:    "Hello Ayşe,\nopen https://example.com/verify?token=abc\n",
+		HTML:    `<p>Hello Ayşe, <a href="https://example.com/verify?token=abc">verify</a></p>`,
+	}
+}
+
+// assertMultipart parses raw as an email and checks both alternatives survive encoding
+func assertMultipart(t *testing.T, raw string, want mail.Message) {
+	t.Helper()
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, want.Subject, subject)
+	to, err := msg.Header.AddressList("To")
+	require.NoError(t, err)
+	wantTo, err := netmail.ParseAddress(want.To)
+	require.NoError(t, err)
+	assert.Equal(t, wantTo, to[0])
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		require.NoError(t, err)
+		bodies = append(bodies, strings.ReplaceAll(string(body), "\r\n", "\n"))
+	}
+	assert.Equal(t, []string{want.Text, want.HTML}, bodies)
+}
+
+// TestSMTPMailer_Send tests the SMTP exchange and the MIME encoding of the message
+func TestSMTPMailer_Send(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	mailer := mail.NewSMTPMailer(server.ln.Addr().String(), "Q4 <no-reply@example.com>", "", "")
+
+	require.NoError(t, mailer.Send(sampleMessage()))
+
+	var commands []string
+	for len(server.commands) > 0 {
+		commands = append(commands, <-server.commands)
+	}
+	assert.Contains(t, commands, "MAIL FROM:<no-reply@example.com> BODY=8BITMIME")
+	assert.Contains(t, commands, "RCPT TO:<ayse@example.com>")
+
+	assertMultipart(t, <-server.data, sampleMessage())
+}
+
+// TestSMTPMailer_InvalidRecipient tests that malformed addresses fail before connecting
+func TestSMTPMailer_InvalidRecipient(t *testing.T) {
+	mailer := mail.NewSMTPMailer("127.0.0.1:1", "no-reply@example.com", "", "")
+	msg := sampleMessage()
+	msg.To = "not an address"
+	assert.Error(t, mailer.Send(msg))
+}
+
+// TestFileMailer_Send tests that each message is written as a readable .eml file
+func TestFileMailer_Send(t *testing.T) {
+	dir := t.TempDir()
+	mailer := mail.NewFileMailer(dir, "no-reply@example.com")
+
+	require.NoError(t, mailer.Send(sampleMessage()))
+	require.NoError(t, mailer.Send(sampleMessage()))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	raw, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assertMultipart(t, string(raw), sampleMessage())
+}
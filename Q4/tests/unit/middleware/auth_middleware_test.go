@@ -0,0 +1,173 @@
+package middleware_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/middleware"
+	"Q4/internal/model"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sessionToken = "session-token"
+
+// tokenAuthenticator accepts sessionToken only
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) Authenticate(token string) (*auth.Principal, error) {
+	if token != sessionToken {
+		return nil, fmt.Errorf("%w: unknown token", auth.ErrUnauthenticated)
+	}
+	return &auth.Principal{UserID: 7, SessionID: "s1"}, nil
+}
+
+// serve runs r through AuthMiddleware and returns the response and the user ID the handler saw
+func serve(r *http.Request) (*httptest.ResponseRecorder, int) {
+	userID := 0
+	handler := middleware.AuthMiddleware(tokenAuthenticator{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal := auth.PrincipalFrom(r.Context()); principal != nil {
+			userID = principal.UserID
+		}
+	}))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	return rw, userID
+}
+
+// sessionCookies returns the cookies a browser keeps after signing in
+func sessionCookies(t *testing.T) []*http.Cookie {
+	rw := httptest.NewRecorder()
+	auth.SessionCookies{Secure: true}.Set(rw, sessionToken, time.Now().Add(time.Hour))
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 2)
+	return cookies
+}
+
+// TestSessionCookies_Attributes tests that scripts can read the CSRF token but not the session token
+func TestSessionCookies_Attributes(t *testing.T) {
+	cookies := sessionCookies(t)
+	assert.Equal(t, auth.SessionCookie, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, auth.CSRFCookie, cookies[1].Name)
+	assert.False(t, cookies[1].HttpOnly)
+	assert.Equal(t, auth.CSRFToken(sessionToken), cookies[1].Value)
+	for _, cookie := range cookies {
+		assert.True(t, cookie.Secure)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	}
+	assert.NotEqual(t, auth.HashOpaqueToken(sessionToken), auth.CSRFToken(sessionToken), "the CSRF token is not the stored hash")
+}
+
+// TestAuthMiddleware_BearerToken tests the Authorization header
+func TestAuthMiddleware_BearerToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/users", nil)
+	r.Header.Set("Authorization", "Bearer "+sessionToken)
+	rw, userID := serve(r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 7, userID, "bearer tokens need no CSRF token")
+
+	r.Header.Set("Authorization", "Bearer revoked")
+	rw, _ = serve(r)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	r.Header.Set("Authorization", "Basic "+sessionToken)
+	rw, _ = serve(r)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	_, userID = serve(httptest.NewRequest(http.MethodGet, "/api/v1/users", nil))
+	assert.Zero(t, userID, "requests without credentials stay anonymous")
+}
+
+// TestAuthMiddleware_SessionCookie tests that cookie sessions need the CSRF token for unsafe requests only
+func TestAuthMiddleware_SessionCookie(t *testing.T) {
+	request := func(method, csrfToken string) *http.Request {
+		r := httptest.NewRequest(method, "/api/v1/users/7/sessions", nil)
+		for _, cookie := range sessionCookies(t) {
+			r.AddCookie(cookie)
+		}
+		if csrfToken != "" {
+			r.Header.Set(auth.CSRFHeader, csrfToken)
+		}
+		return r
+	}
+
+	rw, userID := serve(request(http.MethodGet, ""))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 7, userID)
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		rw, userID = serve(request(method, ""))
+		assert.Equal(t, http.StatusForbidden, rw.Code, method)
+		assert.Zero(t, userID)
+
+		rw, _ = serve(request(method, auth.CSRFToken("another-session")))
+		assert.Equal(t, http.StatusForbidden, rw.Code, "a CSRF token only works with its own session")
+
+		rw, userID = serve(request(method, auth.CSRFToken(sessionToken)))
+		assert.Equal(t, http.StatusOK, rw.Code, method)
+		assert.Equal(t, 7, userID)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+	r.AddCookie(&http.Cookie{Name: auth.SessionCookie, Value: "revoked"})
+	rw, _ = serve(r)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code, "a revoked cookie is rejected, not ignored")
+}
+
+// TestRequireScope tests that API keys reach routes within their scopes only and user-only routes not at all
+func TestRequireScope(t *testing.T) {
+	service := &auth.Principal{ServicePrincipalID: "sp1", APIKeyID: "k1", Scopes: []string{auth.ScopeUsersRead}}
+	user := &auth.Principal{UserID: 7, SessionID: "s1"}
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	call := func(handler http.Handler, principal *auth.Principal) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+		if principal != nil {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call(middleware.RequireScope(auth.ScopeUsersRead)(ok), service))
+	assert.Equal(t, http.StatusForbidden, call(middleware.RequireScope(auth.ScopeUsersWrite)(ok), service))
+	assert.Equal(t, http.StatusOK, call(middleware.RequireScope(auth.ScopeUsersWrite)(ok), user))
+	assert.Equal(t, http.StatusOK, call(middleware.RequireScope(auth.ScopeUsersWrite)(ok), nil))
+
+	assert.Equal(t, http.StatusForbidden, call(middleware.RequireAuth(ok), service))
+	assert.Equal(t, http.StatusOK, call(middleware.RequireAuth(ok), user))
+	assert.Equal(t, http.StatusUnauthorized, call(middleware.RequireAuth(ok), nil))
+}
+
+// userRoles looks users up by ID with only their role set
+type userRoles map[int]string
+
+func (u userRoles) GetUserByID(id int) (*model.User, error) {
+	return &model.User{ID: id, Role: u[id]}, nil
+}
+
+// TestRequireAdmin tests that only admins and API keys with the scope get through
+func TestRequireAdmin(t *testing.T) {
+	handler := middleware.RequireAdmin(userRoles{1: model.RoleAdmin, 7: model.RoleUser}, auth.ScopeMetricsRead)(
+		http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	call := func(principal *auth.Principal) int {
+		r := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		if principal != nil {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call(nil))
+	assert.Equal(t, http.StatusForbidden, call(&auth.Principal{UserID: 7, SessionID: "s1"}))
+	assert.Equal(t, http.StatusOK, call(&auth.Principal{UserID: 1, SessionID: "s2"}))
+	assert.Equal(t, http.StatusForbidden, call(&auth.Principal{ServicePrincipalID: "sp1", Scopes: []string{auth.ScopeUsersRead}}))
+	assert.Equal(t, http.StatusOK, call(&auth.Principal{ServicePrincipalID: "sp2", Scopes: []string{auth.ScopeMetricsRead}}))
+}
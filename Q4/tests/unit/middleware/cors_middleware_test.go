@@ -0,0 +1,108 @@
+package middleware_test
+
+import (
+	"Q4/internal/cors"
+	"Q4/internal/middleware"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// corsHandler serves the API under appCORS, except /api/v1/private which stays same-origin
+func corsHandler() http.Handler {
+	appCORS := cors.MustNew(cors.Options{
+		Origins:          []string{"https://app.example.com"},
+		ExposedHeaders:   []string{"RateLimit-Remaining"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	return middleware.CORS(
+		middleware.CORSRoute{PathPrefix: "/api/v1/private"},
+		middleware.CORSRoute{PathPrefix: "/api/v1", Policy: appCORS},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func corsRequest(method, path, origin string) *http.Request {
+	r := httptest.NewRequest(method, "http://api.example.com"+path, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+// TestCORS_Preflight tests that allowed preflights are answered and others refused
+func TestCORS_Preflight(t *testing.T) {
+	handler := corsHandler()
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		r := corsRequest(http.MethodOptions, "/api/v1/users/7", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		r.Header.Set("Access-Control-Request-Headers", headers)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw
+	}
+
+	rw := preflight("https://app.example.com", http.MethodDelete, "authorization, x-csrf-token")
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST, PUT, DELETE", rw.Header().Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, rw.Header().Get("Access-Control-Allow-Headers"), "X-CSRF-Token")
+	assert.Equal(t, "600", rw.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rw.Header().Get("Vary"), "Access-Control-Request-Headers")
+
+	for _, rejected := range []*httptest.ResponseRecorder{
+		preflight("https://evil.example.net", http.MethodDelete, ""),
+		preflight("https://app.example.com", http.MethodPatch, ""),
+		preflight("https://app.example.com", http.MethodPost, "x-debug"),
+	} {
+		assert.Equal(t, http.StatusForbidden, rejected.Code)
+		assert.Empty(t, rejected.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+// TestCORS_Requests tests the headers of actual requests
+func TestCORS_Requests(t *testing.T) {
+	handler := corsHandler()
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, corsRequest(http.MethodGet, "/api/v1/users", "https://app.example.com"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "RateLimit-Remaining", rw.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, corsRequest(http.MethodGet, "/api/v1/users", "https://evil.example.net"))
+	assert.Equal(t, http.StatusOK, rw.Code, "the browser, not the server, withholds the response")
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, corsRequest(http.MethodPost, "/api/v1/users", "http://api.example.com"))
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"), "same-origin requests need no CORS headers")
+}
+
+// TestCORS_RouteOverrides tests that the first route covering a path decides
+func TestCORS_RouteOverrides(t *testing.T) {
+	handler := corsHandler()
+
+	r := corsRequest(http.MethodOptions, "/api/v1/private/keys", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code, "uncovered paths are left to the router")
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rw.Header().Get("Vary"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, corsRequest(http.MethodGet, "/api/v1x", "https://app.example.com"))
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"), "prefixes match whole path segments")
+}
@@ -0,0 +1,27 @@
+package middleware_test
+
+import (
+	"Q4/internal/middleware"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHSTS tests that the header is only sent over TLS
+func TestHSTS(t *testing.T) {
+	handler := middleware.HSTS(180*24*time.Hour, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/api/v1/users", nil)
+	r.TLS = &tls.ConnectionState{}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, "max-age=15552000; includeSubDomains", rw.Header().Get("Strict-Transport-Security"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://api.example.com/api/v1/users", nil))
+	assert.Empty(t, rw.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,142 @@
+package middleware_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/idempotency"
+	"Q4/internal/middleware"
+	"Q4/internal/repository"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idempotencyFixture serves a create handler behind the middleware and counts its calls
+type idempotencyFixture struct {
+	keys    *idempotency.Keys
+	now     time.Time
+	calls   atomic.Int32
+	status  int
+	handler http.Handler
+	// block, if set, holds requests until it is closed
+	block chan struct{}
+}
+
+func newIdempotencyFixture() *idempotencyFixture {
+	f := &idempotencyFixture{now: time.Unix(1700000000, 0), status: http.StatusCreated}
+	f.keys = idempotency.NewKeys(repository.NewMemoryStore().IdempotencyKeys)
+	f.keys.Now = func() time.Time { return f.now }
+	f.handler = middleware.Idempotency(f.keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := f.calls.Add(1)
+		if f.block != nil {
+			<-f.block
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("RateLimit-Remaining", "9")
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	}))
+	return f
+}
+
+func (f *idempotencyFixture) post(key, body string, principal *auth.Principal) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(middleware.IdempotencyKeyHeader, key)
+	}
+	if principal != nil {
+		r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+	}
+	rw := httptest.NewRecorder()
+	f.handler.ServeHTTP(rw, r)
+	return rw
+}
+
+// TestIdempotency_Replay tests that retries get the first response and other requests do not
+func TestIdempotency_Replay(t *testing.T) {
+	f := newIdempotencyFixture()
+	ahmet := &auth.Principal{UserID: 1}
+
+	first := f.post("retry-1", `{"name":"Ahmet"}`, ahmet)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(middleware.IdempotentReplayedHeader))
+
+	retry := f.post("retry-1", `{"name":"Ahmet"}`, ahmet)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retry.Header().Get(middleware.IdempotentReplayedHeader))
+	assert.Empty(t, retry.Header().Get("RateLimit-Remaining"), "only the content headers are replayed")
+	assert.EqualValues(t, 1, f.calls.Load())
+
+	reused := f.post("retry-1", `{"name":"Ayşe"}`, ahmet)
+	assert.Equal(t, http.StatusUnprocessableEntity, reused.Code)
+
+	assert.Equal(t, http.StatusCreated, f.post("retry-1", `{"name":"Ahmet"}`, &auth.Principal{UserID: 2}).Code, "keys are scoped to the caller")
+	assert.Equal(t, http.StatusCreated, f.post("retry-1", `{"name":"Ahmet"}`, &auth.Principal{ServicePrincipalID: "sync"}).Code)
+	assert.Equal(t, http.StatusCreated, f.post("", `{"name":"Ahmet"}`, ahmet).Code)
+	assert.Equal(t, http.StatusCreated, f.post("", `{"name":"Ahmet"}`, ahmet).Code, "requests without a key are not deduplicated")
+	assert.EqualValues(t, 5, f.calls.Load())
+
+	f.now = f.now.Add(idempotency.DefaultTTL)
+	assert.Empty(t, f.post("retry-1", `{"name":"Ayşe"}`, ahmet).Header().Get(middleware.IdempotentReplayedHeader), "keys expire after the window")
+	assert.EqualValues(t, 6, f.calls.Load())
+
+	assert.Equal(t, http.StatusBadRequest, f.post(strings.Repeat("k", idempotency.MaxKeyLength+1), "{}", ahmet).Code)
+	assert.Equal(t, http.StatusBadRequest, f.post("café", "{}", ahmet).Code)
+}
+
+// TestIdempotency_Concurrent tests that a request with the key of one in progress gets 409 and
+// exactly one of many concurrent requests is handled
+func TestIdempotency_Concurrent(t *testing.T) {
+	f := newIdempotencyFixture()
+	f.block = make(chan struct{})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- f.post("retry-1", "{}", nil) }()
+	require.Eventually(t, func() bool { return f.calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	const retries = 10
+	results := make(chan int, retries)
+	for i := 0; i < retries; i++ {
+		go func() { results <- f.post("retry-1", "{}", nil).Code }()
+	}
+	for i := 0; i < retries; i++ {
+		assert.Equal(t, http.StatusConflict, <-results)
+	}
+	close(f.block)
+	assert.Equal(t, http.StatusCreated, (<-done).Code)
+	assert.EqualValues(t, 1, f.calls.Load())
+
+	assert.Equal(t, "true", f.post("retry-1", "{}", nil).Header().Get(middleware.IdempotentReplayedHeader))
+}
+
+// TestIdempotency_ServerErrors tests that failed requests are not stored, so they can be retried
+func TestIdempotency_ServerErrors(t *testing.T) {
+	f := newIdempotencyFixture()
+	f.status = http.StatusInternalServerError
+	assert.Equal(t, http.StatusInternalServerError, f.post("retry-1", "{}", nil).Code)
+
+	f.status = http.StatusCreated
+	rw := f.post("retry-1", "{}", nil)
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.Empty(t, rw.Header().Get(middleware.IdempotentReplayedHeader))
+	assert.EqualValues(t, 2, f.calls.Load())
+
+	// A request that never finished holds its key only until the lock times out
+	f.now = f.now.Add(time.Hour)
+	_, err := f.keys.Begin("ip:192.0.2.1", "stuck", "fp")
+	require.NoError(t, err)
+	_, err = f.keys.Begin("ip:192.0.2.1", "stuck", "fp")
+	assert.ErrorIs(t, err, idempotency.ErrKeyInUse)
+	f.now = f.now.Add(idempotency.DefaultLockTimeout)
+	claim, err := f.keys.Begin("ip:192.0.2.1", "stuck", "fp")
+	require.NoError(t, err)
+	assert.Zero(t, claim.Status)
+}
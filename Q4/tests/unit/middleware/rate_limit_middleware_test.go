@@ -0,0 +1,143 @@
+package middleware_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/middleware"
+	"Q4/internal/ratelimit"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStore stands in for a store that cannot be reached
+type failingStore struct{}
+
+func (failingStore) Get(string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingStore) CompareAndSwap(string, []byte, []byte, time.Duration) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func limited(policies ...middleware.RateLimitPolicy) http.Handler {
+	var handler http.Handler = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, policy := range policies {
+		handler = middleware.RateLimit(policy)(handler)
+	}
+	return handler
+}
+
+func request(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/users", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+// TestRateLimit_Headers tests the quota headers and the 429 once it runs out
+func TestRateLimit_Headers(t *testing.T) {
+	handler := limited(middleware.RateLimitPolicy{
+		Name:    "signup",
+		Limiter: ratelimit.NewTokenBucket(ratelimit.NewMemoryStore(), 2, time.Minute),
+		Key:     middleware.KeyByIP,
+	})
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, request("192.0.2.10:5000"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rw.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rw.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", rw.Header().Get("RateLimit-Policy"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), request("192.0.2.10:5001"))
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, request("192.0.2.10:5002"))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code, "ports do not matter")
+	assert.Equal(t, "0", rw.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rw.Header().Get("Retry-After"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, request("198.51.100.7:5000"))
+	assert.Equal(t, http.StatusOK, rw.Code, "other clients are not affected")
+}
+
+// TestRateLimit_NestedPolicies tests that the headers describe the policy closest to running out
+func TestRateLimit_NestedPolicies(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	handler := limited(
+		middleware.RateLimitPolicy{Name: "route", Limiter: ratelimit.NewTokenBucket(store, 5, time.Minute), Key: middleware.KeyByIP},
+		middleware.RateLimitPolicy{Name: "global", Limiter: ratelimit.NewTokenBucket(store, 100, time.Minute), Key: middleware.KeyByIP},
+	)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, request("192.0.2.10:5000"))
+	assert.Equal(t, "5", rw.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "4", rw.Header().Get("RateLimit-Remaining"))
+}
+
+// TestRateLimit_Keys tests that signed-in users and API keys are counted apart from their address
+func TestRateLimit_Keys(t *testing.T) {
+	plain := request("192.0.2.10:5000")
+	withKey := request("192.0.2.10:5000")
+	withKey.Header.Set(middleware.APIKeyHeader, "q4_secret")
+	signedIn := withKey.WithContext(auth.WithPrincipal(withKey.Context(), &auth.Principal{UserID: 7}))
+
+	assert.Equal(t, "ip:192.0.2.10", middleware.KeyByIP(withKey))
+	assert.Equal(t, "ip:192.0.2.10", middleware.KeyByAPIKey(plain))
+	assert.NotContains(t, middleware.KeyByAPIKey(withKey), "q4_secret", "API keys are not stored in plain text")
+	assert.Equal(t, "ip:192.0.2.10", middleware.KeyByUser(withKey), "keys that did not sign in are not trusted")
+	assert.Equal(t, "user:7", middleware.KeyByUser(signedIn))
+
+	// API keys carry no user ID, so each service principal gets a bucket of its own
+	service := withKey.WithContext(auth.WithPrincipal(withKey.Context(), &auth.Principal{ServicePrincipalID: "sp_1", APIKeyID: "k1"}))
+	other := withKey.WithContext(auth.WithPrincipal(withKey.Context(), &auth.Principal{ServicePrincipalID: "sp_2", APIKeyID: "k2"}))
+	assert.Equal(t, "service-principal:sp_1", middleware.KeyByUser(service))
+	assert.NotEqual(t, middleware.KeyByUser(service), middleware.KeyByUser(other))
+}
+
+// TestRateLimit_MadeUpKeys tests that a client sending a new API key with every request still runs
+// out of requests when the key policy sits behind one keyed by address, as the global limit does
+func TestRateLimit_MadeUpKeys(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	handler := limited(
+		middleware.RateLimitPolicy{Name: "api-key", Limiter: ratelimit.NewTokenBucket(store, 2, time.Minute), Key: middleware.KeyByAPIKey},
+		middleware.RateLimitPolicy{Name: "global", Limiter: ratelimit.NewTokenBucket(store, 2, time.Minute), Key: middleware.KeyByIP},
+	)
+
+	codes := []int{}
+	for i := range 3 {
+		r := request("192.0.2.10:5000")
+		r.Header.Set(middleware.APIKeyHeader, fmt.Sprintf("q4k_madeup_%d", i))
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		codes = append(codes, rw.Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+
+	r := request("192.0.2.10:5000")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code, "requests without a key share the bucket of the address")
+}
+
+// TestRateLimit_StoreUnavailable tests that requests are let through when the store fails
+func TestRateLimit_StoreUnavailable(t *testing.T) {
+	handler := limited(middleware.RateLimitPolicy{
+		Name:    "signup",
+		Limiter: ratelimit.NewTokenBucket(failingStore{}, 1, time.Minute),
+		Key:     middleware.KeyByIP,
+	})
+
+	for range 3 {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, request("192.0.2.10:5000"))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Header().Get("RateLimit-Limit"))
+	}
+}
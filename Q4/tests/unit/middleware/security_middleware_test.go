@@ -0,0 +1,70 @@
+package middleware_test
+
+import (
+	"Q4/internal/middleware"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSecurityHeaders tests that every response carries the headers and pages may replace the policy
+func TestSecurityHeaders(t *testing.T) {
+	page := middleware.SecurityHeaders("default-src 'self'")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	handler := middleware.SecurityHeaders(middleware.APIContentSecurityPolicy)(page)
+
+	rw := httptest.NewRecorder()
+	middleware.SecurityHeaders(middleware.APIContentSecurityPolicy)(http.NotFoundHandler()).
+		ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/users/1", nil))
+	assert.Equal(t, middleware.APIContentSecurityPolicy, rw.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", rw.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", rw.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "no-referrer", rw.Header().Get("Referrer-Policy"))
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/swagger/index.html", nil))
+	assert.Equal(t, "default-src 'self'", rw.Header().Get("Content-Security-Policy"))
+}
+
+// TestLimitRequests tests URL, content type and body size limits per route
+func TestLimitRequests(t *testing.T) {
+	handler := middleware.LimitRequests(64,
+		middleware.RequestLimits{PathPrefix: "/api/v1/users:import", MaxBodyBytes: 100},
+		middleware.RequestLimits{PathPrefix: "/api/v1", MaxBodyBytes: 10, ContentTypes: []string{"application/json"}},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	for _, tt := range []struct {
+		name, method, target, contentType, body string
+		chunked                                 bool
+		status                                  int
+	}{
+		{"json body", http.MethodPost, "/api/v1/users", "application/json; charset=utf-8", `{"a":1}`, false, http.StatusOK},
+		{"no body", http.MethodPost, "/api/v1/auth/logout", "", "", false, http.StatusOK},
+		{"get", http.MethodGet, "/api/v1/users?name=a", "", "", false, http.StatusOK},
+		{"long URL", http.MethodGet, "/api/v1/users?name=" + strings.Repeat("a", 64), "", "", false, http.StatusRequestURITooLong},
+		{"form on the API", http.MethodPost, "/api/v1/users", "application/x-www-form-urlencoded", "a=1", false, http.StatusUnsupportedMediaType},
+		{"missing content type", http.MethodPost, "/api/v1/users", "", `{"a":1}`, false, http.StatusUnsupportedMediaType},
+		{"declared too large", http.MethodPost, "/api/v1/users", "application/json", `{"name":"ahmet"}`, false, http.StatusRequestEntityTooLarge},
+		{"streamed too large", http.MethodPost, "/api/v1/users", "application/json", `{"name":"ahmet"}`, true, http.StatusRequestEntityTooLarge},
+		{"import", http.MethodPost, "/api/v1/users:import", "text/csv", "name,email\nAhmet,ahmet@example.com\n", false, http.StatusOK},
+		{"uncovered path", http.MethodPost, "/other", "text/plain", strings.Repeat("a", 1000), false, http.StatusOK},
+	} {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.chunked {
+			r.ContentLength = -1
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		assert.Equal(t, tt.status, rw.Code, tt.name)
+	}
+}
@@ -0,0 +1,107 @@
+package oidc_test
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/oidc"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestS256Challenge_RFC7636Example tests the challenge against the example in RFC 7636 appendix B
+func TestS256Challenge_RFC7636Example(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.Equal(t, challenge, oidc.S256Challenge(verifier))
+	assert.True(t, oidc.ValidCodeChallenge(challenge))
+	assert.True(t, oidc.VerifyCodeChallenge(verifier, challenge))
+	assert.False(t, oidc.VerifyCodeChallenge(verifier+"x", challenge))
+	assert.False(t, oidc.VerifyCodeChallenge(challenge, challenge), "the challenge is not its own verifier")
+}
+
+// TestValidCodeVerifier tests the length and alphabet limits of RFC 7636
+func TestValidCodeVerifier(t *testing.T) {
+	assert.True(t, oidc.ValidCodeVerifier(strings.Repeat("a", 43)))
+	assert.True(t, oidc.ValidCodeVerifier(strings.Repeat("-._~", 32)))
+	assert.False(t, oidc.ValidCodeVerifier(strings.Repeat("a", 42)), "too short")
+	assert.False(t, oidc.ValidCodeVerifier(strings.Repeat("a", 129)), "too long")
+	assert.False(t, oidc.ValidCodeVerifier(strings.Repeat("a", 42)+"+"), "not unreserved")
+	assert.False(t, oidc.ValidCodeChallenge("plain-text-challenge"))
+}
+
+// TestSigningKey_SignAndVerify tests that ID tokens verify against the JWKS and not after tampering
+func TestSigningKey_SignAndVerify(t *testing.T) {
+	key, err := oidc.NewSigningKey()
+	require.NoError(t, err)
+	keys := &oidc.JSONWebKeySet{Keys: []oidc.JWK{key.JWK()}}
+
+	token, err := key.Sign(oidc.IDTokenClaims{Issuer: "https://id.example.com", Audience: "wiki", UserClaims: oidc.UserClaims{Subject: "42"}})
+	require.NoError(t, err)
+
+	var claims oidc.IDTokenClaims
+	require.NoError(t, oidc.Verify(token, keys, &claims))
+	assert.Equal(t, "42", claims.Subject)
+	assert.Equal(t, "wiki", claims.Audience)
+
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]string{"iss": "https://id.example.com", "aud": "wiki", "sub": "1"})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	assert.ErrorIs(t, oidc.Verify(tampered, keys, &claims), oidc.ErrInvalidJWT)
+
+	none, _ := json.Marshal(map[string]string{"alg": "none", "kid": key.ID})
+	unsigned := base64.RawURLEncoding.EncodeToString(none) + "." + parts[1] + "."
+	assert.ErrorIs(t, oidc.Verify(unsigned, keys, &claims), oidc.ErrInvalidJWT, "alg none is refused")
+
+	other, err := oidc.NewSigningKey()
+	require.NoError(t, err)
+	assert.ErrorIs(t, oidc.Verify(token, &oidc.JSONWebKeySet{Keys: []oidc.JWK{other.JWK()}}, &claims), oidc.ErrInvalidJWT, "unknown kid")
+}
+
+// TestParseSigningKey tests that a stored key keeps its ID
+func TestParseSigningKey(t *testing.T) {
+	key, err := oidc.NewSigningKey()
+	require.NoError(t, err)
+	der, err := key.Marshal()
+	require.NoError(t, err)
+
+	parsed, err := oidc.ParseSigningKey(der)
+	require.NoError(t, err)
+	assert.Equal(t, key.ID, parsed.ID)
+	assert.Equal(t, key.JWK(), parsed.JWK())
+	assert.Equal(t, "AQAB", key.JWK().E)
+}
+
+// TestClaimsForUser tests that each scope releases only its own claims
+func TestClaimsForUser(t *testing.T) {
+	user := &model.User{ID: 42, Name: "Ahmet", Email: "ahmet@example.com", Role: model.RoleAdmin, EmailVerified: true}
+
+	claims := oidc.ClaimsForUser(user, []string{oidc.ScopeOpenID})
+	assert.Equal(t, oidc.UserClaims{Subject: "42"}, claims)
+
+	claims = oidc.ClaimsForUser(user, []string{oidc.ScopeOpenID, oidc.ScopeProfile})
+	assert.Equal(t, "Ahmet", claims.Name)
+	assert.Equal(t, model.RoleAdmin, claims.Role)
+	assert.Empty(t, claims.Email)
+
+	claims = oidc.ClaimsForUser(user, []string{oidc.ScopeOpenID, oidc.ScopeEmail})
+	assert.Empty(t, claims.Name)
+	assert.Equal(t, "ahmet@example.com", claims.Email)
+	require.NotNil(t, claims.EmailVerified)
+	assert.True(t, *claims.EmailVerified)
+}
+
+// TestError_Is tests that OAuth errors match by code
+func TestError_Is(t *testing.T) {
+	err := oidc.Errorf(oidc.ErrInvalidGrant, "code expired")
+	assert.ErrorIs(t, err, oidc.ErrInvalidGrant)
+	assert.NotErrorIs(t, err, oidc.ErrInvalidRequest)
+	assert.Equal(t, "invalid_grant: code expired", err.Error())
+
+	body, _ := json.Marshal(err)
+	assert.JSONEq(t, `{"error":"invalid_grant","error_description":"code expired"}`, string(body))
+}
@@ -0,0 +1,112 @@
+package ratelimit_test
+
+import (
+	"Q4/internal/ratelimit"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// take sends n requests for key and returns the last decision
+func take(t *testing.T, limiter ratelimit.Limiter, key string, n int) ratelimit.Decision {
+	t.Helper()
+	var decision ratelimit.Decision
+	for range n {
+		var err error
+		decision, err = limiter.Take(key)
+		require.NoError(t, err)
+	}
+	return decision
+}
+
+// TestTokenBucket_BurstAndRefill tests that a full bucket allows a burst and then refills steadily
+func TestTokenBucket_BurstAndRefill(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	bucket := ratelimit.NewTokenBucket(ratelimit.NewMemoryStore(), 6, time.Minute)
+	bucket.Now = func() time.Time { return now }
+
+	decision := take(t, bucket, "ahmet", 6)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 6, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Equal(t, time.Minute, decision.Reset)
+
+	decision = take(t, bucket, "ahmet", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 10*time.Second, decision.RetryAfter, "one token comes back every 10s")
+	assert.True(t, take(t, bucket, "ayse", 1).Allowed, "keys have buckets of their own")
+
+	now = now.Add(25 * time.Second)
+	decision = take(t, bucket, "ahmet", 1)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, 5, take(t, bucket, "ahmet", 1).Remaining, "buckets do not fill beyond their size")
+}
+
+// TestTokenBucket_Burst tests a bucket larger than its rate
+func TestTokenBucket_Burst(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	bucket := ratelimit.NewTokenBucket(ratelimit.NewMemoryStore(), 1, time.Second)
+	bucket.Burst = 3
+	bucket.Now = func() time.Time { return now }
+
+	assert.True(t, take(t, bucket, "ahmet", 3).Allowed)
+	assert.False(t, take(t, bucket, "ahmet", 1).Allowed)
+	now = now.Add(time.Second)
+	assert.True(t, take(t, bucket, "ahmet", 1).Allowed)
+	assert.False(t, take(t, bucket, "ahmet", 1).Allowed)
+}
+
+// TestSlidingWindowCounter_WeighsPreviousWindow tests that requests of the previous window fade out gradually
+func TestSlidingWindowCounter_WeighsPreviousWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	counter := ratelimit.NewSlidingWindowCounter(ratelimit.NewMemoryStore(), 10, time.Minute)
+	counter.Now = func() time.Time { return now }
+
+	decision := take(t, counter, "ahmet", 10)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	decision = take(t, counter, "ahmet", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Minute, decision.Reset)
+	assert.Equal(t, time.Minute+6*time.Second, decision.RetryAfter, "the next window has room once a tenth of this one faded")
+
+	// A quarter into the next window, the 10 earlier requests still count as 7.5
+	now = now.Add(75 * time.Second)
+	decision = take(t, counter, "ahmet", 2)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	decision = take(t, counter, "ahmet", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 3*time.Second, decision.RetryAfter, "room for one more once the earlier requests count as 7")
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 9, take(t, counter, "ahmet", 1).Remaining, "older windows no longer count")
+}
+
+// TestMemoryStore_CompareAndSwap tests that swaps fail once the value changed or expired
+func TestMemoryStore_CompareAndSwap(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := ratelimit.NewMemoryStore()
+	store.Now = func() time.Time { return now }
+
+	swapped, err := store.CompareAndSwap("k", []byte("1"), []byte("2"), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, swapped, "the key is missing")
+	swapped, _ = store.CompareAndSwap("k", nil, []byte("1"), time.Minute)
+	assert.True(t, swapped)
+	swapped, _ = store.CompareAndSwap("k", nil, []byte("1"), time.Minute)
+	assert.False(t, swapped, "the key exists now")
+	swapped, _ = store.CompareAndSwap("k", []byte("1"), []byte("2"), time.Minute)
+	assert.True(t, swapped)
+
+	value, _ := store.Get("k")
+	assert.Equal(t, []byte("2"), value)
+	now = now.Add(time.Minute)
+	value, _ = store.Get("k")
+	assert.Nil(t, value)
+}
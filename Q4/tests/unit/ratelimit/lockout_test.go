@@ -0,0 +1,78 @@
+package ratelimit_test
+
+import (
+	"Q4/internal/ratelimit"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLockout(now *time.Time) *ratelimit.Lockout {
+	lockout := ratelimit.NewLockout(3, 10*time.Minute)
+	lockout.MaxDuration = time.Hour
+	lockout.Now = func() time.Time { return *now }
+	return lockout
+}
+
+// TestLockout_LocksAfterThreshold tests the progressive delay and the lockout that follows it
+func TestLockout_LocksAfterThreshold(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lockout := newLockout(&now)
+
+	delay, locked := lockout.Fail("ahmet")
+	assert.Equal(t, 250*time.Millisecond, delay)
+	assert.Zero(t, locked)
+	delay, _ = lockout.Fail("ahmet")
+	assert.Equal(t, 500*time.Millisecond, delay)
+	assert.Zero(t, lockout.Locked("ahmet"))
+
+	_, locked = lockout.Fail("ahmet")
+	assert.Equal(t, 10*time.Minute, locked)
+	now = now.Add(4 * time.Minute)
+	assert.Equal(t, 6*time.Minute, lockout.Locked("ahmet"))
+	assert.Zero(t, lockout.Locked("ayse"), "keys are tracked apart")
+
+	now = now.Add(6 * time.Minute)
+	assert.Zero(t, lockout.Locked("ahmet"))
+}
+
+// TestLockout_RepeatedLockoutsDouble tests that lockouts grow while failures continue and reset after a quiet window
+func TestLockout_RepeatedLockoutsDouble(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lockout := newLockout(&now)
+	lockOut := func() time.Duration {
+		var locked time.Duration
+		for range 3 {
+			_, locked = lockout.Fail("ahmet")
+		}
+		now = now.Add(locked)
+		return locked
+	}
+
+	assert.Equal(t, 10*time.Minute, lockOut())
+	assert.Equal(t, 20*time.Minute, lockOut())
+	assert.Equal(t, 40*time.Minute, lockOut())
+	assert.Equal(t, time.Hour, lockOut(), "capped at MaxDuration")
+
+	now = now.Add(10*time.Minute + time.Second)
+	assert.Equal(t, 10*time.Minute, lockOut(), "a quiet window starts over")
+}
+
+// TestLockout_Reset tests that resetting lifts a lockout and forgets earlier failures
+func TestLockout_Reset(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lockout := newLockout(&now)
+
+	lockout.Fail("ahmet")
+	lockout.Fail("ahmet")
+	assert.False(t, lockout.Reset("ahmet"), "the key was not locked yet")
+	_, locked := lockout.Fail("ahmet")
+	assert.Zero(t, locked, "the failures before the reset no longer count")
+
+	lockout.Fail("ahmet")
+	lockout.Fail("ahmet")
+	assert.Positive(t, lockout.Locked("ahmet"))
+	assert.True(t, lockout.Reset("ahmet"))
+	assert.Zero(t, lockout.Locked("ahmet"))
+}
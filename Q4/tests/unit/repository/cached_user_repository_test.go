@@ -0,0 +1,101 @@
+package repository_test
+
+import (
+	"Q4/internal/cache"
+	"Q4/internal/model"
+	"Q4/internal/repository"
+	repomock "Q4/internal/repository/mock"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCachedUserRepository_ReadThrough tests that repeated lookups only reach the inner repository once
+func TestCachedUserRepository_ReadThrough(t *testing.T) {
+	mockRepo := new(repomock.MockUserRepository)
+	mockRepo.On("GetUserByID", 1).Return(&model.User{ID: 1, Name: "Ahmet", Email: "ahmet@example.com"}, nil).Once()
+
+	cached := repository.NewCachedUserRepository(mockRepo, cache.NewLRU(10))
+	for i := 0; i < 3; i++ {
+		user, err := cached.GetUserByID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Ahmet", user.Name)
+	}
+
+	assert.Equal(t, repository.CacheStats{Hits: 2, Misses: 1}, cached.Stats())
+	mockRepo.AssertExpectations(t)
+}
+
+// TestCachedUserRepository_NegativeCaching tests that missing IDs are cached until a user is created with that ID
+func TestCachedUserRepository_NegativeCaching(t *testing.T) {
+	mockRepo := new(repomock.MockUserRepository)
+	mockRepo.On("GetUserByID", 7).Return(nil, repository.ErrUserNotFound).Once()
+
+	cached := repository.NewCachedUserRepository(mockRepo, cache.NewLRU(10))
+	for i := 0; i < 2; i++ {
+		_, err := cached.GetUserByID(7)
+		assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	}
+	assert.Equal(t, int64(1), cached.Stats().NegativeHits)
+
+	mockRepo.On("CreateUser", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*model.User).ID = 7
+	}).Return(nil)
+	mockRepo.On("GetUserByID", 7).Return(&model.User{ID: 7, Name: "Ayse"}, nil).Once()
+
+	require.NoError(t, cached.CreateUser(&model.User{Name: "Ayse"}))
+	user, err := cached.GetUserByID(7)
+	require.NoError(t, err)
+	assert.Equal(t, "Ayse", user.Name)
+	mockRepo.AssertExpectations(t)
+}
+
+// TestCachedUserRepository_Invalidation tests that updates and deletes evict the cached user
+func TestCachedUserRepository_Invalidation(t *testing.T) {
+	mockRepo := new(repomock.MockUserRepository)
+	mockRepo.On("GetUserByID", 1).Return(&model.User{ID: 1, Name: "Ahmet"}, nil).Once()
+	mockRepo.On("UpdateUser", mock.Anything).Return(nil)
+	mockRepo.On("DeleteUser", 1).Return(nil)
+
+	cached := repository.NewCachedUserRepository(mockRepo, cache.NewLRU(10))
+	_, err := cached.GetUserByID(1)
+	require.NoError(t, err)
+
+	require.NoError(t, cached.UpdateUser(&model.User{ID: 1, Name: "Ahmet Y."}))
+	mockRepo.On("GetUserByID", 1).Return(&model.User{ID: 1, Name: "Ahmet Y."}, nil).Once()
+	user, err := cached.GetUserByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ahmet Y.", user.Name)
+
+	require.NoError(t, cached.DeleteUser(1))
+	mockRepo.On("GetUserByID", 1).Return(nil, repository.ErrUserNotFound).Once()
+	_, err = cached.GetUserByID(1)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	mockRepo.AssertExpectations(t)
+}
+
+// TestCachedUserRepository_Singleflight tests that concurrent misses share one load
+func TestCachedUserRepository_Singleflight(t *testing.T) {
+	mockRepo := new(repomock.MockUserRepository)
+	mockRepo.On("GetUserByID", 1).After(50*time.Millisecond).Return(&model.User{ID: 1, Name: "Ahmet"}, nil)
+
+	cached := repository.NewCachedUserRepository(mockRepo, cache.NewLRU(10))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := cached.GetUserByID(1)
+			assert.NoError(t, err)
+			assert.Equal(t, "Ahmet", user.Name)
+		}()
+	}
+	wg.Wait()
+
+	mockRepo.AssertNumberOfCalls(t, "GetUserByID", 1)
+}
@@ -0,0 +1,91 @@
+package service_test
+
+import (
+	"Q4/internal/model"
+	"Q4/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUserEvents_Publish tests that subscribers get the events in order, without passwords
+func TestUserEvents_Publish(t *testing.T) {
+	events := service.NewUserEvents(0)
+	sub := events.Subscribe(4)
+	defer sub.Close()
+
+	events.Publish(model.UserCreated, model.User{ID: 1, Name: "Ahmet", Password: "secret-password"})
+	events.Publish(model.UserDeleted, model.User{ID: 1, Name: "Ahmet"})
+
+	first := <-sub.Events()
+	assert.Equal(t, model.UserCreated, first.Type)
+	assert.Empty(t, first.User.Password)
+	second := <-sub.Events()
+	assert.Equal(t, model.UserDeleted, second.Type)
+	assert.Equal(t, first.ID+1, second.ID)
+}
+
+// TestUserEvents_SlowSubscriber tests that a subscriber whose buffer is full is dropped without
+// holding up the publisher or the other subscribers
+func TestUserEvents_SlowSubscriber(t *testing.T) {
+	events := service.NewUserEvents(0)
+	slow := events.Subscribe(1)
+	fast := events.Subscribe(8)
+	defer fast.Close()
+
+	for id := 1; id <= 3; id++ {
+		events.Publish(model.UserUpdated, model.User{ID: id})
+	}
+
+	event, ok := <-slow.Events()
+	require.True(t, ok)
+	assert.Equal(t, 1, event.User.ID)
+	_, ok = <-slow.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, slow.Err(), service.ErrSubscriberTooSlow)
+	slow.Close()
+
+	assert.Len(t, fast.Events(), 3)
+}
+
+// TestUserEvents_Close tests that closing a subscription ends it without an error
+func TestUserEvents_Close(t *testing.T) {
+	events := service.NewUserEvents(0)
+	sub := events.Subscribe(0)
+	sub.Close()
+	sub.Close()
+
+	events.Publish(model.UserCreated, model.User{ID: 1})
+	_, ok := <-sub.Events()
+	assert.False(t, ok)
+	assert.NoError(t, sub.Err())
+}
+
+// TestUserEvents_Resume tests that resuming replays the kept events after the last one seen, and
+// reports when some of them are gone
+func TestUserEvents_Resume(t *testing.T) {
+	events := service.NewUserEvents(2)
+	first := events.Publish(model.UserCreated, model.User{ID: 1})
+	second := events.Publish(model.UserCreated, model.User{ID: 2})
+
+	sub, complete := events.Resume(first.ID, 0)
+	assert.True(t, complete)
+	assert.Equal(t, second.ID, (<-sub.Events()).ID)
+	sub.Close()
+
+	sub, complete = events.Resume(second.ID, 0)
+	assert.True(t, complete)
+	assert.Empty(t, sub.Events())
+	sub.Close()
+
+	third := events.Publish(model.UserCreated, model.User{ID: 3})
+	sub, complete = events.Resume(first.ID-1, 0)
+	assert.False(t, complete, "the first event is no longer kept")
+	assert.Empty(t, sub.Events())
+	sub.Close()
+
+	sub, complete = events.Resume(third.ID+100, 0)
+	assert.False(t, complete, "IDs from the future are unknown")
+	sub.Close()
+}
@@ -0,0 +1,221 @@
+package tlsutil_test
+
+import (
+	"Q4/internal/auth"
+	"Q4/internal/middleware"
+	"Q4/internal/tlsutil"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate with its key, signed by a testCA or by itself
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// newCert issues a certificate for subject. A nil parent makes a self-signed CA.
+func newCert(t *testing.T, parent *testCert, subject pkix.Name, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	pair, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	require.NoError(t, err)
+	return pair
+}
+
+// writePair writes c to cert.pem and key.pem in dir, dated at modTime
+func writePair(t *testing.T, dir string, c *testCert, modTime time.Time) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, c.certPEM(), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, c.keyPEM(t), 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func servedCN(t *testing.T, certs *tlsutil.CertReloader) string {
+	cert, err := certs.GetCertificate(nil)
+	require.NoError(t, err)
+	return cert.Leaf.Subject.CommonName
+}
+
+// TestCertReloader_Watch tests that replaced files are picked up and broken ones are not
+func TestCertReloader_Watch(t *testing.T) {
+	ca := newCert(t, nil, pkix.Name{CommonName: "Test CA"}, 0)
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writePair(t, dir, newCert(t, ca, pkix.Name{CommonName: "first"}, x509.ExtKeyUsageServerAuth), now)
+
+	certs, err := tlsutil.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", servedCN(t, certs))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go certs.Watch(10*time.Millisecond, stop)
+
+	writePair(t, dir, newCert(t, ca, pkix.Name{CommonName: "renewed"}, x509.ExtKeyUsageServerAuth), now.Add(time.Minute))
+	require.Eventually(t, func() bool { return servedCN(t, certs) == "renewed" }, time.Second, 10*time.Millisecond)
+
+	// A renewal that has written the certificate but not yet its key
+	require.NoError(t, os.WriteFile(certFile, newCert(t, ca, pkix.Name{CommonName: "half"}, x509.ExtKeyUsageServerAuth).certPEM(), 0o600))
+	reloaded, err := certs.Reload()
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "renewed", servedCN(t, certs))
+
+	_, err = tlsutil.NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	assert.Error(t, err)
+}
+
+// certAuthenticator maps the subject "CN=sync,O=Example" to the service principal "sync"
+type certAuthenticator struct{}
+
+func (certAuthenticator) Authenticate(string) (*auth.Principal, error) {
+	return nil, auth.ErrUnauthenticated
+}
+
+func (certAuthenticator) AuthenticateCertificate(cert *x509.Certificate) (*auth.Principal, error) {
+	if cert.Subject.String() != "CN=sync,O=Example" {
+		return nil, fmt.Errorf("%w: unknown certificate", auth.ErrUnauthenticated)
+	}
+	return &auth.Principal{ServicePrincipalID: "sync"}, nil
+}
+
+// TestServerConfig_MutualTLS tests that verified client certificates sign in as their service principal
+func TestServerConfig_MutualTLS(t *testing.T) {
+	ca := newCert(t, nil, pkix.Name{CommonName: "Test CA"}, 0)
+	certFile, keyFile := writePair(t, t.TempDir(), newCert(t, ca, pkix.Name{CommonName: "localhost"}, x509.ExtKeyUsageServerAuth), time.Now())
+	certs, err := tlsutil.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	// Served like main does; httptest.Server would replace the certificate with its own
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: middleware.AuthMiddleware(certAuthenticator{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if principal := auth.PrincipalFrom(r.Context()); principal != nil {
+				fmt.Fprint(w, principal.ServicePrincipalID)
+			}
+		})),
+		TLSConfig: tlsutil.ServerConfig(certs, clientCAs),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	get := func(clientCert *testCert) (int, string, error) {
+		config := &tls.Config{RootCAs: clientCAs}
+		if clientCert != nil {
+			pair := clientCert.tlsCertificate(t)
+			// Sent even if the server does not list its CA, which crypto/tls would otherwise avoid
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		res, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body), nil
+	}
+
+	status, body, err := get(newCert(t, ca, pkix.Name{CommonName: "sync", Organization: []string{"Example"}}, x509.ExtKeyUsageClientAuth))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "sync", body)
+
+	status, body, err = get(nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body, "clients without a certificate stay anonymous")
+
+	status, _, err = get(newCert(t, ca, pkix.Name{CommonName: "stranger"}, x509.ExtKeyUsageClientAuth))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status, "unmapped certificates are rejected")
+
+	otherCA := newCert(t, nil, pkix.Name{CommonName: "Other CA"}, 0)
+	_, _, err = get(newCert(t, otherCA, pkix.Name{CommonName: "sync", Organization: []string{"Example"}}, x509.ExtKeyUsageClientAuth))
+	assert.Error(t, err, "certificates from untrusted CAs fail the handshake")
+}
+
+// TestRedirectHandler tests the redirect from HTTP to HTTPS
+func TestRedirectHandler(t *testing.T) {
+	for _, tt := range []struct {
+		httpsAddr, target, location string
+	}{
+		{":443", "http://api.example.com/api/v1/users?name=a", "https://api.example.com/api/v1/users?name=a"},
+		{":8443", "http://api.example.com:8080/api/v1/users", "https://api.example.com:8443/api/v1/users"},
+		{":8443", "http://[::1]:8080/", "https://[::1]:8443/"},
+		{":443", "http://[::1]/", "https://[::1]/"},
+	} {
+		rw := httptest.NewRecorder()
+		tlsutil.RedirectHandler(tt.httpsAddr).ServeHTTP(rw, httptest.NewRequest(http.MethodPost, tt.target, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, rw.Code)
+		assert.Equal(t, tt.location, rw.Header().Get("Location"), tt.target)
+	}
+}
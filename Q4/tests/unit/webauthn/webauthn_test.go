@@ -0,0 +1,190 @@
+package webauthn_test
+
+import (
+	"Q4/internal/webauthn"
+	"Q4/internal/webauthn/webauthntest"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const origin = "https://app.example.com"
+
+var rp = &webauthn.RelyingParty{ID: "example.com", Name: "Q4", Origins: []string{origin}}
+
+func creationOptions(challenge []byte) webauthn.CredentialCreationOptions {
+	return webauthn.CredentialCreationOptions{
+		RP:        webauthn.RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:      webauthn.UserEntity{ID: []byte("42"), Name: "ahmet@example.com"},
+		Challenge: challenge,
+	}
+}
+
+func requestOptions(challenge []byte) webauthn.CredentialRequestOptions {
+	return webauthn.CredentialRequestOptions{Challenge: challenge, RPID: rp.ID}
+}
+
+// TestVerifyRegistration_Formats tests that every supported attestation format is accepted
+func TestVerifyRegistration_Formats(t *testing.T) {
+	for name, attestation := range map[string]webauthntest.Attestation{
+		"none":         webauthntest.NoAttestation,
+		"packed self":  webauthntest.SelfAttestation,
+		"packed basic": webauthntest.BasicAttestation,
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := webauthntest.New(attestation)
+			challenge := webauthn.NewChallenge()
+
+			reg, err := rp.VerifyRegistration(challenge, a.Register(origin, creationOptions(challenge)))
+			require.NoError(t, err)
+			assert.Equal(t, a.CredentialID, reg.CredentialID)
+			assert.Equal(t, a.PublicKey(), reg.PublicKey)
+			assert.Equal(t, a.AAGUID, reg.AAGUID)
+			assert.Equal(t, webauthn.AlgES256, reg.Algorithm)
+			if attestation == webauthntest.NoAttestation {
+				assert.Equal(t, webauthn.FormatNone, reg.AttestationFormat)
+			} else {
+				assert.Equal(t, webauthn.FormatPacked, reg.AttestationFormat)
+			}
+		})
+	}
+}
+
+// TestVerifyRegistration_Rejects tests that responses from the wrong context or with broken
+// attestation are refused
+func TestVerifyRegistration_Rejects(t *testing.T) {
+	challenge := webauthn.NewChallenge()
+	tests := []struct {
+		name   string
+		tamper func(a *webauthntest.Authenticator, origin *string, options *webauthn.CredentialCreationOptions)
+	}{
+		{"wrong challenge", func(_ *webauthntest.Authenticator, _ *string, o *webauthn.CredentialCreationOptions) {
+			o.Challenge = webauthn.NewChallenge()
+		}},
+		{"wrong origin", func(_ *webauthntest.Authenticator, origin *string, _ *webauthn.CredentialCreationOptions) {
+			*origin = "https://evil.example.net"
+		}},
+		{"wrong relying party", func(_ *webauthntest.Authenticator, _ *string, o *webauthn.CredentialCreationOptions) {
+			o.RP.ID = "evil.example.net"
+		}},
+		{"no user verification", func(a *webauthntest.Authenticator, _ *string, _ *webauthn.CredentialCreationOptions) {
+			a.SkipUserVerification = true
+		}},
+		{"certificate for another model", func(a *webauthntest.Authenticator, _ *string, _ *webauthn.CredentialCreationOptions) {
+			a.AAGUID = make([]byte, 16)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := webauthntest.New(webauthntest.BasicAttestation)
+			o, options := origin, creationOptions(challenge)
+			tt.tamper(a, &o, &options)
+
+			_, err := rp.VerifyRegistration(challenge, a.Register(o, options))
+			assert.ErrorIs(t, err, webauthn.ErrVerification)
+		})
+	}
+}
+
+// TestVerifyRegistration_BadSignature tests that a packed statement must be signed over the response
+func TestVerifyRegistration_BadSignature(t *testing.T) {
+	a := webauthntest.New(webauthntest.SelfAttestation)
+	challenge := webauthn.NewChallenge()
+	credential := a.Register(origin, creationOptions(challenge))
+
+	// Client data that still passes its own checks, but is not what the statement was signed over
+	credential.Response.ClientDataJSON, _ = json.Marshal(map[string]any{
+		"type": "webauthn.create", "challenge": webauthn.Base64URL(challenge).String(), "origin": origin, "extra": 1,
+	})
+
+	_, err := rp.VerifyRegistration(challenge, credential)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+}
+
+// TestVerifyAssertion_SignCount tests the signature check and that the counter must grow
+func TestVerifyAssertion_SignCount(t *testing.T) {
+	a := webauthntest.New(webauthntest.NoAttestation)
+	challenge := webauthn.NewChallenge()
+	reg, err := rp.VerifyRegistration(challenge, a.Register(origin, creationOptions(challenge)))
+	require.NoError(t, err)
+
+	challenge = webauthn.NewChallenge()
+	count, err := rp.VerifyAssertion(challenge, a.Login(origin, requestOptions(challenge)), reg.PublicKey, reg.SignCount)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), count)
+
+	_, err = rp.VerifyAssertion(webauthn.NewChallenge(), a.Login(origin, requestOptions(challenge)), reg.PublicKey, count)
+	assert.ErrorIs(t, err, webauthn.ErrVerification, "the challenge is bound to the signature")
+
+	a.SignCount = 0
+	challenge = webauthn.NewChallenge()
+	_, err = rp.VerifyAssertion(challenge, a.Login(origin, requestOptions(challenge)), reg.PublicKey, 5)
+	assert.ErrorIs(t, err, webauthn.ErrSignCountRegression)
+
+	other := webauthntest.New(webauthntest.NoAttestation)
+	challenge = webauthn.NewChallenge()
+	_, err = rp.VerifyAssertion(challenge, other.Login(origin, requestOptions(challenge)), reg.PublicKey, 0)
+	assert.ErrorIs(t, err, webauthn.ErrVerification, "another key's signature is refused")
+}
+
+// TestVerifyAssertion_ZeroCounter tests that authenticators without a counter may keep reporting zero
+func TestVerifyAssertion_ZeroCounter(t *testing.T) {
+	a := webauthntest.New(webauthntest.NoAttestation)
+	for range 2 {
+		a.SignCount = ^uint32(0) // wraps to zero in Login
+		challenge := webauthn.NewChallenge()
+		count, err := rp.VerifyAssertion(challenge, a.Login(origin, requestOptions(challenge)), a.PublicKey(), 0)
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	}
+}
+
+// TestParsePublicKey_Algorithms tests the EdDSA and RS256 keys next to the ES256 ones above
+func TestParsePublicKey_Algorithms(t *testing.T) {
+	data := []byte("signed data")
+	digest := sha256.Sum256(data)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKey, err := cbor.Marshal(map[int]any{1: 1, 3: webauthn.AlgEdDSA, -1: 6, -2: []byte(edPublic)})
+	require.NoError(t, err)
+	key, err := webauthn.ParsePublicKey(edKey)
+	require.NoError(t, err)
+	assert.NoError(t, key.Verify(data, ed25519.Sign(edPrivate, data)))
+
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKey, err := cbor.Marshal(map[int]any{1: 3, 3: webauthn.AlgRS256, -1: rsaPrivate.N.Bytes(), -2: big.NewInt(int64(rsaPrivate.E)).Bytes()})
+	require.NoError(t, err)
+	key, err = webauthn.ParsePublicKey(rsaKey)
+	require.NoError(t, err)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaPrivate, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	assert.NoError(t, key.Verify(data, sig))
+	assert.ErrorIs(t, key.Verify([]byte("other data"), sig), webauthn.ErrVerification)
+
+	unsupported, err := cbor.Marshal(map[int]any{1: 2, 3: -35})
+	require.NoError(t, err)
+	_, err = webauthn.ParsePublicKey(unsupported)
+	assert.ErrorIs(t, err, webauthn.ErrVerification)
+}
+
+// TestBase64URL_JSON tests that binary fields round-trip as unpadded base64url and accept padding
+func TestBase64URL_JSON(t *testing.T) {
+	data, err := json.Marshal(webauthn.Base64URL{0xfb, 0xff})
+	require.NoError(t, err)
+	assert.Equal(t, `"-_8"`, string(data))
+
+	var decoded webauthn.Base64URL
+	require.NoError(t, json.Unmarshal([]byte(`"-_8="`), &decoded))
+	assert.Equal(t, webauthn.Base64URL{0xfb, 0xff}, decoded)
+}
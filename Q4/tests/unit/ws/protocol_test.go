@@ -0,0 +1,36 @@
+package ws_test
+
+import (
+	"Q4/internal/ws"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseTopic tests the canonical forms of valid topics and the rejection of the others
+func TestParseTopic(t *testing.T) {
+	for topic, want := range map[string]string{
+		"users":       "users",
+		" users ":     "users",
+		"user:42":     "user:42",
+		"user:042":    "user:42",
+		"role:admin":  "role:admin",
+		"role:user":   "role:user",
+		"user:0":      "",
+		"user:-1":     "",
+		"user:abc":    "",
+		"user:":       "",
+		"role:root":   "",
+		"group:staff": "",
+		"":            "",
+	} {
+		got, err := ws.ParseTopic(topic)
+		if want == "" {
+			assert.Error(t, err, topic)
+			continue
+		}
+		if assert.NoError(t, err, topic) {
+			assert.Equal(t, want, got, topic)
+		}
+	}
+}